@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/rs/zerolog"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+var (
+	// Version information (set by build flags)
+	version   = "dev"
+	buildDate = "unknown"
+	gitCommit = "unknown"
+)
+
+func main() {
+	// Parse command-line flags
+	var (
+		listenAddr       = flag.String("listen-addr", ":9440", "address the agent API listens on")
+		tokenFile        = flag.String("token-file", "/etc/orca/agent/token", "path to the API token file")
+		tlsCertFile      = flag.String("tls-cert-file", "/etc/orca/agent/tls.crt", "path to the API serving certificate")
+		tlsKeyFile       = flag.String("tls-key-file", "/etc/orca/agent/tls.key", "path to the API serving key")
+		logDir           = flag.String("log-dir", "/var/log/orca/containers", "directory for container logs")
+		volumeDir        = flag.String("volume-dir", "/var/lib/orca/volumes", "directory for the files and mounted disks of pod volumes")
+		runtimeBinary    = flag.String("runtime-binary", "nerdctl", "path to the nerdctl binary")
+		runtimeNamespace = flag.String("runtime-namespace", "orca", "containerd namespace for pod containers")
+		sandboxImage     = flag.String("sandbox-image", "registry.k8s.io/pause:3.10", "image of the pod sandbox that holds the namespaces containers share")
+		nvidiaSMI        = flag.String("nvidia-smi", "nvidia-smi", "path to the nvidia-smi binary used to report GPU usage")
+		ecrLogin         = flag.Bool("ecr-login", true, "log in to ECR registries with the instance's AWS credentials")
+		logLevel         = flag.String("log-level", "info", "log level (debug, info, warn, error)")
+		showVersion      = flag.Bool("version", false, "show version information")
+	)
+	flag.Parse()
+
+	// Show version and exit
+	if *showVersion {
+		fmt.Printf("ORCA agent version %s\n", version)
+		fmt.Printf("  Git commit: %s\n", gitCommit)
+		fmt.Printf("  Built:      %s\n", buildDate)
+		os.Exit(0)
+	}
+
+	logger := setupLogging(*logLevel)
+
+	logger.Info().
+		Str("version", version).
+		Str("git_commit", gitCommit).
+		Str("build_date", buildDate).
+		Msg("Starting ORCA agent")
+
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read API token")
+	}
+
+	// Create context with cancellation on shutdown signals
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// ECR images need no pull secret when the instance profile may pull them
+	var registries agent.CredentialProvider
+	if *ecrLogin {
+		awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to load AWS credentials, ECR images need pull secrets")
+		} else {
+			registries = agent.NewECRCredentialProvider(awsConfig.Credentials)
+		}
+	}
+
+	// Create the agent
+	rt := agent.NewContainerdRuntime(*runtimeBinary, *runtimeNamespace, *sandboxImage)
+	a := agent.New(rt, agent.NewLinuxHost("/proc", *nvidiaSMI), registries, agent.NewLinuxMounter("/dev"), agent.NewLinuxNetwork(), *logDir, *volumeDir, logger)
+
+	go func() {
+		if err := a.Run(ctx); err != nil {
+			logger.Error().Err(err).Msg("Agent error")
+		}
+	}()
+
+	// Serve the agent API until shutdown
+	server := agent.NewServer(a, *listenAddr, strings.TrimSpace(string(token)), logger)
+	if err := server.Start(ctx, *tlsCertFile, *tlsKeyFile); err != nil {
+		logger.Fatal().Err(err).Msg("Agent API server error")
+	}
+
+	logger.Info().Msg("ORCA agent shutdown complete")
+}
+
+// setupLogging configures a JSON zerolog logger at the given level.
+func setupLogging(level string) zerolog.Logger {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		lvl = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(lvl)
+
+	return zerolog.New(os.Stdout).With().Timestamp().Logger()
+}
@@ -58,6 +58,9 @@ func main() {
 	if *logLevel != "" {
 		cfg.Logging.Level = *logLevel
 	}
+	if cfg.Kubelet.Address == "" {
+		cfg.Kubelet.Address = os.Getenv("POD_IP")
+	}
 
 	// Setup logging
 	logger := setupLogging(cfg.Logging)
@@ -131,6 +134,7 @@ func main() {
 
 	logger.Info().
 		Int("http_port", cfg.Metrics.Port).
+		Int("kubelet_port", cfg.Kubelet.Port).
 		Msg("ORCA is running. Press Ctrl+C to stop.")
 
 	// Wait for shutdown signal or error
@@ -2,8 +2,10 @@ package aws
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -20,10 +22,35 @@ const (
 	annotationLaunchType = "orca.research/launch-type"
 )
 
+// maxFilterValues is the most values EC2 accepts in one filter.
+const maxFilterValues = 200
+
+// ec2API is the part of the EC2 API that ORCA uses.
+type ec2API interface {
+	RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceTypes(ctx context.Context, params *ec2.DescribeInstanceTypesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypesOutput, error)
+	DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+	DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error)
+	CreatePlacementGroup(ctx context.Context, params *ec2.CreatePlacementGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreatePlacementGroupOutput, error)
+	DeletePlacementGroup(ctx context.Context, params *ec2.DeletePlacementGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeletePlacementGroupOutput, error)
+	DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+	AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error)
+	DetachVolume(ctx context.Context, params *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error)
+}
+
 // Client is the AWS EC2 client for ORCA operations.
 type Client struct {
-	ec2Client *ec2.Client
+	ec2Client ec2API
 	config    *orcaconfig.Config
+
+	// cacheMu guards the AMI root devices, instance storage sizes and EFA
+	// support, which never change.
+	cacheMu         sync.Mutex
+	rootDevices     map[string]rootDevice
+	instanceStorage map[string]int64
+	efaSupport      map[string]bool
 }
 
 // NewClient creates a new AWS client.
@@ -65,13 +92,17 @@ func NewClient(ctx context.Context, cfg *orcaconfig.Config) (*Client, error) {
 	}
 
 	return &Client{
-		ec2Client: ec2Client,
-		config:    cfg,
+		ec2Client:       ec2Client,
+		config:          cfg,
+		rootDevices:     make(map[string]rootDevice),
+		instanceStorage: make(map[string]int64),
+		efaSupport:      make(map[string]bool),
 	}, nil
 }
 
-// CreateInstance creates an EC2 instance for a pod.
-func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, instanceType string) (string, error) {
+// CreateInstance launches an EC2 instance for a pod and returns its ID
+// without waiting for it to run.
+func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, opts LaunchOptions) (string, error) {
 	if pod == nil {
 		return "", fmt.Errorf("pod cannot be nil")
 	}
@@ -83,7 +114,8 @@ func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, instanceTy
 	}
 
 	// Build instance tags
-	tags := c.buildInstanceTags(pod, instanceType)
+	instanceType := opts.InstanceType
+	tags := c.buildInstanceTags(pod, instanceType, opts.Tags)
 	tagSpecs := []types.TagSpecification{
 		{
 			ResourceType: types.ResourceTypeInstance,
@@ -95,14 +127,61 @@ func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, instanceTy
 		},
 	}
 
+	subnetID := opts.SubnetID
+	if subnetID == "" {
+		subnetID = c.config.AWS.SubnetID
+	}
+	securityGroupIDs := append(append([]string(nil), c.config.AWS.SecurityGroupIDs...), opts.SecurityGroupIDs...)
+
 	// Build RunInstances input
 	runInput := &ec2.RunInstancesInput{
 		MaxCount:          aws.Int32(1),
 		MinCount:          aws.Int32(1),
 		InstanceType:      types.InstanceType(instanceType),
-		SubnetId:          aws.String(c.config.AWS.SubnetID),
-		SecurityGroupIds:  c.config.AWS.SecurityGroupIDs,
+		SubnetId:          aws.String(subnetID),
+		SecurityGroupIds:  securityGroupIDs,
 		TagSpecifications: tagSpecs,
+		// User data carries the agent's credentials. IMDSv2 with a hop
+		// limit of 1 keeps it from anything behind a NAT or proxy hop;
+		// the bootstrap blocks the pod's containers on the host
+		MetadataOptions: &types.InstanceMetadataOptionsRequest{
+			HttpEndpoint:            types.InstanceMetadataEndpointStateEnabled,
+			HttpTokens:              types.HttpTokensStateRequired,
+			HttpPutResponseHopLimit: aws.Int32(1),
+		},
+	}
+
+	// The instance profile gives the agent its AWS credentials, such as
+	// for pulling ECR images
+	if profile := c.config.AWS.InstanceProfile; profile != "" {
+		if strings.HasPrefix(profile, "arn:") {
+			runInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{Arn: aws.String(profile)}
+		} else {
+			runInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{Name: aws.String(profile)}
+		}
+	}
+
+	if opts.PlacementGroup != "" {
+		runInput.Placement = &types.Placement{GroupName: aws.String(opts.PlacementGroup)}
+	}
+	// An EFA is the primary interface, which then carries the subnet and
+	// security groups
+	if opts.EFA {
+		runInput.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{
+			{
+				DeviceIndex:         aws.Int32(0),
+				InterfaceType:       aws.String(string(types.NetworkInterfaceTypeEfa)),
+				SubnetId:            runInput.SubnetId,
+				Groups:              securityGroupIDs,
+				DeleteOnTermination: aws.Bool(true),
+			},
+		}
+		runInput.SubnetId = nil
+		runInput.SecurityGroupIds = nil
+	}
+
+	if len(opts.UserData) > 0 {
+		runInput.UserData = aws.String(base64.StdEncoding.EncodeToString(opts.UserData))
 	}
 
 	// Set AMI (either from config or use latest Amazon Linux 2023)
@@ -114,6 +193,14 @@ func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, instanceTy
 		return "", fmt.Errorf("aws.amiID must be specified in config")
 	}
 
+	mapping, err := c.rootVolumeMapping(ctx, c.config.AWS.AMIID, opts.RootVolume, opts.EphemeralStorageGiB)
+	if err != nil {
+		return "", err
+	}
+	if mapping != nil {
+		runInput.BlockDeviceMappings = []types.BlockDeviceMapping{*mapping}
+	}
+
 	// Configure spot instances if requested
 	if launchType == "spot" {
 		runInput.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{
@@ -139,19 +226,8 @@ func (c *Client) CreateInstance(ctx context.Context, pod *corev1.Pod, instanceTy
 		return "", fmt.Errorf("no instances were created")
 	}
 
-	instanceID := *result.Instances[0].InstanceId
-
-	// Wait for instance to be running (with timeout)
-	waiter := ec2.NewInstanceRunningWaiter(c.ec2Client)
-	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{
-		InstanceIds: []string{instanceID},
-	}, 5*time.Minute); err != nil {
-		// Cleanup: terminate the instance if it fails to start
-		_ = c.TerminateInstance(ctx, instanceID)
-		return "", fmt.Errorf("instance failed to reach running state: %w", err)
-	}
-
-	return instanceID, nil
+	// The instance is still pending; callers track it until it is running.
+	return *result.Instances[0].InstanceId, nil
 }
 
 // TerminateInstance terminates an EC2 instance.
@@ -170,18 +246,15 @@ func (c *Client) TerminateInstance(ctx context.Context, instanceID string) error
 	return nil
 }
 
-// GetInstanceByPod retrieves an instance by pod namespace and name using tags.
-func (c *Client) GetInstanceByPod(ctx context.Context, namespace, name string) (*Instance, error) {
+// GetInstanceByPod retrieves the instance of a pod using its UID tag, so
+// that the instances of other pods with the same name never match.
+func (c *Client) GetInstanceByPod(ctx context.Context, pod *corev1.Pod) (*Instance, error) {
 	// Search for instance by pod tags
 	result, err := c.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
 			{
-				Name:   aws.String("tag:orca.research/pod-namespace"),
-				Values: []string{namespace},
-			},
-			{
-				Name:   aws.String("tag:orca.research/pod-name"),
-				Values: []string{name},
+				Name:   aws.String("tag:orca.research/pod-uid"),
+				Values: []string{string(pod.UID)},
 			},
 			{
 				Name: aws.String("instance-state-name"),
@@ -205,7 +278,7 @@ func (c *Client) GetInstanceByPod(ctx context.Context, namespace, name string) (
 		}
 	}
 
-	return nil, fmt.Errorf("instance not found for pod %s/%s", namespace, name)
+	return nil, fmt.Errorf("instance not found for pod %s/%s", pod.Namespace, pod.Name)
 }
 
 // GetInstance retrieves an instance by ID.
@@ -228,9 +301,45 @@ func (c *Client) GetInstance(ctx context.Context, instanceID string) (*Instance,
 	return c.convertInstance(&result.Reservations[0].Instances[0]), nil
 }
 
+// GetInstances retrieves instances by ID, with one describe call for each
+// batch of maxFilterValues IDs. Instances EC2 does not know about yet are
+// missing from the result.
+func (c *Client) GetInstances(ctx context.Context, instanceIDs []string) (map[string]*Instance, error) {
+	instances := make(map[string]*Instance, len(instanceIDs))
+
+	for start := 0; start < len(instanceIDs); start += maxFilterValues {
+		batch := instanceIDs[start:min(start+maxFilterValues, len(instanceIDs))]
+
+		// Filtering by instance-id, rather than passing InstanceIds, does not
+		// fail the whole call when a just-launched ID is not yet visible.
+		paginator := ec2.NewDescribeInstancesPaginator(c.ec2Client, &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{
+				{
+					Name:   aws.String("instance-id"),
+					Values: batch,
+				},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe instances: %w", err)
+			}
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					inst := instance // Create local copy for pointer
+					instances[*inst.InstanceId] = c.convertInstance(&inst)
+				}
+			}
+		}
+	}
+
+	return instances, nil
+}
+
 // ListInstances lists all ORCA-managed instances.
 func (c *Client) ListInstances(ctx context.Context) ([]*Instance, error) {
-	result, err := c.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+	paginator := ec2.NewDescribeInstancesPaginator(c.ec2Client, &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
 			{
 				Name:   aws.String("tag:ManagedBy"),
@@ -247,25 +356,31 @@ func (c *Client) ListInstances(ctx context.Context) ([]*Instance, error) {
 			},
 		},
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list instances: %w", err)
-	}
 
 	var instances []*Instance
-	for _, reservation := range result.Reservations {
-		for _, instance := range reservation.Instances {
-			inst := instance // Create local copy for pointer
-			instances = append(instances, c.convertInstance(&inst))
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instances: %w", err)
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				inst := instance // Create local copy for pointer
+				instances = append(instances, c.convertInstance(&inst))
+			}
 		}
 	}
 
 	return instances, nil
 }
 
-// buildInstanceTags builds EC2 tags for an instance.
-func (c *Client) buildInstanceTags(pod *corev1.Pod, instanceType string) []types.Tag {
+// buildInstanceTags builds EC2 tags for an instance, with extra tags.
+func (c *Client) buildInstanceTags(pod *corev1.Pod, instanceType string, extra map[string]string) []types.Tag {
 	// Get pod-specific tags from config
-	tagMap := c.config.AWS.GetPodTags(pod.Namespace, pod.Name, instanceType)
+	tagMap := c.config.AWS.GetPodTags(pod.Namespace, pod.Name, string(pod.UID), instanceType)
+	for k, v := range extra {
+		tagMap[k] = v
+	}
 
 	// Convert to EC2 tags
 	tags := make([]types.Tag, 0, len(tagMap))
@@ -305,5 +420,18 @@ func (c *Client) convertInstance(instance *types.Instance) *Instance {
 		inst.LaunchTime = *instance.LaunchTime
 	}
 
+	if instance.StateReason != nil && instance.StateReason.Message != nil {
+		inst.StateReason = *instance.StateReason.Message
+	}
+
+	if len(instance.Tags) > 0 {
+		inst.Tags = make(map[string]string, len(instance.Tags))
+		for _, tag := range instance.Tags {
+			if tag.Key != nil && tag.Value != nil {
+				inst.Tags[*tag.Key] = *tag.Value
+			}
+		}
+	}
+
 	return inst
 }
@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeEC2 serves DescribeInstances for the instances it knows, a page of
+// pageSize instances at a time. Other EC2 calls are not implemented.
+type fakeEC2 struct {
+	ec2API
+
+	known    map[string]bool
+	pageSize int
+	calls    int
+}
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.calls++
+	if len(params.Filters) != 1 || *params.Filters[0].Name != "instance-id" {
+		return nil, fmt.Errorf("unexpected filters %v", params.Filters)
+	}
+	values := params.Filters[0].Values
+	if len(values) > maxFilterValues {
+		return nil, fmt.Errorf("filter has %d values, more than %d", len(values), maxFilterValues)
+	}
+
+	var instances []types.Instance
+	for _, id := range values {
+		if f.known[id] {
+			instances = append(instances, types.Instance{
+				InstanceId: aws.String(id),
+				State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+			})
+		}
+	}
+
+	start := 0
+	if params.NextToken != nil {
+		start, _ = strconv.Atoi(*params.NextToken)
+	}
+	end := min(start+f.pageSize, len(instances))
+	output := &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: instances[start:end]}},
+	}
+	if end < len(instances) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return output, nil
+}
+
+func TestGetInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		ids       int
+		unknown   int
+		wantCalls int
+	}{
+		{name: "no instances", ids: 0, wantCalls: 0},
+		{name: "one instance", ids: 1, wantCalls: 1},
+		{name: "one full batch", ids: maxFilterValues, wantCalls: 2},
+		{name: "more than one batch", ids: 2*maxFilterValues + 50, wantCalls: 5},
+		{name: "unknown instances", ids: maxFilterValues + 1, unknown: 10, wantCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec2Client := &fakeEC2{known: make(map[string]bool), pageSize: 150}
+			ids := make([]string, tt.ids)
+			for i := range ids {
+				ids[i] = fmt.Sprintf("i-%05d", i)
+				if i >= tt.unknown {
+					ec2Client.known[ids[i]] = true
+				}
+			}
+			c := &Client{ec2Client: ec2Client}
+
+			instances, err := c.GetInstances(context.Background(), ids)
+			if err != nil {
+				t.Fatalf("failed to get instances: %v", err)
+			}
+			if len(instances) != tt.ids-tt.unknown {
+				t.Errorf("expected %d instances, got %d", tt.ids-tt.unknown, len(instances))
+			}
+			for id := range ec2Client.known {
+				if instance := instances[id]; instance == nil || instance.ID != id || instance.State != "running" {
+					t.Errorf("expected running instance %s, got %+v", id, instance)
+				}
+			}
+			if ec2Client.calls != tt.wantCalls {
+				t.Errorf("expected %d describe calls, got %d", tt.wantCalls, ec2Client.calls)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@
 // - Terminating instances
 // - Querying instance state
 // - Support for both on-demand and spot instances
+// - Attaching and detaching the EBS volumes of pods
 //
 // The client automatically applies ORCA resource tags to all created instances
 // for proper resource tracking and cost attribution.
@@ -0,0 +1,79 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// CreatePlacementGroup creates a cluster placement group, which packs its
+// instances close together for low-latency networking.
+func (c *Client) CreatePlacementGroup(ctx context.Context, name string) error {
+	tags := make([]types.Tag, 0, len(c.config.AWS.GetResourceTags())+1)
+	for k, v := range c.config.AWS.GetResourceTags() {
+		tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	tags = append(tags, types.Tag{Key: aws.String("Name"), Value: aws.String(name)})
+
+	_, err := c.ec2Client.CreatePlacementGroup(ctx, &ec2.CreatePlacementGroupInput{
+		GroupName: aws.String(name),
+		Strategy:  types.PlacementStrategyCluster,
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypePlacementGroup, Tags: tags},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create placement group %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeletePlacementGroup deletes a placement group. It fails while the group
+// still has instances, terminating ones included. Deleting a group that
+// does not exist succeeds.
+func (c *Client) DeletePlacementGroup(ctx context.Context, name string) error {
+	_, err := c.ec2Client.DeletePlacementGroup(ctx, &ec2.DeletePlacementGroupInput{
+		GroupName: aws.String(name),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPlacementGroup.Unknown" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete placement group %s: %w", name, err)
+	}
+	return nil
+}
+
+// EFASupported reports whether an instance type supports Elastic Fabric
+// Adapters.
+func (c *Client) EFASupported(ctx context.Context, instanceType string) (bool, error) {
+	c.cacheMu.Lock()
+	supported, ok := c.efaSupport[instanceType]
+	c.cacheMu.Unlock()
+	if ok {
+		return supported, nil
+	}
+
+	result, err := c.ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe instance type %s: %w", instanceType, err)
+	}
+	for _, t := range result.InstanceTypes {
+		if t.NetworkInfo != nil {
+			supported = aws.ToBool(t.NetworkInfo.EfaSupported)
+		}
+	}
+
+	c.cacheMu.Lock()
+	c.efaSupport[instanceType] = supported
+	c.cacheMu.Unlock()
+	return supported, nil
+}
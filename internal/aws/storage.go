@@ -0,0 +1,118 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	orcaconfig "github.com/scttfrdmn/orca/pkg/config"
+)
+
+// rootDevice is the root device of an AMI.
+type rootDevice struct {
+	name    string
+	sizeGiB int32
+}
+
+// rootVolumeMapping returns the block device mapping of an instance's root
+// volume, or nil if neither the configuration nor the pod change the AMI's.
+// The volume is at least as large as the AMI's snapshot.
+func (c *Client) rootVolumeMapping(ctx context.Context, amiID string, volume orcaconfig.RootVolume, extraGiB int32) (*types.BlockDeviceMapping, error) {
+	if volume == (orcaconfig.RootVolume{}) && extraGiB == 0 {
+		return nil, nil
+	}
+
+	device, err := c.amiRootDevice(ctx, amiID)
+	if err != nil {
+		return nil, err
+	}
+
+	ebs := &types.EbsBlockDevice{
+		DeleteOnTermination: aws.Bool(true),
+		Encrypted:           volume.Encrypted,
+	}
+	if size := max(device.sizeGiB, volume.SizeGiB) + extraGiB; size != device.sizeGiB {
+		ebs.VolumeSize = aws.Int32(size)
+	}
+	if volume.VolumeType != "" {
+		ebs.VolumeType = types.VolumeType(volume.VolumeType)
+	}
+	if volume.IOPS != 0 {
+		ebs.Iops = aws.Int32(volume.IOPS)
+	}
+	if volume.Throughput != 0 {
+		ebs.Throughput = aws.Int32(volume.Throughput)
+	}
+	if volume.KMSKeyID != "" {
+		ebs.KmsKeyId = aws.String(volume.KMSKeyID)
+	}
+
+	return &types.BlockDeviceMapping{DeviceName: aws.String(device.name), Ebs: ebs}, nil
+}
+
+// amiRootDevice returns the root device of an AMI.
+func (c *Client) amiRootDevice(ctx context.Context, amiID string) (rootDevice, error) {
+	c.cacheMu.Lock()
+	device, ok := c.rootDevices[amiID]
+	c.cacheMu.Unlock()
+	if ok {
+		return device, nil
+	}
+
+	result, err := c.ec2Client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	})
+	if err != nil {
+		return rootDevice{}, fmt.Errorf("failed to describe AMI %s: %w", amiID, err)
+	}
+	if len(result.Images) == 0 {
+		return rootDevice{}, fmt.Errorf("AMI %s not found", amiID)
+	}
+
+	image := result.Images[0]
+	device.name = aws.ToString(image.RootDeviceName)
+	for _, m := range image.BlockDeviceMappings {
+		if aws.ToString(m.DeviceName) == device.name && m.Ebs != nil {
+			device.sizeGiB = aws.ToInt32(m.Ebs.VolumeSize)
+		}
+	}
+	if device.name == "" {
+		return rootDevice{}, fmt.Errorf("AMI %s has no root device", amiID)
+	}
+
+	c.cacheMu.Lock()
+	c.rootDevices[amiID] = device
+	c.cacheMu.Unlock()
+	return device, nil
+}
+
+// InstanceStorageGB returns the total size of an instance type's instance
+// store volumes in GB, or 0 if it has none.
+func (c *Client) InstanceStorageGB(ctx context.Context, instanceType string) (int64, error) {
+	c.cacheMu.Lock()
+	size, ok := c.instanceStorage[instanceType]
+	c.cacheMu.Unlock()
+	if ok {
+		return size, nil
+	}
+
+	result, err := c.ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to describe instance type %s: %w", instanceType, err)
+	}
+	for _, t := range result.InstanceTypes {
+		if t.InstanceStorageSupported != nil && *t.InstanceStorageSupported && t.InstanceStorageInfo != nil {
+			size = aws.ToInt64(t.InstanceStorageInfo.TotalSizeInGB)
+		}
+	}
+
+	c.cacheMu.Lock()
+	c.instanceStorage[instanceType] = size
+	c.cacheMu.Unlock()
+	return size, nil
+}
@@ -1,14 +1,71 @@
 package aws
 
-import "time"
+import (
+	"time"
+
+	orcaconfig "github.com/scttfrdmn/orca/pkg/config"
+)
 
 // Instance represents an EC2 instance.
 type Instance struct {
 	ID           string
 	Type         string
 	State        string
+	StateReason  string
 	PublicIP     string
 	PrivateIP    string
 	LaunchTime   time.Time
 	InstanceType string
+	Tags         map[string]string
+}
+
+// LaunchOptions describes the instance to launch for a pod.
+type LaunchOptions struct {
+	InstanceType string
+
+	// SubnetID is the subnet to launch in, or the configured subnet if
+	// empty.
+	SubnetID string
+
+	// SecurityGroupIDs are added to the configured security groups.
+	SecurityGroupIDs []string
+
+	// UserData is the raw bootstrap document; it is base64 encoded for EC2.
+	UserData []byte
+
+	// RootVolume configures the instance's root volume; unset fields keep
+	// the AMI's settings.
+	RootVolume orcaconfig.RootVolume
+
+	// EphemeralStorageGiB is added to the root volume's size for the pod's
+	// ephemeral storage.
+	EphemeralStorageGiB int32
+
+	// PlacementGroup is the placement group to launch in, if any.
+	PlacementGroup string
+
+	// EFA gives the instance an Elastic Fabric Adapter as its primary
+	// network interface.
+	EFA bool
+
+	// Tags are added to the tags of the instance and its volumes.
+	Tags map[string]string
+}
+
+// Volume represents an EBS volume.
+type Volume struct {
+	ID               string
+	State            string
+	AvailabilityZone string
+
+	// Attachments lists the instances the volume is attached to, or being
+	// attached to or detached from
+	Attachments []VolumeAttachment
+}
+
+// VolumeAttachment is the attachment of a volume to an instance.
+type VolumeAttachment struct {
+	InstanceID string
+	Device     string
+	State      string
 }
@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// GetVolume retrieves an EBS volume by ID.
+func (c *Client) GetVolume(ctx context.Context, volumeID string) (*Volume, error) {
+	if volumeID == "" {
+		return nil, fmt.Errorf("volumeID cannot be empty")
+	}
+
+	result, err := c.ec2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []string{volumeID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe volume %s: %w", volumeID, err)
+	}
+	if len(result.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found", volumeID)
+	}
+
+	v := result.Volumes[0]
+	volume := &Volume{
+		ID:               volumeID,
+		State:            string(v.State),
+		AvailabilityZone: aws.ToString(v.AvailabilityZone),
+	}
+	for _, a := range v.Attachments {
+		volume.Attachments = append(volume.Attachments, VolumeAttachment{
+			InstanceID: aws.ToString(a.InstanceId),
+			Device:     aws.ToString(a.Device),
+			State:      string(a.State),
+		})
+	}
+
+	return volume, nil
+}
+
+// AttachVolume attaches an EBS volume to an instance as device. The
+// attachment completes in the background.
+func (c *Client) AttachVolume(ctx context.Context, volumeID, instanceID, device string) error {
+	_, err := c.ec2Client.AttachVolume(ctx, &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(volumeID),
+		InstanceId: aws.String(instanceID),
+		Device:     aws.String(device),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach volume %s to instance %s: %w", volumeID, instanceID, err)
+	}
+
+	return nil
+}
+
+// DetachVolume detaches an EBS volume from an instance. EC2 waits for the
+// instance to release the volume; the detachment completes in the
+// background.
+func (c *Client) DetachVolume(ctx context.Context, volumeID, instanceID string) error {
+	_, err := c.ec2Client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeID),
+		InstanceId: aws.String(instanceID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to detach volume %s from instance %s: %w", volumeID, instanceID, err)
+	}
+
+	return nil
+}
+
+// SubnetZones returns the availability zone of each subnet.
+func (c *Client) SubnetZones(ctx context.Context, subnetIDs []string) (map[string]string, error) {
+	zones := make(map[string]string, len(subnetIDs))
+	if len(subnetIDs) == 0 {
+		return zones, nil
+	}
+
+	result, err := c.ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: subnetIDs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe subnets: %w", err)
+	}
+	for _, s := range result.Subnets {
+		zones[aws.ToString(s.SubnetId)] = aws.ToString(s.AvailabilityZone)
+	}
+
+	return zones, nil
+}
@@ -0,0 +1,920 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrPodAlreadyStarted is returned when a second, different pod is submitted
+// to an agent. Each instance runs exactly one pod.
+var ErrPodAlreadyStarted = errors.New("a different pod is already running on this instance")
+
+// ErrContainerNotFound is returned for requests naming a container that is
+// not part of the pod.
+var ErrContainerNotFound = errors.New("container not found")
+
+// ErrContainerNotStarted is returned for requests that need a container that
+// has not started yet.
+var ErrContainerNotStarted = errors.New("container has not started")
+
+// Agent runs a pod's containers on the instance and tracks their state.
+type Agent struct {
+	runtime    Runtime
+	host       Host
+	registries CredentialProvider
+	mounter    Mounter
+	network    Network
+	logDir     string
+	volumeDir  string
+	logger     zerolog.Logger
+
+	// statsInterval is how often resource usage is sampled
+	statsInterval time.Duration
+
+	// restartBackoff is the delay before a crashed container's first restart
+	restartBackoff time.Duration
+
+	// probeUnit is the length of a second in probe timings
+	probeUnit time.Duration
+
+	// podCh hands the submitted pod to Run
+	podCh chan *corev1.Pod
+
+	// stopping is closed once the pod is being stopped
+	stopping chan struct{}
+
+	// Pod state
+	mu         sync.RWMutex
+	pod        *corev1.Pod
+	containers []*container
+
+	// volumes names the pod volumes whose files the controller provides
+	volumes map[string]bool
+
+	// disks and filesystems are the pod's volumes that the agent mounts;
+	// mounted names those that are mounted and mountErrors holds the
+	// latest failure of those that are not
+	disks       map[string]Disk
+	filesystems map[string]Filesystem
+	mounted     map[string]bool
+	mountErrors map[string]string
+
+	// emptyDirs maps the pod's disk-backed emptyDir volumes to their
+	// directories
+	emptyDirs map[string]string
+
+	// podNetwork is how the pod connects to the cluster network, nil to
+	// use the instance's
+	podNetwork *PodNetwork
+
+	// sandbox is the ID of the running pod sandbox, and hostsFile and
+	// resolvConf the pod's managed /etc/hosts and /etc/resolv.conf if it
+	// has them
+	sandbox    string
+	hostsFile  string
+	resolvConf string
+
+	// credentials are the logins of the pod's image pull secrets
+	credentials []RegistryCredential
+
+	// mountMu serializes mounting and unmounting, and starting and
+	// removing the sandbox
+	mountMu sync.Mutex
+
+	// Latest usage sample; statsUpdated is closed and replaced on every
+	// new sample
+	statsMu      sync.RWMutex
+	stats        *StatsSample
+	statsUpdated chan struct{}
+}
+
+// container tracks a single container of the pod.
+type container struct {
+	spec   corev1.Container
+	status corev1.ContainerStatus
+
+	// init is set for init containers, including sidecars
+	init bool
+
+	// restartPolicy decides whether the container is restarted after it
+	// exits
+	restartPolicy corev1.RestartPolicy
+
+	// started is closed when the container first starts, after its startup
+	// probe passes; finished is closed when it has exited and will not be
+	// restarted
+	started  chan struct{}
+	finished chan struct{}
+
+	// run is the current run of the container, nil until it first starts
+	run *containerRun
+
+	// backoff is the current delay before restarting the container
+	backoff time.Duration
+
+	// stdout and stderr copy output to attached sessions
+	stdout *fanout
+	stderr *fanout
+}
+
+// containerRun is one run of a container's main process.
+type containerRun struct {
+	id   string
+	proc Process
+
+	// stdin feeds the process when the container spec asks for stdin
+	stdin *io.PipeWriter
+
+	// exited is closed once the process has exited and its status is set
+	exited chan struct{}
+}
+
+// New creates a new agent that runs containers with the given runtime, writes
+// container logs below logDir and the files of controller provided volumes
+// below volumeDir. Instance usage is read from host, which may be nil to
+// report container usage only. Images from registries the pod has no pull
+// secret for are pulled with logins from registries, which may be nil. The
+// pod's disks, shared filesystems and memory-backed emptyDir volumes are
+// mounted below volumeDir with mounter, which may be nil on instances that
+// run no pods with them; disk-backed emptyDir volumes then stay on the root
+// volume. Pods on the cluster's overlay network are connected to it with
+// network, which may be nil on instances without one.
+func New(rt Runtime, host Host, registries CredentialProvider, mounter Mounter, network Network, logDir, volumeDir string, logger zerolog.Logger) *Agent {
+	return &Agent{
+		runtime:        rt,
+		host:           host,
+		registries:     registries,
+		mounter:        mounter,
+		network:        network,
+		logDir:         logDir,
+		volumeDir:      volumeDir,
+		logger:         logger,
+		statsInterval:  defaultStatsInterval,
+		restartBackoff: defaultRestartBackoff,
+		probeUnit:      time.Second,
+		podCh:          make(chan *corev1.Pod, 1),
+		stopping:       make(chan struct{}),
+		statsUpdated:   make(chan struct{}),
+	}
+}
+
+// Start submits the pod to be run by the agent, along with the files of the
+// volumes, the disks and filesystems to mount and the registry logins the
+// controller provides.
+// Submitting the same pod again is a no-op.
+func (a *Agent) Start(submission PodSubmission) error {
+	pod := submission.Pod
+	if pod == nil {
+		return fmt.Errorf("pod cannot be nil")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pod != nil {
+		if a.pod.UID == pod.UID {
+			return nil
+		}
+		return ErrPodAlreadyStarted
+	}
+
+	if err := a.writeVolumes(submission.Volumes, podFSGroup(pod)); err != nil {
+		return err
+	}
+	a.volumes = make(map[string]bool, len(submission.Volumes))
+	for name := range submission.Volumes {
+		a.volumes[name] = true
+	}
+	a.disks = submission.Disks
+	a.filesystems = podFilesystems(pod, submission.Filesystems)
+	a.mounted = make(map[string]bool)
+	a.mountErrors = make(map[string]string)
+	a.credentials = submission.RegistryCredentials
+	a.podNetwork = submission.Network
+
+	a.pod = pod.DeepCopy()
+	a.containers = make([]*container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for _, spec := range a.pod.Spec.InitContainers {
+		a.containers = append(a.containers, newContainer(spec, true, "ContainerCreating", restartPolicy(a.pod)))
+	}
+	for _, spec := range a.pod.Spec.Containers {
+		reason := "ContainerCreating"
+		if len(a.pod.Spec.InitContainers) > 0 {
+			reason = "PodInitializing"
+		}
+		a.containers = append(a.containers, newContainer(spec, false, reason, restartPolicy(a.pod)))
+	}
+
+	a.podCh <- a.pod
+
+	return nil
+}
+
+// newContainer creates the state of a container that is waiting to start
+// for the given reason.
+func newContainer(spec corev1.Container, init bool, reason string, podPolicy corev1.RestartPolicy) *container {
+	return &container{
+		spec:          spec,
+		init:          init,
+		restartPolicy: containerRestartPolicy(spec, init, podPolicy),
+		started:       make(chan struct{}),
+		finished:      make(chan struct{}),
+		stdout:        newFanout(),
+		stderr:        newFanout(),
+		status: corev1.ContainerStatus{
+			Name:  spec.Name,
+			Image: spec.Image,
+			State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: reason},
+			},
+		},
+	}
+}
+
+// markStarted records that the container has started and, without a
+// readiness probe, is ready. Callers must hold a.mu.
+func (c *container) markStarted() {
+	started := true
+	c.status.Started = &started
+	if c.spec.ReadinessProbe == nil {
+		c.status.Ready = true
+	}
+	if !isClosed(c.started) {
+		close(c.started)
+	}
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// sidecar reports whether the container is a restartable init container,
+// which keeps running alongside the app containers.
+func (c *container) sidecar() bool {
+	return c.init && c.restartPolicy == corev1.RestartPolicyAlways
+}
+
+// Run waits for a pod to be submitted and runs its containers, sampling
+// resource usage in the background. It blocks until ctx is cancelled.
+func (a *Agent) Run(ctx context.Context) error {
+	go a.sampleStats(ctx)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case pod := <-a.podCh:
+		a.logger.Info().
+			Str("pod", pod.Namespace+"/"+pod.Name).
+			Str("uid", string(pod.UID)).
+			Msg("Starting pod")
+		a.runPod(ctx)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// Status returns the current state of the pod's containers.
+func (a *Agent) Status() *PodReport {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	report := &PodReport{Phase: corev1.PodPending}
+	if a.pod == nil {
+		return report
+	}
+
+	report.PodUID = a.pod.UID
+	if len(a.mountErrors) > 0 {
+		report.MountErrors = make(map[string]string, len(a.mountErrors))
+		for name, msg := range a.mountErrors {
+			report.MountErrors[name] = msg
+		}
+	}
+	for _, c := range a.containers {
+		if c.init {
+			report.InitContainerStatuses = append(report.InitContainerStatuses, *c.status.DeepCopy())
+		} else {
+			report.ContainerStatuses = append(report.ContainerStatuses, *c.status.DeepCopy())
+		}
+	}
+
+	initialized, initFailed := a.initProgress()
+	report.Initialized = initialized
+	switch {
+	case initFailed:
+		report.Phase = corev1.PodFailed
+	case a.stopped():
+		report.Phase = a.stoppingPhase(report.ContainerStatuses, initialized)
+	case !initialized:
+		report.Phase = corev1.PodPending
+	default:
+		report.Phase = podPhase(report.ContainerStatuses, restartPolicy(a.pod))
+	}
+
+	// The pod finishes once its volumes are unmounted, so that disks are
+	// clean when the controller detaches them
+	if (report.Phase == corev1.PodSucceeded || report.Phase == corev1.PodFailed) && len(a.mounted) > 0 {
+		report.Phase = corev1.PodRunning
+	}
+
+	return report
+}
+
+// initProgress reports whether every init container has completed, or for
+// sidecars started, and whether one has failed for good. Callers must hold
+// a.mu.
+func (a *Agent) initProgress() (initialized, failed bool) {
+	initialized = true
+	for _, c := range a.containers {
+		if !c.init {
+			continue
+		}
+		if c.sidecar() {
+			initialized = initialized && isClosed(c.started)
+			continue
+		}
+
+		terminated := c.status.State.Terminated
+		switch {
+		case terminated != nil && terminated.ExitCode == 0:
+		case terminated != nil && c.restartPolicy == corev1.RestartPolicyNever:
+			return false, true
+		default:
+			initialized = false
+		}
+	}
+	return initialized, false
+}
+
+// stoppingPhase returns the phase of a pod that is being stopped. It stays
+// Running until every container, sidecars included, has stopped, and nothing
+// is restarted. Callers must hold a.mu.
+func (a *Agent) stoppingPhase(statuses []corev1.ContainerStatus, initialized bool) corev1.PodPhase {
+	for _, c := range a.containers {
+		if c.status.State.Running != nil {
+			return corev1.PodRunning
+		}
+	}
+	if !initialized {
+		return corev1.PodFailed
+	}
+	return podPhase(statuses, corev1.RestartPolicyNever)
+}
+
+// podPhase derives the pod phase from its container states, as the kubelet
+// does: the pod is Pending while any container has yet to start, Running
+// while containers run or will be restarted under policy, and Succeeded or
+// Failed once no container will run again.
+func podPhase(statuses []corev1.ContainerStatus, policy corev1.RestartPolicy) corev1.PodPhase {
+	var waiting, running, stopped, succeeded int
+	for _, s := range statuses {
+		switch {
+		case s.State.Running != nil:
+			running++
+		case s.State.Terminated != nil:
+			stopped++
+			if s.State.Terminated.ExitCode == 0 {
+				succeeded++
+			}
+		case s.LastTerminationState.Terminated != nil:
+			// Waiting to be restarted
+			stopped++
+		default:
+			waiting++
+		}
+	}
+
+	switch {
+	case waiting > 0 || len(statuses) == 0:
+		return corev1.PodPending
+	case running > 0:
+		return corev1.PodRunning
+	case policy == corev1.RestartPolicyAlways:
+		return corev1.PodRunning
+	case stopped == succeeded:
+		return corev1.PodSucceeded
+	case policy == corev1.RestartPolicyOnFailure:
+		return corev1.PodRunning
+	default:
+		return corev1.PodFailed
+	}
+}
+
+// Logs writes the logs of the named container to w. When following, Logs
+// blocks until the container exits or ctx is cancelled.
+func (a *Agent) Logs(ctx context.Context, name string, opts LogOptions, w io.Writer) error {
+	a.mu.RLock()
+	c := a.container(name)
+	if c == nil {
+		a.mu.RUnlock()
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, name)
+	}
+	restartCount := c.status.RestartCount
+	started := c.status.ContainerID != ""
+	a.mu.RUnlock()
+
+	if opts.Previous {
+		if restartCount == 0 {
+			return fmt.Errorf("%w: previous terminated container %q", ErrContainerNotFound, name)
+		}
+		restartCount--
+	} else if !started {
+		return fmt.Errorf("%w: container %q is waiting to start", ErrContainerNotStarted, name)
+	}
+
+	// The run is finished once the container is no longer running or has
+	// been restarted into a new log file.
+	done := func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return c.status.RestartCount != restartCount || c.status.State.Running == nil
+	}
+
+	return copyLog(ctx, containerLogPath(a.logDir, name, restartCount), opts, w, done)
+}
+
+// Exec runs command in the named container and returns its exit code.
+// The process is stopped when ctx is cancelled.
+func (a *Agent) Exec(ctx context.Context, name string, command []string, sio StreamIO) (int, error) {
+	_, run, err := a.running(name)
+	if err != nil {
+		return -1, err
+	}
+
+	proc, err := a.runtime.ExecContainer(ctx, run.id, &ExecConfig{
+		Command: command,
+		TTY:     sio.TTY,
+		Stdin:   sio.Stdin,
+		Stdout:  sio.Stdout,
+		Stderr:  sio.Stderr,
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	go forwardResize(ctx, sio.Resize, proc)
+
+	return proc.Wait()
+}
+
+// Attach connects sio to the main process of the named container. It returns
+// the container's exit code once it exits, or 0 when ctx is cancelled first.
+func (a *Agent) Attach(ctx context.Context, name string, sio StreamIO) (int, error) {
+	c, run, err := a.running(name)
+	if err != nil {
+		return -1, err
+	}
+
+	if sio.Stdout != nil {
+		id := c.stdout.add(sio.Stdout)
+		defer c.stdout.remove(id)
+	}
+	if sio.Stderr != nil && !c.spec.TTY {
+		id := c.stderr.add(sio.Stderr)
+		defer c.stderr.remove(id)
+	}
+
+	if sio.Stdin != nil && run.stdin != nil {
+		go func() {
+			_, _ = io.Copy(run.stdin, sio.Stdin)
+			if c.spec.StdinOnce {
+				_ = run.stdin.Close()
+			}
+		}()
+	}
+
+	go forwardResize(ctx, sio.Resize, run.proc)
+
+	select {
+	case <-ctx.Done():
+		return 0, nil
+	case <-run.exited:
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if t := c.status.State.Terminated; t != nil {
+		return int(t.ExitCode), nil
+	}
+	return 0, nil
+}
+
+// running returns the named container and its current run, failing if the
+// container is not running.
+func (a *Agent) running(name string) (*container, *containerRun, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	c := a.container(name)
+	if c == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrContainerNotFound, name)
+	}
+	if c.run == nil || c.status.State.Running == nil {
+		return nil, nil, fmt.Errorf("%w: container %q is not running", ErrContainerNotStarted, name)
+	}
+
+	return c, c.run, nil
+}
+
+// forwardResize applies terminal size changes to proc until sizes is closed
+// or ctx is cancelled.
+func forwardResize(ctx context.Context, sizes <-chan TermSize, proc Process) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case size, ok := <-sizes:
+			if !ok {
+				return
+			}
+			_ = proc.Resize(size)
+		}
+	}
+}
+
+// container returns the named container, or nil. Callers must hold a.mu.
+func (a *Agent) container(name string) *container {
+	for _, c := range a.containers {
+		if c.spec.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// runPod connects the instance to the overlay, mounts the pod's disks and
+// filesystems, creates its emptyDir volumes and starts its sandbox, then runs the init containers one at a
+// time, each to completion, or for sidecars until started. It then pulls images and
+// starts every app container in spec order; containers whose image fails
+// to pull start once a retry succeeds.
+func (a *Agent) runPod(ctx context.Context) {
+	if !a.connectOverlay(ctx) {
+		return
+	}
+	if err := a.prepareEmptyDirs(ctx); err != nil {
+		a.logger.Error().Err(err).Msg("Failed to prepare emptyDir volumes")
+		a.setCreating(err.Error())
+		return
+	}
+	if !a.mountVolumes(ctx) {
+		return
+	}
+	go a.unmountWhenFinished(ctx)
+	if !a.startSandbox(ctx) {
+		return
+	}
+
+	for _, c := range a.containers {
+		if !c.init {
+			continue
+		}
+		if !a.runInitContainer(ctx, c) {
+			return
+		}
+	}
+
+	for _, c := range a.containers {
+		if c.init {
+			continue
+		}
+		if a.stopped() {
+			return
+		}
+		if err := a.attemptPull(ctx, c); err != nil {
+			// Retry in the background so that the other containers start
+			// in the meantime
+			go func() {
+				if a.retryPull(ctx, c, err) == nil {
+					a.startAppContainer(ctx, c)
+				}
+			}()
+			continue
+		}
+
+		a.startAppContainer(ctx, c)
+	}
+}
+
+// startAppContainer starts an app container whose image has been pulled.
+func (a *Agent) startAppContainer(ctx context.Context, c *container) {
+	if err := a.startContainer(ctx, c); err != nil {
+		a.logger.Error().Err(err).Str("container", c.spec.Name).Msg("Failed to start container")
+	}
+}
+
+// runInitContainer starts an init container and waits until it has
+// completed, restarting it on failure as its restart policy allows. A sidecar
+// only needs to start. It reports whether the pod may go on.
+func (a *Agent) runInitContainer(ctx context.Context, c *container) bool {
+	log := a.logger.With().Str("container", c.spec.Name).Logger()
+
+	if err := a.pullImage(ctx, c); err != nil {
+		log.Error().Err(err).Msg("Failed to pull image")
+		return false
+	}
+	if err := a.startContainer(ctx, c); err != nil {
+		log.Error().Err(err).Msg("Failed to start init container")
+	}
+
+	done := c.finished
+	if c.sidecar() {
+		done = c.started
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-a.stopping:
+		return false
+	case <-done:
+	}
+
+	if c.sidecar() {
+		return true
+	}
+
+	a.mu.RLock()
+	terminated := c.status.State.Terminated
+	a.mu.RUnlock()
+	if terminated == nil || terminated.ExitCode != 0 {
+		log.Error().Msg("Init container failed; not starting the pod's containers")
+		return false
+	}
+	return true
+}
+
+// pullImage pulls the container's image and records the image ID, retrying
+// until the pull succeeds or the pod stops.
+func (a *Agent) pullImage(ctx context.Context, c *container) error {
+	if err := a.attemptPull(ctx, c); err != nil {
+		return a.retryPull(ctx, c, err)
+	}
+	return nil
+}
+
+// attemptPull pulls the container's image once. A failed pull leaves the
+// container waiting with ErrImagePull.
+func (a *Agent) attemptPull(ctx context.Context, c *container) error {
+	imageID, err := a.pullOnce(ctx, c.spec.Image)
+	if err != nil {
+		a.setWaiting(c, "ErrImagePull", err.Error())
+		return err
+	}
+
+	a.mu.Lock()
+	c.status.ImageID = imageID
+	a.mu.Unlock()
+
+	return nil
+}
+
+// retryPull retries the pull of the container's image after it failed with
+// err, with the same back-off as restarts, until it succeeds or the pod
+// stops. The container is in ImagePullBackOff between attempts after the
+// first.
+func (a *Agent) retryPull(ctx context.Context, c *container, err error) error {
+	backoff := a.restartBackoff
+	for attempt := 1; ; attempt++ {
+		a.logger.Warn().Err(err).Str("container", c.spec.Name).Dur("backoff", backoff).Msg("Failed to pull image")
+		if attempt > 1 {
+			a.setWaiting(c, "ImagePullBackOff", fmt.Sprintf("Back-off pulling image %q: %v", c.spec.Image, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-a.stopping:
+			return err
+		case <-time.After(backoff):
+		}
+
+		if err = a.attemptPull(ctx, c); err == nil {
+			return nil
+		}
+		backoff = min(2*backoff, maxRestartBackoff)
+	}
+}
+
+// pullOnce pulls an image with each matching login of the pod's pull
+// secrets in turn, or with a login from a.registries if none match, or
+// anonymously.
+func (a *Agent) pullOnce(ctx context.Context, image string) (string, error) {
+	a.mu.RLock()
+	logins := matchCredentials(a.credentials, image)
+	a.mu.RUnlock()
+
+	if len(logins) == 0 && a.registries != nil {
+		registry, _ := imageRepository(image)
+		login, err := a.registries.Credential(ctx, registry)
+		if err != nil {
+			return "", err
+		}
+		if login != nil {
+			logins = append(logins, *login)
+		}
+	}
+
+	if len(logins) == 0 {
+		return a.runtime.PullImage(ctx, image, nil)
+	}
+
+	var err error
+	for _, login := range logins {
+		var imageID string
+		if imageID, err = a.runtime.PullImage(ctx, image, &login); err == nil {
+			return imageID, nil
+		}
+	}
+	return "", err
+}
+
+// startContainer starts the container and watches it in the background until
+// it exits. The container's postStart hook runs before it counts as started.
+func (a *Agent) startContainer(ctx context.Context, c *container) error {
+	if a.stopped() {
+		return fmt.Errorf("pod is stopping")
+	}
+
+	a.mu.RLock()
+	restartCount := c.status.RestartCount
+	mounts := a.containerMounts(c.spec)
+	sandbox, hostsFile, resolvConf := a.sandbox, a.hostsFile, a.resolvConf
+	security, err := containerSecurity(a.pod, c.spec)
+	a.mu.RUnlock()
+	if err != nil {
+		go a.restartAfterExit(ctx, c, a.setStartError(c, err), 0)
+		return err
+	}
+
+	logs, err := openLogFile(containerLogPath(a.logDir, c.spec.Name, restartCount))
+	if err != nil {
+		go a.restartAfterExit(ctx, c, a.setStartError(c, err), 0)
+		return err
+	}
+	stdout := logs.Stream(streamStdout)
+	stderr := logs.Stream(streamStderr)
+
+	env := containerEnv(c.spec)
+	run := &containerRun{
+		id:     fmt.Sprintf("%s-%d", c.spec.Name, restartCount),
+		exited: make(chan struct{}),
+	}
+
+	var stdin io.Reader
+	if c.spec.Stdin {
+		stdin, run.stdin = io.Pipe()
+	}
+
+	proc, err := a.runtime.StartContainer(ctx, &ContainerConfig{
+		ID:         run.id,
+		Image:      c.spec.Image,
+		Command:    expandAll(c.spec.Command, env),
+		Args:       expandAll(c.spec.Args, env),
+		Env:        env,
+		WorkingDir: c.spec.WorkingDir,
+		Resources:  c.spec.Resources,
+		Mounts:     mounts,
+		Sandbox:    sandbox,
+		HostsFile:  hostsFile,
+		ResolvConf: resolvConf,
+		Security:   security,
+		Stdin:      stdin,
+		TTY:        c.spec.TTY,
+		Stdout:     io.MultiWriter(stdout, c.stdout),
+		Stderr:     io.MultiWriter(stderr, c.stderr),
+	})
+	if err != nil {
+		_ = logs.Close()
+		go a.restartAfterExit(ctx, c, a.setStartError(c, err), 0)
+		return err
+	}
+	run.proc = proc
+
+	id := run.id
+	startedAt := metav1.Now()
+	started := false
+
+	// The container counts as started, and is ready, once its postStart
+	// hook has run and its startup and readiness probes pass
+	a.mu.Lock()
+	c.run = run
+	c.status.ContainerID = "containerd://" + id
+	c.status.State = corev1.ContainerState{
+		Running: &corev1.ContainerStateRunning{StartedAt: startedAt},
+	}
+	c.status.Ready = false
+	c.status.Started = &started
+	stopping := a.stopped()
+	a.mu.Unlock()
+
+	a.logger.Info().Str("container", c.spec.Name).Str("id", id).Msg("Container started")
+
+	go func() {
+		exitCode, err := proc.Wait()
+		_ = stdout.Flush()
+		_ = stderr.Flush()
+		_ = logs.Close()
+
+		terminated := &corev1.ContainerStateTerminated{
+			ExitCode:    int32(exitCode),
+			Reason:      "Completed",
+			StartedAt:   startedAt,
+			FinishedAt:  metav1.Now(),
+			ContainerID: "containerd://" + id,
+		}
+		if err != nil {
+			terminated.Reason = "Error"
+			terminated.Message = err.Error()
+		} else if exitCode != 0 {
+			terminated.Reason = "Error"
+		}
+
+		started := false
+
+		a.mu.Lock()
+		c.status.State = corev1.ContainerState{Terminated: terminated}
+		c.status.Ready = false
+		c.status.Started = &started
+		a.mu.Unlock()
+
+		if run.stdin != nil {
+			_ = run.stdin.Close()
+		}
+		close(run.exited)
+
+		a.logger.Info().
+			Str("container", c.spec.Name).
+			Int("exit_code", exitCode).
+			Msg("Container exited")
+
+		a.restartAfterExit(ctx, c, terminated, time.Since(startedAt.Time))
+	}()
+
+	// Stop may have missed a container that started while it began
+	if stopping {
+		_ = a.runtime.KillContainer(ctx, id, syscall.SIGKILL)
+		return fmt.Errorf("pod is stopping")
+	}
+
+	if err := a.runPostStart(ctx, c, run); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	if c.run == run && c.status.State.Running != nil && c.spec.StartupProbe == nil {
+		c.markStarted()
+	}
+	a.mu.Unlock()
+
+	if hasProbes(c.spec) {
+		go a.runProbes(ctx, c, run)
+	}
+
+	return nil
+}
+
+// setWaiting marks the container as waiting with the given reason.
+func (a *Agent) setWaiting(c *container, reason, message string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c.status.State = corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message},
+	}
+	c.status.Ready = false
+}
+
+// setStartError marks a container that could not be started as terminated,
+// the way the kubelet reports a failed start, and returns that state.
+func (a *Agent) setStartError(c *container, err error) *corev1.ContainerStateTerminated {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := metav1.Now()
+	terminated := &corev1.ContainerStateTerminated{
+		ExitCode:   128,
+		Reason:     "StartError",
+		Message:    err.Error(),
+		StartedAt:  now,
+		FinishedAt: now,
+	}
+	c.status.State = corev1.ContainerState{Terminated: terminated}
+	c.status.Ready = false
+
+	return terminated
+}
@@ -0,0 +1,782 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeRuntime is an in-memory Runtime used to test the agent without
+// containerd.
+type fakeRuntime struct {
+	mu        sync.Mutex
+	pulled    []string
+	started   map[string]*ContainerConfig
+	processes map[string]*fakeProcess
+	pullErr   map[string]error
+	pullAuth  []*RegistryCredential
+	output    map[string]string
+
+	// execs records exec'd commands; execCode is their exit code
+	execs    []*ExecConfig
+	execCode int
+
+	// stats is reported by ContainerStats
+	stats map[string]*ContainerStats
+
+	// kills records signalled containers as "id:signal"; containers ignore
+	// SIGTERM when ignoreTerm is set
+	kills      []string
+	ignoreTerm bool
+
+	// sandbox is the running pod sandbox; sandboxErr fails starting one
+	sandbox    *SandboxConfig
+	sandboxErr error
+	removed    []string
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		started:   make(map[string]*ContainerConfig),
+		processes: make(map[string]*fakeProcess),
+		pullErr:   make(map[string]error),
+		output:    make(map[string]string),
+		stats:     make(map[string]*ContainerStats),
+	}
+}
+
+func (r *fakeRuntime) PullImage(ctx context.Context, image string, auth *RegistryCredential) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pullAuth = append(r.pullAuth, auth)
+	if err := r.pullErr[image]; err != nil {
+		return "", err
+	}
+	r.pulled = append(r.pulled, image)
+	return "sha256:" + image, nil
+}
+
+func (r *fakeRuntime) StartContainer(ctx context.Context, cfg *ContainerConfig) (Process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if out, ok := r.output[cfg.ID]; ok {
+		_, _ = io.WriteString(cfg.Stdout, out)
+	}
+
+	// Containers with stdin echo it to stdout.
+	if cfg.Stdin != nil {
+		go func() { _, _ = io.Copy(cfg.Stdout, cfg.Stdin) }()
+	}
+
+	proc := &fakeProcess{exit: make(chan int, 1)}
+	r.started[cfg.ID] = cfg
+	r.processes[cfg.ID] = proc
+	return proc, nil
+}
+
+// ExecContainer writes the command to stdout and stderr, echoes stdin to
+// stdout, and exits with execCode.
+func (r *fakeRuntime) ExecContainer(ctx context.Context, id string, cfg *ExecConfig) (Process, error) {
+	r.mu.Lock()
+	r.execs = append(r.execs, cfg)
+	code := r.execCode
+	r.mu.Unlock()
+
+	proc := &fakeProcess{exit: make(chan int, 1)}
+	go func() {
+		_, _ = io.WriteString(cfg.Stdout, strings.Join(cfg.Command, " ")+"\n")
+		if cfg.Stderr != nil {
+			_, _ = io.WriteString(cfg.Stderr, "to stderr\n")
+		}
+		if cfg.Stdin != nil {
+			_, _ = io.Copy(cfg.Stdout, cfg.Stdin)
+		}
+		proc.exit <- code
+	}()
+	return proc, nil
+}
+
+func (r *fakeRuntime) KillContainer(ctx context.Context, id string, sig syscall.Signal) error {
+	r.mu.Lock()
+	proc, ok := r.processes[id]
+	r.kills = append(r.kills, fmt.Sprintf("%s:%d", id, sig))
+	ignore := r.ignoreTerm && sig == syscall.SIGTERM
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("container %s not found", id)
+	}
+	if ignore {
+		return nil
+	}
+	select {
+	case proc.exit <- 128 + int(sig):
+	default:
+		// Already exiting
+	}
+	return nil
+}
+
+func (r *fakeRuntime) StartSandbox(ctx context.Context, cfg *SandboxConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sandboxErr != nil {
+		return r.sandboxErr
+	}
+	r.sandbox = cfg
+	return nil
+}
+
+func (r *fakeRuntime) RemoveSandbox(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sandbox = nil
+	r.removed = append(r.removed, id)
+	return nil
+}
+
+func (r *fakeRuntime) ContainerStats(ctx context.Context, id string) (*ContainerStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, ok := r.stats[id]
+	if !ok {
+		return nil, fmt.Errorf("container %s not found", id)
+	}
+	copied := *stats
+	return &copied, nil
+}
+
+// config returns the config a container was started with.
+func (r *fakeRuntime) config(id string) *ContainerConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.started[id]
+}
+
+// process returns the main process of a container.
+func (r *fakeRuntime) process(id string) *fakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.processes[id]
+}
+
+// exit makes the container exit with the given code.
+func (r *fakeRuntime) exit(id string, code int) {
+	r.process(id).exit <- code
+}
+
+type fakeProcess struct {
+	exit chan int
+
+	mu      sync.Mutex
+	resizes []TermSize
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	return <-p.exit, nil
+}
+
+func (p *fakeProcess) Resize(size TermSize) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resizes = append(p.resizes, size)
+	return nil
+}
+
+func testPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "train",
+			Namespace: "default",
+			UID:       "pod-uid-1",
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:    "trainer",
+					Image:   "pytorch:latest",
+					Command: []string{"python", "train.py"},
+					Args:    []string{"--epochs", "$(EPOCHS)"},
+					Env: []corev1.EnvVar{
+						{Name: "EPOCHS", Value: "10"},
+						{Name: "MESSAGE", Value: "epochs=$(EPOCHS) cost=$$(free)"},
+					},
+					WorkingDir: "/workspace",
+				},
+				{
+					Name:  "sidecar",
+					Image: "busybox",
+				},
+			},
+		},
+	}
+}
+
+// startAgent runs an agent with the fake runtime until the test ends.
+func startAgent(t *testing.T, rt Runtime) *Agent {
+	t.Helper()
+	return startAgentWithHost(t, rt, nil)
+}
+
+// startAgentWithHost runs an agent with the fake runtime and the given host
+// until the test ends.
+func startAgentWithHost(t *testing.T, rt Runtime, host Host) *Agent {
+	t.Helper()
+
+	a := New(rt, host, nil, nil, nil, t.TempDir(), t.TempDir(), zerolog.Nop())
+	a.restartBackoff = 10 * time.Millisecond
+	a.probeUnit = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = a.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return a
+}
+
+// waitFor polls cond until it returns true or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// safeBuffer is a bytes.Buffer that can be written and read concurrently.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// containerStatus returns the named container's status from the agent.
+func containerStatus(a *Agent, name string) corev1.ContainerStatus {
+	for _, s := range a.Status().ContainerStatuses {
+		if s.Name == name {
+			return s
+		}
+	}
+	return corev1.ContainerStatus{}
+}
+
+func TestAgentRunsContainers(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitFor(t, "containers to start", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil &&
+			containerStatus(a, "sidecar").State.Running != nil
+	})
+
+	cfg := rt.config("trainer-0")
+	if cfg == nil {
+		t.Fatal("trainer container was not started")
+	}
+	if got := strings.Join(cfg.Command, " "); got != "python train.py" {
+		t.Errorf("expected command 'python train.py', got %q", got)
+	}
+	if got := strings.Join(cfg.Args, " "); got != "--epochs 10" {
+		t.Errorf("expected expanded args '--epochs 10', got %q", got)
+	}
+	if cfg.WorkingDir != "/workspace" {
+		t.Errorf("expected working dir /workspace, got %s", cfg.WorkingDir)
+	}
+
+	wantEnv := []string{"EPOCHS=10", "MESSAGE=epochs=10 cost=$(free)"}
+	if strings.Join(cfg.Env, "\n") != strings.Join(wantEnv, "\n") {
+		t.Errorf("expected env %v, got %v", wantEnv, cfg.Env)
+	}
+
+	status := containerStatus(a, "trainer")
+	if status.ImageID != "sha256:pytorch:latest" {
+		t.Errorf("expected image ID to be recorded, got %s", status.ImageID)
+	}
+	if status.ContainerID != "containerd://trainer-0" {
+		t.Errorf("expected container ID containerd://trainer-0, got %s", status.ContainerID)
+	}
+	if !status.Ready {
+		t.Error("expected running container to be ready")
+	}
+}
+
+func TestAgentReportsExitCodes(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "containers to start", func() bool {
+		return rt.config("trainer-0") != nil && rt.config("sidecar-0") != nil
+	})
+
+	rt.exit("trainer-0", 0)
+	rt.exit("sidecar-0", 3)
+
+	waitFor(t, "containers to exit", func() bool {
+		return containerStatus(a, "trainer").State.Terminated != nil &&
+			containerStatus(a, "sidecar").State.Terminated != nil
+	})
+
+	trainer := containerStatus(a, "trainer").State.Terminated
+	if trainer.ExitCode != 0 || trainer.Reason != "Completed" {
+		t.Errorf("expected trainer Completed/0, got %s/%d", trainer.Reason, trainer.ExitCode)
+	}
+
+	sidecar := containerStatus(a, "sidecar").State.Terminated
+	if sidecar.ExitCode != 3 || sidecar.Reason != "Error" {
+		t.Errorf("expected sidecar Error/3, got %s/%d", sidecar.Reason, sidecar.ExitCode)
+	}
+	if containerStatus(a, "sidecar").Ready {
+		t.Error("expected exited container to not be ready")
+	}
+	if phase := a.Status().Phase; phase != corev1.PodFailed {
+		t.Errorf("expected pod phase Failed, got %s", phase)
+	}
+}
+
+func TestPodPhase(t *testing.T) {
+	waiting := corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}}
+	running := corev1.ContainerStatus{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	completed := corev1.ContainerStatus{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}}
+	failed := corev1.ContainerStatus{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}}
+	backoff := corev1.ContainerStatus{
+		State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+	}
+
+	tests := []struct {
+		name     string
+		statuses []corev1.ContainerStatus
+		policy   corev1.RestartPolicy
+		expected corev1.PodPhase
+	}{
+		{name: "no containers", policy: corev1.RestartPolicyNever, expected: corev1.PodPending},
+		{name: "all waiting", statuses: []corev1.ContainerStatus{waiting, waiting}, policy: corev1.RestartPolicyNever, expected: corev1.PodPending},
+		{name: "one not started", statuses: []corev1.ContainerStatus{running, waiting}, policy: corev1.RestartPolicyNever, expected: corev1.PodPending},
+		{name: "all running", statuses: []corev1.ContainerStatus{running, running}, policy: corev1.RestartPolicyNever, expected: corev1.PodRunning},
+		{name: "one completed", statuses: []corev1.ContainerStatus{completed, running}, policy: corev1.RestartPolicyNever, expected: corev1.PodRunning},
+		{name: "never all completed", statuses: []corev1.ContainerStatus{completed, completed}, policy: corev1.RestartPolicyNever, expected: corev1.PodSucceeded},
+		{name: "never one failed", statuses: []corev1.ContainerStatus{completed, failed}, policy: corev1.RestartPolicyNever, expected: corev1.PodFailed},
+		{name: "on failure all completed", statuses: []corev1.ContainerStatus{completed, completed}, policy: corev1.RestartPolicyOnFailure, expected: corev1.PodSucceeded},
+		{name: "on failure one failed", statuses: []corev1.ContainerStatus{completed, failed}, policy: corev1.RestartPolicyOnFailure, expected: corev1.PodRunning},
+		{name: "on failure backing off", statuses: []corev1.ContainerStatus{backoff}, policy: corev1.RestartPolicyOnFailure, expected: corev1.PodRunning},
+		{name: "always all completed", statuses: []corev1.ContainerStatus{completed, completed}, policy: corev1.RestartPolicyAlways, expected: corev1.PodRunning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if phase := podPhase(tt.statuses, tt.policy); phase != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, phase)
+			}
+		})
+	}
+}
+
+func TestAgentRestartsContainers(t *testing.T) {
+	tests := []struct {
+		policy   corev1.RestartPolicy
+		exitCode int
+		restarts bool
+	}{
+		{corev1.RestartPolicyAlways, 0, true},
+		{corev1.RestartPolicyAlways, 1, true},
+		{corev1.RestartPolicyOnFailure, 0, false},
+		{corev1.RestartPolicyOnFailure, 1, true},
+		{corev1.RestartPolicyNever, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s exit %d", tt.policy, tt.exitCode), func(t *testing.T) {
+			rt := newFakeRuntime()
+			a := startAgent(t, rt)
+			a.restartBackoff = 50 * time.Millisecond
+
+			pod := testPod()
+			pod.Spec.RestartPolicy = tt.policy
+			pod.Spec.Containers = pod.Spec.Containers[:1]
+			if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+			rt.exit("trainer-0", tt.exitCode)
+
+			if !tt.restarts {
+				waitFor(t, "container to exit", func() bool {
+					return containerStatus(a, "trainer").State.Terminated != nil
+				})
+				time.Sleep(50 * time.Millisecond)
+				if rt.config("trainer-1") != nil {
+					t.Fatal("expected container not to be restarted")
+				}
+				return
+			}
+
+			waitFor(t, "container to restart", func() bool {
+				return containerStatus(a, "trainer").State.Running != nil && rt.config("trainer-1") != nil
+			})
+			status := containerStatus(a, "trainer")
+			if status.RestartCount != 1 {
+				t.Errorf("expected restart count 1, got %d", status.RestartCount)
+			}
+			last := status.LastTerminationState.Terminated
+			if last == nil || last.ExitCode != int32(tt.exitCode) {
+				t.Errorf("expected last termination with exit code %d, got %+v", tt.exitCode, last)
+			}
+
+			// A second crash backs off for longer
+			rt.exit("trainer-1", 1)
+			waitFor(t, "crash loop back-off", func() bool {
+				w := containerStatus(a, "trainer").State.Waiting
+				return w != nil && w.Reason == "CrashLoopBackOff" && strings.Contains(w.Message, "back-off 100ms")
+			})
+			if phase := a.Status().Phase; phase != corev1.PodRunning {
+				t.Errorf("expected pod phase Running while backing off, got %s", phase)
+			}
+		})
+	}
+}
+
+func TestAgentImagePullFailure(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.pullErr["busybox"] = fmt.Errorf("manifest unknown")
+	a := startAgent(t, rt)
+	a.restartBackoff = time.Hour
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitFor(t, "pull failure", func() bool {
+		w := containerStatus(a, "sidecar").State.Waiting
+		return w != nil && w.Reason == "ErrImagePull"
+	})
+
+	// The other container is unaffected.
+	waitFor(t, "trainer to start", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil
+	})
+}
+
+func TestAgentImagePullBackOff(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.pullErr["busybox"] = fmt.Errorf("manifest unknown")
+	a := startAgent(t, rt)
+	a.restartBackoff = 50 * time.Millisecond
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "pull back-off", func() bool {
+		w := containerStatus(a, "sidecar").State.Waiting
+		return w != nil && w.Reason == "ImagePullBackOff"
+	})
+
+	// The container starts once its image can be pulled
+	rt.mu.Lock()
+	delete(rt.pullErr, "busybox")
+	rt.mu.Unlock()
+	waitFor(t, "sidecar to start", func() bool {
+		return containerStatus(a, "sidecar").State.Running != nil
+	})
+}
+
+// initStatus returns the named init container's status from the agent.
+func initStatus(a *Agent, name string) corev1.ContainerStatus {
+	for _, s := range a.Status().InitContainerStatuses {
+		if s.Name == name {
+			return s
+		}
+	}
+	return corev1.ContainerStatus{}
+}
+
+// initPod returns testPod with an init container and a sidecar.
+func initPod() *corev1.Pod {
+	pod := testPod()
+	always := corev1.ContainerRestartPolicyAlways
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "setup", Image: "busybox"},
+		{Name: "proxy", Image: "envoy", RestartPolicy: &always},
+	}
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	return pod
+}
+
+func TestAgentRunsInitContainers(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: initPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "init container to start", func() bool { return rt.config("setup-0") != nil })
+
+	// Nothing else starts until the init container completes
+	time.Sleep(50 * time.Millisecond)
+	if rt.config("proxy-0") != nil || rt.config("trainer-0") != nil {
+		t.Fatal("expected containers to wait for the init container")
+	}
+	report := a.Status()
+	if report.Initialized || report.Phase != corev1.PodPending {
+		t.Errorf("expected uninitialized Pending pod, got initialized=%v phase=%s", report.Initialized, report.Phase)
+	}
+	if w := containerStatus(a, "trainer").State.Waiting; w == nil || w.Reason != "PodInitializing" {
+		t.Errorf("expected trainer to wait with PodInitializing, got %+v", w)
+	}
+
+	rt.exit("setup-0", 0)
+	waitFor(t, "sidecar and app containers to start", func() bool {
+		return initStatus(a, "proxy").State.Running != nil && containerStatus(a, "trainer").State.Running != nil
+	})
+
+	report = a.Status()
+	if !report.Initialized || len(report.InitContainerStatuses) != 2 || len(report.ContainerStatuses) != 1 {
+		t.Fatalf("unexpected report: initialized=%v init=%d app=%d",
+			report.Initialized, len(report.InitContainerStatuses), len(report.ContainerStatuses))
+	}
+	if terminated := initStatus(a, "setup").State.Terminated; terminated == nil || terminated.Reason != "Completed" {
+		t.Errorf("expected setup to be Completed, got %+v", terminated)
+	}
+
+	// The pod completes with its app containers; the sidecar does not hold
+	// it up
+	rt.exit("trainer-0", 0)
+	waitFor(t, "pod to succeed", func() bool { return a.Status().Phase == corev1.PodSucceeded })
+}
+
+func TestAgentInitContainerFailure(t *testing.T) {
+	tests := []struct {
+		policy   corev1.RestartPolicy
+		expected corev1.PodPhase
+	}{
+		{corev1.RestartPolicyNever, corev1.PodFailed},
+		{corev1.RestartPolicyAlways, corev1.PodPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rt := newFakeRuntime()
+			a := startAgent(t, rt)
+
+			pod := initPod()
+			pod.Spec.RestartPolicy = tt.policy
+			if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			waitFor(t, "init container to start", func() bool { return rt.config("setup-0") != nil })
+
+			rt.exit("setup-0", 1)
+			if tt.policy != corev1.RestartPolicyNever {
+				// Retried rather than failing the pod
+				waitFor(t, "init container to restart", func() bool { return rt.config("setup-1") != nil })
+			}
+			waitFor(t, "pod phase "+string(tt.expected), func() bool { return a.Status().Phase == tt.expected })
+
+			if rt.config("trainer-0") != nil {
+				t.Error("expected app container not to start after a failed init container")
+			}
+		})
+	}
+}
+
+func TestAgentWritesContainerLogs(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.output["trainer-0"] = "epoch 1\nepoch 2\npartial"
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "trainer to start", func() bool { return rt.config("trainer-0") != nil })
+
+	rt.exit("trainer-0", 0)
+	waitFor(t, "trainer to exit", func() bool {
+		return containerStatus(a, "trainer").State.Terminated != nil
+	})
+
+	data, err := os.ReadFile(containerLogPath(a.logDir, "trainer", 0))
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{"stdout F epoch 1", "stdout F epoch 2", "stdout F partial"}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d log lines, got %d: %q", len(want), len(lines), lines)
+	}
+	for i, line := range lines {
+		ts, rest, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Errorf("line %d has invalid timestamp %q", i, ts)
+		}
+		if rest != want[i] {
+			t.Errorf("line %d: expected %q, got %q", i, want[i], rest)
+		}
+	}
+}
+
+func TestAgentLogs(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.output["trainer-0"] = "epoch 1\n"
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "trainer to start", func() bool { return rt.config("trainer-0") != nil })
+
+	// Follow until the container exits.
+	var buf safeBuffer
+	result := make(chan error, 1)
+	go func() {
+		result <- a.Logs(context.Background(), "trainer", LogOptions{Follow: true}, &buf)
+	}()
+
+	waitFor(t, "first line", func() bool { return buf.String() == "epoch 1\n" })
+	_, _ = rt.config("trainer-0").Stdout.Write([]byte("epoch 2\n"))
+	rt.exit("trainer-0", 0)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not end after the container exited")
+	}
+	if buf.String() != "epoch 1\nepoch 2\n" {
+		t.Errorf("unexpected logs %q", buf.String())
+	}
+
+	tests := []struct {
+		name        string
+		container   string
+		opts        LogOptions
+		expectedErr error
+	}{
+		{name: "unknown container", container: "missing", expectedErr: ErrContainerNotFound},
+		{name: "no previous run", container: "trainer", opts: LogOptions{Previous: true}, expectedErr: ErrContainerNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.Logs(context.Background(), tt.container, tt.opts, io.Discard)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestAgentLogsBeforeStart(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.pullErr["busybox"] = fmt.Errorf("manifest unknown")
+	a := startAgent(t, rt)
+	a.restartBackoff = time.Hour
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "pull failure", func() bool {
+		w := containerStatus(a, "sidecar").State.Waiting
+		return w != nil && w.Reason == "ErrImagePull"
+	})
+
+	err := a.Logs(context.Background(), "sidecar", LogOptions{}, io.Discard)
+	if !errors.Is(err, ErrContainerNotStarted) {
+		t.Errorf("expected ErrContainerNotStarted, got %v", err)
+	}
+}
+
+func TestAgentRejectsSecondPod(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Resubmitting the same pod is idempotent.
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Errorf("expected resubmitting the same pod to succeed, got %v", err)
+	}
+
+	other := testPod()
+	other.UID = "pod-uid-2"
+	if err := a.Start(PodSubmission{Pod: other}); err != ErrPodAlreadyStarted {
+		t.Errorf("expected ErrPodAlreadyStarted, got %v", err)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"A": "1", "B": "two"}
+
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "plain", expected: "plain"},
+		{in: "$(A)", expected: "1"},
+		{in: "$(A)-$(B)", expected: "1-two"},
+		{in: "$(MISSING)", expected: "$(MISSING)"},
+		{in: "$$(A)", expected: "$(A)"},
+		{in: "cost $5", expected: "cost $5"},
+		{in: "$(unterminated", expected: "$(unterminated"},
+		{in: "trailing $", expected: "trailing $"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := expandVars(tt.in, vars); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupDir returns the cgroup v2 path of a process from its
+// /proc/<pid>/cgroup file.
+func cgroupDir(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if dir, ok := strings.CutPrefix(line, "0::"); ok {
+			return dir, nil
+		}
+	}
+
+	return "", fmt.Errorf("no cgroup v2 entry in %s", path)
+}
+
+// readCgroupStats reads CPU and memory usage from a cgroup v2 directory.
+func readCgroupStats(dir string) (*ContainerStats, error) {
+	cpu, err := readKeyedFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	memoryStat, err := readKeyedFile(filepath.Join(dir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	usage, err := strconv.ParseUint(string(bytes.TrimSpace(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected memory.current value %q", data)
+	}
+
+	// The working set excludes inactive page cache, which the kernel can
+	// reclaim under pressure, matching the kubelet's definition.
+	workingSet := usage
+	if inactive := memoryStat["inactive_file"]; inactive < workingSet {
+		workingSet -= inactive
+	} else {
+		workingSet = 0
+	}
+
+	return &ContainerStats{
+		CPUUsageNanoSeconds:   cpu["usage_usec"] * 1000,
+		MemoryUsageBytes:      usage,
+		MemoryWorkingSetBytes: workingSet,
+	}, nil
+}
+
+// readKeyedFile reads a cgroup file of "key value" lines.
+func readKeyedFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+
+	return values, scanner.Err()
+}
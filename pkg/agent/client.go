@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Client talks to the agent running on an instance.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the agent listening on host:port.
+func NewClient(host string, port int, token string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		baseURL: "https://" + net.JoinHostPort(host, strconv.Itoa(port)),
+		token:   token,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+// Close releases idle connections to the agent.
+func (c *Client) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// Health checks that the agent API is reachable.
+func (c *Client) Health(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, pathHealth, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Status returns the pod report of the agent.
+func (c *Client) Status(ctx context.Context) (*PodReport, error) {
+	resp, err := c.do(ctx, http.MethodGet, pathPod, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var report PodReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to decode pod report: %w", err)
+	}
+
+	return &report, nil
+}
+
+// StartPod submits the pod to the agent, along with the files of the volumes
+// and the registry credentials the controller provides.
+func (c *Client) StartPod(ctx context.Context, submission PodSubmission) error {
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return fmt.Errorf("failed to encode pod: %w", err)
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, pathPod, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// UpdateVolumes replaces the files of volumes the controller provides.
+func (c *Client) UpdateVolumes(ctx context.Context, volumes map[string][]VolumeFile) error {
+	body, err := json.Marshal(volumes)
+	if err != nil {
+		return fmt.Errorf("failed to encode volumes: %w", err)
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, pathVolumes, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// StopPod asks the agent to stop the pod within gracePeriod. It returns once
+// stopping has begun; the pod report shows when it is done.
+func (c *Client) StopPod(ctx context.Context, gracePeriod time.Duration) error {
+	path := fmt.Sprintf("%s?gracePeriodSeconds=%d", pathPod, int64(gracePeriod/time.Second))
+	resp, err := c.do(ctx, http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stats returns the agent's latest resource usage sample.
+func (c *Client) Stats(ctx context.Context) (*StatsSample, error) {
+	resp, err := c.do(ctx, http.MethodGet, pathStats, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sample StatsSample
+	if err := json.NewDecoder(resp.Body).Decode(&sample); err != nil {
+		return nil, fmt.Errorf("failed to decode stats: %w", err)
+	}
+
+	return &sample, nil
+}
+
+// WatchStats calls fn with every usage sample the agent takes until ctx is
+// cancelled or the stream fails. It always returns a non-nil error.
+func (c *Client) WatchStats(ctx context.Context, fn func(*StatsSample)) error {
+	resp, err := c.do(ctx, http.MethodGet, pathStats+"?watch=true", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var sample StatsSample
+		if err := dec.Decode(&sample); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return fmt.Errorf("stats stream ended: %w", err)
+		}
+		fn(&sample)
+	}
+}
+
+// Logs streams the logs of the named container. The caller must close the
+// returned reader; cancelling ctx ends a followed stream.
+func (c *Client) Logs(ctx context.Context, container string, opts LogOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	if opts.Follow {
+		q.Set("follow", "true")
+	}
+	if opts.Previous {
+		q.Set("previous", "true")
+	}
+	if opts.Timestamps {
+		q.Set("timestamps", "true")
+	}
+	if opts.Tail > 0 {
+		q.Set("tailLines", strconv.Itoa(opts.Tail))
+	}
+	if opts.LimitBytes > 0 {
+		q.Set("limitBytes", strconv.Itoa(opts.LimitBytes))
+	}
+	if !opts.SinceTime.IsZero() {
+		q.Set("sinceTime", opts.SinceTime.UTC().Format(time.RFC3339Nano))
+	}
+
+	path := pathContainers + url.PathEscape(container) + "/logs"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Exec runs command in the named container with the given streams and
+// returns the command's exit code. Cancelling ctx ends the session.
+func (c *Client) Exec(ctx context.Context, container string, command []string, sio StreamIO) (int, error) {
+	q := streamQuery(sio)
+	for _, arg := range command {
+		q.Add("command", arg)
+	}
+	return c.stream(ctx, pathContainers+url.PathEscape(container)+"/exec?"+q.Encode(), sio)
+}
+
+// Attach connects the given streams to the main process of the named
+// container. It returns the container's exit code if it exits during the
+// session. Cancelling ctx detaches.
+func (c *Client) Attach(ctx context.Context, container string, sio StreamIO) (int, error) {
+	return c.stream(ctx, pathContainers+url.PathEscape(container)+"/attach?"+streamQuery(sio).Encode(), sio)
+}
+
+// streamQuery returns the query parameters describing sio.
+func streamQuery(sio StreamIO) url.Values {
+	q := url.Values{}
+	if sio.Stdin != nil {
+		q.Set("stdin", "true")
+	}
+	if sio.TTY {
+		q.Set("tty", "true")
+	}
+	return q
+}
+
+// stream runs an interactive session on a connection upgraded to the framed
+// stream protocol.
+func (c *Client) stream(ctx context.Context, path string, sio StreamIO) (int, error) {
+	conn, err := c.upgrade(ctx, path, streamProtocol)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks the frame reader on cancellation.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	fc := newFrameConn(conn, conn)
+
+	if sio.Stdin != nil {
+		go func() {
+			_, _ = io.Copy(&frameWriter{conn: fc, kind: frameStdin}, sio.Stdin)
+			_ = fc.writeFrame(frameStdin, nil)
+		}()
+	}
+	if sio.Resize != nil {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case size, ok := <-sio.Resize:
+					if !ok {
+						return
+					}
+					if fc.writeJSON(frameResize, size) != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for {
+		kind, payload, err := fc.readFrame()
+		if err != nil {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			return -1, fmt.Errorf("agent session ended unexpectedly: %w", err)
+		}
+
+		switch kind {
+		case frameStdout:
+			if sio.Stdout != nil {
+				_, _ = sio.Stdout.Write(payload)
+			}
+		case frameStderr:
+			if sio.Stderr != nil {
+				_, _ = sio.Stderr.Write(payload)
+			}
+		case frameExit:
+			var report exitReport
+			if err := json.Unmarshal(payload, &report); err != nil {
+				return -1, fmt.Errorf("failed to decode session exit: %w", err)
+			}
+			if report.Error != "" {
+				return report.ExitCode, errors.New(report.Error)
+			}
+			return report.ExitCode, nil
+		}
+	}
+}
+
+// PortForward tunnels stream to port on the instance until either side
+// closes the connection or ctx is cancelled.
+func (c *Client) PortForward(ctx context.Context, port int32, stream io.ReadWriteCloser) error {
+	conn, err := c.upgrade(ctx, pathPortForward+strconv.Itoa(int(port)), tunnelProtocol)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	err = tunnel(stream, conn)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// upgrade sends an authenticated request that switches the connection to
+// protocol and returns the upgraded connection.
+func (c *Client) upgrade(ctx context.Context, path, protocol string) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build agent request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("agent request POST %s failed: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, responseError(http.MethodPost, path, resp)
+	}
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("agent returned a non-writable upgraded connection")
+	}
+
+	return conn, nil
+}
+
+// do sends an authenticated request and fails on non-2xx responses.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build agent request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("agent request %s %s failed: %w", method, path, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, responseError(method, path, resp)
+	}
+
+	return resp, nil
+}
+
+// responseError consumes an unsuccessful response and describes it.
+func responseError(method, path string, resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("agent request %s %s failed: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+}
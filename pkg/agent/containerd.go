@@ -0,0 +1,444 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodSlice is the systemd slice, and cgroup, that pod containers and
+// sandboxes run in. The instance's firewall matches it to keep their traffic
+// away from the instance metadata service and the agent's API.
+const PodSlice = "orca.slice"
+
+// ContainerdRuntime runs containers in containerd through the nerdctl CLI.
+//
+// nerdctl is used instead of the containerd Go client because it applies
+// image entrypoint/command semantics the same way Kubernetes expects
+// (command overrides the entrypoint, args override the command).
+type ContainerdRuntime struct {
+	binary    string
+	namespace string
+
+	// sandboxImage is the image of pod sandboxes, which only hold their
+	// namespaces
+	sandboxImage string
+}
+
+// NewContainerdRuntime creates a runtime that invokes the given nerdctl
+// binary in the given containerd namespace, with pod sandboxes running
+// sandboxImage, like registry.k8s.io/pause.
+func NewContainerdRuntime(binary, namespace, sandboxImage string) *ContainerdRuntime {
+	return &ContainerdRuntime{
+		binary:       binary,
+		namespace:    namespace,
+		sandboxImage: sandboxImage,
+	}
+}
+
+// PullImage pulls the image and returns its image ID.
+func (r *ContainerdRuntime) PullImage(ctx context.Context, image string, auth *RegistryCredential) (string, error) {
+	cmd := r.command(ctx, "pull", "--quiet", image)
+
+	if auth != nil {
+		// nerdctl reads logins from a docker config file. It only exists for
+		// the duration of the pull, readable by the agent alone.
+		dir, err := writeDockerConfig(image, auth)
+		if err != nil {
+			return "", fmt.Errorf("failed to write registry login: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	}
+
+	if _, err := run(cmd); err != nil {
+		return "", fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+
+	id, err := r.output(ctx, "image", "inspect", "--format", "{{.ID}}", image)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", image, err)
+	}
+
+	return strings.TrimSpace(id), nil
+}
+
+// StartContainer starts a container in the foreground so that its output
+// and exit code are delivered through the nerdctl process.
+func (r *ContainerdRuntime) StartContainer(ctx context.Context, cfg *ContainerConfig) (Process, error) {
+	// Containers share the network namespace and hostname of their sandbox
+	network := "host"
+	if cfg.Sandbox != "" {
+		network = "container:" + cfg.Sandbox
+	}
+	args := []string{"run", "--rm", "--name", cfg.ID, "--net", network, "--cgroup-parent", PodSlice}
+
+	// Containers that must not run as root and name no user run as the
+	// image's user, which must then be a non-root UID, as with the kubelet
+	if cfg.Security.RunAsNonRoot && cfg.Security.User == nil {
+		user, err := r.output(ctx, "image", "inspect", "--format", "{{.Config.User}}", cfg.Image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect image %s: %w", cfg.Image, err)
+		}
+		if err := checkNonRoot(cfg.Security, strings.TrimSpace(user)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Stdin != nil {
+		args = append(args, "--interactive")
+	}
+	if cfg.TTY {
+		args = append(args, "--tty")
+	}
+	if cfg.WorkingDir != "" {
+		args = append(args, "--workdir", cfg.WorkingDir)
+	}
+	for _, env := range cfg.Env {
+		args = append(args, "--env", env)
+	}
+	mounted := make(map[string]bool, len(cfg.Mounts))
+	for _, m := range cfg.Mounts {
+		volume := m.HostPath + ":" + m.ContainerPath
+		if m.ReadOnly {
+			volume += ":ro"
+		}
+		args = append(args, "--volume", volume)
+		mounted[m.ContainerPath] = true
+	}
+	// A container that mounts its own /etc/hosts or /etc/resolv.conf keeps
+	// it, as with the kubelet
+	if cfg.HostsFile != "" && !mounted["/etc/hosts"] {
+		args = append(args, "--volume", cfg.HostsFile+":/etc/hosts")
+	}
+	if cfg.ResolvConf != "" && !mounted["/etc/resolv.conf"] {
+		args = append(args, "--volume", cfg.ResolvConf+":/etc/resolv.conf")
+	}
+	args = append(args, resourceArgs(cfg.Resources)...)
+	args = append(args, securityArgs(cfg.Security)...)
+	args = append(args, efaArgs()...)
+
+	// Kubernetes semantics: command replaces the entrypoint (and drops the
+	// image command), args replace the image command.
+	positional := cfg.Args
+	if len(cfg.Command) > 0 {
+		args = append(args, "--entrypoint", cfg.Command[0])
+		positional = append(append([]string{}, cfg.Command[1:]...), cfg.Args...)
+	}
+
+	args = append(args, cfg.Image)
+	args = append(args, positional...)
+
+	// The container outlives the request that started it, so the process is
+	// deliberately not bound to ctx.
+	cmd := r.command(context.Background(), args...)
+
+	proc, err := startProcess(cmd, cfg.TTY, cfg.Stdin, cfg.Stdout, cfg.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container %s: %w", cfg.ID, err)
+	}
+
+	return proc, nil
+}
+
+// ExecContainer runs a process in a running container through nerdctl exec.
+func (r *ContainerdRuntime) ExecContainer(ctx context.Context, id string, cfg *ExecConfig) (Process, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("exec command cannot be empty")
+	}
+
+	args := []string{"exec"}
+	if cfg.Stdin != nil {
+		args = append(args, "--interactive")
+	}
+	if cfg.TTY {
+		args = append(args, "--tty")
+	}
+	args = append(args, id)
+	args = append(args, cfg.Command...)
+
+	proc, err := startProcess(r.command(ctx, args...), cfg.TTY, cfg.Stdin, cfg.Stdout, cfg.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec in container %s: %w", id, err)
+	}
+
+	return proc, nil
+}
+
+// startProcess starts cmd with the given streams. With tty, the process gets
+// a pseudo-terminal and its combined output goes to stdout.
+func startProcess(cmd *exec.Cmd, tty bool, stdin io.Reader, stdout, stderr io.Writer) (*cliProcess, error) {
+	if !tty {
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &cliProcess{cmd: cmd}, nil
+	}
+
+	pty, err := startTTY(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	proc := &cliProcess{cmd: cmd, pty: pty, copyDone: make(chan struct{})}
+	go func() {
+		// Reading the terminal fails with EIO once the process exits.
+		_, _ = io.Copy(stdout, pty)
+		close(proc.copyDone)
+	}()
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(pty, stdin)
+		}()
+	}
+
+	return proc, nil
+}
+
+// KillContainer sends a signal to the container's main process.
+func (r *ContainerdRuntime) KillContainer(ctx context.Context, id string, sig syscall.Signal) error {
+	if _, err := r.output(ctx, "kill", "--signal", strconv.Itoa(int(sig)), id); err != nil {
+		return fmt.Errorf("failed to signal container %s: %w", id, err)
+	}
+	return nil
+}
+
+// ContainerStats reads the container's usage from its cgroup v2 files.
+func (r *ContainerdRuntime) ContainerStats(ctx context.Context, id string) (*ContainerStats, error) {
+	out, err := r.output(ctx, "inspect", "--format", "{{.State.Pid}}", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+	}
+
+	pid := strings.TrimSpace(out)
+	dir, err := cgroupDir(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find cgroup of container %s: %w", id, err)
+	}
+
+	stats, err := readCgroupStats(filepath.Join("/sys/fs/cgroup", dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup of container %s: %w", id, err)
+	}
+
+	return stats, nil
+}
+
+// StartSandbox starts the sandbox image in the background. Sandboxes use
+// the instance's network namespace, so that the pod's IP is the instance's
+// and its ports are reachable as they are, but a hostname of their own.
+// A sandbox left over from a previous agent is replaced.
+//
+// Sharing the instance's network namespace needs no CNI plugin and keeps
+// the pod on the instance's ENI, EFA included, but containers can reach
+// everything the instance can, such as the agent's API on the loopback
+// address. The instance's firewall rejects traffic from PodSlice to the
+// agent's port and to the metadata service instead.
+func (r *ContainerdRuntime) StartSandbox(ctx context.Context, cfg *SandboxConfig) error {
+	_, _ = r.output(ctx, "rm", "--force", cfg.ID)
+
+	args := []string{"run", "--detach", "--name", cfg.ID, "--net", "host", "--cgroup-parent", PodSlice}
+	if cfg.Hostname != "" {
+		args = append(args, "--hostname", cfg.Hostname)
+	}
+	args = append(args, r.sandboxImage)
+
+	if _, err := r.output(ctx, args...); err != nil {
+		return fmt.Errorf("failed to start sandbox %s: %w", cfg.ID, err)
+	}
+	return nil
+}
+
+// RemoveSandbox stops and removes a sandbox.
+func (r *ContainerdRuntime) RemoveSandbox(ctx context.Context, id string) error {
+	if _, err := r.output(ctx, "rm", "--force", id); err != nil {
+		return fmt.Errorf("failed to remove sandbox %s: %w", id, err)
+	}
+	return nil
+}
+
+// command builds a nerdctl command in the runtime's namespace.
+func (r *ContainerdRuntime) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, r.binary, append([]string{"--namespace", r.namespace}, args...)...)
+}
+
+// output runs a nerdctl command and returns its stdout.
+func (r *ContainerdRuntime) output(ctx context.Context, args ...string) (string, error) {
+	return run(r.command(ctx, args...))
+}
+
+// run runs cmd and returns its stdout. Errors include its stderr.
+func run(cmd *exec.Cmd) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
+
+// writeDockerConfig writes a docker config file with the login for the
+// registry of image to a new private directory, and returns the directory.
+func writeDockerConfig(image string, auth *RegistryCredential) (string, error) {
+	registry, _ := imageRepository(image)
+	if registry == dockerHub {
+		// Docker Hub logins are keyed by their legacy index URL
+		registry = "https://index.docker.io/v1/"
+	}
+
+	config, err := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			registry: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password)),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "orca-pull-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), config, 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// resourceArgs converts container requests and limits into nerdctl cgroup
+// flags. CPU requests become CPU shares, as with the kubelet, so that
+// containers contending for the instance's CPUs get them in proportion.
+func resourceArgs(res corev1.ResourceRequirements) []string {
+	var args []string
+
+	if cpu, ok := res.Requests[corev1.ResourceCPU]; ok {
+		args = append(args, "--cpu-shares", strconv.FormatInt(max(cpu.MilliValue()*1024/1000, 2), 10))
+	}
+
+	if cpu, ok := res.Limits[corev1.ResourceCPU]; ok {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(cpu.MilliValue())/1000, 'f', 3, 64))
+	}
+	if memory, ok := res.Limits[corev1.ResourceMemory]; ok {
+		args = append(args, "--memory", strconv.FormatInt(memory.Value(), 10))
+	}
+	if gpu, ok := res.Limits["nvidia.com/gpu"]; ok && gpu.Value() > 0 {
+		args = append(args, "--gpus", strconv.FormatInt(gpu.Value(), 10))
+	}
+
+	return args
+}
+
+// efaDevices matches the devices of the instance's Elastic Fabric Adapters.
+var efaDevices = "/dev/infiniband/uverbs*"
+
+// efaArgs gives containers the instance's EFA devices, if it has any, with
+// the unlimited locked memory that libfabric needs to register buffers.
+func efaArgs() []string {
+	devices, _ := filepath.Glob(efaDevices)
+	if len(devices) == 0 {
+		return nil
+	}
+
+	args := []string{"--ulimit", "memlock=-1:-1"}
+	for _, device := range devices {
+		args = append(args, "--device", device)
+	}
+	return args
+}
+
+// securityArgs converts a container's security context into nerdctl flags.
+func securityArgs(sec ContainerSecurity) []string {
+	var args []string
+
+	if sec.User != nil {
+		user := strconv.FormatInt(*sec.User, 10)
+		if sec.Group != nil {
+			user += ":" + strconv.FormatInt(*sec.Group, 10)
+		}
+		args = append(args, "--user", user)
+	}
+	for _, group := range sec.SupplementalGroups {
+		args = append(args, "--group-add", strconv.FormatInt(group, 10))
+	}
+	if sec.Privileged {
+		args = append(args, "--privileged")
+	}
+	if sec.ReadOnlyRootFilesystem {
+		args = append(args, "--read-only")
+	}
+	for _, c := range sec.CapAdd {
+		args = append(args, "--cap-add", c)
+	}
+	for _, c := range sec.CapDrop {
+		args = append(args, "--cap-drop", c)
+	}
+	if sec.NoNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+	if sec.Seccomp != "" {
+		args = append(args, "--security-opt", "seccomp="+sec.Seccomp)
+	}
+
+	return args
+}
+
+// cliProcess is a container process started by a foreground nerdctl process.
+type cliProcess struct {
+	cmd *exec.Cmd
+
+	// pty is the terminal of processes started with a TTY
+	pty      *os.File
+	copyDone chan struct{}
+}
+
+// Wait waits for the process to exit and returns its exit code.
+func (p *cliProcess) Wait() (int, error) {
+	err := p.cmd.Wait()
+	if p.pty != nil {
+		<-p.copyDone
+		_ = p.pty.Close()
+	}
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+
+	return -1, err
+}
+
+// Resize changes the terminal size of the process.
+func (p *cliProcess) Resize(size TermSize) error {
+	if p.pty == nil {
+		return nil
+	}
+	return setTTYSize(p.pty, size)
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ServerName is the name agents present in their serving certificate.
+// Clients verify it instead of the instance IP, which is not known when the
+// certificate is issued.
+const ServerName = "orca-agent"
+
+// Credentials are the secrets an agent needs to serve its API.
+type Credentials struct {
+	// Token authenticates the controller to the agent.
+	Token string
+
+	// CertPEM and KeyPEM are the agent's serving certificate and key.
+	CertPEM []byte
+	KeyPEM  []byte
+
+	// CAPEM is the certificate of the issuing authority.
+	CAPEM []byte
+}
+
+// Authority issues agent credentials and builds the matching client
+// configuration.
+//
+// Tokens are derived from the authority key and the pod UID, so an
+// authority loaded from the same files can reach agents launched before a
+// controller restart.
+type Authority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	hmacKey []byte
+}
+
+// NewAuthority creates an ephemeral, self-signed authority.
+func NewAuthority() (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "orca-agent-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CA key: %w", err)
+	}
+
+	return newAuthority(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+// LoadAuthority loads an authority from PEM encoded certificate and key files.
+func LoadAuthority(certFile, keyFile string) (*Authority, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", err)
+	}
+
+	return newAuthority(certPEM, keyPEM)
+}
+
+// newAuthority parses a PEM encoded CA certificate and key.
+func newAuthority(certPEM, keyPEM []byte) (*Authority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key pair: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", cert.Subject.CommonName)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(pair.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CA key: %w", err)
+	}
+	hmacKey := sha256.Sum256(keyDER)
+
+	return &Authority{
+		cert:    cert,
+		certPEM: certPEM,
+		key:     key,
+		hmacKey: hmacKey[:],
+	}, nil
+}
+
+// Token returns the API token of the agent running the given pod.
+func (a *Authority) Token(podUID types.UID) string {
+	mac := hmac.New(sha256.New, a.hmacKey)
+	mac.Write([]byte(podUID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates the credentials for the agent running the given pod.
+func (a *Authority) Issue(podUID types.UID) (*Credentials, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate agent key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: ServerName, OrganizationalUnit: []string{string(podUID)}},
+		DNSNames:     []string{ServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     a.cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, key.Public(), a.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal agent key: %w", err)
+	}
+
+	return &Credentials{
+		Token:   a.Token(podUID),
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		CAPEM:   a.certPEM,
+	}, nil
+}
+
+// ClientTLSConfig returns the TLS configuration used to connect to the
+// agent running the given pod. Besides the authority's signature, it checks
+// that the agent's certificate was issued for that pod, so that an instance
+// that took over another's IP cannot pose as its agent.
+func (a *Authority) ClientTLSConfig(podUID types.UID) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.cert)
+
+	return &tls.Config{
+		RootCAs:    pool,
+		ServerName: ServerName,
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("agent presented no certificate")
+			}
+			cert := cs.PeerCertificates[0]
+			if !slices.Contains(cert.Subject.OrganizationalUnit, string(podUID)) {
+				return fmt.Errorf("agent certificate was issued for pod %v, not %s", cert.Subject.OrganizationalUnit, podUID)
+			}
+			return nil
+		},
+	}
+}
+
+// randomSerial returns a random certificate serial number.
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,21 @@
+// Package agent implements the ORCA agent that runs on each EC2 instance.
+//
+// ORCA maps every pod to a dedicated instance. The agent is bootstrapped on
+// that instance, receives the pod spec, pulls the container images and runs
+// every container through containerd. It exposes an authenticated HTTPS API
+// that the ORCA controller uses to submit the pod and read container state.
+//
+// The package contains both sides of that API:
+// - Agent: Runs the pod's containers and tracks their status
+// - Server: Serves the agent API on the instance
+// - Client: Used by the provider to talk to an agent
+// - Authority: Issues the per-pod TLS certificate and token an agent uses
+//
+// Example usage on the instance:
+//
+//	rt := agent.NewContainerdRuntime("nerdctl", "orca", "registry.k8s.io/pause:3.10")
+//	a := agent.New(rt, host, nil, agent.NewLinuxMounter("/dev"), agent.NewLinuxNetwork(), "/var/log/orca/containers", "/var/lib/orca/volumes", logger)
+//	go a.Run(ctx)
+//
+//	err := a.Start(agent.PodSubmission{Pod: pod, Volumes: volumes})
+package agent
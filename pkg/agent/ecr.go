@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// ecrTokenRefreshMargin is how long before expiry an ECR login is renewed.
+// Logins are valid for 12 hours.
+const ecrTokenRefreshMargin = 30 * time.Minute
+
+// ecrRegistryPattern matches ECR private registry hosts and captures their
+// region and partition suffix.
+var ecrRegistryPattern = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ECRCredentialProvider logs in to ECR registries with the instance's AWS
+// credentials, normally those of its instance profile, so that ECR images
+// need no pull secret.
+type ECRCredentialProvider struct {
+	credentials aws.CredentialsProvider
+	httpClient  *http.Client
+
+	// endpoint returns the ECR API endpoint of a registry
+	endpoint func(fips bool, region, suffix string) string
+
+	mu     sync.Mutex
+	logins map[string]ecrLogin
+}
+
+// ecrLogin is a cached ECR login.
+type ecrLogin struct {
+	credential RegistryCredential
+	expiresAt  time.Time
+}
+
+// NewECRCredentialProvider returns a provider that signs ECR requests with
+// credentials.
+func NewECRCredentialProvider(credentials aws.CredentialsProvider) *ECRCredentialProvider {
+	return &ECRCredentialProvider{
+		credentials: credentials,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		endpoint:    ecrEndpoint,
+		logins:      make(map[string]ecrLogin),
+	}
+}
+
+// ecrEndpoint returns the public ECR API endpoint of a region.
+func ecrEndpoint(fips bool, region, suffix string) string {
+	if fips {
+		return fmt.Sprintf("https://ecr-fips.%s.amazonaws.com%s/", region, suffix)
+	}
+	return fmt.Sprintf("https://api.ecr.%s.amazonaws.com%s/", region, suffix)
+}
+
+// Credential returns an ECR login for registry, or nil for registries that
+// are not ECR.
+func (p *ECRCredentialProvider) Credential(ctx context.Context, registry string) (*RegistryCredential, error) {
+	m := ecrRegistryPattern.FindStringSubmatch(registry)
+	if m == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	login, ok := p.logins[registry]
+	p.mu.Unlock()
+	if ok && time.Now().Before(login.expiresAt.Add(-ecrTokenRefreshMargin)) {
+		return &login.credential, nil
+	}
+
+	login, err := p.login(ctx, m[1] != "", m[2], m[3])
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to %s: %w", registry, err)
+	}
+	login.credential.Registry = registry
+
+	p.mu.Lock()
+	p.logins[registry] = login
+	p.mu.Unlock()
+
+	return &login.credential, nil
+}
+
+// login calls ECR's GetAuthorizationToken in a region.
+func (p *ECRCredentialProvider) login(ctx context.Context, fips bool, region, suffix string) (ecrLogin, error) {
+	creds, err := p.credentials.Retrieve(ctx)
+	if err != nil {
+		return ecrLogin{}, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+
+	body := []byte("{}")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint(fips, region, suffix), bytes.NewReader(body))
+	if err != nil {
+		return ecrLogin{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+
+	payloadHash := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "ecr", region, time.Now()); err != nil {
+		return ecrLogin{}, fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return ecrLogin{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return ecrLogin{}, fmt.Errorf("GetAuthorizationToken returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ecrLogin{}, fmt.Errorf("failed to decode GetAuthorizationToken response: %w", err)
+	}
+	if len(result.AuthorizationData) == 0 {
+		return ecrLogin{}, fmt.Errorf("GetAuthorizationToken returned no authorization data")
+	}
+
+	data := result.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return ecrLogin{}, fmt.Errorf("failed to decode authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return ecrLogin{}, fmt.Errorf("malformed authorization token")
+	}
+
+	return ecrLogin{
+		credential: RegistryCredential{Username: username, Password: password},
+		expiresAt:  time.Unix(int64(data.ExpiresAt), 0),
+	}, nil
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// instanceStoreDirName is where the instance store is mounted below the
+// volume directory. Pod volume names cannot start with "..".
+const instanceStoreDirName = "..instance-store"
+
+// podFilesystems returns the filesystems the agent mounts for a pod: the
+// shared filesystems the controller resolved, and a tmpfs for every
+// memory-backed emptyDir volume.
+func podFilesystems(pod *corev1.Pod, shared map[string]Filesystem) map[string]Filesystem {
+	filesystems := make(map[string]Filesystem, len(shared))
+	for name, fs := range shared {
+		filesystems[name] = fs
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir == nil || v.EmptyDir.Medium != corev1.StorageMediumMemory {
+			continue
+		}
+		fs := Filesystem{Type: "tmpfs", Source: "tmpfs"}
+		if limit := v.EmptyDir.SizeLimit; limit != nil && !limit.IsZero() {
+			fs.Options = []string{fmt.Sprintf("size=%d", limit.Value())}
+		}
+		filesystems[v.Name] = fs
+	}
+	return filesystems
+}
+
+// prepareEmptyDirs creates the directories of the pod's disk-backed
+// emptyDir volumes. They go on the instance store if the instance has one,
+// and on the root volume otherwise.
+func (a *Agent) prepareEmptyDirs(ctx context.Context) error {
+	a.mu.RLock()
+	var names []string
+	for _, v := range a.pod.Spec.Volumes {
+		if v.EmptyDir != nil && v.EmptyDir.Medium != corev1.StorageMediumMemory {
+			names = append(names, v.Name)
+		}
+	}
+	fsGroup := podFSGroup(a.pod)
+	a.mu.RUnlock()
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	base := a.volumeDir
+	if a.mounter != nil {
+		target := filepath.Join(a.volumeDir, instanceStoreDirName)
+		ok, err := a.mounter.PrepareInstanceStore(ctx, target)
+		switch {
+		case err != nil:
+			a.logger.Warn().Err(err).Msg("Failed to prepare the instance store, keeping emptyDir volumes on the root volume")
+		case ok:
+			a.logger.Info().Str("path", target).Msg("Instance store mounted for emptyDir volumes")
+			base = target
+		}
+	}
+
+	dirs := make(map[string]string, len(names))
+	for _, name := range names {
+		dir := filepath.Join(base, name)
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			return fmt.Errorf("failed to create emptyDir volume %s: %w", name, err)
+		}
+		// Any container user may write to the volume, as with the kubelet
+		if err := os.Chmod(dir, 0o777); err != nil {
+			return fmt.Errorf("failed to create emptyDir volume %s: %w", name, err)
+		}
+		if fsGroup != nil {
+			if err := setVolumeGroup(dir, *fsGroup, false, false); err != nil {
+				return fmt.Errorf("failed to apply fsGroup to emptyDir volume %s: %w", name, err)
+			}
+		}
+		dirs[name] = dir
+	}
+
+	a.mu.Lock()
+	a.emptyDirs = dirs
+	a.mu.Unlock()
+	return nil
+}
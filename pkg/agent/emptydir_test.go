@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// emptyDirPod returns a one-container pod with a disk-backed emptyDir
+// volume "scratch" and a memory-backed one "shm".
+func emptyDirPod() *corev1.Pod {
+	limit := resource.MustParse("1Gi")
+	pod := testPod()
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	pod.Spec.Volumes = []corev1.Volume{
+		{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{Name: "shm", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory, SizeLimit: &limit}}},
+	}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "scratch", MountPath: "/scratch"},
+		{Name: "scratch", MountPath: "/cache", SubPath: "cache"},
+		{Name: "shm", MountPath: "/dev/shm"},
+	}
+	return pod
+}
+
+func TestAgentEmptyDirs(t *testing.T) {
+	tests := []struct {
+		name          string
+		instanceStore bool
+		dir           string
+	}{
+		{"root volume", false, ""},
+		{"instance store", true, instanceStoreDirName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			mounter := newFakeMounter()
+			mounter.instanceStore = tt.instanceStore
+			a := startAgent(t, rt)
+			a.mounter = mounter
+
+			if err := a.Start(PodSubmission{Pod: emptyDirPod()}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+			scratch := filepath.Join(a.volumeDir, tt.dir, "scratch")
+			shm := filepath.Join(a.volumeDir, "shm")
+			want := []Mount{
+				{HostPath: scratch, ContainerPath: "/scratch"},
+				{HostPath: filepath.Join(scratch, "cache"), ContainerPath: "/cache"},
+				{HostPath: shm, ContainerPath: "/dev/shm"},
+			}
+			if mounts := rt.config("trainer-0").Mounts; !slices.Equal(mounts, want) {
+				t.Errorf("expected mounts %+v, got %+v", want, mounts)
+			}
+
+			// Every container user may write to the volume
+			if _, err := os.Stat(filepath.Join(scratch, "cache")); err != nil {
+				t.Fatalf("expected the sub path to be created: %v", err)
+			}
+			info, err := os.Stat(scratch)
+			if err != nil || info.Mode().Perm() != 0o777 {
+				t.Errorf("expected %s to be world writable, got %v", scratch, err)
+			}
+
+			mounter.mu.Lock()
+			fs := mounter.filesystems[shm]
+			mounter.mu.Unlock()
+			if fs.Type != "tmpfs" || !slices.Equal(fs.Options, []string{"size=1073741824"}) {
+				t.Errorf("expected a 1Gi tmpfs at %s, got %+v", shm, fs)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerEnv returns the container's environment in KEY=VALUE form.
+// Variable references of the form $(VAR) are expanded using the variables
+// defined earlier in the list, following Kubernetes semantics.
+func containerEnv(c corev1.Container) []string {
+	values := make(map[string]string, len(c.Env))
+	env := make([]string, 0, len(c.Env))
+
+	for _, e := range c.Env {
+		value := expandVars(e.Value, values)
+		values[e.Name] = value
+		env = append(env, e.Name+"="+value)
+	}
+
+	return env
+}
+
+// expandAll expands variable references in each element of in.
+func expandAll(in []string, env []string) []string {
+	if len(in) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(env))
+	for _, e := range env {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			values[k] = v
+		}
+	}
+
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = expandVars(s, values)
+	}
+	return out
+}
+
+// expandVars replaces $(VAR) references in s with values from vars.
+// References to undefined variables are left untouched and "$$" escapes a
+// literal "$(", matching the kubelet's expansion rules.
+func expandVars(s string, vars map[string]string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				b.WriteString(s[i:])
+				return b.String()
+			}
+			name := s[i+2 : i+2+end]
+			if value, ok := vars[name]; ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(s[i : i+3+end])
+			}
+			i += 2 + end
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"io"
+	"sync"
+)
+
+// fanout copies container output to the writers of attached sessions.
+// Writers that fail are dropped; the container is never blocked by an
+// error of an attached session.
+type fanout struct {
+	mu      sync.Mutex
+	next    int
+	writers map[int]io.Writer
+}
+
+func newFanout() *fanout {
+	return &fanout{writers: make(map[int]io.Writer)}
+}
+
+// add attaches w and returns an ID for remove.
+func (f *fanout) add(w io.Writer) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	f.writers[f.next] = w
+	return f.next
+}
+
+// remove detaches the writer with the given ID.
+func (f *fanout) remove(id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.writers, id)
+}
+
+// Write copies p to every attached writer.
+func (f *fanout) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, w := range f.writers {
+		if _, err := w.Write(p); err != nil {
+			delete(f.writers, id)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,15 @@
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileGroup returns the group that owns a file.
+func fileGroup(info os.FileInfo) (int64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(stat.Gid), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package agent
+
+import "os"
+
+func fileGroup(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
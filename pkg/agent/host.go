@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// userHZ is the kernel clock tick rate used in /proc/stat.
+const userHZ = 100
+
+// LinuxHost reads instance usage from procfs and GPU usage from nvidia-smi.
+type LinuxHost struct {
+	procDir   string
+	nvidiaSMI string
+}
+
+// NewLinuxHost creates a host that reads procfs at procDir and queries GPUs
+// with the given nvidia-smi binary.
+func NewLinuxHost(procDir, nvidiaSMI string) *LinuxHost {
+	return &LinuxHost{
+		procDir:   procDir,
+		nvidiaSMI: nvidiaSMI,
+	}
+}
+
+// CPUUsage returns the cumulative non-idle CPU time from /proc/stat.
+func (h *LinuxHost) CPUUsage() (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(h.procDir, "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected /proc/stat format")
+	}
+
+	// user nice system idle iowait irq softirq steal
+	var ticks uint64
+	for i, field := range fields[1:9] {
+		if i == 3 || i == 4 {
+			continue // idle and iowait
+		}
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected /proc/stat value %q", field)
+		}
+		ticks += v
+	}
+
+	return ticks * (1e9 / userHZ), nil
+}
+
+// MemoryUsage returns the instance memory usage from /proc/meminfo.
+func (h *LinuxHost) MemoryUsage() (MemoryUsage, error) {
+	f, err := os.Open(filepath.Join(h.procDir, "meminfo"))
+	if err != nil {
+		return MemoryUsage{}, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[name] = v * 1024 // kB
+	}
+	if err := scanner.Err(); err != nil {
+		return MemoryUsage{}, err
+	}
+
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total == 0 {
+		return MemoryUsage{}, fmt.Errorf("MemTotal missing from /proc/meminfo")
+	}
+
+	return MemoryUsage{
+		UsageBytes:      total - values["MemFree"],
+		WorkingSetBytes: total - available,
+		AvailableBytes:  available,
+	}, nil
+}
+
+// GPUUsage queries nvidia-smi for the usage of every GPU. Instances without
+// nvidia-smi have no GPUs.
+func (h *LinuxHost) GPUUsage(ctx context.Context) ([]GPUUsage, error) {
+	out, err := exec.CommandContext(ctx, h.nvidiaSMI,
+		"--query-gpu=uuid,name,utilization.gpu,memory.used,memory.total",
+		"--format=csv,noheader,nounits",
+	).Output()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %w", err)
+	}
+
+	return parseNvidiaSMI(out)
+}
+
+// parseNvidiaSMI parses nvidia-smi CSV output. Memory is reported in MiB.
+func parseNvidiaSMI(out []byte) ([]GPUUsage, error) {
+	reader := csv.NewReader(bytes.NewReader(out))
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nvidia-smi output: %w", err)
+	}
+
+	gpus := make([]GPUUsage, 0, len(records))
+	for _, record := range records {
+		if len(record) != 5 {
+			return nil, fmt.Errorf("unexpected nvidia-smi output %q", strings.Join(record, ","))
+		}
+
+		// Unsupported values are reported as "[N/A]" and read as zero.
+		utilization, _ := strconv.ParseUint(record[2], 10, 64)
+		used, _ := strconv.ParseUint(record[3], 10, 64)
+		total, _ := strconv.ParseUint(record[4], 10, 64)
+
+		gpus = append(gpus, GPUUsage{
+			ID:                 record[0],
+			Model:              record[1],
+			UtilizationPercent: utilization,
+			MemoryUsedBytes:    used << 20,
+			MemoryTotalBytes:   total << 20,
+		})
+	}
+
+	return gpus, nil
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultTerminationGracePeriod is the grace period of a pod that does not
+// set one, as applied by the API server.
+const defaultTerminationGracePeriod = 30 * time.Second
+
+// terminationGracePeriod returns the pod's grace period for stopping.
+func (a *Agent) terminationGracePeriod() time.Duration {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.pod == nil || a.pod.Spec.TerminationGracePeriodSeconds == nil {
+		return defaultTerminationGracePeriod
+	}
+	return time.Duration(*a.pod.Spec.TerminationGracePeriodSeconds) * time.Second
+}
+
+// Stop shuts the pod down the way the kubelet does. App containers are
+// stopped together, then sidecars one at a time in reverse order. Each
+// container runs its preStop hook, is sent SIGTERM, and is killed once the
+// grace period is over. Nothing is started or restarted once Stop is called.
+// Stop returns when every container has stopped; calling it again is a no-op.
+func (a *Agent) Stop(ctx context.Context, gracePeriod time.Duration) {
+	a.mu.Lock()
+	if isClosed(a.stopping) {
+		a.mu.Unlock()
+		return
+	}
+	close(a.stopping)
+	containers := append([]*container(nil), a.containers...)
+	a.mu.Unlock()
+
+	a.logger.Info().Dur("grace_period", gracePeriod).Msg("Stopping pod")
+
+	deadline := time.Now().Add(gracePeriod)
+
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		if c.sidecar() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.stopContainer(ctx, c, deadline)
+		}()
+	}
+	wg.Wait()
+
+	for i := len(containers) - 1; i >= 0; i-- {
+		if containers[i].sidecar() {
+			a.stopContainer(ctx, containers[i], deadline)
+		}
+	}
+
+	a.unmountVolumes(ctx)
+	a.removeSandbox(ctx)
+
+	// Containers that never ran, or were waiting to be restarted, are
+	// reported as terminated so that the pod can finish
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range containers {
+		if c.status.State.Terminated != nil {
+			continue
+		}
+		now := metav1.Now()
+		c.status.State = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{
+				ExitCode:   137,
+				Reason:     "ContainerStatusUnknown",
+				Message:    "The container could not be located when the pod was terminated",
+				StartedAt:  now,
+				FinishedAt: now,
+			},
+		}
+		c.status.Ready = false
+		if !isClosed(c.finished) {
+			close(c.finished)
+		}
+	}
+}
+
+// stopContainer stops the current run of a container, if it is running,
+// killing it at deadline.
+func (a *Agent) stopContainer(ctx context.Context, c *container, deadline time.Time) {
+	a.mu.RLock()
+	run := c.run
+	running := run != nil && c.status.State.Running != nil
+	a.mu.RUnlock()
+	if !running {
+		return
+	}
+	a.stopRun(ctx, c, run, deadline)
+}
+
+// stopRun stops a run of a container the way the kubelet does: it runs the
+// preStop hook, sends SIGTERM, and kills the run at deadline.
+func (a *Agent) stopRun(ctx context.Context, c *container, run *containerRun, deadline time.Time) {
+	log := a.logger.With().Str("container", c.spec.Name).Logger()
+
+	graceCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	if c.spec.Lifecycle != nil && c.spec.Lifecycle.PreStop != nil {
+		if err := a.runHandler(graceCtx, c, run, c.spec.Lifecycle.PreStop); err != nil {
+			log.Warn().Err(err).Msg("PreStop hook failed")
+		}
+	}
+
+	select {
+	case <-run.exited:
+		return
+	default:
+	}
+	if err := a.runtime.KillContainer(ctx, run.id, syscall.SIGTERM); err != nil {
+		log.Error().Err(err).Msg("Failed to signal container")
+	}
+
+	select {
+	case <-run.exited:
+		return
+	case <-graceCtx.Done():
+	}
+
+	select {
+	case <-run.exited:
+		return
+	default:
+	}
+	log.Warn().Msg("Container did not stop within its grace period, killing it")
+	if err := a.runtime.KillContainer(ctx, run.id, syscall.SIGKILL); err != nil {
+		log.Error().Err(err).Msg("Failed to kill container")
+	}
+
+	select {
+	case <-run.exited:
+	case <-ctx.Done():
+	}
+}
+
+// stopped reports whether the pod is being stopped.
+func (a *Agent) stopped() bool {
+	return isClosed(a.stopping)
+}
+
+// runPostStart runs the container's postStart hook, if any. A container
+// whose hook fails is killed, and then restarted according to its restart
+// policy.
+func (a *Agent) runPostStart(ctx context.Context, c *container, run *containerRun) error {
+	if c.spec.Lifecycle == nil || c.spec.Lifecycle.PostStart == nil {
+		return nil
+	}
+
+	if err := a.runHandler(ctx, c, run, c.spec.Lifecycle.PostStart); err != nil {
+		a.logger.Warn().Err(err).Str("container", c.spec.Name).Msg("PostStart hook failed, killing container")
+		if err := a.runtime.KillContainer(ctx, run.id, syscall.SIGKILL); err != nil {
+			a.logger.Error().Err(err).Str("container", c.spec.Name).Msg("Failed to kill container")
+		}
+		return fmt.Errorf("PostStart hook failed: %w", err)
+	}
+	return nil
+}
+
+// runHandler runs a lifecycle hook against a container run. Hooks share
+// their exec and HTTP handlers with probes; the deprecated TCP handler is
+// ignored, as it is by the kubelet.
+func (a *Agent) runHandler(ctx context.Context, c *container, run *containerRun, handler *corev1.LifecycleHandler) error {
+	switch {
+	case handler.Exec != nil:
+		return a.execProbe(ctx, run.id, handler.Exec)
+	case handler.HTTPGet != nil:
+		return httpProbe(ctx, c.spec, handler.HTTPGet)
+	case handler.Sleep != nil:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(handler.Sleep.Seconds) * time.Second):
+			return nil
+		}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// killed returns the signals sent to containers, as "id:signal".
+func (r *fakeRuntime) killed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.kills...)
+}
+
+// execCommands returns the commands exec'd in containers.
+func (r *fakeRuntime) execCommands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var commands []string
+	for _, cfg := range r.execs {
+		commands = append(commands, strings.Join(cfg.Command, " "))
+	}
+	return commands
+}
+
+// execHook returns a lifecycle hook that runs command.
+func execHook(command ...string) *corev1.LifecycleHandler {
+	return &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: command}}
+}
+
+func TestAgentStop(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	pod := testPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PreStop: execHook("checkpoint")}
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "containers to start", func() bool { return a.Status().Phase == corev1.PodRunning })
+
+	a.Stop(context.Background(), time.Second)
+
+	if commands := rt.execCommands(); !slices.Equal(commands, []string{"checkpoint"}) {
+		t.Errorf("expected the preStop hook to run, got %v", commands)
+	}
+	for _, name := range []string{"trainer", "sidecar"} {
+		terminated := containerStatus(a, name).State.Terminated
+		if terminated == nil || terminated.ExitCode != 128+int32(syscall.SIGTERM) {
+			t.Errorf("expected %s to stop on SIGTERM, got %+v", name, terminated)
+		}
+	}
+
+	// Stopped containers are not restarted, whatever the pod's policy
+	time.Sleep(50 * time.Millisecond)
+	if rt.config("trainer-1") != nil {
+		t.Error("expected container not to be restarted")
+	}
+	if phase := a.Status().Phase; phase != corev1.PodFailed {
+		t.Errorf("expected phase Failed, got %s", phase)
+	}
+}
+
+func TestAgentStopGracePeriod(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.ignoreTerm = true
+	a := startAgent(t, rt)
+
+	pod := testPod()
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return containerStatus(a, "trainer").State.Running != nil })
+
+	start := time.Now()
+	a.Stop(context.Background(), 100*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the container to get its grace period, stopped after %s", elapsed)
+	}
+	want := []string{fmt.Sprintf("trainer-0:%d", syscall.SIGTERM), fmt.Sprintf("trainer-0:%d", syscall.SIGKILL)}
+	if kills := rt.killed(); !slices.Equal(kills, want) {
+		t.Errorf("expected signals %v, got %v", want, kills)
+	}
+	if terminated := containerStatus(a, "trainer").State.Terminated; terminated == nil || terminated.ExitCode != 137 {
+		t.Errorf("expected container to be killed, got %+v", terminated)
+	}
+}
+
+func TestAgentStopsSidecarsLast(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	pod := initPod()
+	always := corev1.ContainerRestartPolicyAlways
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: "logger", Image: "fluentbit", RestartPolicy: &always})
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "init container to start", func() bool { return rt.config("setup-0") != nil })
+	rt.exit("setup-0", 0)
+	waitFor(t, "app container to start", func() bool { return containerStatus(a, "trainer").State.Running != nil })
+
+	a.Stop(context.Background(), time.Second)
+
+	term := int(syscall.SIGTERM)
+	want := []string{
+		fmt.Sprintf("trainer-0:%d", term),
+		fmt.Sprintf("logger-0:%d", term),
+		fmt.Sprintf("proxy-0:%d", term),
+	}
+	if kills := rt.killed(); !slices.Equal(kills, want) {
+		t.Errorf("expected signals %v, got %v", want, kills)
+	}
+}
+
+func TestAgentStopBeforeStart(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	pod := initPod()
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "init container to start", func() bool { return rt.config("setup-0") != nil })
+
+	a.Stop(context.Background(), time.Second)
+
+	report := a.Status()
+	if report.Phase != corev1.PodFailed {
+		t.Errorf("expected phase Failed, got %s", report.Phase)
+	}
+	terminated := containerStatus(a, "trainer").State.Terminated
+	if terminated == nil || terminated.Reason != "ContainerStatusUnknown" {
+		t.Errorf("expected trainer that never ran to be terminated, got %+v", terminated)
+	}
+	if rt.config("proxy-0") != nil || rt.config("trainer-0") != nil {
+		t.Error("expected no containers to start once the pod is stopping")
+	}
+}
+
+func TestAgentPostStartHook(t *testing.T) {
+	tests := []struct {
+		name     string
+		execCode int
+		started  bool
+	}{
+		{"hook succeeds", 0, true},
+		{"hook fails", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			rt.setExecCode(tt.execCode)
+			a := startAgent(t, rt)
+
+			pod := testPod()
+			pod.Spec.Containers = pod.Spec.Containers[:1]
+			pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PostStart: execHook("warmup")}
+			if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.started {
+				waitFor(t, "container to be ready", func() bool { return containerStatus(a, "trainer").Ready })
+				if commands := rt.execCommands(); !slices.Equal(commands, []string{"warmup"}) {
+					t.Errorf("expected the postStart hook to run, got %v", commands)
+				}
+				return
+			}
+
+			waitFor(t, "container to be killed", func() bool {
+				terminated := containerStatus(a, "trainer").State.Terminated
+				return terminated != nil && terminated.ExitCode == 137
+			})
+			if phase := a.Status().Phase; phase != corev1.PodFailed {
+				t.Errorf("expected phase Failed, got %s", phase)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Log streams used in container log files.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// logFile is a container log file in the CRI logging format:
+//
+//	<RFC3339Nano timestamp> <stream> <F|P> <line>
+//
+// Each container run gets its own file so logs from previous restarts
+// remain available.
+type logFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// containerLogPath returns the log file path for a container run.
+func containerLogPath(logDir, containerName string, restartCount int32) string {
+	return filepath.Join(logDir, containerName, strconv.Itoa(int(restartCount))+".log")
+}
+
+// openLogFile creates (or truncates) the log file at path.
+func openLogFile(path string) (*logFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	return &logFile{file: f}, nil
+}
+
+// Stream returns a writer that records output for the named stream.
+func (l *logFile) Stream(stream string) *logStream {
+	return &logStream{file: l, stream: stream}
+}
+
+// Close closes the underlying file.
+func (l *logFile) Close() error {
+	return l.file.Close()
+}
+
+// writeEntry appends one log entry. tag is "F" for a full line and "P" for a
+// partial line that continues in the next entry.
+func (l *logFile) writeEntry(stream, tag string, line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := make([]byte, 0, len(line)+64)
+	entry = time.Now().UTC().AppendFormat(entry, time.RFC3339Nano)
+	entry = append(entry, ' ')
+	entry = append(entry, stream...)
+	entry = append(entry, ' ')
+	entry = append(entry, tag...)
+	entry = append(entry, ' ')
+	entry = append(entry, line...)
+	entry = append(entry, '\n')
+
+	_, err := l.file.Write(entry)
+	return err
+}
+
+// maxLogLine is the longest line written as a single entry. Longer lines are
+// split into partial entries, as the kubelet does.
+const maxLogLine = 16 * 1024
+
+// logStream splits one output stream into log entries.
+type logStream struct {
+	file   *logFile
+	stream string
+	buf    []byte
+}
+
+// Write buffers output and writes an entry for every complete line.
+func (s *logStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := s.file.writeEntry(s.stream, "F", s.buf[:i]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[i+1:]
+	}
+
+	for len(s.buf) >= maxLogLine {
+		if err := s.file.writeEntry(s.stream, "P", s.buf[:maxLogLine]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[maxLogLine:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line as a final entry.
+func (s *logStream) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.file.writeEntry(s.stream, "F", s.buf)
+	s.buf = nil
+	return err
+}
+
+// logPollInterval is how often a followed log file is checked for new
+// entries.
+const logPollInterval = 250 * time.Millisecond
+
+// errLimitReached stops copying once LogOptions.LimitBytes have been written.
+var errLimitReached = errors.New("log byte limit reached")
+
+// copyLog writes the entries of the log file at path to w, filtered and
+// formatted according to opts. When following, copyLog waits for new entries
+// until done reports that the container will write no more, or ctx is
+// cancelled.
+func copyLog(ctx context.Context, path string, opts LogOptions, w io.Writer, done func() bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer f.Close()
+
+	if opts.Tail > 0 {
+		offset, err := tailOffset(f, opts.Tail)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek log file: %w", err)
+		}
+	}
+
+	if opts.LimitBytes > 0 {
+		w = &limitWriter{w: w, remaining: opts.LimitBytes}
+	}
+
+	reader := bufio.NewReader(f)
+	var pending []byte
+	exited := false
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		pending = append(pending, line...)
+
+		if err == nil {
+			if err := writeLogEntry(w, pending, opts); err != nil {
+				if errors.Is(err, errLimitReached) {
+					return nil
+				}
+				return err
+			}
+			pending = pending[:0]
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read log file: %w", err)
+		}
+
+		// At the end of the file. Read once more after the container has
+		// exited to pick up its final entries.
+		if !opts.Follow || exited {
+			return nil
+		}
+		exited = done()
+		if exited {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// writeLogEntry writes the content of one CRI log entry to w.
+func writeLogEntry(w io.Writer, entry []byte, opts LogOptions) error {
+	ts, tag, content, ok := parseLogEntry(entry)
+	if !ok {
+		return nil
+	}
+	if !opts.SinceTime.IsZero() && ts.Before(opts.SinceTime) {
+		return nil
+	}
+
+	out := make([]byte, 0, len(content)+40)
+	if opts.Timestamps {
+		out = ts.AppendFormat(out, time.RFC3339Nano)
+		out = append(out, ' ')
+	}
+	out = append(out, content...)
+	if tag == "F" {
+		out = append(out, '\n')
+	}
+
+	_, err := w.Write(out)
+	return err
+}
+
+// parseLogEntry splits a CRI log entry into its timestamp, tag and content.
+func parseLogEntry(entry []byte) (time.Time, string, []byte, bool) {
+	entry = bytes.TrimSuffix(entry, []byte("\n"))
+
+	fields := bytes.SplitN(entry, []byte(" "), 4)
+	if len(fields) < 3 {
+		return time.Time{}, "", nil, false
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return time.Time{}, "", nil, false
+	}
+
+	var content []byte
+	if len(fields) == 4 {
+		content = fields[3]
+	}
+
+	return ts, string(fields[2]), content, true
+}
+
+// tailOffset returns the offset of the last n entries of f.
+func tailOffset(f *os.File, n int) (int64, error) {
+	offsets := make([]int64, 0, n)
+	var offset int64
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && bytes.HasSuffix(line, []byte("\n")) {
+			if len(offsets) == n {
+				offsets = offsets[1:]
+			}
+			offsets = append(offsets, offset)
+			offset += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read log file: %w", err)
+		}
+	}
+
+	if len(offsets) == 0 {
+		return offset, nil
+	}
+	return offsets[0], nil
+}
+
+// limitWriter stops writing after a number of bytes.
+type limitWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+// Write writes up to the remaining byte budget and then returns
+// errLimitReached.
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if len(p) <= l.remaining {
+		n, err := l.w.Write(p)
+		l.remaining -= n
+		return n, err
+	}
+
+	n, err := l.w.Write(p[:l.remaining])
+	l.remaining -= n
+	if err != nil {
+		return n, err
+	}
+	return n, errLimitReached
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestLog writes CRI log entries to a file and returns its path.
+func writeTestLog(t *testing.T, entries ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "0.log")
+	if err := os.WriteFile(path, []byte(strings.Join(entries, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write log: %v", err)
+	}
+	return path
+}
+
+func TestCopyLog(t *testing.T) {
+	path := writeTestLog(t,
+		"not a log entry",
+		"2025-01-01T10:00:00Z stdout F one",
+		"2025-01-01T10:00:01Z stderr F two",
+		"2025-01-01T10:00:02Z stdout P thr",
+		"2025-01-01T10:00:02.5Z stdout F ee",
+		"2025-01-01T10:00:03Z stdout F four",
+	)
+
+	tests := []struct {
+		name     string
+		opts     LogOptions
+		expected string
+	}{
+		{
+			name:     "all",
+			expected: "one\ntwo\nthree\nfour\n",
+		},
+		{
+			name:     "tail",
+			opts:     LogOptions{Tail: 1},
+			expected: "four\n",
+		},
+		{
+			name:     "tail larger than log",
+			opts:     LogOptions{Tail: 100},
+			expected: "one\ntwo\nthree\nfour\n",
+		},
+		{
+			name:     "since time",
+			opts:     LogOptions{SinceTime: time.Date(2025, 1, 1, 10, 0, 1, 0, time.UTC)},
+			expected: "two\nthree\nfour\n",
+		},
+		{
+			name:     "timestamps",
+			opts:     LogOptions{Tail: 1, Timestamps: true},
+			expected: "2025-01-01T10:00:03Z four\n",
+		},
+		{
+			name:     "limit bytes",
+			opts:     LogOptions{LimitBytes: 6},
+			expected: "one\ntw",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := copyLog(context.Background(), path, tt.opts, &buf, func() bool { return true }); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestCopyLogFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.log")
+	logs, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("failed to open log file: %v", err)
+	}
+	stdout := logs.Stream(streamStdout)
+	_, _ = stdout.Write([]byte("first\n"))
+
+	exited := make(chan struct{})
+	done := func() bool {
+		select {
+		case <-exited:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var buf safeBuffer
+	result := make(chan error, 1)
+	go func() {
+		result <- copyLog(context.Background(), path, LogOptions{Follow: true}, &buf, done)
+	}()
+
+	waitFor(t, "first line", func() bool { return buf.String() == "first\n" })
+
+	_, _ = stdout.Write([]byte("second\nlast"))
+	_ = stdout.Flush()
+	_ = logs.Close()
+	close(exited)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not end after the container exited")
+	}
+
+	if buf.String() != "first\nsecond\nlast\n" {
+		t.Errorf("unexpected followed output %q", buf.String())
+	}
+}
@@ -0,0 +1,350 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mounter mounts the block devices and shared filesystems of a pod's
+// volumes on the instance.
+type Mounter interface {
+	// MountDisk mounts the filesystem of an attached volume at target,
+	// creating one of type fsType first if the volume is blank.
+	MountDisk(ctx context.Context, disk Disk, target string) error
+
+	// MountFilesystem mounts a shared filesystem at target.
+	MountFilesystem(ctx context.Context, fs Filesystem, target string) error
+
+	// Unmount unmounts the filesystem at target.
+	Unmount(ctx context.Context, target string) error
+
+	// PrepareInstanceStore formats the instance's instance store volumes
+	// as one filesystem and mounts it at target. It reports false if the
+	// instance has no instance store.
+	PrepareInstanceStore(ctx context.Context, target string) (bool, error)
+}
+
+// LinuxMounter mounts volumes with the standard Linux tools. EFS access
+// points need amazon-efs-utils and FSx for Lustre the Lustre client on the
+// instance image.
+type LinuxMounter struct {
+	// devDir is the device directory, normally /dev
+	devDir string
+}
+
+// NewLinuxMounter returns a mounter that finds devices below devDir.
+func NewLinuxMounter(devDir string) *LinuxMounter {
+	return &LinuxMounter{devDir: devDir}
+}
+
+// MountDisk implements Mounter.
+func (m *LinuxMounter) MountDisk(ctx context.Context, disk Disk, target string) error {
+	device, err := m.devicePath(disk)
+	if err != nil {
+		return err
+	}
+
+	// blkid exits with 2 when it finds no filesystem
+	fsType, err := run(exec.CommandContext(ctx, "blkid", "-p", "-s", "TYPE", "-o", "value", device))
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		fsType = strings.TrimSpace(fsType)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 2:
+		if disk.ReadOnly {
+			return fmt.Errorf("volume %s has no filesystem and is read-only", disk.VolumeID)
+		}
+		if _, err := run(exec.CommandContext(ctx, "mkfs."+disk.FSType, device)); err != nil {
+			return fmt.Errorf("failed to create %s filesystem on %s: %w", disk.FSType, device, err)
+		}
+		fsType = disk.FSType
+	default:
+		return fmt.Errorf("failed to probe %s: %w", device, err)
+	}
+
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	options := "rw"
+	if disk.ReadOnly {
+		options = "ro"
+	}
+	if _, err := run(exec.CommandContext(ctx, "mount", "-t", fsType, "-o", options, device, target)); err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %w", device, target, err)
+	}
+	return nil
+}
+
+// MountFilesystem implements Mounter.
+func (m *LinuxMounter) MountFilesystem(ctx context.Context, fs Filesystem, target string) error {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	options := append([]string(nil), fs.Options...)
+	if fs.ReadOnly {
+		options = append(options, "ro")
+	}
+
+	args := []string{"-t", fs.Type}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	if _, err := run(exec.CommandContext(ctx, "mount", append(args, fs.Source, target)...)); err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %w", fs.Source, target, err)
+	}
+	return nil
+}
+
+// Unmount implements Mounter.
+func (m *LinuxMounter) Unmount(ctx context.Context, target string) error {
+	if _, err := run(exec.CommandContext(ctx, "umount", target)); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", target, err)
+	}
+	return nil
+}
+
+// PrepareInstanceStore implements Mounter. Several instance store volumes
+// are striped together with mdadm.
+func (m *LinuxMounter) PrepareInstanceStore(ctx context.Context, target string) (bool, error) {
+	devices, err := m.instanceStoreDevices()
+	if err != nil || len(devices) == 0 {
+		return false, err
+	}
+
+	device := devices[0]
+	if len(devices) > 1 {
+		device = filepath.Join(m.devDir, "md", "orca-instance-store")
+		args := append([]string{"--create", device, "--run", "--level=0", "--raid-devices=" + strconv.Itoa(len(devices))}, devices...)
+		if _, err := run(exec.CommandContext(ctx, "mdadm", args...)); err != nil {
+			return false, fmt.Errorf("failed to create RAID 0 array of %s: %w", strings.Join(devices, ", "), err)
+		}
+	}
+
+	// Instance store volumes are blank when the instance starts
+	if _, err := run(exec.CommandContext(ctx, "mkfs.ext4", "-F", device)); err != nil {
+		return false, fmt.Errorf("failed to create ext4 filesystem on %s: %w", device, err)
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return false, err
+	}
+	if _, err := run(exec.CommandContext(ctx, "mount", "-t", "ext4", "-o", "noatime", device, target)); err != nil {
+		return false, fmt.Errorf("failed to mount %s at %s: %w", device, target, err)
+	}
+	return true, nil
+}
+
+// instanceStoreDevices returns the NVMe instance store volumes of the
+// instance. Each may be linked more than once by ID.
+func (m *LinuxMounter) instanceStoreDevices() ([]string, error) {
+	links, err := filepath.Glob(filepath.Join(m.devDir, "disk", "by-id", "nvme-Amazon_EC2_NVMe_Instance_Storage_*"))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var devices []string
+	for _, link := range links {
+		if strings.Contains(filepath.Base(link), "-part") {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", link, err)
+		}
+		if !seen[device] {
+			seen[device] = true
+			devices = append(devices, device)
+		}
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// devicePath finds the block device of an attached volume. On Nitro
+// instances EBS volumes are NVMe devices whose serial is the volume ID;
+// elsewhere they keep the requested device name, or its xvd/sd alias.
+func (m *LinuxMounter) devicePath(disk Disk) (string, error) {
+	candidates := []string{
+		filepath.Join(m.devDir, "disk", "by-id", "nvme-Amazon_Elastic_Block_Store_"+strings.ReplaceAll(disk.VolumeID, "-", "")),
+		filepath.Join(m.devDir, filepath.Base(disk.Device)),
+	}
+	if name := filepath.Base(disk.Device); strings.HasPrefix(name, "xvd") {
+		candidates = append(candidates, filepath.Join(m.devDir, "sd"+strings.TrimPrefix(name, "xvd")))
+	}
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return filepath.EvalSymlinks(path)
+		}
+	}
+	return "", fmt.Errorf("no device found for volume %s", disk.VolumeID)
+}
+
+// mountVolumes mounts the pod's disks and shared filesystems below
+// a.volumeDir, retrying with the restart back-off until every volume is
+// mounted or the pod stops. It reports whether the pod may go on.
+func (a *Agent) mountVolumes(ctx context.Context) bool {
+	a.mu.RLock()
+	names := make([]string, 0, len(a.disks)+len(a.filesystems))
+	for name := range a.disks {
+		names = append(names, name)
+	}
+	for name := range a.filesystems {
+		names = append(names, name)
+	}
+	a.mu.RUnlock()
+	if len(names) == 0 {
+		return true
+	}
+	if a.mounter == nil {
+		a.logger.Error().Msg("Pod has volumes to mount but the agent has no mounter")
+		return false
+	}
+	sort.Strings(names)
+
+	backoff := a.restartBackoff
+	for _, name := range names {
+		for {
+			err := a.mountVolume(ctx, name)
+			if err == nil {
+				break
+			}
+			a.logger.Warn().Err(err).Str("volume", name).Dur("backoff", backoff).Msg("Failed to mount volume")
+			a.setCreating(fmt.Sprintf("failed to mount volume %q: %v", name, err))
+
+			select {
+			case <-ctx.Done():
+				return false
+			case <-a.stopping:
+				return false
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxRestartBackoff)
+		}
+		a.logger.Info().Str("volume", name).Msg("Volume mounted")
+	}
+	return true
+}
+
+// mountVolume mounts one of the pod's disks or shared filesystems, unless
+// the pod is stopping. A failure is kept for the pod's report.
+func (a *Agent) mountVolume(ctx context.Context, name string) error {
+	a.mountMu.Lock()
+	defer a.mountMu.Unlock()
+
+	if a.stopped() {
+		return fmt.Errorf("pod is stopping")
+	}
+
+	a.mu.RLock()
+	disk, isDisk := a.disks[name]
+	fs := a.filesystems[name]
+	fsGroup := podFSGroup(a.pod)
+	onRootMismatch := fsGroup != nil && podFSGroupOnRootMismatch(a.pod)
+	a.mu.RUnlock()
+
+	target := filepath.Join(a.volumeDir, name)
+	var err error
+	if isDisk {
+		err = a.mounter.MountDisk(ctx, disk, target)
+	} else {
+		err = a.mounter.MountFilesystem(ctx, fs, target)
+	}
+	// The fsGroup owns writable disks and memory-backed emptyDirs, as with
+	// the kubelet; shared filesystems keep the ownership their server sets
+	if err == nil && fsGroup != nil && (isDisk && !disk.ReadOnly || fs.Type == "tmpfs") {
+		if err = setVolumeGroup(target, *fsGroup, false, onRootMismatch); err != nil {
+			err = fmt.Errorf("failed to apply fsGroup %d: %w", *fsGroup, err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.mountErrors[name] = err.Error()
+		return err
+	}
+	delete(a.mountErrors, name)
+	a.mounted[name] = true
+	return nil
+}
+
+// setCreating reports every container as still being created, with message
+// saying why.
+func (a *Agent) setCreating(message string) {
+	a.mu.RLock()
+	containers := append([]*container(nil), a.containers...)
+	a.mu.RUnlock()
+
+	for _, c := range containers {
+		a.setWaiting(c, "ContainerCreating", message)
+	}
+}
+
+// unmountVolumes unmounts the pod's disks and shared filesystems, so that
+// disk filesystems are clean before the controller detaches them. Failures
+// are logged; a volume that is still busy is released when the instance
+// shuts down.
+func (a *Agent) unmountVolumes(ctx context.Context) {
+	a.mountMu.Lock()
+	defer a.mountMu.Unlock()
+
+	a.mu.RLock()
+	names := make([]string, 0, len(a.mounted))
+	for name := range a.mounted {
+		names = append(names, name)
+	}
+	a.mu.RUnlock()
+
+	for _, name := range names {
+		if err := a.mounter.Unmount(ctx, filepath.Join(a.volumeDir, name)); err != nil {
+			a.logger.Error().Err(err).Str("volume", name).Msg("Failed to unmount volume")
+		}
+
+		a.mu.Lock()
+		delete(a.mounted, name)
+		a.mu.Unlock()
+	}
+}
+
+// unmountWhenFinished unmounts the pod's volumes once every container that
+// is not a sidecar has exited for good. Sidecars are stopped with the
+// instance.
+func (a *Agent) unmountWhenFinished(ctx context.Context) {
+	a.mu.RLock()
+	containers := append([]*container(nil), a.containers...)
+	a.mu.RUnlock()
+
+	for _, c := range containers {
+		if c.sidecar() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.finished:
+		}
+	}
+	a.unmountVolumes(ctx)
+}
+
+// mountedReadOnly reports whether the named volume is a disk or shared
+// filesystem that the agent mounts, and whether it is read-only. Callers
+// must hold a.mu.
+func (a *Agent) mountedReadOnly(name string) (readOnly, ok bool) {
+	if disk, ok := a.disks[name]; ok {
+		return disk.ReadOnly, true
+	}
+	if fs, ok := a.filesystems[name]; ok {
+		return fs.ReadOnly, true
+	}
+	return false, false
+}
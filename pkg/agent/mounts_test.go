@@ -0,0 +1,299 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeMounter records mounts instead of running mount. Mounts fail while
+// mountErr is set. The instance has an instance store if instanceStore is
+// set; it is a plain directory.
+type fakeMounter struct {
+	mu            sync.Mutex
+	mounted       map[string]Disk
+	filesystems   map[string]Filesystem
+	unmounts      []string
+	mountErr      error
+	instanceStore bool
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{mounted: make(map[string]Disk), filesystems: make(map[string]Filesystem)}
+}
+
+func (m *fakeMounter) MountDisk(ctx context.Context, disk Disk, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mountErr != nil {
+		return m.mountErr
+	}
+	m.mounted[target] = disk
+	return nil
+}
+
+func (m *fakeMounter) MountFilesystem(ctx context.Context, fs Filesystem, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mountErr != nil {
+		return m.mountErr
+	}
+	m.filesystems[target] = fs
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mounted, target)
+	m.unmounts = append(m.unmounts, target)
+	return nil
+}
+
+func (m *fakeMounter) PrepareInstanceStore(ctx context.Context, target string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.instanceStore {
+		return false, nil
+	}
+	return true, os.MkdirAll(target, 0o755)
+}
+
+// unmounted returns the unmounted targets.
+func (m *fakeMounter) unmounted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.unmounts...)
+}
+
+// setMountErr makes MountDisk fail with err, or succeed if err is nil.
+func (m *fakeMounter) setMountErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mountErr = err
+}
+
+// diskPod returns a one-container pod that mounts the disk "data".
+func diskPod() *corev1.Pod {
+	pod := testPod()
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "data", MountPath: "/data"},
+		{Name: "data", MountPath: "/checkpoints", SubPath: "checkpoints", ReadOnly: true},
+	}
+	return pod
+}
+
+func TestAgentMountsDisks(t *testing.T) {
+	rt := newFakeRuntime()
+	mounter := newFakeMounter()
+	a := startAgent(t, rt)
+	a.mounter = mounter
+
+	disk := Disk{VolumeID: "vol-0123", Device: "/dev/xvdb", FSType: "ext4"}
+	if err := a.Start(PodSubmission{Pod: diskPod(), Disks: map[string]Disk{"data": disk}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+	target := filepath.Join(a.volumeDir, "data")
+	mounter.mu.Lock()
+	mounted := mounter.mounted[target]
+	mounter.mu.Unlock()
+	if mounted != disk {
+		t.Errorf("expected %+v mounted at %s, got %+v", disk, target, mounted)
+	}
+
+	want := []Mount{
+		{HostPath: target, ContainerPath: "/data"},
+		{HostPath: filepath.Join(target, "checkpoints"), ContainerPath: "/checkpoints", ReadOnly: true},
+	}
+	if mounts := rt.config("trainer-0").Mounts; !slices.Equal(mounts, want) {
+		t.Errorf("expected mounts %+v, got %+v", want, mounts)
+	}
+
+	// The pod only finishes once its disk is unmounted
+	rt.exit("trainer-0", 0)
+	waitFor(t, "pod to succeed", func() bool { return a.Status().Phase == corev1.PodSucceeded })
+	if unmounted := mounter.unmounted(); !slices.Equal(unmounted, []string{target}) {
+		t.Errorf("expected %s to be unmounted, got %v", target, unmounted)
+	}
+}
+
+func TestAgentRetriesDiskMounts(t *testing.T) {
+	rt := newFakeRuntime()
+	mounter := newFakeMounter()
+	mounter.setMountErr(errors.New("no device found for volume vol-0123"))
+	a := startAgent(t, rt)
+	a.mounter = mounter
+
+	disk := Disk{VolumeID: "vol-0123", Device: "/dev/xvdb", FSType: "ext4"}
+	if err := a.Start(PodSubmission{Pod: diskPod(), Disks: map[string]Disk{"data": disk}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "mount failure to be reported", func() bool {
+		waiting := containerStatus(a, "trainer").State.Waiting
+		return waiting != nil && waiting.Reason == "ContainerCreating" && waiting.Message != ""
+	})
+	if rt.config("trainer-0") != nil {
+		t.Fatal("expected the container to wait for its disk")
+	}
+	if msg := a.Status().MountErrors["data"]; msg != "no device found for volume vol-0123" {
+		t.Errorf("expected the mount error in the report, got %q", msg)
+	}
+
+	mounter.setMountErr(nil)
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+	if errs := a.Status().MountErrors; len(errs) != 0 {
+		t.Errorf("expected no mount errors once mounted, got %v", errs)
+	}
+}
+
+func TestAgentMountsFilesystems(t *testing.T) {
+	rt := newFakeRuntime()
+	mounter := newFakeMounter()
+	a := startAgent(t, rt)
+	a.mounter = mounter
+
+	fs := Filesystem{Type: "lustre", Source: "fs-0123.fsx.us-east-1.amazonaws.com@tcp:/abcdef", ReadOnly: true}
+	if err := a.Start(PodSubmission{Pod: diskPod(), Filesystems: map[string]Filesystem{"data": fs}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+	target := filepath.Join(a.volumeDir, "data")
+	mounter.mu.Lock()
+	mounted := mounter.filesystems[target]
+	mounter.mu.Unlock()
+	if mounted.Source != fs.Source || mounted.Type != fs.Type {
+		t.Errorf("expected %+v mounted at %s, got %+v", fs, target, mounted)
+	}
+
+	// A read-only filesystem is read-only in every container
+	want := []Mount{
+		{HostPath: target, ContainerPath: "/data", ReadOnly: true},
+		{HostPath: filepath.Join(target, "checkpoints"), ContainerPath: "/checkpoints", ReadOnly: true},
+	}
+	if mounts := rt.config("trainer-0").Mounts; !slices.Equal(mounts, want) {
+		t.Errorf("expected mounts %+v, got %+v", want, mounts)
+	}
+}
+
+func TestAgentStopUnmountsDisks(t *testing.T) {
+	rt := newFakeRuntime()
+	mounter := newFakeMounter()
+	a := startAgent(t, rt)
+	a.mounter = mounter
+
+	pod := diskPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	disk := Disk{VolumeID: "vol-0123", Device: "/dev/xvdb", FSType: "ext4"}
+	if err := a.Start(PodSubmission{Pod: pod, Disks: map[string]Disk{"data": disk}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return a.Status().Phase == corev1.PodRunning })
+
+	a.Stop(context.Background(), 0)
+
+	target := filepath.Join(a.volumeDir, "data")
+	if unmounted := mounter.unmounted(); !slices.Equal(unmounted, []string{target}) {
+		t.Errorf("expected %s to be unmounted, got %v", target, unmounted)
+	}
+	if phase := a.Status().Phase; phase != corev1.PodFailed {
+		t.Errorf("expected phase Failed, got %s", phase)
+	}
+}
+
+func TestLinuxMounterDevicePath(t *testing.T) {
+	devDir := t.TempDir()
+	for _, name := range []string{"nvme1n1", "xvdc", "sdd"} {
+		if err := os.WriteFile(filepath.Join(devDir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	byID := filepath.Join(devDir, "disk", "by-id")
+	if err := os.MkdirAll(byID, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../nvme1n1", filepath.Join(byID, "nvme-Amazon_Elastic_Block_Store_vol0123")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		disk    Disk
+		want    string
+		wantErr bool
+	}{
+		{disk: Disk{VolumeID: "vol-0123", Device: "/dev/xvdb"}, want: "nvme1n1"},
+		{disk: Disk{VolumeID: "vol-0456", Device: "/dev/xvdc"}, want: "xvdc"},
+		{disk: Disk{VolumeID: "vol-0789", Device: "/dev/xvdd"}, want: "sdd"},
+		{disk: Disk{VolumeID: "vol-0abc", Device: "/dev/xvde"}, wantErr: true},
+	}
+
+	m := NewLinuxMounter(devDir)
+	for _, tt := range tests {
+		t.Run(tt.disk.VolumeID, func(t *testing.T) {
+			got, err := m.devicePath(tt.disk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("devicePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && filepath.Base(got) != tt.want {
+				t.Errorf("devicePath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinuxMounterInstanceStoreDevices(t *testing.T) {
+	devDir := t.TempDir()
+	for _, name := range []string{"nvme1n1", "nvme2n1", "nvme3n1"} {
+		if err := os.WriteFile(filepath.Join(devDir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewLinuxMounter(devDir)
+	devices, err := m.instanceStoreDevices()
+	if err != nil || len(devices) != 0 {
+		t.Fatalf("expected no instance store without by-id links, got %v, %v", devices, err)
+	}
+
+	byID := filepath.Join(devDir, "disk", "by-id")
+	if err := os.MkdirAll(byID, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"nvme-Amazon_EC2_NVMe_Instance_Storage_AWS1111":       "nvme2n1",
+		"nvme-Amazon_EC2_NVMe_Instance_Storage_AWS1111_1":     "nvme2n1",
+		"nvme-Amazon_EC2_NVMe_Instance_Storage_AWS2222":       "nvme3n1",
+		"nvme-Amazon_EC2_NVMe_Instance_Storage_AWS2222-part1": "nvme3n1",
+		"nvme-Amazon_Elastic_Block_Store_vol0123":             "nvme1n1",
+	}
+	for link, device := range links {
+		if err := os.Symlink("../../"+device, filepath.Join(byID, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devices, err = m.instanceStoreDevices()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, device := range devices {
+		names = append(names, filepath.Base(device))
+	}
+	if want := []string{"nvme2n1", "nvme3n1"}; !slices.Equal(names, want) {
+		t.Errorf("instanceStoreDevices() = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultClusterDomain is the cluster's DNS domain if the controller
+	// names none.
+	defaultClusterDomain = "cluster.local"
+
+	// resolvConfName is the pod's managed resolv.conf in the volume
+	// directory.
+	resolvConfName = "..resolv.conf"
+
+	// Limits of the resolver, which the kubelet applies as well
+	maxNameservers = 3
+	maxSearches    = 32
+)
+
+// hostResolvConf is the instance's resolver configuration, which pods with
+// the Default DNS policy use.
+var hostResolvConf = "/etc/resolv.conf"
+
+// Network connects the instance to the cluster network.
+type Network interface {
+	// ConnectOverlay brings up the instance's end of the overlay.
+	ConnectOverlay(ctx context.Context, overlay Overlay) error
+}
+
+// LinuxNetwork configures the overlay with the ip and wg commands; the
+// instance image needs wireguard-tools.
+type LinuxNetwork struct{}
+
+// NewLinuxNetwork returns a network that configures the instance's
+// interfaces and routes.
+func NewLinuxNetwork() *LinuxNetwork {
+	return &LinuxNetwork{}
+}
+
+// ConnectOverlay implements Network. The pod's IP is the source address of
+// every route through the overlay, so the cluster sees traffic from the
+// pod.
+func (n *LinuxNetwork) ConnectOverlay(ctx context.Context, overlay Overlay) error {
+	iface := overlay.Interface
+
+	_, _ = run(exec.CommandContext(ctx, "ip", "link", "del", iface))
+	if _, err := run(exec.CommandContext(ctx, "ip", "link", "add", iface, "type", "wireguard")); err != nil {
+		return fmt.Errorf("failed to create WireGuard interface %s: %w", iface, err)
+	}
+
+	// wg reads keys from files only
+	keyFile, err := os.CreateTemp("", "orca-wg-")
+	if err != nil {
+		return fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+	defer os.Remove(keyFile.Name())
+	_, err = keyFile.WriteString(overlay.PrivateKey + "\n")
+	if closeErr := keyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+
+	hub := overlay.HubAddress + "/32"
+	allowed := strings.Join(append([]string{hub}, overlay.Routes...), ",")
+	if _, err := run(exec.CommandContext(ctx, "wg", "set", iface,
+		"listen-port", strconv.Itoa(overlay.ListenPort), "private-key", keyFile.Name(),
+		"peer", overlay.HubPublicKey, "allowed-ips", allowed)); err != nil {
+		return fmt.Errorf("failed to configure WireGuard interface %s: %w", iface, err)
+	}
+
+	if _, err := run(exec.CommandContext(ctx, "ip", "address", "add", overlay.Address+"/32", "dev", iface)); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", overlay.Address, iface, err)
+	}
+	if _, err := run(exec.CommandContext(ctx, "ip", "link", "set", iface, "up")); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", iface, err)
+	}
+	for _, route := range append([]string{hub}, overlay.Routes...) {
+		if _, err := run(exec.CommandContext(ctx, "ip", "route", "replace", route, "dev", iface, "src", overlay.Address)); err != nil {
+			return fmt.Errorf("failed to route %s through %s: %w", route, iface, err)
+		}
+	}
+	return nil
+}
+
+// connectOverlay brings up the pod's end of the overlay, if it is on one,
+// retrying until it is up or the pod stops. It reports whether the pod may
+// go on.
+func (a *Agent) connectOverlay(ctx context.Context) bool {
+	a.mu.RLock()
+	network := a.podNetwork
+	a.mu.RUnlock()
+	if network == nil || network.Overlay == nil {
+		return true
+	}
+	if a.network == nil {
+		a.logger.Error().Msg("Pod is on the overlay but the agent cannot configure the network")
+		a.setCreating("agent cannot connect to the overlay network")
+		return false
+	}
+
+	overlay := *network.Overlay
+	if !a.retrySetup(ctx, "connect to the overlay", func() error {
+		return a.network.ConnectOverlay(ctx, overlay)
+	}) {
+		return false
+	}
+	a.logger.Info().Str("address", overlay.Address).Msg("Connected to the overlay")
+	return true
+}
+
+// clusterDomain returns the cluster's DNS domain. Callers must hold a.mu.
+func (a *Agent) clusterDomain() string {
+	if a.podNetwork != nil && a.podNetwork.ClusterDomain != "" {
+		return a.podNetwork.ClusterDomain
+	}
+	return defaultClusterDomain
+}
+
+// resolvConf returns the resolv.conf of a pod's containers, as the kubelet
+// builds it for the pod's DNS policy and DNS config, or nil if they use
+// the instance's. ClusterFirst pods fall back to the instance's resolver
+// without cluster DNS addresses.
+func resolvConf(pod *corev1.Pod, network *PodNetwork, domain string) ([]byte, error) {
+	policy := pod.Spec.DNSPolicy
+	if policy == "" {
+		policy = corev1.DNSClusterFirst
+	}
+	clusterFirst := policy == corev1.DNSClusterFirstWithHostNet || (policy == corev1.DNSClusterFirst && !pod.Spec.HostNetwork)
+	hasClusterDNS := network != nil && len(network.ClusterDNS) > 0
+
+	var nameservers, searches, options []string
+	switch {
+	case policy == corev1.DNSNone:
+	case clusterFirst && hasClusterDNS:
+		nameservers = network.ClusterDNS
+		searches = []string{pod.Namespace + ".svc." + domain, "svc." + domain, domain}
+		options = []string{"ndots:5"}
+	case pod.Spec.DNSConfig == nil:
+		return nil, nil
+	default:
+		var err error
+		if nameservers, searches, options, err = readResolvConf(hostResolvConf); err != nil {
+			return nil, err
+		}
+	}
+
+	if config := pod.Spec.DNSConfig; config != nil {
+		nameservers = appendUnique(nameservers, config.Nameservers...)
+		searches = appendUnique(searches, config.Searches...)
+		for _, o := range config.Options {
+			option := o.Name
+			if o.Value != nil {
+				option += ":" + *o.Value
+			}
+			options = slices.DeleteFunc(options, func(existing string) bool {
+				name, _, _ := strings.Cut(existing, ":")
+				return name == o.Name
+			})
+			options = append(options, option)
+		}
+	}
+
+	var b bytes.Buffer
+	for _, ns := range nameservers[:min(len(nameservers), maxNameservers)] {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(searches) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searches[:min(len(searches), maxSearches)], " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.Bytes(), nil
+}
+
+// readResolvConf reads the nameservers, search domains and options of a
+// resolv.conf file.
+func readResolvConf(path string) (nameservers, searches, options []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if _, err := netip.ParseAddr(fields[1]); err == nil {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search":
+			searches = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+	return nameservers, searches, options, scanner.Err()
+}
+
+// appendUnique appends the values not yet in list.
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeNetwork records overlay connections.
+type fakeNetwork struct {
+	mu         sync.Mutex
+	overlays   []Overlay
+	connectErr error
+}
+
+func (n *fakeNetwork) ConnectOverlay(ctx context.Context, overlay Overlay) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.connectErr != nil {
+		return n.connectErr
+	}
+	n.overlays = append(n.overlays, overlay)
+	return nil
+}
+
+func (n *fakeNetwork) connected() []Overlay {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.overlays
+}
+
+func TestResolvConf(t *testing.T) {
+	hostConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(hostConf, []byte("# generated\nnameserver 10.0.0.2\nsearch ec2.internal\noptions timeout:2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { hostResolvConf = path }(hostResolvConf)
+	hostResolvConf = hostConf
+
+	ndots := "2"
+	clusterDNS := &PodNetwork{ClusterDNS: []string{"10.96.0.10"}}
+	tests := []struct {
+		name    string
+		spec    corev1.PodSpec
+		network *PodNetwork
+		want    string
+	}{
+		{
+			name:    "cluster first",
+			network: clusterDNS,
+			want:    "nameserver 10.96.0.10\nsearch ml.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n",
+		},
+		{
+			name: "cluster first without cluster DNS",
+		},
+		{
+			name:    "host network",
+			spec:    corev1.PodSpec{HostNetwork: true},
+			network: clusterDNS,
+		},
+		{
+			name:    "cluster first with host network",
+			spec:    corev1.PodSpec{HostNetwork: true, DNSPolicy: corev1.DNSClusterFirstWithHostNet},
+			network: clusterDNS,
+			want:    "nameserver 10.96.0.10\nsearch ml.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n",
+		},
+		{
+			name:    "default",
+			spec:    corev1.PodSpec{DNSPolicy: corev1.DNSDefault},
+			network: clusterDNS,
+		},
+		{
+			name: "default with DNS config",
+			spec: corev1.PodSpec{
+				DNSPolicy: corev1.DNSDefault,
+				DNSConfig: &corev1.PodDNSConfig{Searches: []string{"example.org", "ec2.internal"}},
+			},
+			want: "nameserver 10.0.0.2\nsearch ec2.internal example.org\noptions timeout:2\n",
+		},
+		{
+			name: "cluster first with DNS config",
+			spec: corev1.PodSpec{
+				DNSConfig: &corev1.PodDNSConfig{
+					Nameservers: []string{"1.1.1.1"},
+					Options:     []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}, {Name: "edns0"}},
+				},
+			},
+			network: clusterDNS,
+			want:    "nameserver 10.96.0.10\nnameserver 1.1.1.1\nsearch ml.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:2 edns0\n",
+		},
+		{
+			name: "none",
+			spec: corev1.PodSpec{
+				DNSPolicy: corev1.DNSNone,
+				DNSConfig: &corev1.PodDNSConfig{Nameservers: []string{"1.1.1.1", "8.8.8.8", "9.9.9.9", "8.8.4.4"}},
+			},
+			network: clusterDNS,
+			want:    "nameserver 1.1.1.1\nnameserver 8.8.8.8\nnameserver 9.9.9.9\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "ml"}, Spec: tt.spec}
+			got, err := resolvConf(pod, tt.network, defaultClusterDomain)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("resolvConf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentConnectsOverlay(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	network := &fakeNetwork{connectErr: errors.New("wg: not found")}
+	a.network = network
+
+	overlay := &Overlay{Interface: "orca0", Address: "10.244.0.5", HubAddress: "10.244.0.1"}
+	err := a.Start(PodSubmission{
+		Pod:     testPod(),
+		Network: &PodNetwork{ClusterDomain: "example.org", ClusterDNS: []string{"10.96.0.10"}, Overlay: overlay},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "overlay failure to be reported", func() bool {
+		waiting := containerStatus(a, "trainer").State.Waiting
+		return waiting != nil && strings.Contains(waiting.Message, "wg: not found")
+	})
+	if rt.config("trainer-0") != nil {
+		t.Fatal("expected the container to wait for the overlay")
+	}
+
+	network.mu.Lock()
+	network.connectErr = nil
+	network.mu.Unlock()
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+	if overlays := network.connected(); len(overlays) != 1 || overlays[0].Address != overlay.Address {
+		t.Errorf("expected the instance to join the overlay once, got %+v", overlays)
+	}
+
+	// Containers resolve names with the cluster's DNS
+	resolvPath := filepath.Join(a.volumeDir, resolvConfName)
+	if cfg := rt.config("trainer-0"); cfg.ResolvConf != resolvPath {
+		t.Errorf("expected resolv.conf %s, got %q", resolvPath, cfg.ResolvConf)
+	}
+	resolv, err := os.ReadFile(resolvPath)
+	if err != nil || !strings.Contains(string(resolv), "search default.svc.example.org svc.example.org example.org\n") {
+		t.Errorf("expected the cluster's search domains, got %q, %v", resolv, err)
+	}
+}
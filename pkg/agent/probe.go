@@ -0,0 +1,364 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Probe defaults, as applied by the API server.
+const (
+	defaultProbePeriod           = 10
+	defaultProbeTimeout          = 1
+	defaultProbeFailureThreshold = 3
+)
+
+// probeUserAgent identifies HTTP probes, like the kubelet's.
+const probeUserAgent = "kube-probe/orca"
+
+// probeState is the outcome of a probe once a threshold is crossed.
+type probeState int
+
+const (
+	probeUnknown probeState = iota
+	probeSuccess
+	probeFailure
+)
+
+// hasProbes reports whether the container has any probe.
+func hasProbes(spec corev1.Container) bool {
+	return spec.StartupProbe != nil || spec.ReadinessProbe != nil || spec.LivenessProbe != nil
+}
+
+// runProbes probes one run of a container until it exits. The startup probe
+// runs first; once it passes, readiness and liveness probes run side by
+// side. A container that fails its startup or liveness probe is killed and
+// then restarted according to its restart policy.
+func (a *Agent) runProbes(ctx context.Context, c *container, run *containerRun) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-run.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	startedAt := time.Now()
+
+	if probe := c.spec.StartupProbe; probe != nil {
+		passed := false
+		a.watchProbe(ctx, c, run, probe, startedAt, func(success bool, message string) bool {
+			if !success {
+				a.killUnhealthy(ctx, c, run, probe, "Startup", message)
+				return false
+			}
+			a.mu.Lock()
+			if c.run == run {
+				c.markStarted()
+			}
+			a.mu.Unlock()
+			passed = true
+			return false
+		})
+		if !passed {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	if probe := c.spec.ReadinessProbe; probe != nil {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			a.watchProbe(ctx, c, run, probe, startedAt, func(success bool, message string) bool {
+				a.mu.Lock()
+				if c.run == run && c.status.State.Running != nil {
+					c.status.Ready = success
+				}
+				a.mu.Unlock()
+				return true
+			})
+		}()
+	} else {
+		go func() { done <- struct{}{} }()
+	}
+
+	if probe := c.spec.LivenessProbe; probe != nil {
+		a.watchProbe(ctx, c, run, probe, startedAt, func(success bool, message string) bool {
+			if !success {
+				a.killUnhealthy(ctx, c, run, probe, "Liveness", message)
+				return false
+			}
+			return true
+		})
+	}
+
+	<-done
+}
+
+// watchProbe runs probe every period after its initial delay, counted from
+// startedAt. Each time the success or failure threshold is crossed, update
+// is called with the outcome; watchProbe returns when update returns false
+// or ctx is done.
+func (a *Agent) watchProbe(ctx context.Context, c *container, run *containerRun, probe *corev1.Probe, startedAt time.Time, update func(success bool, message string) bool) {
+	period := a.probeDuration(probe.PeriodSeconds, defaultProbePeriod)
+	successThreshold := max(probe.SuccessThreshold, 1)
+	failureThreshold := probe.FailureThreshold
+	if failureThreshold <= 0 {
+		failureThreshold = defaultProbeFailureThreshold
+	}
+
+	timer := time.NewTimer(time.Until(startedAt.Add(a.probeDuration(probe.InitialDelaySeconds, 0))))
+	defer timer.Stop()
+
+	state := probeUnknown
+	var successes, failures int32
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		err := a.probe(ctx, c, run, probe)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		switch {
+		case err == nil && successes >= successThreshold && state != probeSuccess:
+			state = probeSuccess
+			if !update(true, "") {
+				return
+			}
+		case err != nil && failures >= failureThreshold && state != probeFailure:
+			state = probeFailure
+			if !update(false, err.Error()) {
+				return
+			}
+		}
+
+		timer.Reset(period)
+	}
+}
+
+// probeDuration converts a probe's seconds field to a duration, using def
+// when it is unset.
+func (a *Agent) probeDuration(seconds, def int32) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * a.probeUnit
+}
+
+// killUnhealthy stops a container run that failed its startup or liveness
+// probe as a deleted pod's containers are stopped, within the probe's
+// terminationGracePeriodSeconds or else the pod's. Its exit is then handled
+// like any other.
+func (a *Agent) killUnhealthy(ctx context.Context, c *container, run *containerRun, probe *corev1.Probe, kind, message string) {
+	a.logger.Warn().
+		Str("container", c.spec.Name).
+		Str("probe", kind).
+		Str("message", message).
+		Msg("Container failed probe, killing it")
+
+	gracePeriod := a.terminationGracePeriod()
+	if probe.TerminationGracePeriodSeconds != nil {
+		gracePeriod = a.probeDuration(int32(*probe.TerminationGracePeriodSeconds), 0)
+	}
+	a.stopRun(ctx, c, run, time.Now().Add(gracePeriod))
+}
+
+// probe runs a single check of probe against a container run.
+func (a *Agent) probe(ctx context.Context, c *container, run *containerRun, probe *corev1.Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, a.probeDuration(probe.TimeoutSeconds, defaultProbeTimeout))
+	defer cancel()
+
+	switch {
+	case probe.Exec != nil:
+		return a.execProbe(ctx, run.id, probe.Exec)
+	case probe.HTTPGet != nil:
+		return httpProbe(ctx, c.spec, probe.HTTPGet)
+	case probe.TCPSocket != nil:
+		return tcpProbe(ctx, c.spec, probe.TCPSocket)
+	case probe.GRPC != nil:
+		return grpcProbe(ctx, probe.GRPC)
+	default:
+		return nil
+	}
+}
+
+// execProbe runs a command in the container; it passes if it exits 0.
+func (a *Agent) execProbe(ctx context.Context, id string, action *corev1.ExecAction) error {
+	var output bytes.Buffer
+	proc, err := a.runtime.ExecContainer(ctx, id, &ExecConfig{
+		Command: action.Command,
+		Stdout:  &output,
+		Stderr:  &output,
+	})
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, err := proc.Wait()
+		done <- result{code, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("command timed out")
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		if r.code != 0 {
+			return fmt.Errorf("command exited with code %d: %s", r.code, strings.TrimSpace(output.String()))
+		}
+		return nil
+	}
+}
+
+// httpProbe sends a GET request; it passes on a 2xx or 3xx response.
+// Containers share the instance's network, so the default host is the
+// loopback address.
+func httpProbe(ctx context.Context, spec corev1.Container, action *corev1.HTTPGetAction) error {
+	port, err := probePort(spec, action.Port)
+	if err != nil {
+		return err
+	}
+
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+	target := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(probeHost(action.Host), strconv.Itoa(port)),
+		Path:   action.Path,
+	}
+	if parsed, err := url.Parse(action.Path); err == nil {
+		target.Path = parsed.Path
+		target.RawQuery = parsed.RawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", probeUserAgent)
+	for _, h := range action.HTTPHeaders {
+		if strings.EqualFold(h.Name, "Host") {
+			req.Host = h.Value
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+
+	// Probes do not verify certificates, like the kubelet's
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("HTTP probe failed with statuscode: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tcpProbe passes if a TCP connection can be opened.
+func tcpProbe(ctx context.Context, spec corev1.Container, action *corev1.TCPSocketAction) error {
+	port, err := probePort(spec, action.Port)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(probeHost(action.Host), strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcProbe calls the standard gRPC health service; it passes if the
+// service reports SERVING.
+func grpcProbe(ctx context.Context, action *corev1.GRPCAction) error {
+	conn, err := grpc.NewClient(net.JoinHostPort(probeHost(""), strconv.Itoa(int(action.Port))),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	service := ""
+	if action.Service != nil {
+		service = *action.Service
+	}
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service unhealthy (responded with %q)", resp.Status)
+	}
+	return nil
+}
+
+// probeHost returns the host to probe, defaulting to the loopback address.
+func probeHost(host string) string {
+	if host == "" {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+// probePort resolves a probe port, which may name a container port.
+func probePort(spec corev1.Container, port intstr.IntOrString) (int, error) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), nil
+	}
+	for _, p := range spec.Ports {
+		if p.Name == port.StrVal {
+			return int(p.ContainerPort), nil
+		}
+	}
+	if n, err := strconv.Atoi(port.StrVal); err == nil {
+		return n, nil
+	}
+	return 0, fmt.Errorf("port %q not found in container %s", port.StrVal, spec.Name)
+}
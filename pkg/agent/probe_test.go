@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// setExecCode sets the exit code of exec'd commands.
+func (r *fakeRuntime) setExecCode(code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.execCode = code
+}
+
+// listenerPort returns the port of a listening address.
+func listenerPort(t *testing.T, addr string) int {
+	t.Helper()
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != probeUserAgent {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	port := listenerPort(t, u.Host)
+	spec := corev1.Container{
+		Name:  "web",
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(port)}},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		port    intstr.IntOrString
+		wantErr bool
+	}{
+		{name: "ok", path: "/healthz", port: intstr.FromInt32(int32(port))},
+		{name: "named port", path: "/healthz", port: intstr.FromString("http")},
+		{name: "redirect status", path: "/moved", port: intstr.FromInt32(int32(port))},
+		{name: "server error", path: "/broken", port: intstr.FromInt32(int32(port)), wantErr: true},
+		{name: "unknown port name", path: "/healthz", port: intstr.FromString("metrics"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := httpProbe(context.Background(), spec, &corev1.HTTPGetAction{Path: tt.path, Port: tt.port})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := listenerPort(t, listener.Addr().String())
+
+	action := &corev1.TCPSocketAction{Port: intstr.FromInt32(int32(port))}
+	if err := tcpProbe(context.Background(), corev1.Container{}, action); err != nil {
+		t.Errorf("expected open port to pass, got %v", err)
+	}
+
+	listener.Close()
+	if err := tcpProbe(context.Background(), corev1.Container{}, action); err == nil {
+		t.Error("expected closed port to fail")
+	}
+}
+
+func TestGRPCProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := listenerPort(t, listener.Addr().String())
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("ready", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("draining", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	tests := []struct {
+		service string
+		wantErr bool
+	}{
+		{service: "ready"},
+		{service: "draining", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			service := tt.service
+			err := grpcProbe(ctx, &corev1.GRPCAction{Port: int32(port), Service: &service})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// probedPod returns testPod with a single container and the given probes.
+func probedPod(readiness, liveness *corev1.Probe) *corev1.Pod {
+	pod := testPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	pod.Spec.Containers[0].ReadinessProbe = readiness
+	pod.Spec.Containers[0].LivenessProbe = liveness
+	return pod
+}
+
+// execProbe returns a probe that runs a command every probe second.
+func execProbe() *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler:     corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"check"}}},
+		PeriodSeconds:    1,
+		FailureThreshold: 1,
+	}
+}
+
+func TestAgentReadinessProbe(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.setExecCode(1)
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: probedPod(execProbe(), nil)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if containerStatus(a, "trainer").Ready {
+		t.Fatal("expected container to not be ready while its readiness probe fails")
+	}
+
+	rt.setExecCode(0)
+	waitFor(t, "container to become ready", func() bool { return containerStatus(a, "trainer").Ready })
+
+	rt.setExecCode(1)
+	waitFor(t, "container to become unready", func() bool { return !containerStatus(a, "trainer").Ready })
+
+	// Failing readiness does not restart the container
+	if rt.config("trainer-1") != nil {
+		t.Error("expected container not to be restarted")
+	}
+}
+
+func TestAgentLivenessProbe(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.setExecCode(1)
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: probedPod(nil, execProbe())}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitFor(t, "container to be restarted", func() bool { return rt.config("trainer-1") != nil })
+
+	status := containerStatus(a, "trainer")
+	if status.RestartCount < 1 {
+		t.Errorf("expected a restart to be counted, got %d", status.RestartCount)
+	}
+	if last := status.LastTerminationState.Terminated; last == nil || last.ExitCode != 128+int32(syscall.SIGTERM) {
+		t.Errorf("expected last termination by SIGTERM, got %+v", last)
+	}
+}
+
+func TestAgentLivenessProbeGracePeriod(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.setExecCode(1)
+	rt.ignoreTerm = true
+	a := startAgent(t, rt)
+
+	gracePeriod := int64(5)
+	probe := execProbe()
+	probe.TerminationGracePeriodSeconds = &gracePeriod
+	pod := probedPod(nil, probe)
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PreStop: execHook("drain")}
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitFor(t, "container to be restarted", func() bool { return rt.config("trainer-1") != nil })
+
+	// The container ignores SIGTERM, so it is killed once the probe's grace
+	// period is over
+	want := []string{fmt.Sprintf("trainer-0:%d", syscall.SIGTERM), fmt.Sprintf("trainer-0:%d", syscall.SIGKILL)}
+	if kills := rt.killed(); len(kills) < 2 || !slices.Equal(kills[:2], want) {
+		t.Errorf("expected signals %v, got %v", want, kills)
+	}
+	if execs := rt.execCommands(); !slices.Contains(execs, "drain") {
+		t.Errorf("expected the preStop hook to run, got %v", execs)
+	}
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+)
+
+// dockerHub is the registry of image references without a registry host.
+const dockerHub = "docker.io"
+
+// CredentialProvider supplies registry credentials that do not come from
+// the pod, such as ECR logins for the instance profile.
+type CredentialProvider interface {
+	// Credential returns a login for registry, or nil if the provider does
+	// not serve that registry.
+	Credential(ctx context.Context, registry string) (*RegistryCredential, error)
+}
+
+// imageRepository returns the registry host and repository path of an image
+// reference, with Docker Hub defaults applied.
+func imageRepository(image string) (registry, repository string) {
+	// Drop the digest, then the tag
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	registry, repository, found := strings.Cut(image, "/")
+	if !found || !strings.ContainsAny(registry, ".:") && registry != "localhost" {
+		registry, repository = dockerHub, image
+	}
+	if registry == dockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return normalizeRegistry(registry), repository
+}
+
+// normalizeRegistry maps the aliases of Docker Hub to one name.
+func normalizeRegistry(registry string) string {
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHub
+	}
+	return registry
+}
+
+// matchCredentials returns the credentials whose registry matches image,
+// most specific first, the way the kubelet orders its keyring.
+func matchCredentials(credentials []RegistryCredential, image string) []RegistryCredential {
+	registry, repository := imageRepository(image)
+
+	type match struct {
+		credential RegistryCredential
+		key        string
+	}
+	var matches []match
+	for _, c := range credentials {
+		key := credentialKey(c.Registry)
+		host, prefix, _ := strings.Cut(key, "/")
+		if !hostMatches(host, registry) {
+			continue
+		}
+		if prefix != "" && repository != prefix && !strings.HasPrefix(repository, prefix+"/") {
+			continue
+		}
+		matches = append(matches, match{credential: c, key: key})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return len(matches[i].key) > len(matches[j].key) })
+
+	result := make([]RegistryCredential, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, m.credential)
+	}
+	return result
+}
+
+// credentialKey strips the scheme and API version suffixes that docker
+// config keys often carry, like "https://index.docker.io/v1/".
+func credentialKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.TrimSuffix(key, "/")
+	for _, suffix := range []string{"/v1", "/v2"} {
+		key = strings.TrimSuffix(key, suffix)
+	}
+
+	host, prefix, found := strings.Cut(key, "/")
+	host = normalizeRegistry(host)
+	if found {
+		return host + "/" + prefix
+	}
+	return host
+}
+
+// hostMatches reports whether a registry host matches a credential host,
+// which may use a wildcard for whole labels, like "*.example.com".
+func hostMatches(pattern, host string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, err := path.Match(patternLabels[i], hostLabels[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
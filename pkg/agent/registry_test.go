@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		image      string
+		registry   string
+		repository string
+	}{
+		{"busybox", "docker.io", "library/busybox"},
+		{"busybox:1.36", "docker.io", "library/busybox"},
+		{"pytorch/pytorch:latest", "docker.io", "pytorch/pytorch"},
+		{"index.docker.io/pytorch/pytorch", "docker.io", "pytorch/pytorch"},
+		{"ghcr.io/org/app@sha256:abcd", "ghcr.io", "org/app"},
+		{"registry.example.com:5000/team/app:v1", "registry.example.com:5000", "team/app"},
+		{"localhost/app", "localhost", "app"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/trainer:v2", "123456789012.dkr.ecr.us-east-1.amazonaws.com", "trainer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			registry, repository := imageRepository(tt.image)
+			if registry != tt.registry || repository != tt.repository {
+				t.Errorf("imageRepository(%q) = %q, %q, want %q, %q", tt.image, registry, repository, tt.registry, tt.repository)
+			}
+		})
+	}
+}
+
+func TestMatchCredentials(t *testing.T) {
+	logins := []RegistryCredential{
+		{Registry: "https://index.docker.io/v1/", Username: "hub"},
+		{Registry: "registry.example.com", Username: "example"},
+		{Registry: "registry.example.com/team", Username: "team"},
+		{Registry: "*.azurecr.io", Username: "azure"},
+	}
+
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{"busybox", []string{"hub"}},
+		{"registry.example.com/team/app", []string{"team", "example"}},
+		{"registry.example.com/other/app", []string{"example"}},
+		{"registry.example.com/teams/app", []string{"example"}},
+		{"myregistry.azurecr.io/app", []string{"azure"}},
+		{"a.b.azurecr.io/app", nil},
+		{"ghcr.io/org/app", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			var got []string
+			for _, c := range matchCredentials(logins, tt.image) {
+				got = append(got, c.Username)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("matchCredentials(%q) = %v, want %v", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+// staticProvider serves one login for every registry.
+type staticProvider struct {
+	login *RegistryCredential
+}
+
+func (p staticProvider) Credential(ctx context.Context, registry string) (*RegistryCredential, error) {
+	return p.login, nil
+}
+
+func TestAgentPullsWithCredentials(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	a.registries = staticProvider{login: &RegistryCredential{Username: "AWS"}}
+
+	pod := testPod()
+	pod.Spec.Containers[0].Image = "registry.example.com/team/trainer"
+	err := a.Start(PodSubmission{
+		Pod:                 pod,
+		RegistryCredentials: []RegistryCredential{{Registry: "registry.example.com", Username: "team"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "containers to start", func() bool { return rt.config("sidecar-0") != nil })
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.pullAuth) != 2 {
+		t.Fatalf("expected 2 pulls, got %d", len(rt.pullAuth))
+	}
+	// The pull secret is used where it matches, the provider elsewhere
+	if auth := rt.pullAuth[0]; auth == nil || auth.Username != "team" {
+		t.Errorf("expected the pull secret login, got %+v", auth)
+	}
+	if auth := rt.pullAuth[1]; auth == nil || auth.Username != "AWS" {
+		t.Errorf("expected the provider login, got %+v", auth)
+	}
+}
+
+func TestECRCredentialProvider(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if target := r.Header.Get("X-Amz-Target"); !strings.HasSuffix(target, "GetAuthorizationToken") {
+			t.Errorf("unexpected target %q", target)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/us-west-2/ecr/aws4_request") {
+			t.Errorf("expected a request signed for ECR in us-west-2, got %q", auth)
+		}
+
+		token := base64.StdEncoding.EncodeToString([]byte("AWS:secret"))
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"authorizationData": []map[string]any{
+				{"authorizationToken": token, "expiresAt": time.Now().Add(12 * time.Hour).Unix()},
+			},
+		})
+	}))
+	defer server.Close()
+
+	p := NewECRCredentialProvider(aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")))
+	p.endpoint = func(fips bool, region, suffix string) string { return server.URL }
+
+	registry := "123456789012.dkr.ecr.us-west-2.amazonaws.com"
+	for range 2 {
+		login, err := p.Credential(context.Background(), registry)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if login == nil || login.Username != "AWS" || login.Password != "secret" || login.Registry != registry {
+			t.Errorf("unexpected login %+v", login)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the login to be cached, got %d requests", requests)
+	}
+
+	login, err := p.Credential(context.Background(), "ghcr.io")
+	if err != nil || login != nil {
+		t.Errorf("expected no login for other registries, got %+v, %v", login, err)
+	}
+}
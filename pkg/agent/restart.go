@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultRestartBackoff is the delay before the first restart of a
+	// crashed container. It doubles with every crash, as in the kubelet.
+	defaultRestartBackoff = 10 * time.Second
+
+	// maxRestartBackoff caps the delay between restarts.
+	maxRestartBackoff = 5 * time.Minute
+
+	// backoffResetAfter resets the delay once a container has run this long.
+	backoffResetAfter = 10 * time.Minute
+)
+
+// restartPolicy returns the pod's restart policy, defaulting to Always as
+// the API server does.
+func restartPolicy(pod *corev1.Pod) corev1.RestartPolicy {
+	if pod == nil || pod.Spec.RestartPolicy == "" {
+		return corev1.RestartPolicyAlways
+	}
+	return pod.Spec.RestartPolicy
+}
+
+// containerRestartPolicy returns the restart policy of a container. Sidecars,
+// init containers with restartPolicy Always, always restart; other init
+// containers are retried until they succeed unless the pod never restarts.
+func containerRestartPolicy(spec corev1.Container, init bool, podPolicy corev1.RestartPolicy) corev1.RestartPolicy {
+	if !init {
+		return podPolicy
+	}
+	if spec.RestartPolicy != nil && *spec.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+		return corev1.RestartPolicyAlways
+	}
+	if podPolicy == corev1.RestartPolicyNever {
+		return corev1.RestartPolicyNever
+	}
+	return corev1.RestartPolicyOnFailure
+}
+
+// shouldRestart reports whether a container that exited with exitCode is
+// restarted under policy.
+func shouldRestart(policy corev1.RestartPolicy, exitCode int32) bool {
+	switch policy {
+	case corev1.RestartPolicyNever:
+		return false
+	case corev1.RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return true
+	}
+}
+
+// restartAfterExit restarts a container that terminated after running for
+// ranFor, if its restart policy asks for it and the pod is not stopping. The container waits in
+// CrashLoopBackOff first, with the delay doubling on every crash.
+func (a *Agent) restartAfterExit(ctx context.Context, c *container, terminated *corev1.ContainerStateTerminated, ranFor time.Duration) {
+	a.mu.Lock()
+	if a.stopped() || !shouldRestart(c.restartPolicy, terminated.ExitCode) {
+		close(c.finished)
+		a.mu.Unlock()
+		return
+	}
+
+	switch {
+	case ranFor >= backoffResetAfter || c.backoff == 0:
+		c.backoff = a.restartBackoff
+	default:
+		c.backoff = min(2*c.backoff, maxRestartBackoff)
+	}
+	delay := c.backoff
+
+	c.status.LastTerminationState = corev1.ContainerState{Terminated: terminated}
+	c.status.State = corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{
+			Reason:  "CrashLoopBackOff",
+			Message: fmt.Sprintf("back-off %s restarting failed container=%s pod=%s", delay, c.spec.Name, a.pod.Name),
+		},
+	}
+	a.mu.Unlock()
+
+	a.logger.Info().
+		Str("container", c.spec.Name).
+		Dur("backoff", delay).
+		Msg("Restarting container")
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-a.stopping:
+		return
+	case <-time.After(delay):
+	}
+
+	a.mu.Lock()
+	c.status.RestartCount++
+	a.mu.Unlock()
+
+	if err := a.startContainer(ctx, c); err != nil {
+		a.logger.Error().Err(err).Str("container", c.spec.Name).Msg("Failed to restart container")
+	}
+}
+
+// retrySetup runs one of the pod's setup steps, retrying with the restart
+// back-off until it succeeds or the pod stops. Failures are reported in the
+// pod's status. It reports whether the pod may go on.
+func (a *Agent) retrySetup(ctx context.Context, step string, setup func() error) bool {
+	backoff := a.restartBackoff
+	for {
+		err := setup()
+		if err == nil {
+			return true
+		}
+		a.logger.Warn().Err(err).Dur("backoff", backoff).Msgf("Failed to %s", step)
+		a.setCreating(fmt.Sprintf("failed to %s: %v", step, err))
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-a.stopping:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRestartBackoff)
+	}
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"syscall"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Runtime is the container runtime the agent uses to run pod containers.
+type Runtime interface {
+	// PullImage makes sure the image is available locally and returns its ID.
+	// The registry login is used if auth is set; otherwise the pull is
+	// anonymous.
+	PullImage(ctx context.Context, image string, auth *RegistryCredential) (string, error)
+
+	// StartContainer creates and starts a container.
+	// The returned Process is used to wait for the container to exit.
+	StartContainer(ctx context.Context, cfg *ContainerConfig) (Process, error)
+
+	// ExecContainer runs an additional process in a running container.
+	// The process is stopped when ctx is cancelled.
+	ExecContainer(ctx context.Context, id string, cfg *ExecConfig) (Process, error)
+
+	// KillContainer sends a signal to the container's main process.
+	KillContainer(ctx context.Context, id string, sig syscall.Signal) error
+
+	// ContainerStats returns the resource usage of a running container.
+	ContainerStats(ctx context.Context, id string) (*ContainerStats, error)
+
+	// StartSandbox starts the pod sandbox, which holds the network
+	// namespace and hostname the pod's containers share.
+	StartSandbox(ctx context.Context, cfg *SandboxConfig) error
+
+	// RemoveSandbox stops and removes the pod sandbox.
+	RemoveSandbox(ctx context.Context, id string) error
+}
+
+// SandboxConfig describes a pod sandbox to start.
+type SandboxConfig struct {
+	// ID is the runtime name of the sandbox.
+	ID string
+
+	// Hostname is the pod's hostname, or empty for the instance's.
+	Hostname string
+}
+
+// Process is a process running in a container.
+type Process interface {
+	// Wait blocks until the process exits and returns its exit code.
+	Wait() (int, error)
+
+	// Resize changes the terminal size of a process started with a TTY.
+	// It is a no-op for processes without one.
+	Resize(size TermSize) error
+}
+
+// ContainerConfig describes a container to start.
+type ContainerConfig struct {
+	// ID is the runtime container name, unique on the instance.
+	ID string
+
+	// Image is the image reference to run.
+	Image string
+
+	// Command overrides the image entrypoint when set.
+	Command []string
+
+	// Args overrides the image command when set.
+	Args []string
+
+	// Env holds environment variables in KEY=VALUE form.
+	Env []string
+
+	// WorkingDir overrides the image working directory when set.
+	WorkingDir string
+
+	// Resources are the container's requests and limits.
+	Resources corev1.ResourceRequirements
+
+	// Mounts are bind mounts of instance paths into the container.
+	Mounts []Mount
+
+	// Sandbox is the ID of the pod sandbox whose network namespace and
+	// hostname the container joins, or empty to run on the host network.
+	Sandbox string
+
+	// HostsFile is mounted as the container's /etc/hosts when set.
+	HostsFile string
+
+	// ResolvConf is mounted as the container's /etc/resolv.conf when set.
+	ResolvConf string
+
+	// Security holds the container's user, capabilities and other
+	// security settings.
+	Security ContainerSecurity
+
+	// Stdin is connected to the container's stdin when the container
+	// spec asks for it. It is nil otherwise.
+	Stdin io.Reader
+
+	// TTY runs the container with a terminal. Stdout then receives the
+	// terminal output and Stderr is unused.
+	TTY bool
+
+	// Stdout and Stderr receive the container's output.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// seccompUnconfined is the ContainerSecurity.Seccomp of containers that
+// run without a seccomp profile.
+const seccompUnconfined = "unconfined"
+
+// ContainerSecurity is the security context a container runs with.
+type ContainerSecurity struct {
+	// User and Group are the IDs the container's processes run as, or nil
+	// for the image's.
+	User  *int64
+	Group *int64
+
+	// SupplementalGroups are added to the processes' groups.
+	SupplementalGroups []int64
+
+	// RunAsNonRoot fails the container if it would run as root.
+	RunAsNonRoot bool
+
+	// Privileged runs the container with every capability and device.
+	Privileged bool
+
+	// ReadOnlyRootFilesystem mounts the container's root read-only.
+	ReadOnlyRootFilesystem bool
+
+	// NoNewPrivileges stops processes from gaining privileges, such as
+	// through setuid binaries.
+	NoNewPrivileges bool
+
+	// CapAdd and CapDrop are the capabilities added to and dropped from
+	// the runtime's defaults.
+	CapAdd  []string
+	CapDrop []string
+
+	// Seccomp is the path of the container's seccomp profile,
+	// seccompUnconfined, or empty for the runtime's default profile.
+	Seccomp string
+}
+
+// Mount is a bind mount of an instance path into a container.
+type Mount struct {
+	// HostPath is the path on the instance.
+	HostPath string
+
+	// ContainerPath is where it is mounted in the container.
+	ContainerPath string
+
+	// ReadOnly mounts the path read-only.
+	ReadOnly bool
+}
+
+// ExecConfig describes a process to run in a container.
+type ExecConfig struct {
+	// Command is the command to run.
+	Command []string
+
+	// TTY runs the process with a terminal. Stdout then receives the
+	// terminal output and Stderr is unused.
+	TTY bool
+
+	// Stdin is connected to the process's stdin if set.
+	Stdin io.Reader
+
+	// Stdout and Stderr receive the process's output.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ContainerStats is the resource usage of a container's cgroup.
+type ContainerStats struct {
+	// CPUUsageNanoSeconds is the cumulative CPU time consumed.
+	CPUUsageNanoSeconds uint64
+
+	// MemoryUsageBytes is the memory in use, including page cache.
+	MemoryUsageBytes uint64
+
+	// MemoryWorkingSetBytes is MemoryUsageBytes less inactive file cache.
+	MemoryWorkingSetBytes uint64
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// sandboxID is the runtime name of the pod sandbox. Container IDs
+	// always end in their restart count, so they cannot clash with it.
+	sandboxID = "sandbox"
+
+	// hostsFileName is the pod's managed hosts file in the volume
+	// directory.
+	hostsFileName = "..hosts"
+)
+
+// podHostname returns the hostname of a pod, and its FQDN if it has a
+// subdomain, as the kubelet sets them.
+func podHostname(pod *corev1.Pod, domain string) (hostname, fqdn string) {
+	hostname = pod.Name
+	if pod.Spec.Hostname != "" {
+		hostname = pod.Spec.Hostname
+	}
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-.")
+	}
+	if pod.Spec.Subdomain != "" {
+		fqdn = fmt.Sprintf("%s.%s.%s.svc.%s", hostname, pod.Spec.Subdomain, pod.Namespace, domain)
+	}
+	return hostname, fqdn
+}
+
+// hostsFile returns the /etc/hosts of a pod's containers: the kubelet's
+// managed hosts file with the pod's own address and its host aliases.
+func hostsFile(pod *corev1.Pod, domain string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Kubernetes-managed hosts file.\n")
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("fe00::0\tip6-localnet\n")
+	b.WriteString("fe00::0\tip6-mcastprefix\n")
+	b.WriteString("fe00::1\tip6-allnodes\n")
+	b.WriteString("fe00::2\tip6-allrouters\n")
+
+	hostname, fqdn := podHostname(pod, domain)
+	for _, ip := range podIPs(pod) {
+		if fqdn != "" {
+			fmt.Fprintf(&b, "%s\t%s\t%s\n", ip, fqdn, hostname)
+		} else {
+			fmt.Fprintf(&b, "%s\t%s\n", ip, hostname)
+		}
+	}
+
+	if len(pod.Spec.HostAliases) > 0 {
+		b.WriteString("\n# Entries added by HostAliases.\n")
+		for _, alias := range pod.Spec.HostAliases {
+			fmt.Fprintf(&b, "%s\t%s\n", alias.IP, strings.Join(alias.Hostnames, "\t"))
+		}
+	}
+	return b.Bytes()
+}
+
+// podIPs returns the addresses of a pod, as the controller last reported
+// them.
+func podIPs(pod *corev1.Pod) []string {
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// startSandbox writes the pod's hosts file and resolv.conf and starts the
+// sandbox whose network namespace and hostname its containers share,
+// retrying with the restart back-off until it starts or the pod stops. Pods
+// on the host network keep the instance's hostname and hosts file. It
+// reports whether the pod may go on.
+func (a *Agent) startSandbox(ctx context.Context) bool {
+	a.mu.RLock()
+	pod, network, domain := a.pod, a.podNetwork, a.clusterDomain()
+	a.mu.RUnlock()
+
+	cfg := &SandboxConfig{ID: sandboxID}
+	var hostsPath, resolvPath string
+	if !pod.Spec.HostNetwork {
+		hostname, fqdn := podHostname(pod, domain)
+		cfg.Hostname = hostname
+		if fqdn != "" && pod.Spec.SetHostnameAsFQDN != nil && *pod.Spec.SetHostnameAsFQDN {
+			cfg.Hostname = fqdn
+		}
+
+		hostsPath = filepath.Join(a.volumeDir, hostsFileName)
+		if err := a.writePodFile(hostsPath, hostsFile(pod, domain)); err != nil {
+			a.logger.Error().Err(err).Msg("Failed to write the pod's hosts file")
+			a.setCreating(fmt.Sprintf("failed to write hosts file: %v", err))
+			return false
+		}
+	}
+
+	resolv, err := resolvConf(pod, network, domain)
+	if err == nil && resolv != nil {
+		resolvPath = filepath.Join(a.volumeDir, resolvConfName)
+		err = a.writePodFile(resolvPath, resolv)
+	}
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Failed to write the pod's resolv.conf")
+		a.setCreating(fmt.Sprintf("failed to write resolv.conf: %v", err))
+		return false
+	}
+
+	if !a.retrySetup(ctx, "create pod sandbox", func() error {
+		return a.runSandbox(ctx, cfg)
+	}) {
+		return false
+	}
+
+	a.mu.Lock()
+	a.hostsFile, a.resolvConf = hostsPath, resolvPath
+	a.mu.Unlock()
+	a.logger.Info().Str("hostname", cfg.Hostname).Msg("Pod sandbox started")
+	return true
+}
+
+// writePodFile writes one of the pod's managed files to the volume
+// directory.
+func (a *Agent) writePodFile(path string, data []byte) error {
+	if err := os.MkdirAll(a.volumeDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// runSandbox starts the pod sandbox, unless the pod is stopping.
+func (a *Agent) runSandbox(ctx context.Context, cfg *SandboxConfig) error {
+	a.mountMu.Lock()
+	defer a.mountMu.Unlock()
+
+	if a.stopped() {
+		return fmt.Errorf("pod is stopping")
+	}
+	if err := a.runtime.StartSandbox(ctx, cfg); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.sandbox = cfg.ID
+	a.mu.Unlock()
+	return nil
+}
+
+// removeSandbox removes the pod sandbox once its containers have stopped.
+func (a *Agent) removeSandbox(ctx context.Context) {
+	a.mountMu.Lock()
+	defer a.mountMu.Unlock()
+
+	a.mu.Lock()
+	id := a.sandbox
+	a.sandbox = ""
+	a.mu.Unlock()
+	if id == "" {
+		return
+	}
+
+	if err := a.runtime.RemoveSandbox(ctx, id); err != nil {
+		a.logger.Error().Err(err).Msg("Failed to remove pod sandbox")
+	}
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		pod      corev1.Pod
+		wantHost string
+		wantFQDN string
+	}{
+		{
+			name:     "pod name",
+			pod:      corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "ml"}},
+			wantHost: "train",
+		},
+		{
+			name: "hostname and subdomain",
+			pod: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "train-0", Namespace: "ml"},
+				Spec:       corev1.PodSpec{Hostname: "worker-0", Subdomain: "workers"},
+			},
+			wantHost: "worker-0",
+			wantFQDN: "worker-0.workers.ml.svc.example.org",
+		},
+		{
+			name:     "long pod name",
+			pod:      corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("a", 62) + "-b", Namespace: "ml"}},
+			wantHost: strings.Repeat("a", 62),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, fqdn := podHostname(&tt.pod, "example.org")
+			if hostname != tt.wantHost || fqdn != tt.wantFQDN {
+				t.Errorf("podHostname() = %q, %q, want %q, %q", hostname, fqdn, tt.wantHost, tt.wantFQDN)
+			}
+		})
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "train-0", Namespace: "ml"},
+		Spec: corev1.PodSpec{
+			Hostname:  "worker-0",
+			Subdomain: "workers",
+			HostAliases: []corev1.HostAlias{
+				{IP: "10.0.0.10", Hostnames: []string{"db", "db.internal"}},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.1.5"},
+	}
+
+	hosts := string(hostsFile(pod, defaultClusterDomain))
+	for _, want := range []string{
+		"127.0.0.1\tlocalhost\n",
+		"10.0.1.5\tworker-0.workers.ml.svc.cluster.local\tworker-0\n",
+		"# Entries added by HostAliases.\n10.0.0.10\tdb\tdb.internal\n",
+	} {
+		if !strings.Contains(hosts, want) {
+			t.Errorf("expected hosts file to contain %q, got:\n%s", want, hosts)
+		}
+	}
+}
+
+func TestAgentRunsPodSandbox(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	fqdn := true
+	pod := testPod()
+	pod.Spec.Hostname = "worker-0"
+	pod.Spec.Subdomain = "workers"
+	pod.Spec.SetHostnameAsFQDN = &fqdn
+	pod.Spec.HostAliases = []corev1.HostAlias{{IP: "10.0.0.10", Hostnames: []string{"db"}}}
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "containers to start", func() bool { return rt.config("sidecar-0") != nil })
+
+	rt.mu.Lock()
+	sandbox := rt.sandbox
+	rt.mu.Unlock()
+	if sandbox == nil || sandbox.Hostname != "worker-0.workers.default.svc.cluster.local" {
+		t.Fatalf("expected a sandbox with the pod's FQDN as hostname, got %+v", sandbox)
+	}
+
+	// Every container joins the sandbox and shares its hosts file
+	hostsPath := filepath.Join(a.volumeDir, hostsFileName)
+	for _, id := range []string{"trainer-0", "sidecar-0"} {
+		if cfg := rt.config(id); cfg.Sandbox != sandbox.ID || cfg.HostsFile != hostsPath {
+			t.Errorf("expected %s in sandbox %s with hosts file %s, got %q, %q", id, sandbox.ID, hostsPath, cfg.Sandbox, cfg.HostsFile)
+		}
+	}
+	hosts, err := os.ReadFile(hostsPath)
+	if err != nil || !strings.Contains(string(hosts), "10.0.0.10\tdb\n") {
+		t.Errorf("expected the host aliases in the hosts file, got %q, %v", hosts, err)
+	}
+
+	a.Stop(context.Background(), 0)
+	rt.mu.Lock()
+	removed := rt.removed
+	rt.mu.Unlock()
+	if !slices.Equal(removed, []string{sandbox.ID}) {
+		t.Errorf("expected the sandbox to be removed, got %v", removed)
+	}
+}
+
+func TestAgentRetriesPodSandbox(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.sandboxErr = errors.New("pause image not found")
+	a := startAgent(t, rt)
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "sandbox failure to be reported", func() bool {
+		waiting := containerStatus(a, "trainer").State.Waiting
+		return waiting != nil && strings.Contains(waiting.Message, "pause image not found")
+	})
+	if rt.config("trainer-0") != nil {
+		t.Fatal("expected the container to wait for the sandbox")
+	}
+
+	rt.mu.Lock()
+	rt.sandboxErr = nil
+	rt.mu.Unlock()
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// seccompProfileDir holds the profiles of containers with a Localhost
+// seccomp profile, as /var/lib/kubelet/seccomp does for the kubelet.
+var seccompProfileDir = "/var/lib/orca/seccomp"
+
+// containerSecurity returns the security settings of a container: its
+// security context over the pod's, as the kubelet merges them.
+func containerSecurity(pod *corev1.Pod, spec corev1.Container) (ContainerSecurity, error) {
+	podContext := pod.Spec.SecurityContext
+	if podContext == nil {
+		podContext = &corev1.PodSecurityContext{}
+	}
+	sc := spec.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+
+	security := ContainerSecurity{
+		User:               podContext.RunAsUser,
+		Group:              podContext.RunAsGroup,
+		SupplementalGroups: podContext.SupplementalGroups,
+	}
+	if sc.RunAsUser != nil {
+		security.User = sc.RunAsUser
+	}
+	if sc.RunAsGroup != nil {
+		security.Group = sc.RunAsGroup
+	}
+	if security.Group != nil && security.User == nil {
+		return ContainerSecurity{}, fmt.Errorf("runAsGroup %d requires runAsUser", *security.Group)
+	}
+	// Processes join the fsGroup, which owns the pod's volumes
+	if podContext.FSGroup != nil && !slices.Contains(security.SupplementalGroups, *podContext.FSGroup) {
+		security.SupplementalGroups = append(slices.Clone(security.SupplementalGroups), *podContext.FSGroup)
+	}
+	runAsNonRoot := podContext.RunAsNonRoot
+	if sc.RunAsNonRoot != nil {
+		runAsNonRoot = sc.RunAsNonRoot
+	}
+	security.RunAsNonRoot = runAsNonRoot != nil && *runAsNonRoot
+	if security.RunAsNonRoot && security.User != nil && *security.User == 0 {
+		return ContainerSecurity{}, fmt.Errorf("container's runAsUser breaks non-root policy")
+	}
+
+	security.Privileged = sc.Privileged != nil && *sc.Privileged
+	security.ReadOnlyRootFilesystem = sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem
+	if sc.Capabilities != nil {
+		for _, c := range sc.Capabilities.Add {
+			security.CapAdd = append(security.CapAdd, string(c))
+		}
+		for _, c := range sc.Capabilities.Drop {
+			security.CapDrop = append(security.CapDrop, string(c))
+		}
+	}
+	// Privileged containers and those with CAP_SYS_ADMIN may always
+	// escalate, as in Kubernetes
+	escalates := security.Privileged || slices.Contains(security.CapAdd, "SYS_ADMIN") || slices.Contains(security.CapAdd, "CAP_SYS_ADMIN")
+	security.NoNewPrivileges = sc.AllowPrivilegeEscalation != nil && !*sc.AllowPrivilegeEscalation && !escalates
+
+	seccomp := podContext.SeccompProfile
+	if sc.SeccompProfile != nil {
+		seccomp = sc.SeccompProfile
+	}
+	if seccomp != nil {
+		switch seccomp.Type {
+		case corev1.SeccompProfileTypeUnconfined:
+			security.Seccomp = seccompUnconfined
+		case corev1.SeccompProfileTypeLocalhost:
+			if seccomp.LocalhostProfile == nil || !filepath.IsLocal(*seccomp.LocalhostProfile) {
+				return ContainerSecurity{}, fmt.Errorf("localhost seccomp profile must be a relative path below %s", seccompProfileDir)
+			}
+			security.Seccomp = filepath.Join(seccompProfileDir, *seccomp.LocalhostProfile)
+		}
+	}
+	return security, nil
+}
+
+// podFSGroup returns the group that owns a pod's volumes, or nil.
+func podFSGroup(pod *corev1.Pod) *int64 {
+	if pod == nil || pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	return pod.Spec.SecurityContext.FSGroup
+}
+
+// podFSGroupOnRootMismatch reports whether a pod only changes the
+// ownership of volumes whose root does not match its fsGroup.
+func podFSGroupOnRootMismatch(pod *corev1.Pod) bool {
+	policy := pod.Spec.SecurityContext.FSGroupChangePolicy
+	return policy != nil && *policy == corev1.FSGroupChangeOnRootMismatch
+}
+
+// setVolumeGroup gives a volume to the pod's fsGroup, as the kubelet does:
+// every file gets the group, with group read permission and write
+// permission unless the volume is read-only, and directories get the
+// setgid bit so that new files inherit the group. Volumes whose root
+// already has the group are left alone if onRootMismatch is set.
+func setVolumeGroup(root string, gid int64, readOnly, onRootMismatch bool) error {
+	if onRootMismatch {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if group, ok := fileGroup(info); ok && group == gid && info.Mode()&os.ModeSetgid != 0 {
+			return nil
+		}
+	}
+
+	mask := os.FileMode(0o660)
+	if readOnly {
+		mask = 0o440
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, -1, int(gid)); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()&(fs.ModePerm|os.ModeSticky) | mask
+		if d.IsDir() {
+			mode |= os.ModeSetgid | 0o110
+		}
+		return os.Chmod(path, mode)
+	})
+}
+
+// checkNonRoot fails if an image would run a container that must not run as
+// root as root. user is the image's user, as "user[:group]".
+func checkNonRoot(security ContainerSecurity, user string) error {
+	if !security.RunAsNonRoot || security.User != nil {
+		return nil
+	}
+	name, _, _ := strings.Cut(user, ":")
+	switch {
+	case name == "" || name == "0" || name == "root":
+		return fmt.Errorf("container has runAsNonRoot and image will run as root")
+	case strings.Trim(name, "0123456789") != "":
+		return fmt.Errorf("container has runAsNonRoot and image has non-numeric user (%s), cannot verify user is non-root", name)
+	}
+	return nil
+}
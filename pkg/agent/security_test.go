@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestContainerSecurity(t *testing.T) {
+	user, group, root, fsGroup := int64(1000), int64(3000), int64(0), int64(2000)
+	yes, no := true, false
+	profile := "profiles/train.json"
+	escape := "../train.json"
+
+	tests := []struct {
+		name      string
+		pod       *corev1.PodSecurityContext
+		container *corev1.SecurityContext
+		want      ContainerSecurity
+		wantErr   string
+	}{
+		{
+			name: "no security context",
+		},
+		{
+			name:      "container overrides pod",
+			pod:       &corev1.PodSecurityContext{RunAsUser: &root, RunAsGroup: &group, RunAsNonRoot: &yes},
+			container: &corev1.SecurityContext{RunAsUser: &user, RunAsNonRoot: &no},
+			want:      ContainerSecurity{User: &user, Group: &group},
+		},
+		{
+			name: "fsGroup joins supplemental groups",
+			pod:  &corev1.PodSecurityContext{RunAsUser: &user, SupplementalGroups: []int64{group}, FSGroup: &fsGroup},
+			want: ContainerSecurity{User: &user, SupplementalGroups: []int64{group, fsGroup}},
+		},
+		{
+			name: "restricted container",
+			container: &corev1.SecurityContext{
+				RunAsNonRoot:             &yes,
+				AllowPrivilegeEscalation: &no,
+				ReadOnlyRootFilesystem:   &yes,
+				Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: []corev1.Capability{"NET_BIND_SERVICE"}},
+				SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+			},
+			want: ContainerSecurity{
+				RunAsNonRoot:           true,
+				ReadOnlyRootFilesystem: true,
+				NoNewPrivileges:        true,
+				CapAdd:                 []string{"NET_BIND_SERVICE"},
+				CapDrop:                []string{"ALL"},
+			},
+		},
+		{
+			name:      "privileged containers may escalate",
+			container: &corev1.SecurityContext{Privileged: &yes, AllowPrivilegeEscalation: &no},
+			want:      ContainerSecurity{Privileged: true},
+		},
+		{
+			name:      "unconfined seccomp",
+			pod:       &corev1.PodSecurityContext{SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}},
+			container: &corev1.SecurityContext{},
+			want:      ContainerSecurity{Seccomp: seccompUnconfined},
+		},
+		{
+			name:      "localhost seccomp",
+			container: &corev1.SecurityContext{SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}},
+			want:      ContainerSecurity{Seccomp: filepath.Join(seccompProfileDir, profile)},
+		},
+		{
+			name:      "localhost seccomp outside the profile directory",
+			container: &corev1.SecurityContext{SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &escape}},
+			wantErr:   "relative path",
+		},
+		{
+			name:    "root user with runAsNonRoot",
+			pod:     &corev1.PodSecurityContext{RunAsUser: &root, RunAsNonRoot: &yes},
+			wantErr: "non-root",
+		},
+		{
+			name:    "group without user",
+			pod:     &corev1.PodSecurityContext{RunAsGroup: &group},
+			wantErr: "requires runAsUser",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod()
+			pod.Spec.SecurityContext = tt.pod
+			spec := pod.Spec.Containers[0]
+			spec.SecurityContext = tt.container
+
+			got, err := containerSecurity(pod, spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(securityArgs(got), securityArgs(tt.want)) || got.RunAsNonRoot != tt.want.RunAsNonRoot {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSecurityArgs(t *testing.T) {
+	user, group := int64(1000), int64(3000)
+
+	args := securityArgs(ContainerSecurity{
+		User:                   &user,
+		Group:                  &group,
+		SupplementalGroups:     []int64{2000},
+		ReadOnlyRootFilesystem: true,
+		NoNewPrivileges:        true,
+		CapAdd:                 []string{"NET_BIND_SERVICE"},
+		CapDrop:                []string{"ALL"},
+		Seccomp:                "/var/lib/orca/seccomp/train.json",
+	})
+	want := []string{
+		"--user", "1000:3000", "--group-add", "2000", "--read-only",
+		"--cap-add", "NET_BIND_SERVICE", "--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges", "--security-opt", "seccomp=/var/lib/orca/seccomp/train.json",
+	}
+	if !slices.Equal(args, want) {
+		t.Errorf("expected %v, got %v", want, args)
+	}
+
+	if args := securityArgs(ContainerSecurity{}); len(args) != 0 {
+		t.Errorf("expected no flags for an empty security context, got %v", args)
+	}
+}
+
+func TestCheckNonRoot(t *testing.T) {
+	user := int64(1000)
+	tests := []struct {
+		name      string
+		security  ContainerSecurity
+		imageUser string
+		wantErr   bool
+	}{
+		{name: "not required", imageUser: "", wantErr: false},
+		{name: "user set", security: ContainerSecurity{RunAsNonRoot: true, User: &user}, wantErr: false},
+		{name: "numeric image user", security: ContainerSecurity{RunAsNonRoot: true}, imageUser: "1000:1000", wantErr: false},
+		{name: "image runs as root", security: ContainerSecurity{RunAsNonRoot: true}, imageUser: "", wantErr: true},
+		{name: "image runs as uid 0", security: ContainerSecurity{RunAsNonRoot: true}, imageUser: "0", wantErr: true},
+		{name: "named image user", security: ContainerSecurity{RunAsNonRoot: true}, imageUser: "trainer", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkNonRoot(tt.security, tt.imageUser); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSetVolumeGroup(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "data"), 0o700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file := filepath.Join(root, "data", "weights.bin")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Tests cannot chown to other groups, so use the test's own
+	gid := int64(os.Getgid())
+	if err := setVolumeGroup(root, gid, false, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "data"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0o770 {
+		t.Errorf("expected a setgid directory with mode 0770, got %v", info.Mode())
+	}
+	info, err = os.Stat(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Errorf("expected the file to be group writable, got %v", info.Mode())
+	}
+
+	// Read-only volumes only become group readable
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := setVolumeGroup(root, gid, true, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("expected the file to be group readable, got %v, %v", info.Mode(), err)
+	}
+}
+
+func TestAgentAppliesSecurityContext(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	user, fsGroup := int64(1000), int64(2000)
+	no := false
+	pod := testPod()
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &user, FSGroup: &fsGroup}
+	pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{AllowPrivilegeEscalation: &no}
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+	security := rt.config("trainer-0").Security
+	if security.User == nil || *security.User != user || !slices.Equal(security.SupplementalGroups, []int64{fsGroup}) || !security.NoNewPrivileges {
+		t.Errorf("expected the pod's security context, got %+v", security)
+	}
+}
+
+func TestAgentRejectsInvalidSecurityContext(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	root, yes := int64(0), true
+	pod := testPod()
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &root, RunAsNonRoot: &yes}
+	if err := a.Start(PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "start error to be reported", func() bool {
+		terminated := containerStatus(a, "trainer").State.Terminated
+		return terminated != nil && terminated.Reason == "StartError" && strings.Contains(terminated.Message, "non-root")
+	})
+	if rt.config("trainer-0") != nil {
+		t.Error("expected the container not to start")
+	}
+}
@@ -0,0 +1,463 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Server serves the agent API to the ORCA controller.
+type Server struct {
+	agent      *Agent
+	token      string
+	httpServer *http.Server
+	logger     zerolog.Logger
+}
+
+// NewServer creates a new agent API server listening on addr.
+// Every request except the health check must carry token as a bearer token.
+func NewServer(a *Agent, addr, token string, logger zerolog.Logger) *Server {
+	s := &Server{
+		agent:  a,
+		token:  token,
+		logger: logger,
+	}
+
+	s.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// Handler returns the HTTP handler serving the agent API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+pathHealth, s.handleHealth)
+	mux.Handle("GET "+pathPod, s.authorize(s.handleGetPod))
+	mux.Handle("PUT "+pathPod, s.authorize(s.handlePutPod))
+	mux.Handle("DELETE "+pathPod, s.authorize(s.handleDeletePod))
+	mux.Handle("PUT "+pathVolumes, s.authorize(s.handlePutVolumes))
+	mux.Handle("GET "+pathStats, s.authorize(s.handleStats))
+	mux.Handle("GET "+pathContainers+"{name}/logs", s.authorize(s.handleLogs))
+	mux.Handle("POST "+pathContainers+"{name}/exec", s.authorize(s.handleExec))
+	mux.Handle("POST "+pathContainers+"{name}/attach", s.authorize(s.handleAttach))
+	mux.Handle("POST "+pathPortForward+"{port}", s.authorize(s.handlePortForward))
+
+	return mux
+}
+
+// Start serves the API over TLS until ctx is cancelled.
+func (s *Server) Start(ctx context.Context, certFile, keyFile string) error {
+	s.logger.Info().Str("addr", s.httpServer.Addr).Msg("Starting agent API server")
+
+	errChan := make(chan error, 1)
+	go func() {
+		if err := s.httpServer.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return s.httpServer.Shutdown(shutdownCtx)
+	case err := <-errChan:
+		return fmt.Errorf("agent API server error: %w", err)
+	}
+}
+
+// authorize rejects requests that do not carry the agent token.
+func (s *Server) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleHealth reports that the agent is up.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleGetPod returns the current pod report.
+func (s *Server) handleGetPod(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.agent.Status())
+}
+
+// handlePutPod submits the pod to run.
+func (s *Server) handlePutPod(w http.ResponseWriter, r *http.Request) {
+	var submission PodSubmission
+	if err := json.NewDecoder(r.Body).Decode(&submission); err != nil || submission.Pod == nil {
+		http.Error(w, fmt.Sprintf("invalid pod submission: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.agent.Start(submission); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, s.agent.Status())
+}
+
+// handlePutVolumes replaces the files of controller provided volumes.
+func (s *Server) handlePutVolumes(w http.ResponseWriter, r *http.Request) {
+	var volumes map[string][]VolumeFile
+	if err := json.NewDecoder(r.Body).Decode(&volumes); err != nil {
+		http.Error(w, fmt.Sprintf("invalid volumes: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.agent.UpdateVolumes(volumes); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeletePod stops the pod in the background, within gracePeriodSeconds
+// or else the pod's own grace period. The pod report shows when every
+// container has stopped.
+func (s *Server) handleDeletePod(w http.ResponseWriter, r *http.Request) {
+	gracePeriod := s.agent.terminationGracePeriod()
+	if v := r.URL.Query().Get("gracePeriodSeconds"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds < 0 {
+			http.Error(w, fmt.Sprintf("invalid gracePeriodSeconds %q", v), http.StatusBadRequest)
+			return
+		}
+		gracePeriod = time.Duration(seconds) * time.Second
+	}
+
+	// Stopping outlives the request
+	go s.agent.Stop(context.Background(), gracePeriod)
+
+	writeJSON(w, http.StatusAccepted, s.agent.Status())
+}
+
+// handleStats returns the latest usage sample. With watch=true it streams
+// every new sample as a line of JSON until the client goes away.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") != "true" {
+		sample, _ := s.agent.Stats()
+		if sample == nil {
+			http.Error(w, "no stats sample yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, sample)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(&flushWriter{w: w})
+
+	var sent *StatsSample
+	for {
+		sample, updated := s.agent.Stats()
+		if sample != nil && sample != sent {
+			if err := enc.Encode(sample); err != nil {
+				return
+			}
+			sent = sample
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updated:
+		}
+	}
+}
+
+// handleLogs streams the logs of a container.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseLogOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fw := &flushWriter{w: w}
+	err = s.agent.Logs(r.Context(), r.PathValue("name"), opts, fw)
+	if err == nil {
+		return
+	}
+
+	// Errors after the stream started can only be logged.
+	if fw.wrote {
+		s.logger.Warn().Err(err).Str("container", r.PathValue("name")).Msg("Log stream failed")
+		return
+	}
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// handleExec runs a command in a container over an upgraded connection.
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	command := r.URL.Query()["command"]
+	if len(command) == 0 {
+		http.Error(w, "command is required", http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("name")
+	s.serveStream(w, r, func(ctx context.Context, sio StreamIO) (int, error) {
+		return s.agent.Exec(ctx, name, command, sio)
+	})
+}
+
+// handleAttach attaches to a container's main process over an upgraded
+// connection.
+func (s *Server) handleAttach(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.serveStream(w, r, func(ctx context.Context, sio StreamIO) (int, error) {
+		return s.agent.Attach(ctx, name, sio)
+	})
+}
+
+// serveStream upgrades the connection to the framed stream protocol and runs
+// an interactive session on it. The session ends with an exit frame.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, session func(context.Context, StreamIO) (int, error)) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), streamProtocol) {
+		http.Error(w, "expected upgrade to "+streamProtocol, http.StatusBadRequest)
+		return
+	}
+
+	// Report missing or stopped containers before upgrading.
+	if _, _, err := s.agent.running(r.PathValue("name")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	conn, err := upgrade(w, streamProtocol)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to upgrade session connection")
+		return
+	}
+	defer conn.Close()
+
+	// The session ends when the client goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fc := newFrameConn(conn, conn)
+	tty := r.URL.Query().Get("tty") == "true"
+	resize := make(chan TermSize, 1)
+
+	sio := StreamIO{
+		Stdout: &frameWriter{conn: fc, kind: frameStdout},
+		TTY:    tty,
+		Resize: resize,
+	}
+	if !tty {
+		sio.Stderr = &frameWriter{conn: fc, kind: frameStderr}
+	}
+
+	var stdin *io.PipeWriter
+	if r.URL.Query().Get("stdin") == "true" {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		sio.Stdin, stdin = pr, pw
+	}
+
+	go func() {
+		defer cancel()
+		for {
+			kind, payload, err := fc.readFrame()
+			if err != nil {
+				if stdin != nil {
+					_ = stdin.Close()
+				}
+				return
+			}
+
+			switch kind {
+			case frameStdin:
+				if stdin == nil {
+					continue
+				}
+				if len(payload) == 0 {
+					_ = stdin.Close()
+					continue
+				}
+				_, _ = stdin.Write(payload)
+			case frameResize:
+				var size TermSize
+				if json.Unmarshal(payload, &size) != nil {
+					continue
+				}
+				select {
+				case resize <- size:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	code, err := session(ctx, sio)
+	report := exitReport{ExitCode: code}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if err := fc.writeJSON(frameExit, report); err != nil {
+		s.logger.Debug().Err(err).Msg("Failed to send session exit")
+	}
+}
+
+// handlePortForward tunnels the connection to a port on the instance.
+func (s *Server) handlePortForward(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, fmt.Sprintf("invalid port %q", r.PathValue("port")), http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), tunnelProtocol) {
+		http.Error(w, "expected upgrade to "+tunnelProtocol, http.StatusBadRequest)
+		return
+	}
+
+	// Containers share the instance network, so their ports are local.
+	target, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), portForwardDialTimeout)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to connect to port %d: %v", port, err), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	conn, err := upgrade(w, tunnelProtocol)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to upgrade port-forward connection")
+		return
+	}
+	defer conn.Close()
+
+	if err := tunnel(conn, target); err != nil {
+		s.logger.Debug().Err(err).Int("port", port).Msg("Port-forward tunnel closed with error")
+	}
+}
+
+// upgrade hijacks the connection and switches it to protocol.
+func upgrade(w http.ResponseWriter, protocol string) (*hijackedConn, error) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to upgrade connection: %v", err), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &hijackedConn{Conn: conn, r: brw.Reader}, nil
+}
+
+// hijackedConn is a hijacked connection that first drains data the HTTP
+// server already buffered.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the connection if the underlying connection
+// supports it.
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// parseLogOptions decodes log options from query parameters.
+func parseLogOptions(q url.Values) (LogOptions, error) {
+	opts := LogOptions{
+		Follow:     q.Get("follow") == "true",
+		Previous:   q.Get("previous") == "true",
+		Timestamps: q.Get("timestamps") == "true",
+	}
+
+	var err error
+	if v := q.Get("tailLines"); v != "" {
+		if opts.Tail, err = strconv.Atoi(v); err != nil || opts.Tail < 0 {
+			return opts, fmt.Errorf("invalid tailLines %q", v)
+		}
+	}
+	if v := q.Get("limitBytes"); v != "" {
+		if opts.LimitBytes, err = strconv.Atoi(v); err != nil || opts.LimitBytes < 0 {
+			return opts, fmt.Errorf("invalid limitBytes %q", v)
+		}
+	}
+	if v := q.Get("sinceTime"); v != "" {
+		if opts.SinceTime, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return opts, fmt.Errorf("invalid sinceTime %q", v)
+		}
+	}
+
+	return opts, nil
+}
+
+// errorStatus maps agent errors to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrContainerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrContainerNotStarted):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrPodAlreadyStarted):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// flushWriter flushes every write so followed streams are delivered as they
+// are produced.
+type flushWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.wrote = true
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,451 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// startServer serves the agent API over TLS with credentials issued for
+// podUID and returns a client connected to it.
+func startServer(t *testing.T, a *Agent, podUID string) (*Client, *Authority) {
+	t.Helper()
+
+	authority, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("failed to create authority: %v", err)
+	}
+
+	creds, err := authority.Issue(types.UID(podUID))
+	if err != nil {
+		t.Fatalf("failed to issue credentials: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(creds.CertPEM, creds.KeyPEM)
+	if err != nil {
+		t.Fatalf("failed to load issued key pair: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(NewServer(a, "", creds.Token, zerolog.Nop()).Handler())
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	return NewClient(host, portNum, authority.Token(types.UID(podUID)), authority.ClientTLSConfig(types.UID(podUID))), authority
+}
+
+func TestServerStartAndStatus(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	if err := client.Health(ctx); err != nil {
+		t.Fatalf("health check failed: %v", err)
+	}
+
+	report, err := client.Status(ctx)
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if report.PodUID != "" {
+		t.Errorf("expected empty report before a pod is submitted, got %s", report.PodUID)
+	}
+
+	if err := client.StartPod(ctx, PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+
+	waitFor(t, "containers to start", func() bool {
+		report, err := client.Status(ctx)
+		if err != nil || len(report.ContainerStatuses) != 2 {
+			return false
+		}
+		for _, s := range report.ContainerStatuses {
+			if s.State.Running == nil {
+				return false
+			}
+		}
+		return true
+	})
+
+	other := testPod()
+	other.UID = "pod-uid-2"
+	err = client.StartPod(ctx, PodSubmission{Pod: other})
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("expected conflict for a second pod, got %v", err)
+	}
+}
+
+func TestServerStopPod(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	if err := client.StartPod(ctx, PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+	waitFor(t, "containers to start", func() bool { return a.Status().Phase == corev1.PodRunning })
+
+	if err := client.StopPod(ctx, time.Second); err != nil {
+		t.Fatalf("stop pod failed: %v", err)
+	}
+	waitFor(t, "pod to stop", func() bool {
+		report, err := client.Status(ctx)
+		return err == nil && report.Phase == corev1.PodFailed
+	})
+}
+
+func TestServerUpdateVolumes(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	volumes := map[string][]VolumeFile{"config": {{Path: "app.yaml", Data: []byte("v1"), Mode: 0o644}}}
+	if err := client.StartPod(ctx, PodSubmission{Pod: testPod(), Volumes: volumes}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+	if got := readVolumeFile(t, filepath.Join(a.volumeDir, "config", "app.yaml")); got != "v1" {
+		t.Errorf("expected submitted contents, got %q", got)
+	}
+
+	volumes["config"][0].Data = []byte("v2")
+	if err := client.UpdateVolumes(ctx, volumes); err != nil {
+		t.Fatalf("update volumes failed: %v", err)
+	}
+	if got := readVolumeFile(t, filepath.Join(a.volumeDir, "config", "app.yaml")); got != "v2" {
+		t.Errorf("expected updated contents, got %q", got)
+	}
+
+	err := client.UpdateVolumes(ctx, map[string][]VolumeFile{"other": nil})
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("expected conflict for an unknown volume, got %v", err)
+	}
+}
+
+func TestServerRejectsWrongToken(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+	client, authority := startServer(t, a, "pod-uid-1")
+
+	// A token for another pod must not be accepted.
+	client.token = authority.Token("pod-uid-2")
+
+	_, err := client.Status(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+
+	// The health check does not require a token.
+	if err := client.Health(context.Background()); err != nil {
+		t.Errorf("expected health check to succeed, got %v", err)
+	}
+}
+
+func TestClientRejectsOtherPodsAgent(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+	client, authority := startServer(t, a, "pod-uid-1")
+
+	// The agent's certificate is valid, but was issued for another pod
+	client.httpClient.Transport.(*http.Transport).TLSClientConfig = authority.ClientTLSConfig("pod-uid-2")
+
+	err := client.Health(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "issued for pod") {
+		t.Errorf("expected the agent to be rejected, got %v", err)
+	}
+}
+
+func TestAuthorityTokensAreStable(t *testing.T) {
+	authority, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("failed to create authority: %v", err)
+	}
+
+	if authority.Token("a") != authority.Token("a") {
+		t.Error("expected tokens for the same pod to match")
+	}
+	if authority.Token("a") == authority.Token("b") {
+		t.Error("expected tokens for different pods to differ")
+	}
+
+	other, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("failed to create authority: %v", err)
+	}
+	if authority.Token("a") == other.Token("a") {
+		t.Error("expected tokens from different authorities to differ")
+	}
+}
+
+func TestServerStreamsLogs(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.output["trainer-0"] = "epoch 1\nepoch 2\nepoch 3\n"
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	if err := client.StartPod(ctx, PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+	waitFor(t, "trainer to start", func() bool { return rt.config("trainer-0") != nil })
+	rt.exit("trainer-0", 0)
+	waitFor(t, "trainer to exit", func() bool {
+		return containerStatus(a, "trainer").State.Terminated != nil
+	})
+
+	logs, err := client.Logs(ctx, "trainer", LogOptions{Tail: 2, Follow: true})
+	if err != nil {
+		t.Fatalf("logs failed: %v", err)
+	}
+	data, err := io.ReadAll(logs)
+	_ = logs.Close()
+	if err != nil {
+		t.Fatalf("failed to read logs: %v", err)
+	}
+	if string(data) != "epoch 2\nepoch 3\n" {
+		t.Errorf("unexpected logs %q", data)
+	}
+
+	_, err = client.Logs(ctx, "missing", LogOptions{})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestServerExec(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.execCode = 3
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	if err := client.StartPod(ctx, PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+	waitFor(t, "trainer to start", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil
+	})
+
+	var stdout, stderr safeBuffer
+	code, err := client.Exec(ctx, "trainer", []string{"cat", "-"}, StreamIO{
+		Stdin:  strings.NewReader("hello\n"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	if stdout.String() != "cat -\nhello\n" {
+		t.Errorf("unexpected stdout %q", stdout.String())
+	}
+	if stderr.String() != "to stderr\n" {
+		t.Errorf("unexpected stderr %q", stderr.String())
+	}
+
+	_, err = client.Exec(ctx, "missing", []string{"true"}, StreamIO{})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestServerAttach(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+	ctx := context.Background()
+
+	pod := testPod()
+	pod.Spec.Containers[0].Stdin = true
+	pod.Spec.Containers[0].TTY = true
+	if err := client.StartPod(ctx, PodSubmission{Pod: pod}); err != nil {
+		t.Fatalf("start pod failed: %v", err)
+	}
+	waitFor(t, "trainer to start", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil
+	})
+
+	stdinR, stdinW := io.Pipe()
+	defer stdinW.Close()
+	resize := make(chan TermSize, 1)
+	resize <- TermSize{Width: 120, Height: 40}
+
+	var stdout safeBuffer
+	result := make(chan int, 1)
+	go func() {
+		code, err := client.Attach(ctx, "trainer", StreamIO{
+			Stdin:  stdinR,
+			Stdout: &stdout,
+			TTY:    true,
+			Resize: resize,
+		})
+		if err != nil {
+			t.Errorf("attach failed: %v", err)
+		}
+		result <- code
+	}()
+
+	// The fake container echoes its stdin.
+	if _, err := stdinW.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("failed to write stdin: %v", err)
+	}
+	waitFor(t, "echoed input", func() bool { return stdout.String() == "ping\n" })
+
+	proc := rt.process("trainer-0")
+	waitFor(t, "resize", func() bool {
+		proc.mu.Lock()
+		defer proc.mu.Unlock()
+		return len(proc.resizes) == 1 && proc.resizes[0] == TermSize{Width: 120, Height: 40}
+	})
+
+	rt.exit("trainer-0", 7)
+	select {
+	case code := <-result:
+		if code != 7 {
+			t.Errorf("expected exit code 7, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("attach did not end when the container exited")
+	}
+}
+
+// startEchoServer listens on a local port and echoes every connection.
+func startEchoServer(t *testing.T) int32 {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return int32(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServerPortForward(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+	client, _ := startServer(t, a, "pod-uid-1")
+	port := startEchoServer(t)
+
+	local, remote := net.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		result <- client.PortForward(context.Background(), port, remote)
+	}()
+
+	if _, err := local.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	buf := make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(buf) != "hello\n" {
+		t.Errorf("expected echo, got %q", buf)
+	}
+
+	_ = local.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("port-forward did not end after the stream closed")
+	}
+}
+
+func TestServerPortForwardUnreachable(t *testing.T) {
+	a := startAgent(t, newFakeRuntime())
+	client, _ := startServer(t, a, "pod-uid-1")
+
+	// Find a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+	_ = l.Close()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	err = client.PortForward(context.Background(), port, remote)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("expected bad gateway error, got %v", err)
+	}
+}
+
+func TestServerWatchStats(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+	client, _ := startServer(t, a, "pod-uid-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The agent takes its first sample as soon as it runs.
+	waitFor(t, "first sample", func() bool {
+		sample, _ := a.Stats()
+		return sample != nil
+	})
+
+	sample, err := client.Stats(ctx)
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	if sample.Time.IsZero() {
+		t.Error("expected sample time to be set")
+	}
+
+	samples := make(chan *StatsSample, 1)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	result := make(chan error, 1)
+	go func() {
+		result <- client.WatchStats(watchCtx, func(s *StatsSample) { samples <- s })
+	}()
+
+	select {
+	case s := <-samples:
+		if !s.Time.Equal(sample.Time) {
+			t.Errorf("expected the watch to start with the latest sample")
+		}
+	case <-ctx.Done():
+		t.Fatal("watch did not deliver the latest sample")
+	}
+
+	stopWatch()
+	if err := <-result; err != context.Canceled {
+		t.Errorf("expected watch to end with context.Canceled, got %v", err)
+	}
+}
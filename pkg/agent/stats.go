@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+// defaultStatsInterval is how often the agent samples resource usage.
+const defaultStatsInterval = 10 * time.Second
+
+// StatsSample is a point-in-time resource usage sample of the instance and
+// the pod's containers.
+type StatsSample struct {
+	// Time is when the sample was taken.
+	Time time.Time `json:"time"`
+
+	// CPU and Memory are the usage of the whole instance.
+	CPU    CPUUsage    `json:"cpu"`
+	Memory MemoryUsage `json:"memory"`
+
+	// Containers holds the usage of each running container.
+	Containers []ContainerUsage `json:"containers,omitempty"`
+
+	// GPUs holds the usage of each GPU on the instance.
+	GPUs []GPUUsage `json:"gpus,omitempty"`
+}
+
+// CPUUsage is CPU usage.
+type CPUUsage struct {
+	// UsageCoreNanoSeconds is the cumulative CPU time consumed.
+	UsageCoreNanoSeconds uint64 `json:"usageCoreNanoSeconds"`
+
+	// UsageNanoCores is the CPU usage rate over the last sampling interval.
+	// It is zero in the first sample.
+	UsageNanoCores uint64 `json:"usageNanoCores"`
+}
+
+// MemoryUsage is memory usage.
+type MemoryUsage struct {
+	// UsageBytes is the total memory in use, including page cache.
+	UsageBytes uint64 `json:"usageBytes"`
+
+	// WorkingSetBytes is the memory in use that cannot be reclaimed
+	// easily, as used by the kubelet for eviction and metrics.
+	WorkingSetBytes uint64 `json:"workingSetBytes"`
+
+	// AvailableBytes is the memory still available, if known.
+	AvailableBytes uint64 `json:"availableBytes,omitempty"`
+}
+
+// ContainerUsage is the resource usage of one container.
+type ContainerUsage struct {
+	Name      string      `json:"name"`
+	StartTime time.Time   `json:"startTime"`
+	CPU       CPUUsage    `json:"cpu"`
+	Memory    MemoryUsage `json:"memory"`
+}
+
+// GPUUsage is the usage of one GPU.
+type GPUUsage struct {
+	// ID is the GPU UUID.
+	ID string `json:"id"`
+
+	// Model is the GPU product name.
+	Model string `json:"model"`
+
+	// UtilizationPercent is the percentage of time the GPU was busy over
+	// the driver's last sample period.
+	UtilizationPercent uint64 `json:"utilizationPercent"`
+
+	MemoryUsedBytes  uint64 `json:"memoryUsedBytes"`
+	MemoryTotalBytes uint64 `json:"memoryTotalBytes"`
+}
+
+// Host reports instance-wide resource usage.
+type Host interface {
+	// CPUUsage returns the cumulative CPU time used by the instance in
+	// nanoseconds.
+	CPUUsage() (uint64, error)
+
+	// MemoryUsage returns the instance's memory usage.
+	MemoryUsage() (MemoryUsage, error)
+
+	// GPUUsage returns the usage of each GPU. It returns no GPUs and no
+	// error on instances without GPUs.
+	GPUUsage(ctx context.Context) ([]GPUUsage, error)
+}
+
+// Stats returns the latest usage sample and a channel that is closed when a
+// newer sample is available. The sample is nil until the first one is taken.
+func (a *Agent) Stats() (*StatsSample, <-chan struct{}) {
+	a.statsMu.RLock()
+	defer a.statsMu.RUnlock()
+	return a.stats, a.statsUpdated
+}
+
+// sampleStats samples resource usage every stats interval until ctx is
+// cancelled.
+func (a *Agent) sampleStats(ctx context.Context) {
+	ticker := time.NewTicker(a.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		prev, _ := a.Stats()
+		sample := a.collectStats(ctx, prev)
+
+		a.statsMu.Lock()
+		a.stats = sample
+		close(a.statsUpdated)
+		a.statsUpdated = make(chan struct{})
+		a.statsMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectStats takes a usage sample. Rates are computed against prev.
+// Failing sources are logged and left out of the sample.
+func (a *Agent) collectStats(ctx context.Context, prev *StatsSample) *StatsSample {
+	sample := &StatsSample{Time: time.Now()}
+
+	if a.host != nil {
+		if cpu, err := a.host.CPUUsage(); err == nil {
+			sample.CPU.UsageCoreNanoSeconds = cpu
+		} else {
+			a.logger.Debug().Err(err).Msg("Failed to read instance CPU usage")
+		}
+		if memory, err := a.host.MemoryUsage(); err == nil {
+			sample.Memory = memory
+		} else {
+			a.logger.Debug().Err(err).Msg("Failed to read instance memory usage")
+		}
+		if gpus, err := a.host.GPUUsage(ctx); err == nil {
+			sample.GPUs = gpus
+		} else {
+			a.logger.Debug().Err(err).Msg("Failed to read GPU usage")
+		}
+	}
+
+	type runningContainer struct {
+		name      string
+		id        string
+		startTime time.Time
+	}
+
+	var running []runningContainer
+	a.mu.RLock()
+	for _, c := range a.containers {
+		if c.run != nil && c.status.State.Running != nil {
+			running = append(running, runningContainer{
+				name:      c.spec.Name,
+				id:        c.run.id,
+				startTime: c.status.State.Running.StartedAt.Time,
+			})
+		}
+	}
+	a.mu.RUnlock()
+
+	for _, c := range running {
+		stats, err := a.runtime.ContainerStats(ctx, c.id)
+		if err != nil {
+			a.logger.Debug().Err(err).Str("container", c.name).Msg("Failed to read container stats")
+			continue
+		}
+		sample.Containers = append(sample.Containers, ContainerUsage{
+			Name:      c.name,
+			StartTime: c.startTime,
+			CPU:       CPUUsage{UsageCoreNanoSeconds: stats.CPUUsageNanoSeconds},
+			Memory: MemoryUsage{
+				UsageBytes:      stats.MemoryUsageBytes,
+				WorkingSetBytes: stats.MemoryWorkingSetBytes,
+			},
+		})
+	}
+
+	if prev != nil {
+		elapsed := sample.Time.Sub(prev.Time)
+		sample.CPU.UsageNanoCores = cpuRate(prev.CPU, sample.CPU, elapsed)
+		for i := range sample.Containers {
+			for _, p := range prev.Containers {
+				if p.Name == sample.Containers[i].Name && p.StartTime.Equal(sample.Containers[i].StartTime) {
+					sample.Containers[i].CPU.UsageNanoCores = cpuRate(p.CPU, sample.Containers[i].CPU, elapsed)
+				}
+			}
+		}
+	}
+
+	return sample
+}
+
+// cpuRate returns the CPU usage rate in nanocores between two samples.
+func cpuRate(prev, cur CPUUsage, elapsed time.Duration) uint64 {
+	if elapsed <= 0 || cur.UsageCoreNanoSeconds < prev.UsageCoreNanoSeconds {
+		return 0
+	}
+	used := cur.UsageCoreNanoSeconds - prev.UsageCoreNanoSeconds
+	return uint64(float64(used) / elapsed.Seconds())
+}
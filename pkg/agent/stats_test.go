@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeHost reports fixed instance usage.
+type fakeHost struct {
+	cpu    uint64
+	memory MemoryUsage
+	gpus   []GPUUsage
+}
+
+func (h *fakeHost) CPUUsage() (uint64, error)                    { return h.cpu, nil }
+func (h *fakeHost) MemoryUsage() (MemoryUsage, error)            { return h.memory, nil }
+func (h *fakeHost) GPUUsage(context.Context) ([]GPUUsage, error) { return h.gpus, nil }
+
+func TestCollectStats(t *testing.T) {
+	rt := newFakeRuntime()
+	rt.stats["trainer-0"] = &ContainerStats{
+		CPUUsageNanoSeconds:   3e9,
+		MemoryUsageBytes:      2048,
+		MemoryWorkingSetBytes: 1024,
+	}
+	a := startAgentWithHost(t, rt, &fakeHost{
+		cpu:    10e9,
+		memory: MemoryUsage{UsageBytes: 8192, WorkingSetBytes: 4096, AvailableBytes: 4096},
+		gpus:   []GPUUsage{{ID: "GPU-1", Model: "NVIDIA A10G", UtilizationPercent: 80}},
+	})
+
+	if err := a.Start(PodSubmission{Pod: testPod()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "trainer to run", func() bool {
+		return containerStatus(a, "trainer").State.Running != nil
+	})
+
+	ctx := context.Background()
+	first := a.collectStats(ctx, nil)
+	if first.CPU.UsageNanoCores != 0 {
+		t.Errorf("expected no CPU rate in the first sample, got %d", first.CPU.UsageNanoCores)
+	}
+	if first.Memory.WorkingSetBytes != 4096 || len(first.GPUs) != 1 {
+		t.Errorf("unexpected instance usage %+v", first)
+	}
+	// The sidecar has no stats in the fake runtime and is left out.
+	if len(first.Containers) != 1 || first.Containers[0].Name != "trainer" {
+		t.Fatalf("unexpected containers %+v", first.Containers)
+	}
+	if first.Containers[0].Memory.WorkingSetBytes != 1024 {
+		t.Errorf("expected working set 1024, got %d", first.Containers[0].Memory.WorkingSetBytes)
+	}
+
+	// One core-second of instance usage and half a core-second of
+	// container usage over two seconds.
+	prev := *first
+	prev.Time = first.Time.Add(-2 * time.Second)
+	prev.CPU.UsageCoreNanoSeconds = 9e9
+	prev.Containers = []ContainerUsage{first.Containers[0]}
+	prev.Containers[0].CPU.UsageCoreNanoSeconds = 2.5e9
+
+	second := a.collectStats(ctx, &prev)
+	if got := second.CPU.UsageNanoCores; got < 0.45e9 || got > 0.5e9 {
+		t.Errorf("expected about 0.5 cores of instance usage, got %d", got)
+	}
+	if got := second.Containers[0].CPU.UsageNanoCores; got < 0.2e9 || got > 0.25e9 {
+		t.Errorf("expected about 0.25 cores of container usage, got %d", got)
+	}
+}
+
+func TestCPURate(t *testing.T) {
+	tests := []struct {
+		name     string
+		prev     uint64
+		cur      uint64
+		elapsed  time.Duration
+		expected uint64
+	}{
+		{name: "one core", prev: 1e9, cur: 3e9, elapsed: 2 * time.Second, expected: 1e9},
+		{name: "idle", prev: 1e9, cur: 1e9, elapsed: time.Second, expected: 0},
+		{name: "counter reset", prev: 3e9, cur: 1e9, elapsed: time.Second, expected: 0},
+		{name: "no elapsed time", prev: 1e9, cur: 2e9, elapsed: 0, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cpuRate(CPUUsage{UsageCoreNanoSeconds: tt.prev}, CPUUsage{UsageCoreNanoSeconds: tt.cur}, tt.elapsed)
+			if got != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseNvidiaSMI(t *testing.T) {
+	out := []byte("GPU-aaa, NVIDIA A10G, 87, 1024, 23028\nGPU-bbb, NVIDIA A10G, [N/A], 0, 23028\n")
+
+	gpus, err := parseNvidiaSMI(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gpus) != 2 {
+		t.Fatalf("expected 2 GPUs, got %d", len(gpus))
+	}
+
+	expected := GPUUsage{
+		ID:                 "GPU-aaa",
+		Model:              "NVIDIA A10G",
+		UtilizationPercent: 87,
+		MemoryUsedBytes:    1024 << 20,
+		MemoryTotalBytes:   23028 << 20,
+	}
+	if gpus[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, gpus[0])
+	}
+	if gpus[1].UtilizationPercent != 0 {
+		t.Errorf("expected unsupported utilization to read as 0, got %d", gpus[1].UtilizationPercent)
+	}
+
+	if _, err := parseNvidiaSMI([]byte("GPU-aaa, NVIDIA A10G\n")); err == nil {
+		t.Error("expected error for short record")
+	}
+}
+
+// writeFiles writes name to content pairs below dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestLinuxHost(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"stat":    "cpu  100 10 50 1000 20 5 5 0 0 0\ncpu0 100 10 50 1000 20 5 5 0 0 0\n",
+		"meminfo": "MemTotal:       16000 kB\nMemFree:         4000 kB\nMemAvailable:   10000 kB\n",
+	})
+	host := NewLinuxHost(dir, filepath.Join(dir, "no-nvidia-smi"))
+
+	cpu, err := host.CPUUsage()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// user+nice+system+irq+softirq+steal = 170 ticks of 10ms
+	if cpu != 1.7e9 {
+		t.Errorf("expected 1.7e9 ns, got %d", cpu)
+	}
+
+	memory, err := host.MemoryUsage()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := MemoryUsage{UsageBytes: 12000 << 10, WorkingSetBytes: 6000 << 10, AvailableBytes: 10000 << 10}
+	if memory != expected {
+		t.Errorf("expected %+v, got %+v", expected, memory)
+	}
+
+	gpus, err := host.GPUUsage(context.Background())
+	if err != nil || gpus != nil {
+		t.Errorf("expected no GPUs without nvidia-smi, got %v, %v", gpus, err)
+	}
+}
+
+func TestReadCgroupStats(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"cgroup":         "0::/orca/trainer\n",
+		"cpu.stat":       "usage_usec 2500\nuser_usec 2000\nsystem_usec 500\n",
+		"memory.current": "8192\n",
+		"memory.stat":    "anon 4096\nfile 4096\ninactive_file 3072\n",
+	})
+
+	cgroup, err := cgroupDir(filepath.Join(dir, "cgroup"))
+	if err != nil || cgroup != "/orca/trainer" {
+		t.Errorf("expected /orca/trainer, got %q, %v", cgroup, err)
+	}
+
+	stats, err := readCgroupStats(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ContainerStats{CPUUsageNanoSeconds: 2500000, MemoryUsageBytes: 8192, MemoryWorkingSetBytes: 5120}
+	if *stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, *stats)
+	}
+}
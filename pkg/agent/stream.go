@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// streamProtocol is the Upgrade header value for interactive sessions (exec
+// and attach). Upgraded connections carry frames: a one byte kind, a four
+// byte big-endian payload length, and the payload.
+const streamProtocol = "orca-stream/1"
+
+// Frame kinds.
+const (
+	// frameStdin carries stdin data to the agent. An empty payload closes
+	// stdin.
+	frameStdin byte = iota
+	// frameStdout and frameStderr carry output from the agent.
+	frameStdout
+	frameStderr
+	// frameResize carries a JSON encoded TermSize to the agent.
+	frameResize
+	// frameExit carries the JSON encoded exitReport that ends the session.
+	frameExit
+)
+
+// maxFramePayload bounds frame payloads so a malformed length cannot make
+// either side allocate unbounded memory.
+const maxFramePayload = 1 << 20
+
+// exitReport ends an interactive session.
+type exitReport struct {
+	// ExitCode is the exit code of the process.
+	ExitCode int `json:"exitCode"`
+
+	// Error is set if the session failed before the process exited.
+	Error string `json:"error,omitempty"`
+}
+
+// StreamIO carries the streams of an exec or attach session.
+type StreamIO struct {
+	// Stdin is forwarded to the process. Nil if stdin is not attached.
+	Stdin io.Reader
+
+	// Stdout and Stderr receive the process's output. Either may be nil.
+	// With TTY all output goes to Stdout.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// TTY requests a terminal for the session.
+	TTY bool
+
+	// Resize delivers terminal size changes. It may be nil.
+	Resize <-chan TermSize
+}
+
+// frameConn reads and writes frames on a connection.
+type frameConn struct {
+	r io.Reader
+
+	wmu sync.Mutex
+	w   io.Writer
+}
+
+func newFrameConn(r io.Reader, w io.Writer) *frameConn {
+	return &frameConn{r: r, w: w}
+}
+
+// writeFrame writes one frame. It is safe for concurrent use.
+func (c *frameConn) writeFrame(kind byte, payload []byte) error {
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(payload)
+	return err
+}
+
+// writeJSON writes v as the JSON payload of a frame.
+func (c *frameConn) writeJSON(kind byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(kind, payload)
+}
+
+// readFrame reads the next frame.
+func (c *frameConn) readFrame() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// frameWriter writes everything written to it as frames of one kind.
+type frameWriter struct {
+	conn *frameConn
+	kind byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFramePayload {
+			chunk = chunk[:maxFramePayload]
+		}
+		if err := w.conn.writeFrame(w.kind, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startTTY starts cmd with a new pseudo-terminal as its controlling terminal
+// and returns the terminal's master side.
+func startTTY(cmd *exec.Cmd) (*os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+	defer slave.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	if err := cmd.Start(); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+
+	return master, nil
+}
+
+// setTTYSize sets the window size of the terminal.
+func setTTYSize(pty *os.File, size TermSize) error {
+	return unix.IoctlSetWinsize(int(pty.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: size.Height,
+		Col: size.Width,
+	})
+}
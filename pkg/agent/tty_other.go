@@ -0,0 +1,21 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// errTTYUnsupported is returned when a terminal is requested on a platform
+// the agent cannot allocate one on.
+var errTTYUnsupported = errors.New("terminals are only supported on linux")
+
+func startTTY(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errTTYUnsupported
+}
+
+func setTTYSize(pty *os.File, size TermSize) error {
+	return errTTYUnsupported
+}
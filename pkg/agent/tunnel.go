@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// tunnelProtocol is the Upgrade header value for port-forward connections.
+// Upgraded connections carry the raw bytes of the forwarded TCP connection.
+const tunnelProtocol = "orca-tunnel/1"
+
+// portForwardDialTimeout bounds connecting to a forwarded port.
+const portForwardDialTimeout = 5 * time.Second
+
+// tunnel copies data between a and b in both directions. When one side
+// finishes sending, the other is half-closed so the remaining direction can
+// drain. If it cannot be half-closed, or a copy fails, both are closed.
+func tunnel(a, b io.ReadWriteCloser) error {
+	results := make(chan copyResult, 2)
+
+	go func() { results <- halfCopy(a, b) }()
+	go func() { results <- halfCopy(b, a) }()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+		if result.err != nil || !result.halfClosed {
+			// Unblock the other direction.
+			_ = a.Close()
+			_ = b.Close()
+		}
+	}
+
+	_ = a.Close()
+	_ = b.Close()
+
+	return firstErr
+}
+
+// copyResult is the outcome of one direction of a tunnel.
+type copyResult struct {
+	halfClosed bool
+	err        error
+}
+
+// halfCopy copies src to dst and half-closes dst when src is exhausted.
+func halfCopy(dst io.Writer, src io.Reader) copyResult {
+	if _, err := io.Copy(dst, src); err != nil {
+		// Closing the tunnel from the other direction is not a failure.
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			return copyResult{}
+		}
+		return copyResult{err: err}
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return copyResult{halfClosed: true}
+	}
+	return copyResult{}
+}
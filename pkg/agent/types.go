@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// API paths served by the agent.
+const (
+	pathHealth  = "/healthz"
+	pathPod     = "/v1/pod"
+	pathVolumes = "/v1/volumes"
+	pathStats   = "/v1/stats"
+
+	// pathContainers is followed by the container name and an operation.
+	pathContainers = "/v1/containers/"
+
+	// pathPortForward is followed by the port to forward to.
+	pathPortForward = "/v1/portforward/"
+)
+
+// PodSubmission is the body of a pod submission. The controller resolves
+// everything the pod refers to, so the agent never needs cluster access.
+type PodSubmission struct {
+	// Pod is the pod to run, with its environment variables resolved to
+	// plain values.
+	Pod *corev1.Pod `json:"pod"`
+
+	// Volumes holds the files of the pod's configMap, secret, downwardAPI
+	// and projected volumes, by volume name.
+	Volumes map[string][]VolumeFile `json:"volumes,omitempty"`
+
+	// Disks holds the EBS volumes of the pod's persistentVolumeClaim
+	// volumes, by volume name. The controller attaches them to the
+	// instance before submitting the pod.
+	Disks map[string]Disk `json:"disks,omitempty"`
+
+	// Filesystems holds the shared filesystems of the pod's nfs volumes and
+	// EFS or FSx for Lustre claims, by volume name.
+	Filesystems map[string]Filesystem `json:"filesystems,omitempty"`
+
+	// RegistryCredentials holds the credentials of the pod's image pull
+	// secrets. They are kept in memory and only handed to the runtime for
+	// pulls from matching registries.
+	RegistryCredentials []RegistryCredential `json:"registryCredentials,omitempty"`
+
+	// Network holds the cluster's DNS settings and the pod's end of the
+	// overlay.
+	Network *PodNetwork `json:"network,omitempty"`
+}
+
+// PodNetwork connects a pod to the cluster network.
+type PodNetwork struct {
+	// ClusterDomain is the cluster's DNS domain, like "cluster.local".
+	ClusterDomain string `json:"clusterDomain"`
+
+	// ClusterDNS are the addresses of the cluster DNS Service. Without
+	// them, ClusterFirst pods use the instance's resolver.
+	ClusterDNS []string `json:"clusterDNS,omitempty"`
+
+	// Overlay is the instance's WireGuard peer configuration, if the pod
+	// is on the overlay.
+	Overlay *Overlay `json:"overlay,omitempty"`
+}
+
+// Overlay is the instance's end of the WireGuard overlay that connects it
+// to the cluster through ORCA.
+type Overlay struct {
+	// Interface is the name of the WireGuard interface.
+	Interface string `json:"interface"`
+
+	// Address is the pod's IP on the overlay.
+	Address string `json:"address"`
+
+	// PrivateKey is the instance's WireGuard key, base64 encoded.
+	PrivateKey string `json:"privateKey"`
+
+	// ListenPort is the UDP port ORCA connects to.
+	ListenPort int `json:"listenPort"`
+
+	// HubPublicKey and HubAddress identify ORCA's end of the overlay.
+	HubPublicKey string `json:"hubPublicKey"`
+	HubAddress   string `json:"hubAddress"`
+
+	// Routes are the networks reached through ORCA.
+	Routes []string `json:"routes"`
+}
+
+// Disk is an EBS volume attached to the instance for a pod volume.
+type Disk struct {
+	VolumeID string `json:"volumeID"`
+
+	// Device is the device name the volume was attached as. NVMe instances
+	// expose it under a different name.
+	Device string `json:"device"`
+
+	// FSType is the filesystem created on a blank volume.
+	FSType string `json:"fsType"`
+
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Filesystem is a shared filesystem mounted on the instance for a pod
+// volume.
+type Filesystem struct {
+	// Type is the mount type: nfs, nfs4, efs, lustre or tmpfs.
+	Type string `json:"type"`
+
+	// Source is the mount source, like "fs-0123.efs.us-east-1.amazonaws.com:/".
+	Source string `json:"source"`
+
+	// Options are the mount options.
+	Options []string `json:"options,omitempty"`
+
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// RegistryCredential is a login for an image registry, as found in a
+// docker config file.
+type RegistryCredential struct {
+	// Registry is the registry host, optionally with a path prefix and
+	// wildcard host labels, as keyed in a docker config file.
+	Registry string `json:"registry"`
+
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// VolumeFile is a file of a volume whose contents the controller provides.
+type VolumeFile struct {
+	// Path is the file's path relative to the volume root.
+	Path string `json:"path"`
+
+	// Data is the file's content.
+	Data []byte `json:"data"`
+
+	// Mode holds the file's permission bits.
+	Mode int32 `json:"mode"`
+}
+
+// PodReport is the pod state reported by an agent.
+type PodReport struct {
+	// PodUID is the UID of the pod the agent runs.
+	// It is empty until a pod has been submitted.
+	PodUID types.UID `json:"podUID,omitempty"`
+
+	// Phase is the pod phase derived from the container states: Succeeded
+	// or Failed once every container has terminated.
+	Phase corev1.PodPhase `json:"phase,omitempty"`
+
+	// Initialized is set once every init container has completed, or for
+	// sidecars started.
+	Initialized bool `json:"initialized,omitempty"`
+
+	// InitContainerStatuses holds the state of each init container, in spec
+	// order.
+	InitContainerStatuses []corev1.ContainerStatus `json:"initContainerStatuses,omitempty"`
+
+	// ContainerStatuses holds the state of each container, in spec order.
+	ContainerStatuses []corev1.ContainerStatus `json:"containerStatuses,omitempty"`
+
+	// MountErrors holds the latest error mounting each volume that is not
+	// mounted yet, by volume name.
+	MountErrors map[string]string `json:"mountErrors,omitempty"`
+}
+
+// LogOptions selects which container log entries are returned and how.
+type LogOptions struct {
+	// Follow keeps the stream open until the container exits.
+	Follow bool
+
+	// Previous returns the logs of the previous run of a restarted container.
+	Previous bool
+
+	// Timestamps prefixes every line with its RFC3339Nano timestamp.
+	Timestamps bool
+
+	// Tail returns only the last Tail lines. Zero returns all lines.
+	Tail int
+
+	// LimitBytes stops the stream after this many bytes. Zero is unlimited.
+	LimitBytes int
+
+	// SinceTime skips entries logged before this time.
+	SinceTime time.Time
+}
+
+// TermSize is the size of a terminal in characters.
+type TermSize struct {
+	Width  uint16 `json:"width"`
+	Height uint16 `json:"height"`
+}
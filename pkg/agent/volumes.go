@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dataDirName is the link in a volume directory to the current generation
+// of its files. Every visible entry links through it, so updates swap all
+// files at once, like the kubelet's atomic writer.
+const dataDirName = "..data"
+
+// writeVolumes writes the files of the given volumes below a.volumeDir.
+// The files are readable by the pod's fsGroup if it has one.
+func (a *Agent) writeVolumes(volumes map[string][]VolumeFile, fsGroup *int64) error {
+	for name, files := range volumes {
+		dir := filepath.Join(a.volumeDir, name)
+		if err := writeVolume(dir, files); err != nil {
+			return fmt.Errorf("failed to write volume %s: %w", name, err)
+		}
+		if fsGroup == nil {
+			continue
+		}
+		if err := setVolumeGroup(dir, *fsGroup, true, false); err != nil {
+			return fmt.Errorf("failed to apply fsGroup to volume %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// UpdateVolumes replaces the files of volumes that the controller provides,
+// after their source ConfigMaps, Secrets or pod metadata changed. Mounts
+// with a subPath keep the files they started with, as in Kubernetes.
+func (a *Agent) UpdateVolumes(volumes map[string][]VolumeFile) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pod == nil {
+		return fmt.Errorf("no pod has been submitted")
+	}
+	for name := range volumes {
+		if !a.volumes[name] {
+			return fmt.Errorf("volume %s is not provided by the controller", name)
+		}
+	}
+
+	return a.writeVolumes(volumes, podFSGroup(a.pod))
+}
+
+// writeVolume writes a new generation of files into dir and switches the
+// volume over to it.
+func writeVolume(dir string, files []VolumeFile) error {
+	for _, f := range files {
+		if err := validateVolumePath(f.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	generation, err := os.MkdirTemp(dir, time.Now().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(generation, 0o755); err != nil {
+		return err
+	}
+
+	visible := make(map[string]bool)
+	for _, f := range files {
+		path := filepath.Join(generation, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, f.Data, os.FileMode(f.Mode)); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, os.FileMode(f.Mode)); err != nil {
+			return err
+		}
+		visible[strings.SplitN(filepath.ToSlash(f.Path), "/", 2)[0]] = true
+	}
+
+	// Swap the data link to the new generation in one rename
+	previous, _ := os.Readlink(filepath.Join(dir, dataDirName))
+	tmpLink := filepath.Join(dir, dataDirName+"_tmp")
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(generation), tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, dataDirName)); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "..") || visible[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	for name := range visible {
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataDirName, name), link); err != nil {
+			return err
+		}
+	}
+
+	if previous != "" && previous != filepath.Base(generation) {
+		return os.RemoveAll(filepath.Join(dir, previous))
+	}
+	return nil
+}
+
+// validateVolumePath rejects paths that would escape the volume or clash
+// with its data links.
+func validateVolumePath(path string) error {
+	switch {
+	case path == "":
+		return errors.New("volume file path cannot be empty")
+	case filepath.IsAbs(path):
+		return fmt.Errorf("volume file path %q must be relative", path)
+	case strings.HasPrefix(path, ".."):
+		return fmt.Errorf("volume file path %q must not start with '..'", path)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return fmt.Errorf("volume file path %q must not contain '..'", path)
+		}
+	}
+	return nil
+}
+
+// containerMounts returns the mounts of a container's volumes that the
+// agent provides. Volumes of other kinds are not mounted. Callers must hold
+// a.mu.
+func (a *Agent) containerMounts(spec corev1.Container) []Mount {
+	var mounts []Mount
+	for _, m := range spec.VolumeMounts {
+		if readOnly, ok := a.mountedReadOnly(m.Name); ok {
+			mounts = append(mounts, Mount{
+				HostPath:      filepath.Join(a.volumeDir, m.Name, m.SubPath),
+				ContainerPath: m.MountPath,
+				ReadOnly:      m.ReadOnly || readOnly,
+			})
+			continue
+		}
+		if dir, ok := a.emptyDirs[m.Name]; ok {
+			// Sub paths of emptyDir volumes are created on first use
+			hostPath := filepath.Join(dir, m.SubPath)
+			if err := os.MkdirAll(hostPath, 0o777); err != nil {
+				a.logger.Warn().Err(err).Str("volume", m.Name).Msg("Failed to create emptyDir sub path")
+			}
+			mounts = append(mounts, Mount{
+				HostPath:      hostPath,
+				ContainerPath: m.MountPath,
+				ReadOnly:      m.ReadOnly,
+			})
+			continue
+		}
+		if !a.volumes[m.Name] {
+			continue
+		}
+		// Controller provided volumes are always read-only
+		mounts = append(mounts, Mount{
+			HostPath:      filepath.Join(a.volumeDir, m.Name, m.SubPath),
+			ContainerPath: m.MountPath,
+			ReadOnly:      true,
+		})
+	}
+	return mounts
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// readVolumeFile returns the contents of a file as a container sees it.
+func readVolumeFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestWriteVolume(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+
+	err := writeVolume(dir, []VolumeFile{
+		{Path: "app.yaml", Data: []byte("v1"), Mode: 0o644},
+		{Path: "certs/ca.crt", Data: []byte("ca"), Mode: 0o600},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := readVolumeFile(t, filepath.Join(dir, "app.yaml")); got != "v1" {
+		t.Errorf("expected app.yaml to contain v1, got %q", got)
+	}
+	if got := readVolumeFile(t, filepath.Join(dir, "certs", "ca.crt")); got != "ca" {
+		t.Errorf("expected certs/ca.crt to contain ca, got %q", got)
+	}
+	info, err := os.Stat(filepath.Join(dir, "certs", "ca.crt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("expected mode 0600, got %o", mode)
+	}
+
+	// An update replaces every file at once and drops removed ones
+	err = writeVolume(dir, []VolumeFile{{Path: "app.yaml", Data: []byte("v2"), Mode: 0o644}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := readVolumeFile(t, filepath.Join(dir, "app.yaml")); got != "v2" {
+		t.Errorf("expected app.yaml to contain v2, got %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "certs")); !os.IsNotExist(err) {
+		t.Errorf("expected certs to be removed, got %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || !slices.Contains(names, dataDirName) || !slices.Contains(names, "app.yaml") {
+		t.Errorf("expected one generation, the data link and app.yaml, got %v", names)
+	}
+}
+
+func TestValidateVolumePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"app.yaml", false},
+		{"nested/dir/app.yaml", false},
+		{"..hidden", true},
+		{"../escape", true},
+		{"nested/../../escape", true},
+		{"/etc/passwd", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := validateVolumePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateVolumePath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentMountsVolumes(t *testing.T) {
+	rt := newFakeRuntime()
+	a := startAgent(t, rt)
+
+	pod := testPod()
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "config", MountPath: "/etc/app"},
+		{Name: "config", MountPath: "/etc/app.yaml", SubPath: "app.yaml"},
+		{Name: "scratch", MountPath: "/scratch"},
+	}
+	volumes := map[string][]VolumeFile{
+		"config": {{Path: "app.yaml", Data: []byte("v1"), Mode: 0o644}},
+	}
+	if err := a.Start(PodSubmission{Pod: pod, Volumes: volumes}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "container to start", func() bool { return rt.config("trainer-0") != nil })
+
+	want := []Mount{
+		{HostPath: filepath.Join(a.volumeDir, "config"), ContainerPath: "/etc/app", ReadOnly: true},
+		{HostPath: filepath.Join(a.volumeDir, "config", "app.yaml"), ContainerPath: "/etc/app.yaml", ReadOnly: true},
+	}
+	if mounts := rt.config("trainer-0").Mounts; !slices.Equal(mounts, want) {
+		t.Errorf("expected mounts %+v, got %+v", want, mounts)
+	}
+
+	if err := a.UpdateVolumes(map[string][]VolumeFile{"config": {{Path: "app.yaml", Data: []byte("v2"), Mode: 0o644}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readVolumeFile(t, filepath.Join(a.volumeDir, "config", "app.yaml")); got != "v2" {
+		t.Errorf("expected updated contents, got %q", got)
+	}
+
+	if err := a.UpdateVolumes(map[string][]VolumeFile{"scratch": nil}); err == nil {
+		t.Error("expected an error updating a volume the controller does not provide")
+	}
+}
@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -15,6 +19,10 @@ type Config struct {
 	AWS         AWSConfig         `yaml:"aws"`
 	Node        NodeConfig        `yaml:"node"`
 	Instances   InstancesConfig   `yaml:"instances"`
+	Agent       AgentConfig       `yaml:"agent"`
+	Kubelet     KubeletConfig     `yaml:"kubelet"`
+	Network     NetworkConfig     `yaml:"network"`
+	Security    SecurityConfig    `yaml:"security"`
 	Limits      LimitsConfig      `yaml:"limits"`
 	Logging     LoggingConfig     `yaml:"logging"`
 	Metrics     MetricsConfig     `yaml:"metrics"`
@@ -27,13 +35,102 @@ type AWSConfig struct {
 	Credentials        *AWSCredentials   `yaml:"credentials,omitempty"`
 	VPCID              string            `yaml:"vpcID"`
 	SubnetID           string            `yaml:"subnetID"`
+	SubnetIDs          []string          `yaml:"subnetIDs,omitempty"`
 	SecurityGroupIDs   []string          `yaml:"securityGroupIDs"`
 	AMIID              string            `yaml:"amiID,omitempty"`
+	InstanceProfile    string            `yaml:"instanceProfile,omitempty"`
+	SharedFilesystems  SharedFilesystems `yaml:"sharedFilesystems,omitempty"`
+	RootVolume         RootVolume        `yaml:"rootVolume,omitempty"`
 	LocalStackEndpoint string            `yaml:"localStackEndpoint,omitempty"`
 	Tags               map[string]string `yaml:"tags,omitempty"`
 	DevelopmentMode    bool              `yaml:"developmentMode"`
 }
 
+// SharedFilesystems configures how instances mount EFS, FSx for Lustre and
+// NFS volumes.
+type SharedFilesystems struct {
+	// MountTargets maps EFS and FSx file system IDs to the address
+	// instances mount them from. By default EFS file systems are mounted
+	// by their regional DNS name, which needs DNS resolution in the VPC.
+	MountTargets map[string]string `yaml:"mountTargets,omitempty"`
+
+	// SecurityGroupIDs are added to the instances of pods with shared
+	// filesystem volumes, so that they may reach the mount targets.
+	SecurityGroupIDs []string `yaml:"securityGroupIDs,omitempty"`
+}
+
+// RootVolume configures the root EBS volume of pod instances. Unset fields
+// keep the AMI's settings.
+type RootVolume struct {
+	// SizeGiB is the minimum size of the volume, for the operating system
+	// and container images. The ephemeral storage that pods request is
+	// added on top.
+	SizeGiB int32 `yaml:"sizeGiB,omitempty"`
+
+	// VolumeType is the EBS volume type: gp2, gp3, io1, io2, st1, sc1 or
+	// standard.
+	VolumeType string `yaml:"volumeType,omitempty"`
+
+	// IOPS is the provisioned IOPS of gp3, io1 and io2 volumes.
+	IOPS int32 `yaml:"iops,omitempty"`
+
+	// Throughput is the provisioned throughput of gp3 volumes in MiB/s.
+	Throughput int32 `yaml:"throughput,omitempty"`
+
+	// Encrypted encrypts the volume, with KMSKeyID if set or else the
+	// account's default EBS key.
+	Encrypted *bool  `yaml:"encrypted,omitempty"`
+	KMSKeyID  string `yaml:"kmsKeyID,omitempty"`
+}
+
+// Override returns r with the fields set in o replacing its own.
+func (r RootVolume) Override(o *RootVolume) RootVolume {
+	if o == nil {
+		return r
+	}
+	if o.SizeGiB != 0 {
+		r.SizeGiB = o.SizeGiB
+	}
+	if o.VolumeType != "" {
+		r.VolumeType = o.VolumeType
+	}
+	if o.IOPS != 0 {
+		r.IOPS = o.IOPS
+	}
+	if o.Throughput != 0 {
+		r.Throughput = o.Throughput
+	}
+	if o.Encrypted != nil {
+		r.Encrypted = o.Encrypted
+	}
+	if o.KMSKeyID != "" {
+		r.KMSKeyID = o.KMSKeyID
+	}
+	return r
+}
+
+// validate checks the volume settings; field is where they are configured.
+func (r *RootVolume) validate(field string) error {
+	switch r.VolumeType {
+	case "", "gp2", "gp3", "io1", "io2", "st1", "sc1", "standard":
+	default:
+		return fmt.Errorf("%s.volumeType must be gp2, gp3, io1, io2, st1, sc1 or standard", field)
+	}
+	if r.SizeGiB < 0 || r.IOPS < 0 || r.Throughput < 0 {
+		return fmt.Errorf("%s sizes, IOPS and throughput cannot be negative", field)
+	}
+	if r.IOPS != 0 && r.VolumeType != "gp3" && r.VolumeType != "io1" && r.VolumeType != "io2" {
+		return fmt.Errorf("%s.iops requires volumeType gp3, io1 or io2", field)
+	}
+	if r.Throughput != 0 && r.VolumeType != "gp3" {
+		return fmt.Errorf("%s.throughput requires volumeType gp3", field)
+	}
+	if r.KMSKeyID != "" && (r.Encrypted == nil || !*r.Encrypted) {
+		return fmt.Errorf("%s.kmsKeyID requires encrypted", field)
+	}
+	return nil
+}
+
 // AWSCredentials contains AWS access credentials.
 type AWSCredentials struct {
 	AccessKeyID     string `yaml:"accessKeyID"`
@@ -86,6 +183,139 @@ type WorkloadTemplate struct {
 	InstanceType string `yaml:"instanceType"`
 	LaunchType   string `yaml:"launchType"`
 	MaxSpotPrice string `yaml:"maxSpotPrice,omitempty"`
+
+	// RootVolume overrides the root volume settings of aws.rootVolume for
+	// pods using the template.
+	RootVolume *RootVolume `yaml:"rootVolume,omitempty"`
+}
+
+// AgentConfig contains settings for the ORCA agent that runs on each instance.
+type AgentConfig struct {
+	// Port is the TCP port the agent API listens on.
+	Port int `yaml:"port"`
+
+	// BinaryURL is where instances download the agent binary at boot.
+	// If empty, the agent must already be installed in the AMI at
+	// /usr/local/bin/orca-agent.
+	BinaryURL string `yaml:"binaryURL,omitempty"`
+
+	// CACertFile and CAKeyFile point to the certificate authority used to
+	// issue agent credentials. If unset, an ephemeral authority is generated
+	// at startup and agents launched by a previous ORCA process become
+	// unreachable after a restart.
+	CACertFile string `yaml:"caCertFile,omitempty"`
+	CAKeyFile  string `yaml:"caKeyFile,omitempty"`
+
+	// APIServerURL is where pods on instances reach the Kubernetes API
+	// server, for example the EKS endpoint or a load balancer in front of
+	// it. If empty, the URL of ORCA's own cluster connection is used.
+	APIServerURL string `yaml:"apiServerURL,omitempty"`
+}
+
+// KubeletConfig contains settings for the kubelet API served for the virtual
+// node. The Kubernetes API server calls it for logs, exec, attach,
+// port-forward and stats.
+type KubeletConfig struct {
+	// Port is the TCP port the kubelet API listens on.
+	Port int `yaml:"port"`
+
+	// Address is the IP address advertised in the node status. If empty,
+	// the POD_IP environment variable is used.
+	Address string `yaml:"address,omitempty"`
+
+	// CertDir is where the serving certificate requested through the
+	// Kubernetes CSR API is stored and rotated.
+	CertDir string `yaml:"certDir"`
+
+	// CertFile and KeyFile point to a static serving certificate. When set,
+	// no certificate is requested through the CSR API.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+
+	// ClientCAFile is the CA that signs API server client certificates.
+	// If empty, the CA of the cluster connection is used.
+	ClientCAFile string `yaml:"clientCAFile,omitempty"`
+}
+
+// NetworkConfig contains settings for pod networking and DNS on instances.
+type NetworkConfig struct {
+	// ClusterDomain is the cluster's DNS domain.
+	ClusterDomain string `yaml:"clusterDomain"`
+
+	// ClusterDNS are the addresses of the cluster DNS Service. Pods with
+	// the ClusterFirst DNS policy resolve names through them; if empty,
+	// they use the instance's resolver.
+	ClusterDNS []string `yaml:"clusterDNS,omitempty"`
+
+	// Overlay connects instances to the cluster network.
+	Overlay OverlayConfig `yaml:"overlay"`
+
+	// ServiceProxy publishes pods behind Services through ORCA.
+	ServiceProxy ServiceProxyConfig `yaml:"serviceProxy"`
+}
+
+// OverlayConfig configures the WireGuard overlay between ORCA and pod
+// instances. ORCA runs the hub: every instance is a peer that reaches the
+// cluster through it, and pods get their IPs from the overlay instead of
+// the instances' private IPs.
+type OverlayConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interface is the name of the WireGuard interface, on ORCA and on
+	// instances.
+	Interface string `yaml:"interface"`
+
+	// PodCIDR is the overlay network pod IPs are allocated from. Its first
+	// address is ORCA's. It must not overlap the cluster or VPC networks.
+	PodCIDR string `yaml:"podCIDR"`
+
+	// ListenPort is the UDP port of the WireGuard interfaces. Instances
+	// must accept it from ORCA; ORCA connects to them.
+	ListenPort int `yaml:"listenPort"`
+
+	// PrivateKeyFile holds ORCA's WireGuard private key, base64 encoded.
+	// It is required, so that instances keep their tunnel when ORCA
+	// restarts.
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+
+	// Routes are the networks instances reach through ORCA, like the
+	// cluster's pod and Service CIDRs and on-premises networks. Their
+	// traffic is masqueraded as ORCA's.
+	Routes []string `yaml:"routes,omitempty"`
+}
+
+// ServiceProxyConfig configures the proxy that publishes pods behind
+// Services when the cluster cannot route to their instances. ORCA listens
+// on a port of its own for every container port of a running pod, tunnels
+// connections to it through the pod's agent, and publishes EndpointSlices
+// that point the pod's Services at those ports. Pods then have no IP of
+// their own in their status, which keeps them out of the EndpointSlices
+// of the Kubernetes controller.
+type ServiceProxyConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Address is the IP Service clients connect to, ORCA's pod IP. If
+	// empty, kubelet.address is used.
+	Address string `yaml:"address,omitempty"`
+
+	// PortRange is the range of ports proxied pod ports are given, as
+	// "first-last".
+	PortRange string `yaml:"portRange"`
+}
+
+// Ports returns the first and last port of the proxy's port range.
+func (c ServiceProxyConfig) Ports() (first, last int, err error) {
+	from, to, ok := strings.Cut(c.PortRange, "-")
+	if ok {
+		first, err = strconv.Atoi(strings.TrimSpace(from))
+	}
+	if ok && err == nil {
+		last, err = strconv.Atoi(strings.TrimSpace(to))
+	}
+	if !ok || err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("port range %q is not of the form first-last", c.PortRange)
+	}
+	return first, last, nil
 }
 
 // LimitsConfig contains resource limits and budget controls.
@@ -164,6 +394,19 @@ func (c *Config) Validate() error {
 	if err := c.validateInstances(); err != nil {
 		return err
 	}
+	if err := c.validateAgent(); err != nil {
+		return err
+	}
+	if err := c.validateKubelet(); err != nil {
+		return err
+	}
+	if err := c.validateNetwork(); err != nil {
+		return err
+	}
+	if err := c.Security.validate(); err != nil {
+		return err
+	}
+
 	c.setDefaults()
 	return nil
 }
@@ -172,7 +415,7 @@ func (c *Config) validateAWS() error {
 	if c.AWS.Region == "" {
 		return fmt.Errorf("aws.region is required")
 	}
-	return nil
+	return c.AWS.RootVolume.validate("aws.rootVolume")
 }
 
 func (c *Config) validateNode() error {
@@ -201,6 +444,78 @@ func (c *Config) validateInstances() error {
 	if c.Instances.DefaultLaunchType != "" && !validLaunchTypes[c.Instances.DefaultLaunchType] {
 		return fmt.Errorf("instances.defaultLaunchType must be on-demand or spot")
 	}
+
+	// Template root volumes are checked as they apply, on top of aws.rootVolume
+	for name, template := range c.Instances.Templates {
+		rootVolume := c.AWS.RootVolume.Override(template.RootVolume)
+		if err := rootVolume.validate("instances.templates." + name + ".rootVolume"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateAgent() error {
+	if (c.Agent.CACertFile == "") != (c.Agent.CAKeyFile == "") {
+		return fmt.Errorf("agent.caCertFile and agent.caKeyFile must be set together")
+	}
+	if c.Agent.APIServerURL != "" {
+		u, err := url.Parse(c.Agent.APIServerURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("agent.apiServerURL must be an https URL")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateKubelet() error {
+	if (c.Kubelet.CertFile == "") != (c.Kubelet.KeyFile == "") {
+		return fmt.Errorf("kubelet.certFile and kubelet.keyFile must be set together")
+	}
+	return nil
+}
+
+func (c *Config) validateNetwork() error {
+	for _, addr := range c.Network.ClusterDNS {
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return fmt.Errorf("network.clusterDNS address %q is not an IP address", addr)
+		}
+	}
+
+	proxy := c.Network.ServiceProxy
+	if proxy.Enabled && proxy.Address != "" {
+		if _, err := netip.ParseAddr(proxy.Address); err != nil {
+			return fmt.Errorf("network.serviceProxy.address %q is not an IP address", proxy.Address)
+		}
+	}
+	if proxy.Enabled && proxy.PortRange != "" {
+		if _, _, err := proxy.Ports(); err != nil {
+			return fmt.Errorf("network.serviceProxy.portRange: %w", err)
+		}
+	}
+
+	overlay := c.Network.Overlay
+	if !overlay.Enabled {
+		return nil
+	}
+	if proxy.Enabled {
+		return fmt.Errorf("network.overlay and network.serviceProxy cannot both be enabled")
+	}
+	prefix, err := netip.ParsePrefix(overlay.PodCIDR)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return fmt.Errorf("network.overlay.podCIDR must be an IPv4 CIDR of at least 4 addresses")
+	}
+	if overlay.ListenPort < 0 || overlay.ListenPort > 65535 {
+		return fmt.Errorf("network.overlay.listenPort must be a port number")
+	}
+	if overlay.PrivateKeyFile == "" {
+		return fmt.Errorf("network.overlay.privateKeyFile must be set, so that instances keep their tunnel when ORCA restarts")
+	}
+	for _, route := range overlay.Routes {
+		if _, err := netip.ParsePrefix(route); err != nil {
+			return fmt.Errorf("network.overlay.routes entry %q is not a CIDR", route)
+		}
+	}
 	return nil
 }
 
@@ -214,6 +529,15 @@ func (c *Config) setDefaults() {
 	if c.Instances.DefaultLaunchType == "" {
 		c.Instances.DefaultLaunchType = "on-demand"
 	}
+	if c.Agent.Port == 0 {
+		c.Agent.Port = 9440
+	}
+	if c.Kubelet.Port == 0 {
+		c.Kubelet.Port = 10250
+	}
+	if c.Kubelet.CertDir == "" {
+		c.Kubelet.CertDir = "/var/lib/orca/pki"
+	}
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
 	}
@@ -226,6 +550,21 @@ func (c *Config) setDefaults() {
 	if c.Metrics.Path == "" {
 		c.Metrics.Path = "/metrics"
 	}
+	if c.Network.ClusterDomain == "" {
+		c.Network.ClusterDomain = "cluster.local"
+	}
+	if c.Network.Overlay.Interface == "" {
+		c.Network.Overlay.Interface = "orca0"
+	}
+	if c.Network.Overlay.ListenPort == 0 {
+		c.Network.Overlay.ListenPort = 51820
+	}
+	if c.Security.DefaultProfile == "" {
+		c.Security.DefaultProfile = ProfileBaseline
+	}
+	if c.Network.ServiceProxy.PortRange == "" {
+		c.Network.ServiceProxy.PortRange = "40000-40999"
+	}
 }
 
 // GetResourceTags returns the combined set of default and user-specified tags.
@@ -245,13 +584,15 @@ func (c *AWSConfig) GetResourceTags() map[string]string {
 }
 
 // GetPodTags returns tags specific to a pod instance.
-// Includes base resource tags plus pod-specific metadata.
-func (c *AWSConfig) GetPodTags(podNamespace, podName, instanceType string) map[string]string {
+// Includes base resource tags plus pod-specific metadata. The pod's UID
+// tells its instance apart from those of earlier pods with the same name.
+func (c *AWSConfig) GetPodTags(podNamespace, podName, podUID, instanceType string) map[string]string {
 	tags := c.GetResourceTags()
 
 	// Add pod-specific tags
 	tags["orca.research/pod-namespace"] = podNamespace
 	tags["orca.research/pod-name"] = podName
+	tags["orca.research/pod-uid"] = podUID
 	tags["orca.research/instance-type"] = instanceType
 
 	return tags
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -325,6 +326,185 @@ func TestValidate(t *testing.T) {
 			t.Error("expected validation error for invalid selection mode")
 		}
 	})
+
+	t.Run("agent CA cert without key", func(t *testing.T) {
+		cfg := &Config{
+			AWS: AWSConfig{
+				Region:           "us-east-1",
+				VPCID:            "vpc-12345",
+				SubnetID:         "subnet-12345",
+				SecurityGroupIDs: []string{"sg-12345"},
+			},
+			Node: NodeConfig{
+				Name: "test-node",
+			},
+			Agent: AgentConfig{
+				CACertFile: "/etc/orca/agent-ca/tls.crt",
+			},
+		}
+
+		if err := cfg.Validate(); err == nil {
+			t.Error("expected validation error for agent CA cert without key")
+		}
+	})
+
+	t.Run("kubelet cert without key", func(t *testing.T) {
+		cfg := &Config{
+			AWS: AWSConfig{
+				Region: "us-east-1",
+			},
+			Node: NodeConfig{
+				Name:   "test-node",
+				CPU:    "100",
+				Memory: "1Ti",
+				Pods:   "500",
+			},
+			Kubelet: KubeletConfig{
+				CertFile: "/etc/orca/kubelet/tls.crt",
+			},
+		}
+
+		if err := cfg.Validate(); err == nil {
+			t.Error("expected validation error for kubelet cert without key")
+		}
+	})
+
+	t.Run("agent API server URL", func(t *testing.T) {
+		tests := []struct {
+			url     string
+			wantErr bool
+		}{
+			{"https://ABCD.gr7.us-east-1.eks.amazonaws.com", false},
+			{"https://10.0.0.10:6443", false},
+			{"http://10.0.0.10:6443", true},
+			{"10.0.0.10:6443", true},
+		}
+
+		for _, tt := range tests {
+			cfg := &Config{
+				AWS: AWSConfig{
+					Region: "us-east-1",
+				},
+				Node: NodeConfig{
+					Name:   "test-node",
+					CPU:    "100",
+					Memory: "1Ti",
+					Pods:   "500",
+				},
+				Agent: AgentConfig{
+					APIServerURL: tt.url,
+				},
+			}
+
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with apiServerURL %q error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		}
+	})
+
+	t.Run("root volume", func(t *testing.T) {
+		encrypted := true
+		tests := []struct {
+			name     string
+			volume   RootVolume
+			template *RootVolume
+			wantErr  bool
+		}{
+			{"unset", RootVolume{}, nil, false},
+			{"gp3 with IOPS and throughput", RootVolume{VolumeType: "gp3", IOPS: 6000, Throughput: 500}, nil, false},
+			{"encrypted with key", RootVolume{Encrypted: &encrypted, KMSKeyID: "alias/orca"}, nil, false},
+			{"template sets IOPS for gp3", RootVolume{VolumeType: "gp3"}, &RootVolume{IOPS: 16000}, false},
+			{"unknown type", RootVolume{VolumeType: "gp4"}, nil, true},
+			{"IOPS on gp2", RootVolume{VolumeType: "gp2", IOPS: 3000}, nil, true},
+			{"throughput on io2", RootVolume{VolumeType: "io2", Throughput: 500}, nil, true},
+			{"key without encryption", RootVolume{KMSKeyID: "alias/orca"}, nil, true},
+			{"template throughput on io2", RootVolume{VolumeType: "io2"}, &RootVolume{Throughput: 500}, true},
+		}
+
+		for _, tt := range tests {
+			cfg := &Config{
+				AWS: AWSConfig{
+					Region:     "us-east-1",
+					RootVolume: tt.volume,
+				},
+				Node: NodeConfig{
+					Name:   "test-node",
+					CPU:    "100",
+					Memory: "1Ti",
+					Pods:   "500",
+				},
+				Instances: InstancesConfig{
+					Templates: map[string]WorkloadTemplate{
+						"training": {InstanceType: "p5.48xlarge", RootVolume: tt.template},
+					},
+				},
+			}
+
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with root volume %s error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		}
+	})
+
+	t.Run("network", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			network NetworkConfig
+			wantErr bool
+		}{
+			{"unset", NetworkConfig{}, false},
+			{"cluster DNS", NetworkConfig{ClusterDNS: []string{"10.96.0.10"}}, false},
+			{"overlay", NetworkConfig{Overlay: OverlayConfig{Enabled: true, PodCIDR: "100.96.0.0/16", PrivateKeyFile: "/etc/orca/overlay/private.key", Routes: []string{"10.96.0.0/12", "192.168.0.0/16"}}}, false},
+			{"disabled overlay is not checked", NetworkConfig{Overlay: OverlayConfig{PodCIDR: "invalid"}}, false},
+			{"bad cluster DNS", NetworkConfig{ClusterDNS: []string{"kube-dns"}}, true},
+			{"overlay without pod CIDR", NetworkConfig{Overlay: OverlayConfig{Enabled: true}}, true},
+			{"IPv6 pod CIDR", NetworkConfig{Overlay: OverlayConfig{Enabled: true, PodCIDR: "fd00::/64"}}, true},
+			{"pod CIDR too small", NetworkConfig{Overlay: OverlayConfig{Enabled: true, PodCIDR: "100.96.0.0/31"}}, true},
+			{"overlay without private key file", NetworkConfig{Overlay: OverlayConfig{Enabled: true, PodCIDR: "100.96.0.0/16"}}, true},
+			{"bad route", NetworkConfig{Overlay: OverlayConfig{Enabled: true, PodCIDR: "100.96.0.0/16", PrivateKeyFile: "/etc/orca/overlay/private.key", Routes: []string{"10.96.0.0"}}}, true},
+			{"service proxy", NetworkConfig{ServiceProxy: ServiceProxyConfig{Enabled: true, Address: "10.0.0.10", PortRange: "40000-40099"}}, false},
+			{"service proxy with defaults", NetworkConfig{ServiceProxy: ServiceProxyConfig{Enabled: true}}, false},
+			{"bad service proxy address", NetworkConfig{ServiceProxy: ServiceProxyConfig{Enabled: true, Address: "orca"}}, true},
+			{"bad service proxy port range", NetworkConfig{ServiceProxy: ServiceProxyConfig{Enabled: true, PortRange: "40099-40000"}}, true},
+			{"service proxy port out of range", NetworkConfig{ServiceProxy: ServiceProxyConfig{Enabled: true, PortRange: "65000-70000"}}, true},
+			{"overlay and service proxy", NetworkConfig{
+				Overlay:      OverlayConfig{Enabled: true, PodCIDR: "100.96.0.0/16"},
+				ServiceProxy: ServiceProxyConfig{Enabled: true},
+			}, true},
+		}
+
+		for _, tt := range tests {
+			cfg := &Config{
+				AWS: AWSConfig{Region: "us-east-1"},
+				Node: NodeConfig{
+					Name:   "test-node",
+					CPU:    "100",
+					Memory: "1Ti",
+					Pods:   "500",
+				},
+				Network: tt.network,
+			}
+
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with network %s error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		}
+	})
+}
+
+func TestRootVolumeOverride(t *testing.T) {
+	encrypted := true
+	base := RootVolume{SizeGiB: 50, VolumeType: "gp3", Throughput: 250}
+
+	got := base.Override(&RootVolume{SizeGiB: 500, IOPS: 10000, Encrypted: &encrypted})
+	want := RootVolume{SizeGiB: 500, VolumeType: "gp3", IOPS: 10000, Throughput: 250, Encrypted: &encrypted}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Override() = %+v, want %+v", got, want)
+	}
+
+	if got := base.Override(nil); !reflect.DeepEqual(got, base) {
+		t.Errorf("Override(nil) = %+v, want %+v", got, base)
+	}
 }
 
 func TestNodeCapacity(t *testing.T) {
@@ -438,4 +618,28 @@ func TestSetDefaults(t *testing.T) {
 	if cfg.Metrics.Port != 8080 {
 		t.Errorf("expected default metrics port 8080, got %d", cfg.Metrics.Port)
 	}
+
+	if cfg.Agent.Port != 9440 {
+		t.Errorf("expected default agent port 9440, got %d", cfg.Agent.Port)
+	}
+
+	if cfg.Kubelet.Port != 10250 {
+		t.Errorf("expected default kubelet port 10250, got %d", cfg.Kubelet.Port)
+	}
+
+	if cfg.Kubelet.CertDir != "/var/lib/orca/pki" {
+		t.Errorf("expected default kubelet cert dir /var/lib/orca/pki, got %s", cfg.Kubelet.CertDir)
+	}
+
+	if cfg.Network.ClusterDomain != "cluster.local" {
+		t.Errorf("expected default cluster domain cluster.local, got %s", cfg.Network.ClusterDomain)
+	}
+
+	if cfg.Network.Overlay.Interface != "orca0" || cfg.Network.Overlay.ListenPort != 51820 {
+		t.Errorf("expected default overlay interface orca0 on port 51820, got %s on %d", cfg.Network.Overlay.Interface, cfg.Network.Overlay.ListenPort)
+	}
+
+	if cfg.Network.ServiceProxy.PortRange != "40000-40999" {
+		t.Errorf("expected default service proxy port range 40000-40999, got %s", cfg.Network.ServiceProxy.PortRange)
+	}
 }
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodSecurityProfile is a level of the Kubernetes Pod Security Standards.
+type PodSecurityProfile string
+
+const (
+	// ProfilePrivileged allows everything.
+	ProfilePrivileged PodSecurityProfile = "privileged"
+
+	// ProfileBaseline prevents known privilege escalations: host
+	// namespaces, privileged containers, added capabilities beyond the
+	// runtime's defaults, hostPath volumes and host ports, among others.
+	ProfileBaseline PodSecurityProfile = "baseline"
+
+	// ProfileRestricted additionally requires pods to run as non-root
+	// without privilege escalation, with a seccomp profile and with every
+	// capability dropped.
+	ProfileRestricted PodSecurityProfile = "restricted"
+)
+
+// SecurityConfig is the policy pods must follow to run on ORCA's
+// instances. Pods that violate the profile of their namespace are failed
+// before an instance is launched for them.
+type SecurityConfig struct {
+	// DefaultProfile applies to namespaces not in Namespaces.
+	DefaultProfile PodSecurityProfile `yaml:"defaultProfile"`
+
+	// Namespaces sets the profiles of individual namespaces.
+	Namespaces map[string]PodSecurityProfile `yaml:"namespaces,omitempty"`
+}
+
+// Profile returns the profile pods in a namespace must follow.
+func (c SecurityConfig) Profile(namespace string) PodSecurityProfile {
+	if profile, ok := c.Namespaces[namespace]; ok {
+		return profile
+	}
+	if c.DefaultProfile == "" {
+		return ProfileBaseline
+	}
+	return c.DefaultProfile
+}
+
+// CheckPod returns the ways a pod violates the profile of its namespace,
+// or nil if it follows it.
+func (c SecurityConfig) CheckPod(pod *corev1.Pod) []string {
+	switch c.Profile(pod.Namespace) {
+	case ProfileRestricted:
+		return append(checkBaseline(pod), checkRestricted(pod)...)
+	case ProfileBaseline:
+		return checkBaseline(pod)
+	}
+	return nil
+}
+
+// validate checks that the default profile and those of namespaces are
+// known profiles. An empty default stands for baseline.
+func (c SecurityConfig) validate() error {
+	profiles := []PodSecurityProfile{c.DefaultProfile}
+	for _, profile := range c.Namespaces {
+		profiles = append(profiles, profile)
+	}
+	for _, profile := range profiles {
+		switch profile {
+		case "", ProfilePrivileged, ProfileBaseline, ProfileRestricted:
+		default:
+			return fmt.Errorf("security profile %q must be privileged, baseline or restricted", profile)
+		}
+	}
+	return nil
+}
+
+// baselineCapabilities are the capabilities the baseline profile lets
+// containers add: those container runtimes grant by default.
+var baselineCapabilities = []corev1.Capability{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+	"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// safeSysctls are the sysctls the baseline profile allows, which are
+// namespaced and isolated between pods.
+var safeSysctls = []string{
+	"kernel.shm_rmid_forced", "net.ipv4.ip_local_port_range", "net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.tcp_syncookies", "net.ipv4.ping_group_range", "net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.tcp_keepalive_time", "net.ipv4.tcp_fin_timeout", "net.ipv4.tcp_keepalive_intvl",
+	"net.ipv4.tcp_keepalive_probes",
+}
+
+// selinuxTypes are the SELinux types the baseline profile allows.
+var selinuxTypes = []string{"", "container_t", "container_init_t", "container_kvm_t", "container_engine_t"}
+
+// podContainers returns every container of a pod with its kind, as named
+// in violations.
+func podContainers(pod *corev1.Pod) (containers []corev1.Container, kinds []string) {
+	for _, c := range pod.Spec.InitContainers {
+		containers, kinds = append(containers, c), append(kinds, "init container")
+	}
+	for _, c := range pod.Spec.Containers {
+		containers, kinds = append(containers, c), append(kinds, "container")
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		containers, kinds = append(containers, corev1.Container(c.EphemeralContainerCommon)), append(kinds, "ephemeral container")
+	}
+	return containers, kinds
+}
+
+// checkBaseline returns the ways a pod violates the baseline profile.
+func checkBaseline(pod *corev1.Pod) []string {
+	var violations []string
+	spec := pod.Spec
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		violations = append(violations, "host namespaces (hostNetwork, hostPID or hostIPC) are not allowed")
+	}
+	for _, v := range spec.Volumes {
+		if v.HostPath != nil {
+			violations = append(violations, fmt.Sprintf("volume %q is a hostPath volume", v.Name))
+		}
+	}
+
+	podContext := spec.SecurityContext
+	if podContext == nil {
+		podContext = &corev1.PodSecurityContext{}
+	}
+	if seccompUnconfined(podContext.SeccompProfile) {
+		violations = append(violations, "pod seccomp profile must not be Unconfined")
+	}
+	if !selinuxAllowed(podContext.SELinuxOptions) {
+		violations = append(violations, "pod SELinux options are not allowed")
+	}
+	for _, sysctl := range podContext.Sysctls {
+		if !slices.Contains(safeSysctls, sysctl.Name) {
+			violations = append(violations, fmt.Sprintf("sysctl %s is not allowed", sysctl.Name))
+		}
+	}
+
+	containers, kinds := podContainers(pod)
+	for i, c := range containers {
+		name := fmt.Sprintf("%s %q", kinds[i], c.Name)
+		for _, port := range c.Ports {
+			if port.HostPort != 0 {
+				violations = append(violations, fmt.Sprintf("%s uses host port %d", name, port.HostPort))
+			}
+		}
+
+		sc := c.SecurityContext
+		if sc == nil {
+			continue
+		}
+		if sc.Privileged != nil && *sc.Privileged {
+			violations = append(violations, name+" must not be privileged")
+		}
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Add {
+				if !slices.Contains(baselineCapabilities, capability) {
+					violations = append(violations, fmt.Sprintf("%s must not add capability %s", name, capability))
+				}
+			}
+		}
+		if seccompUnconfined(sc.SeccompProfile) {
+			violations = append(violations, name+" seccomp profile must not be Unconfined")
+		}
+		if !selinuxAllowed(sc.SELinuxOptions) {
+			violations = append(violations, name+" SELinux options are not allowed")
+		}
+		if sc.ProcMount != nil && *sc.ProcMount != corev1.DefaultProcMount {
+			violations = append(violations, name+" must use the default /proc mount")
+		}
+	}
+	return violations
+}
+
+// checkRestricted returns the ways a pod violates the restricted profile
+// beyond the baseline.
+func checkRestricted(pod *corev1.Pod) []string {
+	var violations []string
+	for _, v := range pod.Spec.Volumes {
+		// hostPath volumes fail the baseline already
+		switch {
+		case v.ConfigMap != nil, v.CSI != nil, v.DownwardAPI != nil, v.EmptyDir != nil, v.Ephemeral != nil,
+			v.PersistentVolumeClaim != nil, v.Projected != nil, v.Secret != nil, v.HostPath != nil:
+		default:
+			violations = append(violations, fmt.Sprintf("volume %q has a type the restricted profile does not allow", v.Name))
+		}
+	}
+
+	podContext := pod.Spec.SecurityContext
+	if podContext == nil {
+		podContext = &corev1.PodSecurityContext{}
+	}
+	if podContext.RunAsUser != nil && *podContext.RunAsUser == 0 {
+		violations = append(violations, "pod must not run as user 0")
+	}
+
+	containers, kinds := podContainers(pod)
+	for i, c := range containers {
+		name := fmt.Sprintf("%s %q", kinds[i], c.Name)
+		sc := c.SecurityContext
+		if sc == nil {
+			sc = &corev1.SecurityContext{}
+		}
+
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			violations = append(violations, name+" must set allowPrivilegeEscalation to false")
+		}
+		runAsNonRoot := podContext.RunAsNonRoot
+		if sc.RunAsNonRoot != nil {
+			runAsNonRoot = sc.RunAsNonRoot
+		}
+		if runAsNonRoot == nil || !*runAsNonRoot {
+			violations = append(violations, name+" must set runAsNonRoot to true")
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+			violations = append(violations, name+" must not run as user 0")
+		}
+
+		seccomp := podContext.SeccompProfile
+		if sc.SeccompProfile != nil {
+			seccomp = sc.SeccompProfile
+		}
+		if seccomp == nil || (seccomp.Type != corev1.SeccompProfileTypeRuntimeDefault && seccomp.Type != corev1.SeccompProfileTypeLocalhost) {
+			violations = append(violations, name+" must set a RuntimeDefault or Localhost seccomp profile")
+		}
+
+		if sc.Capabilities == nil || !slices.Contains(sc.Capabilities.Drop, "ALL") {
+			violations = append(violations, name+" must drop ALL capabilities")
+		}
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Add {
+				if capability != "NET_BIND_SERVICE" {
+					violations = append(violations, fmt.Sprintf("%s may only add capability NET_BIND_SERVICE, not %s", name, capability))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// seccompUnconfined reports whether a seccomp profile turns seccomp off.
+func seccompUnconfined(profile *corev1.SeccompProfile) bool {
+	return profile != nil && profile.Type == corev1.SeccompProfileTypeUnconfined
+}
+
+// selinuxAllowed reports whether the baseline profile allows SELinux
+// options: no custom user or role, and a container type.
+func selinuxAllowed(options *corev1.SELinuxOptions) bool {
+	if options == nil {
+		return true
+	}
+	return options.User == "" && options.Role == "" && slices.Contains(selinuxTypes, options.Type)
+}
+
+// FormatViolations joins the violations of a profile into one message.
+func FormatViolations(profile PodSecurityProfile, violations []string) string {
+	return fmt.Sprintf("pod violates the %s security profile: %s", profile, strings.Join(violations, "; "))
+}
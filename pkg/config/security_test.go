@@ -0,0 +1,185 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecurityProfile(t *testing.T) {
+	cfg := SecurityConfig{
+		DefaultProfile: ProfileRestricted,
+		Namespaces:     map[string]PodSecurityProfile{"kube-system": ProfilePrivileged},
+	}
+	if got := cfg.Profile("kube-system"); got != ProfilePrivileged {
+		t.Errorf("Profile(kube-system) = %s, want privileged", got)
+	}
+	if got := cfg.Profile("ml"); got != ProfileRestricted {
+		t.Errorf("Profile(ml) = %s, want restricted", got)
+	}
+	if got := (SecurityConfig{}).Profile("ml"); got != ProfileBaseline {
+		t.Errorf("Profile() without a default = %s, want baseline", got)
+	}
+}
+
+func TestSecurityCheckPod(t *testing.T) {
+	yes, no := true, false
+	user, root := int64(1000), int64(0)
+
+	// restrictedPod follows the restricted profile
+	restrictedPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "ml"},
+			Spec: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{
+					RunAsNonRoot:   &yes,
+					RunAsUser:      &user,
+					SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				},
+				Containers: []corev1.Container{{
+					Name: "trainer",
+					SecurityContext: &corev1.SecurityContext{
+						AllowPrivilegeEscalation: &no,
+						Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: []corev1.Capability{"NET_BIND_SERVICE"}},
+					},
+				}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		profile PodSecurityProfile
+		modify  func(pod *corev1.Pod)
+		want    []string
+	}{
+		{
+			name:    "restricted pod",
+			profile: ProfileRestricted,
+			modify:  func(pod *corev1.Pod) {},
+		},
+		{
+			name:    "privileged container",
+			profile: ProfileBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext.Privileged = &yes
+			},
+			want: []string{`container "trainer" must not be privileged`},
+		},
+		{
+			name:    "privileged profile allows anything",
+			profile: ProfilePrivileged,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.HostNetwork = true
+				pod.Spec.Containers[0].SecurityContext.Privileged = &yes
+			},
+		},
+		{
+			name:    "host namespaces and ports",
+			profile: ProfileBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.HostPID = true
+				pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 80}}
+			},
+			want: []string{"host namespaces", `container "trainer" uses host port 80`},
+		},
+		{
+			name:    "added capabilities",
+			profile: ProfileBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext.Capabilities.Add = []corev1.Capability{"CHOWN", "SYS_ADMIN"}
+			},
+			want: []string{"must not add capability SYS_ADMIN"},
+		},
+		{
+			name:    "unconfined seccomp",
+			profile: ProfileBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext.SeccompProfile.Type = corev1.SeccompProfileTypeUnconfined
+			},
+			want: []string{"pod seccomp profile must not be Unconfined"},
+		},
+		{
+			name:    "hostPath volume",
+			profile: ProfileRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Volumes = []corev1.Volume{{Name: "docker", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/run"}}}}
+			},
+			want: []string{`volume "docker" is a hostPath volume`},
+		},
+		{
+			name:    "unsafe sysctl",
+			profile: ProfileBaseline,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext.Sysctls = []corev1.Sysctl{{Name: "kernel.msgmax", Value: "65536"}}
+			},
+			want: []string{"sysctl kernel.msgmax is not allowed"},
+		},
+		{
+			name:    "root under restricted",
+			profile: ProfileRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext.RunAsNonRoot = nil
+				pod.Spec.Containers[0].SecurityContext.RunAsUser = &root
+			},
+			want: []string{`container "trainer" must set runAsNonRoot to true`, `container "trainer" must not run as user 0`},
+		},
+		{
+			name:    "baseline pod under restricted",
+			profile: ProfileRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext = nil
+				pod.Spec.InitContainers = []corev1.Container{{Name: "setup"}}
+				pod.Spec.Volumes = []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}}}}
+			},
+			want: []string{
+				`volume "data" has a type`,
+				`init container "setup" must set allowPrivilegeEscalation to false`,
+				`init container "setup" must set runAsNonRoot to true`,
+				`init container "setup" must set a RuntimeDefault or Localhost seccomp profile`,
+				`init container "setup" must drop ALL capabilities`,
+				`container "trainer" must set runAsNonRoot to true`,
+				`container "trainer" must set a RuntimeDefault or Localhost seccomp profile`,
+			},
+		},
+		{
+			name:    "restricted capabilities",
+			profile: ProfileRestricted,
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext.Capabilities = &corev1.Capabilities{Add: []corev1.Capability{"CHOWN"}}
+			},
+			want: []string{`must drop ALL capabilities`, `may only add capability NET_BIND_SERVICE, not CHOWN`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := restrictedPod()
+			tt.modify(pod)
+			cfg := SecurityConfig{DefaultProfile: tt.profile}
+
+			violations := cfg.CheckPod(pod)
+			if len(violations) != len(tt.want) {
+				t.Fatalf("CheckPod() = %q, want %d violations", violations, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(violations[i], want) {
+					t.Errorf("violation %d = %q, want it to contain %q", i, violations[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityValidate(t *testing.T) {
+	valid := SecurityConfig{DefaultProfile: ProfileRestricted, Namespaces: map[string]PodSecurityProfile{"ops": ProfilePrivileged}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	invalid := SecurityConfig{Namespaces: map[string]PodSecurityProfile{"ops": "permissive"}}
+	if err := invalid.validate(); err == nil {
+		t.Error("expected an unknown profile to be rejected")
+	}
+}
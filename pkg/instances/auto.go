@@ -2,7 +2,6 @@ package instances
 
 import (
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // AutoSelector automatically selects instance type based on pod resource requests.
@@ -16,22 +15,12 @@ func NewAutoSelector() *AutoSelector {
 
 // Select returns an instance type based on pod resource requirements.
 func (s *AutoSelector) Select(pod *corev1.Pod) (string, error) {
-	// Calculate total resource requests
-	var totalCPU resource.Quantity
-	var totalMemory resource.Quantity
-	var gpuCount int64
-
-	for _, container := range pod.Spec.Containers {
-		if cpu, ok := container.Resources.Requests[corev1.ResourceCPU]; ok {
-			totalCPU.Add(cpu)
-		}
-		if memory, ok := container.Resources.Requests[corev1.ResourceMemory]; ok {
-			totalMemory.Add(memory)
-		}
-		if gpu, ok := container.Resources.Requests["nvidia.com/gpu"]; ok {
-			gpuCount += gpu.Value()
-		}
-	}
+	// Calculate effective resource requests, including init containers
+	requests := PodRequests(pod)
+	totalCPU := requests[corev1.ResourceCPU]
+	totalMemory := requests[corev1.ResourceMemory]
+	gpu := requests["nvidia.com/gpu"]
+	gpuCount := gpu.Value()
 
 	// If GPU requested, select GPU instance
 	if gpuCount > 0 {
@@ -0,0 +1,62 @@
+package instances
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodRequests returns the effective resource requests of a pod, following
+// Kubernetes' rules: the larger of what the app containers need alongside
+// the sidecars, and what each init container needs alongside the sidecars
+// started before it. Pod overhead is added on top.
+func PodRequests(pod *corev1.Pod) corev1.ResourceList {
+	// App containers run together with every sidecar
+	requests := corev1.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		addResources(requests, c.Resources.Requests)
+	}
+
+	initRequests := corev1.ResourceList{}
+	sidecars := corev1.ResourceList{}
+	for _, c := range pod.Spec.InitContainers {
+		step := c.Resources.Requests
+		if c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			addResources(sidecars, c.Resources.Requests)
+			step = sidecars
+		} else {
+			step = sumResources(step, sidecars)
+		}
+		maxResources(initRequests, step)
+	}
+
+	addResources(requests, sidecars)
+	maxResources(requests, initRequests)
+	addResources(requests, pod.Spec.Overhead)
+
+	return requests
+}
+
+// addResources adds src to dst.
+func addResources(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		sum := dst[name]
+		sum.Add(quantity)
+		dst[name] = sum
+	}
+}
+
+// sumResources returns a + b.
+func sumResources(a, b corev1.ResourceList) corev1.ResourceList {
+	sum := corev1.ResourceList{}
+	addResources(sum, a)
+	addResources(sum, b)
+	return sum
+}
+
+// maxResources raises each resource in dst to at least its value in src.
+func maxResources(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		if current, ok := dst[name]; !ok || quantity.Cmp(current) > 0 {
+			dst[name] = quantity.DeepCopy()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package instances
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestPodRequests(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	container := func(name, cpu, memory string) corev1.Container {
+		return corev1.Container{
+			Name: name,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				},
+			},
+		}
+	}
+	sidecar := func(name, cpu, memory string) corev1.Container {
+		c := container(name, cpu, memory)
+		c.RestartPolicy = &always
+		return c
+	}
+
+	tests := []struct {
+		name           string
+		spec           corev1.PodSpec
+		expectedCPU    string
+		expectedMemory string
+	}{
+		{
+			name: "app containers are summed",
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{container("a", "1", "1Gi"), container("b", "2", "2Gi")},
+			},
+			expectedCPU:    "3",
+			expectedMemory: "3Gi",
+		},
+		{
+			name: "larger init container wins",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{container("init", "4", "1Gi")},
+				Containers:     []corev1.Container{container("app", "1", "2Gi")},
+			},
+			expectedCPU:    "4",
+			expectedMemory: "2Gi",
+		},
+		{
+			name: "sidecars run alongside app containers",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{sidecar("proxy", "500m", "256Mi")},
+				Containers:     []corev1.Container{container("app", "1", "1Gi")},
+			},
+			expectedCPU:    "1500m",
+			expectedMemory: "1280Mi",
+		},
+		{
+			name: "init containers run alongside earlier sidecars",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					sidecar("proxy", "1", "1Gi"),
+					container("migrate", "2", "1Gi"),
+				},
+				Containers: []corev1.Container{container("app", "1", "1Gi")},
+			},
+			expectedCPU:    "3",
+			expectedMemory: "2Gi",
+		},
+		{
+			name: "overhead is added",
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{container("app", "1", "1Gi")},
+				Overhead: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("250m"),
+					corev1.ResourceMemory: resource.MustParse("128Mi"),
+				},
+			},
+			expectedCPU:    "1250m",
+			expectedMemory: "1152Mi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := PodRequests(&corev1.Pod{Spec: tt.spec})
+
+			cpu := requests[corev1.ResourceCPU]
+			if cpu.Cmp(resource.MustParse(tt.expectedCPU)) != 0 {
+				t.Errorf("expected cpu %s, got %s", tt.expectedCPU, cpu.String())
+			}
+			memory := requests[corev1.ResourceMemory]
+			if memory.Cmp(resource.MustParse(tt.expectedMemory)) != 0 {
+				t.Errorf("expected memory %s, got %s", tt.expectedMemory, memory.String())
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/virtual-kubelet/virtual-kubelet/node"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	corev1 "k8s.io/api/core/v1"
 
@@ -15,6 +16,9 @@ type VirtualKubeletAdapter struct {
 	provider *provider.OrcaProvider
 }
 
+// The adapter pushes pod status changes instead of being polled.
+var _ node.PodNotifier = (*VirtualKubeletAdapter)(nil)
+
 // NewVirtualKubeletAdapter creates a new adapter.
 func NewVirtualKubeletAdapter(p *provider.OrcaProvider) *VirtualKubeletAdapter {
 	return &VirtualKubeletAdapter{
@@ -47,6 +51,13 @@ func (a *VirtualKubeletAdapter) GetPodStatus(ctx context.Context, namespace, nam
 	return a.provider.GetPodStatus(ctx, namespace, name)
 }
 
+// NotifyPods registers a callback that receives pod status changes. This
+// makes the adapter a node.PodNotifier, so status is pushed rather than
+// polled through GetPodStatus.
+func (a *VirtualKubeletAdapter) NotifyPods(ctx context.Context, cb func(*corev1.Pod)) {
+	a.provider.NotifyPods(ctx, cb)
+}
+
 // GetPods retrieves a list of all pods running on the provider.
 func (a *VirtualKubeletAdapter) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
 	return a.provider.GetPods(ctx)
@@ -56,54 +67,95 @@ func (a *VirtualKubeletAdapter) GetPods(ctx context.Context) ([]*corev1.Pod, err
 func (a *VirtualKubeletAdapter) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
 	// Convert api.ContainerLogOpts to provider.ContainerLogOpts
 	providerOpts := provider.ContainerLogOpts{
-		Tail:       opts.Tail,
-		Follow:     opts.Follow,
-		Previous:   opts.Previous,
-		Timestamps: opts.Timestamps,
-		SinceTime:  opts.SinceTime,
-	}
-
-	_, err := a.provider.GetContainerLogs(ctx, namespace, podName, containerName, providerOpts)
-	if err != nil {
-		return nil, err
+		Tail:         opts.Tail,
+		LimitBytes:   opts.LimitBytes,
+		Follow:       opts.Follow,
+		Previous:     opts.Previous,
+		Timestamps:   opts.Timestamps,
+		SinceSeconds: opts.SinceSeconds,
+		SinceTime:    opts.SinceTime,
 	}
 
-	// TODO: Return proper reader with actual log data
-	return io.NopCloser(io.Reader(nil)), nil
+	return a.provider.GetContainerLogs(ctx, namespace, podName, containerName, providerOpts)
 }
 
 // RunInContainer executes a command in a container in the pod, copying data
 // between in/out/err and the container's stdin/stdout/stderr.
 func (a *VirtualKubeletAdapter) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
-	// Create adapter for AttachIO
-	providerAttach := &attachIOAdapter{attach: attach}
-	return a.provider.RunInContainer(ctx, namespace, podName, containerName, cmd, providerAttach)
+	return a.provider.RunInContainer(ctx, namespace, podName, containerName, cmd, newAttachIOAdapter(ctx, attach))
+}
+
+// AttachToContainer attaches to the main process of a container in the pod,
+// copying data between in/out/err and the container's stdin/stdout/stderr.
+func (a *VirtualKubeletAdapter) AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach api.AttachIO) error {
+	return a.provider.AttachToContainer(ctx, namespace, podName, containerName, newAttachIOAdapter(ctx, attach))
+}
+
+// PortForward forwards a local port to a port of the pod.
+// It implements virtual-kubelet's api.PortForwardHandlerFunc.
+func (a *VirtualKubeletAdapter) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	return a.provider.PortForward(ctx, namespace, pod, port, stream)
 }
 
 // attachIOAdapter adapts api.AttachIO to provider.AttachIO.
 type attachIOAdapter struct {
 	attach api.AttachIO
+	resize chan provider.TermSize
+}
+
+// newAttachIOAdapter wraps attach, converting resize events until ctx is
+// cancelled.
+func newAttachIOAdapter(ctx context.Context, attach api.AttachIO) *attachIOAdapter {
+	a := &attachIOAdapter{attach: attach}
+
+	if sizes := attach.Resize(); sizes != nil {
+		a.resize = make(chan provider.TermSize)
+		go func() {
+			defer close(a.resize)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case size, ok := <-sizes:
+					if !ok {
+						return
+					}
+					select {
+					case a.resize <- provider.TermSize{Width: size.Width, Height: size.Height}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	return a
 }
 
-func (a *attachIOAdapter) Stdin() []byte {
-	// TODO: Implement proper stdin reading
-	return nil
+func (a *attachIOAdapter) Stdin() io.Reader {
+	return a.attach.Stdin()
 }
 
-func (a *attachIOAdapter) Stdout() chan []byte {
-	// TODO: Implement proper stdout channel
-	return make(chan []byte)
+func (a *attachIOAdapter) Stdout() io.WriteCloser {
+	return a.attach.Stdout()
 }
 
-func (a *attachIOAdapter) Stderr() chan []byte {
-	// TODO: Implement proper stderr channel
-	return make(chan []byte)
+func (a *attachIOAdapter) Stderr() io.WriteCloser {
+	return a.attach.Stderr()
 }
 
 func (a *attachIOAdapter) TTY() bool {
 	return a.attach.TTY()
 }
 
+func (a *attachIOAdapter) Resize() <-chan provider.TermSize {
+	if a.resize == nil {
+		return nil
+	}
+	return a.resize
+}
+
 // ConfigureNode enables a provider to configure the node object that will be used for Kubernetes.
 func (a *VirtualKubeletAdapter) ConfigureNode(ctx context.Context, node *corev1.Node) {
 	a.provider.ConfigureNode(ctx, node)
@@ -0,0 +1,140 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kubeletAuth authenticates and authorizes kubelet API requests the way the
+// kubelet does: the caller is identified by a verified client certificate
+// or a bearer token (via TokenReview), and must be allowed the matching
+// node subresource (via SubjectAccessReview).
+type kubeletAuth struct {
+	client   kubernetes.Interface
+	nodeName string
+	logger   zerolog.Logger
+}
+
+// wrap rejects requests that are not authenticated and authorized.
+func (a *kubeletAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.authenticate(r)
+		if err != nil {
+			a.logger.Debug().Err(err).Str("path", r.URL.Path).Msg("Kubelet API request not authenticated")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		attrs := requestAttributes(r, a.nodeName)
+		allowed, err := a.authorize(r.Context(), user, attrs)
+		if err != nil {
+			a.logger.Error().Err(err).Str("user", user.Username).Msg("Failed to authorize kubelet API request")
+			http.Error(w, "Authorization error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			msg := fmt.Sprintf("Forbidden (user=%s, verb=%s, resource=nodes, subresource=%s)", user.Username, attrs.Verb, attrs.Subresource)
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate identifies the caller from its client certificate or bearer
+// token.
+func (a *kubeletAuth) authenticate(r *http.Request) (*authenticationv1.UserInfo, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		return &authenticationv1.UserInfo{
+			Username: cert.Subject.CommonName,
+			Groups:   cert.Subject.Organization,
+		}, nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("no client certificate or bearer token")
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("token not authenticated: %s", review.Status.Error)
+	}
+
+	return &review.Status.User, nil
+}
+
+// authorize checks that user may perform attrs.
+func (a *kubeletAuth) authorize(ctx context.Context, user *authenticationv1.UserInfo, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: attrs,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("subject access review failed: %w", err)
+	}
+
+	return review.Status.Allowed, nil
+}
+
+// requestAttributes maps a request to the node subresource the kubelet
+// checks for it: stats, metrics, log and spec for those paths, and proxy for
+// everything else, including exec, attach and port-forward.
+func requestAttributes(r *http.Request, nodeName string) *authorizationv1.ResourceAttributes {
+	verb := "get"
+	switch r.Method {
+	case http.MethodPost:
+		verb = "create"
+	case http.MethodPut:
+		verb = "update"
+	case http.MethodPatch:
+		verb = "patch"
+	case http.MethodDelete:
+		verb = "delete"
+	}
+
+	subresource := "proxy"
+	for _, s := range []struct{ path, subresource string }{
+		{"/stats", "stats"},
+		{"/metrics", "metrics"},
+		{"/logs", "log"},
+		{"/spec", "spec"},
+	} {
+		if r.URL.Path == s.path || strings.HasPrefix(r.URL.Path, s.path+"/") {
+			subresource = s.subresource
+			break
+		}
+	}
+
+	return &authorizationv1.ResourceAttributes{
+		Verb:        verb,
+		Resource:    "nodes",
+		Subresource: subresource,
+		Name:        nodeName,
+	}
+}
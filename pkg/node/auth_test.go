@@ -0,0 +1,95 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRequestAttributes(t *testing.T) {
+	tests := []struct {
+		method      string
+		path        string
+		verb        string
+		subresource string
+	}{
+		{http.MethodGet, "/stats/summary", "get", "stats"},
+		{http.MethodGet, "/metrics/resource", "get", "metrics"},
+		{http.MethodGet, "/containerLogs/default/web/app", "get", "proxy"},
+		{http.MethodPost, "/exec/default/web/app", "create", "proxy"},
+		{http.MethodGet, "/pods", "get", "proxy"},
+		{http.MethodGet, "/statsx", "get", "proxy"},
+		{http.MethodGet, "/logs/", "get", "log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			attrs := requestAttributes(httptest.NewRequest(tt.method, tt.path, nil), "orca-node")
+			if attrs.Verb != tt.verb || attrs.Subresource != tt.subresource {
+				t.Errorf("expected %s nodes/%s, got %s nodes/%s", tt.verb, tt.subresource, attrs.Verb, attrs.Subresource)
+			}
+			if attrs.Resource != "nodes" || attrs.Name != "orca-node" {
+				t.Errorf("unexpected resource %s/%s", attrs.Resource, attrs.Name)
+			}
+		})
+	}
+}
+
+func TestKubeletAuth(t *testing.T) {
+	client := fake.NewClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "metrics-server-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:metrics-server"}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		// metrics-server may read stats but not exec
+		review.Status.Allowed = review.Spec.User == "system:serviceaccount:kube-system:metrics-server" &&
+			review.Spec.ResourceAttributes.Subresource == "stats"
+		return true, review, nil
+	})
+
+	auth := &kubeletAuth{client: client, nodeName: "orca-node", logger: zerolog.Nop()}
+	handler := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/stats/summary", expected: http.StatusUnauthorized},
+		{name: "invalid token", method: http.MethodGet, path: "/stats/summary", token: "bogus", expected: http.StatusUnauthorized},
+		{name: "allowed", method: http.MethodGet, path: "/stats/summary", token: "metrics-server-token", expected: http.StatusOK},
+		{name: "forbidden", method: http.MethodPost, path: "/exec/default/web/app", token: "metrics-server-token", expected: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
@@ -2,28 +2,51 @@ package node
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/scttfrdmn/orca/pkg/config"
 	"github.com/scttfrdmn/orca/pkg/provider"
 )
 
+const (
+	// informerResyncPeriod is how often informers resync their caches.
+	informerResyncPeriod = time.Minute
+
+	// podWorkers is the number of workers processing pod events.
+	podWorkers = 10
+)
+
 // Controller manages the Virtual Kubelet node lifecycle.
 type Controller struct {
-	config      *config.Config
-	provider    *provider.OrcaProvider
-	nodeRunner  *node.NodeController
-	kubeClient  kubernetes.Interface
-	logger      zerolog.Logger
-	version     string
-	namespace   string
+	config           *config.Config
+	provider         *provider.OrcaProvider
+	nodeRunner       *node.NodeController
+	podController    *node.PodController
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
+	kubeClient       kubernetes.Interface
+	clientCAs        *x509.CertPool
+	logger           zerolog.Logger
+	version          string
+	namespace        string
 }
 
 // NewController creates a new node controller.
@@ -32,13 +55,6 @@ func NewController(cfg *config.Config, kubeconfigPath, namespace, version string
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 
-	// Create ORCA provider
-	logger.Info().Msg("Creating ORCA provider")
-	orcaProvider, err := provider.NewProvider(cfg, cfg.Node.Name, namespace, version)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create provider: %w", err)
-	}
-
 	// Create Kubernetes client
 	logger.Info().Msg("Creating Kubernetes client")
 	kubeConfig, err := buildKubeConfig(kubeconfigPath)
@@ -51,13 +67,46 @@ func NewController(cfg *config.Config, kubeconfigPath, namespace, version string
 		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
 	}
 
+	clientCAs, err := loadClientCAs(cfg.Kubelet.ClientCAFile, kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubelet client CAs: %w", err)
+	}
+	if clientCAs == nil {
+		logger.Warn().Msg("No kubelet client CA available, only bearer tokens are accepted by the kubelet API")
+	}
+
+	// Pods on instances reach the API server where ORCA does, unless told
+	// otherwise. A service address is only routable inside the cluster.
+	if cfg.Agent.APIServerURL == "" {
+		cfg.Agent.APIServerURL = kubeConfig.Host
+		if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" && strings.Contains(kubeConfig.Host, host) {
+			logger.Warn().Str("url", kubeConfig.Host).
+				Msg("API server URL is a cluster service address that instances may not reach, set agent.apiServerURL")
+		}
+	}
+
+	// Pod events of the provider and the pod controller are recorded in
+	// Kubernetes once Run starts
+	eventBroadcaster := record.NewBroadcaster()
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(cfg.Node.Name, "pod-controller")})
+
+	// Create ORCA provider
+	logger.Info().Msg("Creating ORCA provider")
+	orcaProvider, err := provider.NewProvider(cfg, kubeClient, recorder, cfg.Node.Name, namespace, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider: %w", err)
+	}
+
 	return &Controller{
-		config:     cfg,
-		provider:   orcaProvider,
-		kubeClient: kubeClient,
-		logger:     logger,
-		version:    version,
-		namespace:  namespace,
+		config:           cfg,
+		provider:         orcaProvider,
+		eventBroadcaster: eventBroadcaster,
+		recorder:         recorder,
+		kubeClient:       kubeClient,
+		clientCAs:        clientCAs,
+		logger:           logger,
+		version:          version,
+		namespace:        namespace,
 	}, nil
 }
 
@@ -103,6 +152,68 @@ func (c *Controller) Run(ctx context.Context) error {
 
 	c.nodeRunner = nodeRunner
 
+	// Create informers for pods scheduled to this node and for the objects
+	// those pods reference
+	podInformerFactory := informers.NewSharedInformerFactoryWithOptions(
+		c.kubeClient,
+		informerResyncPeriod,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", c.config.Node.Name).String()
+		}),
+	)
+	scmInformerFactory := informers.NewSharedInformerFactory(c.kubeClient, informerResyncPeriod)
+
+	// Record pod events in Kubernetes
+	c.eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events(corev1.NamespaceAll)})
+	defer c.eventBroadcaster.Shutdown()
+
+	// Create pod controller, which drives the provider's pod lifecycle
+	c.logger.Info().Msg("Initializing Virtual Kubelet pod controller")
+	podController, err := node.NewPodController(node.PodControllerConfig{
+		PodClient:         c.kubeClient.CoreV1(),
+		PodInformer:       podInformerFactory.Core().V1().Pods(),
+		EventRecorder:     c.recorder,
+		Provider:          adapter,
+		ConfigMapInformer: scmInformerFactory.Core().V1().ConfigMaps(),
+		SecretInformer:    scmInformerFactory.Core().V1().Secrets(),
+		ServiceInformer:   scmInformerFactory.Core().V1().Services(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create pod controller: %w", err)
+	}
+
+	c.podController = podController
+
+	// Start informers and the pod controller
+	podInformerFactory.Start(ctx.Done())
+	scmInformerFactory.Start(ctx.Done())
+
+	// Track instance launches and pod status in the background; changes are
+	// pushed to the pod controller through NotifyPods
+	go c.provider.Run(ctx)
+
+	go func() {
+		if err := c.podController.Run(ctx, podWorkers); err != nil {
+			c.logger.Error().Err(err).Msg("Pod controller error")
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-c.podController.Ready():
+	case <-c.podController.Done():
+		return fmt.Errorf("pod controller error: %w", c.podController.Err())
+	}
+
+	// Serve the kubelet API for logs, exec, attach, port-forward and stats
+	kubelet := newKubeletServer(c.config.Kubelet, c.config.Node.Name, c.kubeClient, c.clientCAs, adapter, c.logger)
+	go func() {
+		if err := kubelet.Run(ctx); err != nil {
+			c.logger.Error().Err(err).Msg("Kubelet API server error")
+		}
+	}()
+
 	// Start the node runner
 	c.logger.Info().Msg("Starting Virtual Kubelet node controller")
 	if err := c.nodeRunner.Run(ctx); err != nil {
@@ -120,6 +231,32 @@ func (c *Controller) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// loadClientCAs returns the CAs that sign API server client certificates:
+// the configured file, or else the CA of the cluster connection. It returns
+// nil if neither is available.
+func loadClientCAs(caFile string, kubeConfig *rest.Config) (*x509.CertPool, error) {
+	caData := kubeConfig.TLSClientConfig.CAData
+	if caFile == "" && len(caData) == 0 {
+		caFile = kubeConfig.TLSClientConfig.CAFile
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		caData = data
+	}
+	if len(caData) == 0 {
+		return nil, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in client CA")
+	}
+	return pool, nil
+}
+
 // buildKubeConfig builds a Kubernetes REST config.
 func buildKubeConfig(kubeconfigPath string) (*rest.Config, error) {
 	if kubeconfigPath != "" {
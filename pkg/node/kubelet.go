@@ -0,0 +1,184 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/certificate"
+
+	"github.com/scttfrdmn/orca/pkg/config"
+)
+
+// streamIdleTimeout closes exec, attach and port-forward streams that have
+// seen no traffic for this long, matching the kubelet default.
+const streamIdleTimeout = 4 * time.Hour
+
+// kubeletServer serves the kubelet API of the virtual node over TLS.
+type kubeletServer struct {
+	config     config.KubeletConfig
+	nodeName   string
+	kubeClient kubernetes.Interface
+	clientCAs  *x509.CertPool
+	handler    http.Handler
+	logger     zerolog.Logger
+}
+
+// newKubeletServer creates the kubelet API server for the adapter's pods.
+// Requests are authenticated with client certificates signed by clientCAs
+// or with bearer tokens, and authorized against the node's subresources.
+func newKubeletServer(cfg config.KubeletConfig, nodeName string, kubeClient kubernetes.Interface, clientCAs *x509.CertPool, adapter *VirtualKubeletAdapter, logger zerolog.Logger) *kubeletServer {
+	mux := http.NewServeMux()
+	api.AttachPodRoutes(api.PodHandlerConfig{
+		RunInContainer:        adapter.RunInContainer,
+		AttachToContainer:     adapter.AttachToContainer,
+		PortForward:           adapter.PortForward,
+		GetContainerLogs:      adapter.GetContainerLogs,
+		GetPods:               adapter.GetPods,
+		GetPodsFromKubernetes: adapter.GetPods,
+		GetStatsSummary:       adapter.GetStatsSummary,
+		GetMetricsResource:    adapter.GetMetricsResource,
+		StreamIdleTimeout:     streamIdleTimeout,
+		StreamCreationTimeout: 30 * time.Second,
+	}, mux, false)
+
+	auth := &kubeletAuth{
+		client:   kubeClient,
+		nodeName: nodeName,
+		logger:   logger,
+	}
+
+	return &kubeletServer{
+		config:     cfg,
+		nodeName:   nodeName,
+		kubeClient: kubeClient,
+		clientCAs:  clientCAs,
+		handler:    auth.wrap(mux),
+		logger:     logger,
+	}
+}
+
+// Run serves the kubelet API until ctx is cancelled.
+func (s *kubeletServer) Run(ctx context.Context) error {
+	getCertificate, stop, err := s.certificateSource()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	addr := net.JoinHostPort("", strconv.Itoa(s.config.Port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	httpServer := &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getCertificate,
+			ClientCAs:      s.clientCAs,
+			ClientAuth:     tls.VerifyClientCertIfGiven,
+		},
+	}
+
+	s.logger.Info().Str("addr", addr).Msg("Starting kubelet API server")
+
+	errChan := make(chan error, 1)
+	go func() {
+		if err := httpServer.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return httpServer.Shutdown(shutdownCtx)
+	case err := <-errChan:
+		return fmt.Errorf("kubelet API server error: %w", err)
+	}
+}
+
+// certificateSource returns the serving certificate callback and a function
+// that releases it. Without a static certificate, the certificate is
+// requested through the CSR API and rotated before it expires.
+func (s *kubeletServer) certificateSource() (func(*tls.ClientHelloInfo) (*tls.Certificate, error), func(), error) {
+	if s.config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load kubelet serving certificate: %w", err)
+		}
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }, func() {}, nil
+	}
+
+	if err := os.MkdirAll(s.config.CertDir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	store, err := certificate.NewFileStore("kubelet-server", s.config.CertDir, s.config.CertDir, "", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate store: %w", err)
+	}
+
+	manager, err := certificate.NewManager(&certificate.Config{
+		ClientsetFn: func(*tls.Certificate) (kubernetes.Interface, error) {
+			return s.kubeClient, nil
+		},
+		GetTemplate: s.certificateTemplate,
+		SignerName:  certificatesv1.KubeletServingSignerName,
+		Usages: []certificatesv1.KeyUsage{
+			certificatesv1.UsageDigitalSignature,
+			certificatesv1.UsageServerAuth,
+		},
+		CertificateStore: store,
+		Name:             "kubelet-serving",
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate manager: %w", err)
+	}
+	manager.Start()
+
+	s.logger.Info().
+		Str("signer", certificatesv1.KubeletServingSignerName).
+		Msg("Requesting kubelet serving certificate; the CSR must be approved before the API is usable")
+
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := manager.Current()
+		if cert == nil {
+			return nil, fmt.Errorf("no serving certificate available yet")
+		}
+		return cert, nil
+	}
+
+	return getCertificate, manager.Stop, nil
+}
+
+// certificateTemplate is the CSR template for the serving certificate. The
+// kubelet-serving signer requires the node identity as the subject.
+func (s *kubeletServer) certificateTemplate() *x509.CertificateRequest {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "system:node:" + s.nodeName,
+			Organization: []string{"system:nodes"},
+		},
+		DNSNames: []string{s.nodeName},
+	}
+	if ip := net.ParseIP(s.config.Address); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	return template
+}
@@ -0,0 +1,604 @@
+package node
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/scttfrdmn/orca/pkg/config"
+	"github.com/scttfrdmn/orca/pkg/provider"
+)
+
+// testCA is a certificate authority that issues test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+
+	mu     sync.Mutex
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, serial: 1}
+}
+
+// issue signs a certificate for the public key from template and returns it
+// PEM encoded, along with its serial number.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate, pub any) ([]byte, int64) {
+	t.Helper()
+
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	template.SerialNumber = big.NewInt(serial)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Errorf("failed to issue certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), serial
+}
+
+// keyPair issues a certificate for a new key and returns both PEM encoded.
+func (ca *testCA) keyPair(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	certPEM, _ = ca.issue(t, template, &key.PublicKey)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// csrSigner approves or rejects the serving certificate requests of a fake
+// clientset, the way the kubelet-serving signer and an approver would.
+type csrSigner struct {
+	t  *testing.T
+	ca *testCA
+
+	// reject sets this condition instead of approving requests
+	reject certificatesv1.RequestConditionType
+	// lifetime returns the validity of the nth certificate, from 1
+	lifetime func(n int) (notBefore, notAfter time.Time)
+
+	mu       sync.Mutex
+	requests []*x509.CertificateRequest
+	issued   []int64
+}
+
+func (s *csrSigner) install(client *fake.Clientset) {
+	client.PrependReactor("create", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		csr := action.(k8stesting.CreateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		s.sign(csr)
+		// Let the tracker store the request so that it can be watched
+		return false, nil, nil
+	})
+
+	// The fake clientset ignores field selectors, which the certificate
+	// manager uses to watch its latest request only
+	client.PrependReactor("list", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+		obj, err := client.Tracker().List(
+			certificatesv1.SchemeGroupVersion.WithResource("certificatesigningrequests"),
+			certificatesv1.SchemeGroupVersion.WithKind("CertificateSigningRequest"), "")
+		if err != nil {
+			return true, nil, err
+		}
+		list := obj.(*certificatesv1.CertificateSigningRequestList)
+		list.Items = slices.DeleteFunc(list.Items, func(csr certificatesv1.CertificateSigningRequest) bool {
+			return !restrictions.Fields.Matches(fields.Set{"metadata.name": csr.Name})
+		})
+		return true, list, nil
+	})
+}
+
+// sign names the request and sets its outcome.
+func (s *csrSigner) sign(csr *certificatesv1.CertificateSigningRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.requests) + 1
+	csr.Name = fmt.Sprintf("csr-%d", n)
+	csr.UID = types.UID(csr.Name)
+
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil {
+		s.t.Errorf("expected a PEM encoded request, got %q", csr.Spec.Request)
+		return
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		s.t.Errorf("failed to parse request: %v", err)
+		return
+	}
+	s.requests = append(s.requests, request)
+
+	if s.reject != "" {
+		csr.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{
+			{Type: s.reject, Status: corev1.ConditionTrue, Reason: "Test", Message: "rejected by the test"},
+		}
+		return
+	}
+
+	notBefore, notAfter := time.Now().Add(-time.Minute), time.Now().Add(365*24*time.Hour)
+	if s.lifetime != nil {
+		notBefore, notAfter = s.lifetime(n)
+	}
+	certPEM, serial := s.ca.issue(s.t, &x509.Certificate{
+		Subject:     request.Subject,
+		DNSNames:    request.DNSNames,
+		IPAddresses: request.IPAddresses,
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, request.PublicKey)
+	s.issued = append(s.issued, serial)
+
+	csr.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{
+		{Type: certificatesv1.CertificateApproved, Status: corev1.ConditionTrue, Reason: "Test"},
+	}
+	csr.Status.Certificate = certPEM
+}
+
+// counts returns the number of requests and issued certificates so far.
+func (s *csrSigner) counts() (requests, issued int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests), len(s.issued)
+}
+
+// request returns the nth request, from 0.
+func (s *csrSigner) request(n int) *x509.CertificateRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[n]
+}
+
+// serial returns the serial number of the nth certificate issued, from 0, or
+// 0 if it has not been issued yet.
+func (s *csrSigner) serial(n int) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n >= len(s.issued) {
+		return 0
+	}
+	return s.issued[n]
+}
+
+// waitFor waits for a condition to hold.
+func waitFor(t *testing.T, what string, timeout time.Duration, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// servingSerial returns the serial number of the certificate served, or -1.
+func servingSerial(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) int64 {
+	cert, err := getCertificate(nil)
+	if err != nil {
+		return -1
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return -1
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertificateSourceCSR(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject certificatesv1.RequestConditionType
+	}{
+		{name: "approved"},
+		{name: "denied", reject: certificatesv1.CertificateDenied},
+		{name: "failed", reject: certificatesv1.CertificateFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			signer := &csrSigner{t: t, ca: newTestCA(t), reject: tt.reject}
+			signer.install(client)
+
+			s := &kubeletServer{
+				config:     config.KubeletConfig{CertDir: filepath.Join(t.TempDir(), "pki"), Address: "10.0.0.5"},
+				nodeName:   "orca-node",
+				kubeClient: client,
+				logger:     zerolog.Nop(),
+			}
+			getCertificate, stop, err := s.certificateSource()
+			if err != nil {
+				t.Fatalf("failed to create certificate source: %v", err)
+			}
+			defer stop()
+
+			waitFor(t, "a certificate request", 5*time.Second, func() bool {
+				requests, _ := signer.counts()
+				return requests > 0
+			})
+
+			csrs, err := client.CertificatesV1().CertificateSigningRequests().List(context.Background(), metav1.ListOptions{})
+			if err != nil || len(csrs.Items) == 0 {
+				t.Fatalf("expected a CertificateSigningRequest, got %v", err)
+			}
+			csr := csrs.Items[0]
+			if csr.Spec.SignerName != certificatesv1.KubeletServingSignerName {
+				t.Errorf("expected signer %s, got %s", certificatesv1.KubeletServingSignerName, csr.Spec.SignerName)
+			}
+			if !slices.Equal(csr.Spec.Usages, []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageServerAuth}) {
+				t.Errorf("expected digital signature and server auth usages, got %v", csr.Spec.Usages)
+			}
+			request := signer.request(0)
+			if request.Subject.CommonName != "system:node:orca-node" || !slices.Equal(request.Subject.Organization, []string{"system:nodes"}) {
+				t.Errorf("expected the node's identity as the subject, got %v", request.Subject)
+			}
+			if !slices.Equal(request.DNSNames, []string{"orca-node"}) || len(request.IPAddresses) != 1 || !request.IPAddresses[0].Equal(net.ParseIP("10.0.0.5")) {
+				t.Errorf("expected the node's name and address, got %v and %v", request.DNSNames, request.IPAddresses)
+			}
+
+			if tt.reject != "" {
+				// The manager retries after a back-off; nothing is served meanwhile
+				time.Sleep(200 * time.Millisecond)
+				if _, err := getCertificate(nil); err == nil {
+					t.Error("expected no certificate to be served")
+				}
+				if _, err := os.Stat(filepath.Join(s.config.CertDir, "kubelet-server-current.pem")); !os.IsNotExist(err) {
+					t.Errorf("expected no certificate to be stored, got %v", err)
+				}
+				return
+			}
+
+			waitFor(t, "the certificate to be served", 5*time.Second, func() bool {
+				return servingSerial(getCertificate) == signer.serial(0)
+			})
+			if _, err := os.Stat(filepath.Join(s.config.CertDir, "kubelet-server-current.pem")); err != nil {
+				t.Errorf("expected the certificate to be stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestCertificateSourceRotation(t *testing.T) {
+	client := fake.NewClientset()
+	signer := &csrSigner{t: t, ca: newTestCA(t)}
+	// The first certificate is past its rotation deadline, but still valid
+	signer.lifetime = func(n int) (time.Time, time.Time) {
+		if n == 1 {
+			return time.Now().Add(-9 * time.Hour), time.Now().Add(time.Hour)
+		}
+		return time.Now().Add(-time.Minute), time.Now().Add(365 * 24 * time.Hour)
+	}
+	signer.install(client)
+
+	s := &kubeletServer{
+		config:     config.KubeletConfig{CertDir: t.TempDir()},
+		nodeName:   "orca-node",
+		kubeClient: client,
+		logger:     zerolog.Nop(),
+	}
+	getCertificate, stop, err := s.certificateSource()
+	if err != nil {
+		t.Fatalf("failed to create certificate source: %v", err)
+	}
+	defer stop()
+
+	waitFor(t, "the certificate to be rotated", 10*time.Second, func() bool {
+		serial := signer.serial(1)
+		return serial != 0 && servingSerial(getCertificate) == serial
+	})
+	if requests, _ := signer.counts(); requests != 2 {
+		t.Errorf("expected the new certificate to be kept, got %d requests", requests)
+	}
+}
+
+func TestCertificateSourceStatic(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.keyPair(t, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "orca-node"},
+		NotBefore: time.Now().Add(-time.Minute),
+		NotAfter:  time.Now().Add(time.Hour),
+	})
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewClientset()
+	s := &kubeletServer{config: config.KubeletConfig{CertFile: certFile, KeyFile: keyFile}, kubeClient: client, logger: zerolog.Nop()}
+	getCertificate, stop, err := s.certificateSource()
+	if err != nil {
+		t.Fatalf("failed to load the static certificate: %v", err)
+	}
+	defer stop()
+
+	block, _ := pem.Decode(certPEM)
+	static, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := servingSerial(getCertificate); serial != static.SerialNumber.Int64() {
+		t.Errorf("expected the static certificate to be served, got serial %d", serial)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("expected no certificate request, got %v", client.Actions())
+	}
+
+	s.config.KeyFile = filepath.Join(dir, "missing.key")
+	if _, _, err := s.certificateSource(); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+}
+
+// freePort returns a TCP port that nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestKubeletServer(t *testing.T) {
+	ca := newTestCA(t)
+	servingCert, servingKey := ca.keyPair(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "orca-node"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, servingCert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, servingKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The API server's client certificate may do anything; metrics-server's
+	// token may only read stats and metrics
+	client := fake.NewClientset()
+	var reviewsMu sync.Mutex
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "metrics-server-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:metrics-server"}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewsMu.Lock()
+		reviews = append(reviews, review.Spec)
+		reviewsMu.Unlock()
+		subresource := review.Spec.ResourceAttributes.Subresource
+		review.Status.Allowed = review.Spec.User == "kube-apiserver-kubelet-client" ||
+			review.Spec.User == "system:serviceaccount:kube-system:metrics-server" && (subresource == "stats" || subresource == "metrics")
+		return true, review, nil
+	})
+
+	cfg := &config.Config{}
+	cfg.AWS.Region = "us-west-2"
+	cfg.Instances.SelectionMode = "explicit"
+	p, err := provider.NewProvider(cfg, client, record.NewFakeRecorder(10), "orca-node", "orca-system", "test")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	port := freePort(t)
+	kubeletConfig := config.KubeletConfig{Port: port, CertFile: certFile, KeyFile: keyFile}
+	s := newKubeletServer(kubeletConfig, "orca-node", client, ca.pool, NewVirtualKubeletAdapter(p), zerolog.Nop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("failed to stop the server: %v", err)
+		}
+	}()
+
+	apiServerCert, apiServerKey := ca.keyPair(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "kube-apiserver-kubelet-client", Organization: []string{"system:masters"}},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	apiServerPair, err := tls.X509KeyPair(apiServerCert, apiServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client certificate of another CA is not accepted
+	rogueCert, rogueKey := newTestCA(t).keyPair(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "kube-apiserver-kubelet-client"},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	roguePair, err := tls.X509KeyPair(rogueCert, rogueKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := "https://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	waitFor(t, "the server to listen", 5*time.Second, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		token       string
+		clientCert  *tls.Certificate
+		expected    int
+		user        string
+		subresource string
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/stats/summary", expected: http.StatusUnauthorized},
+		{name: "invalid token", method: http.MethodGet, path: "/stats/summary", token: "bogus", expected: http.StatusUnauthorized},
+		{
+			name: "stats with a token", method: http.MethodGet, path: "/stats/summary", token: "metrics-server-token",
+			expected: http.StatusOK, user: "system:serviceaccount:kube-system:metrics-server", subresource: "stats",
+		},
+		{
+			name: "metrics with a token", method: http.MethodGet, path: "/metrics/resource", token: "metrics-server-token",
+			expected: http.StatusOK, user: "system:serviceaccount:kube-system:metrics-server", subresource: "metrics",
+		},
+		{
+			name: "exec with a token", method: http.MethodPost, path: "/exec/default/web/app?command=ls&output=1", token: "metrics-server-token",
+			expected: http.StatusForbidden, user: "system:serviceaccount:kube-system:metrics-server", subresource: "proxy",
+		},
+		{
+			name: "pods with a client certificate", method: http.MethodGet, path: "/pods", clientCert: &apiServerPair,
+			expected: http.StatusOK, user: "kube-apiserver-kubelet-client", subresource: "proxy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}
+			if tt.clientCert != nil {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{*tt.clientCert}
+			}
+			defer transport.CloseIdleConnections()
+
+			req, err := http.NewRequest(tt.method, base+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			reviewsMu.Lock()
+			reviews = nil
+			reviewsMu.Unlock()
+
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("expected status %d, got %d", tt.expected, resp.StatusCode)
+			}
+
+			reviewsMu.Lock()
+			defer reviewsMu.Unlock()
+			if tt.user == "" {
+				if len(reviews) != 0 {
+					t.Errorf("expected no SubjectAccessReview, got %v", reviews)
+				}
+				return
+			}
+			if len(reviews) != 1 {
+				t.Fatalf("expected one SubjectAccessReview, got %d", len(reviews))
+			}
+			attrs := reviews[0].ResourceAttributes
+			if reviews[0].User != tt.user || attrs.Resource != "nodes" || attrs.Name != "orca-node" || attrs.Subresource != tt.subresource {
+				t.Errorf("expected %s to be authorized for nodes/orca-node/%s, got %s for %+v", tt.user, tt.subresource, reviews[0].User, attrs)
+			}
+
+			if tt.path == "/stats/summary" {
+				var summary statsv1alpha1.Summary
+				if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil || summary.Node.NodeName != "orca-node" {
+					t.Errorf("expected the node's stats summary, got %+v, %v", summary, err)
+				}
+			}
+		})
+	}
+
+	t.Run("untrusted client certificate", func(t *testing.T) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{roguePair}}}
+		defer transport.CloseIdleConnections()
+
+		resp, err := (&http.Client{Transport: transport}).Get(base + "/pods")
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("expected the TLS handshake to fail, got status %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
+	"google.golang.org/protobuf/proto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/scttfrdmn/orca/pkg/provider"
+)
+
+// GetStatsSummary returns resource usage in the kubelet /stats/summary
+// format. It implements virtual-kubelet's api.PodStatsSummaryHandlerFunc.
+func (a *VirtualKubeletAdapter) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
+	stats, err := a.provider.GetStatsSummary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return statsSummary(stats), nil
+}
+
+// statsSummary converts provider stats into the /stats/summary format. The
+// format only has accelerators for containers; pod and node GPU totals are
+// served by /metrics/resource.
+func statsSummary(stats *provider.StatsSummary) *statsv1alpha1.Summary {
+	summary := &statsv1alpha1.Summary{
+		Node: statsv1alpha1.NodeStats{
+			NodeName:  stats.Node.NodeName,
+			StartTime: metav1.NewTime(stats.Node.StartTime),
+			CPU:       convertCPUStats(stats.Node.CPU),
+			Memory:    convertMemoryStats(stats.Node.Memory),
+		},
+		Pods: make([]statsv1alpha1.PodStats, 0, len(stats.Pods)),
+	}
+
+	for _, pod := range stats.Pods {
+		podStats := statsv1alpha1.PodStats{
+			PodRef: statsv1alpha1.PodReference{
+				Name:      pod.PodRef.Name,
+				Namespace: pod.PodRef.Namespace,
+				UID:       pod.PodRef.UID,
+			},
+			StartTime:  metav1.NewTime(pod.StartTime),
+			CPU:        convertCPUStats(pod.CPU),
+			Memory:     convertMemoryStats(pod.Memory),
+			Containers: make([]statsv1alpha1.ContainerStats, 0, len(pod.Containers)),
+		}
+
+		for _, c := range pod.Containers {
+			containerStats := statsv1alpha1.ContainerStats{
+				Name:      c.Name,
+				StartTime: metav1.NewTime(c.StartTime),
+				CPU:       convertCPUStats(c.CPU),
+				Memory:    convertMemoryStats(c.Memory),
+			}
+			for _, gpu := range c.GPUs {
+				containerStats.Accelerators = append(containerStats.Accelerators, statsv1alpha1.AcceleratorStats{
+					Make:        gpuMake(gpu.Model),
+					Model:       gpu.Model,
+					ID:          gpu.ID,
+					MemoryTotal: gpu.MemoryTotalBytes,
+					MemoryUsed:  gpu.MemoryUsedBytes,
+					DutyCycle:   gpu.UtilizationPercent,
+				})
+			}
+			podStats.Containers = append(podStats.Containers, containerStats)
+		}
+
+		summary.Pods = append(summary.Pods, podStats)
+	}
+
+	return summary
+}
+
+// GetMetricsResource returns resource usage in the kubelet /metrics/resource
+// format used by metrics-server. It implements virtual-kubelet's
+// api.PodMetricsResourceHandlerFunc.
+func (a *VirtualKubeletAdapter) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	stats, err := a.provider.GetStatsSummary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resourceMetrics(stats), nil
+}
+
+// resourceMetrics converts provider stats into the /metrics/resource format,
+// along with the GPUs of the node and of each pod. Families without samples
+// are left out, as the text format cannot encode them.
+func resourceMetrics(stats *provider.StatsSummary) []*dto.MetricFamily {
+	nodeCPU := newMetricFamily("node_cpu_usage_seconds_total", "Cumulative cpu time consumed by the node in core-seconds", dto.MetricType_COUNTER)
+	nodeMemory := newMetricFamily("node_memory_working_set_bytes", "Current working set of the node in bytes", dto.MetricType_GAUGE)
+	podCPU := newMetricFamily("pod_cpu_usage_seconds_total", "Cumulative cpu time consumed by the pod in core-seconds", dto.MetricType_COUNTER)
+	podMemory := newMetricFamily("pod_memory_working_set_bytes", "Current working set of the pod in bytes", dto.MetricType_GAUGE)
+	containerCPU := newMetricFamily("container_cpu_usage_seconds_total", "Cumulative cpu time consumed by the container in core-seconds", dto.MetricType_COUNTER)
+	containerMemory := newMetricFamily("container_memory_working_set_bytes", "Current working set of the container in bytes", dto.MetricType_GAUGE)
+	containerStart := newMetricFamily("container_start_time_seconds", "Start time of the container since unix epoch in seconds", dto.MetricType_GAUGE)
+	scrapeError := newMetricFamily("scrape_error", "1 if there was an error while getting container metrics, 0 otherwise", dto.MetricType_GAUGE)
+	nodeGPUs := newAcceleratorFamilies("node", "the node")
+	podGPUs := newAcceleratorFamilies("pod", "the pod")
+
+	addCPUMetric(nodeCPU, stats.Node.CPU, nil)
+	addMemoryMetric(nodeMemory, stats.Node.Memory, nil)
+	nodeGPUs.add(stats.Node.GPUs, nil)
+
+	for _, pod := range stats.Pods {
+		podLabels := map[string]string{"namespace": pod.PodRef.Namespace, "pod": pod.PodRef.Name}
+		addCPUMetric(podCPU, pod.CPU, podLabels)
+		addMemoryMetric(podMemory, pod.Memory, podLabels)
+		podGPUs.add(pod.GPUs, podLabels)
+
+		for _, c := range pod.Containers {
+			labels := map[string]string{"container": c.Name, "namespace": pod.PodRef.Namespace, "pod": pod.PodRef.Name}
+			addCPUMetric(containerCPU, c.CPU, labels)
+			addMemoryMetric(containerMemory, c.Memory, labels)
+			addMetric(containerStart, labels, float64(c.StartTime.UnixNano())/1e9, time.Time{})
+		}
+	}
+
+	addMetric(scrapeError, nil, 0, time.Time{})
+
+	families := []*dto.MetricFamily{nodeCPU, nodeMemory}
+	families = append(families, nodeGPUs.families()...)
+	families = append(families, podCPU, podMemory)
+	families = append(families, podGPUs.families()...)
+	families = append(families, containerCPU, containerMemory, containerStart, scrapeError)
+
+	served := families[:0]
+	for _, mf := range families {
+		if len(mf.Metric) > 0 {
+			served = append(served, mf)
+		}
+	}
+	return served
+}
+
+// convertCPUStats converts provider CPU stats.
+func convertCPUStats(cpu *provider.CPUStats) *statsv1alpha1.CPUStats {
+	if cpu == nil {
+		return nil
+	}
+	return &statsv1alpha1.CPUStats{
+		Time:                 metav1.NewTime(cpu.Time),
+		UsageNanoCores:       cpu.UsageNanoCores,
+		UsageCoreNanoSeconds: cpu.UsageCoreNanoSeconds,
+	}
+}
+
+// convertMemoryStats converts provider memory stats.
+func convertMemoryStats(memory *provider.MemoryStats) *statsv1alpha1.MemoryStats {
+	if memory == nil {
+		return nil
+	}
+	return &statsv1alpha1.MemoryStats{
+		Time:            metav1.NewTime(memory.Time),
+		AvailableBytes:  memory.AvailableBytes,
+		UsageBytes:      memory.UsageBytes,
+		WorkingSetBytes: memory.WorkingSetBytes,
+	}
+}
+
+// gpuMake guesses the GPU vendor from its product name.
+func gpuMake(model string) string {
+	if strings.HasPrefix(strings.ToLower(model), "nvidia") {
+		return "nvidia"
+	}
+	return ""
+}
+
+// newMetricFamily creates an empty metric family.
+func newMetricFamily(name, help string, metricType dto.MetricType) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: metricType.Enum(),
+	}
+}
+
+// acceleratorFamilies holds GPU metric families.
+type acceleratorFamilies struct {
+	dutyCycle   *dto.MetricFamily
+	memoryUsed  *dto.MetricFamily
+	memoryTotal *dto.MetricFamily
+}
+
+// newAcceleratorFamilies creates empty GPU metric families for a level, node
+// or pod, named like cAdvisor's container accelerator metrics.
+func newAcceleratorFamilies(level, of string) *acceleratorFamilies {
+	return &acceleratorFamilies{
+		dutyCycle:   newMetricFamily(level+"_accelerator_duty_cycle", "Percent of time over the past sample period during which the accelerator was actively processing, for each accelerator of "+of, dto.MetricType_GAUGE),
+		memoryUsed:  newMetricFamily(level+"_accelerator_memory_used_bytes", "Total accelerator memory allocated, for each accelerator of "+of, dto.MetricType_GAUGE),
+		memoryTotal: newMetricFamily(level+"_accelerator_memory_total_bytes", "Total accelerator memory, for each accelerator of "+of, dto.MetricType_GAUGE),
+	}
+}
+
+// add adds a sample of each GPU.
+func (f *acceleratorFamilies) add(gpus []provider.GPUStats, labels map[string]string) {
+	for _, gpu := range gpus {
+		gpuLabels := map[string]string{"acc_id": gpu.ID, "make": gpuMake(gpu.Model), "model": gpu.Model}
+		for name, value := range labels {
+			gpuLabels[name] = value
+		}
+		addMetric(f.dutyCycle, gpuLabels, float64(gpu.UtilizationPercent), gpu.Time)
+		addMetric(f.memoryUsed, gpuLabels, float64(gpu.MemoryUsedBytes), gpu.Time)
+		addMetric(f.memoryTotal, gpuLabels, float64(gpu.MemoryTotalBytes), gpu.Time)
+	}
+}
+
+// families returns the GPU metric families.
+func (f *acceleratorFamilies) families() []*dto.MetricFamily {
+	return []*dto.MetricFamily{f.dutyCycle, f.memoryUsed, f.memoryTotal}
+}
+
+// addCPUMetric adds cumulative CPU time in core-seconds, if known.
+func addCPUMetric(mf *dto.MetricFamily, cpu *provider.CPUStats, labels map[string]string) {
+	if cpu == nil || cpu.UsageCoreNanoSeconds == nil {
+		return
+	}
+	addMetric(mf, labels, float64(*cpu.UsageCoreNanoSeconds)/1e9, cpu.Time)
+}
+
+// addMemoryMetric adds the working set in bytes, if known.
+func addMemoryMetric(mf *dto.MetricFamily, memory *provider.MemoryStats, labels map[string]string) {
+	if memory == nil || memory.WorkingSetBytes == nil {
+		return
+	}
+	addMetric(mf, labels, float64(*memory.WorkingSetBytes), memory.Time)
+}
+
+// addMetric adds a sample to mf. A zero timestamp is left unset.
+func addMetric(mf *dto.MetricFamily, labels map[string]string, value float64, timestamp time.Time) {
+	metric := &dto.Metric{}
+
+	// Label pairs are added in a fixed order for stable output.
+	for _, name := range []string{"acc_id", "container", "make", "model", "namespace", "pod"} {
+		if v, ok := labels[name]; ok {
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(v)})
+		}
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+	default:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	}
+
+	if !timestamp.IsZero() {
+		metric.TimestampMs = proto.Int64(timestamp.UnixMilli())
+	}
+
+	mf.Metric = append(mf.Metric, metric)
+}
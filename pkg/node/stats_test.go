@@ -0,0 +1,145 @@
+package node
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/scttfrdmn/orca/pkg/provider"
+)
+
+// gpuPodStats returns the stats of a pod whose container trainer uses one
+// GPU and whose container sidecar has no usage sample fields.
+func gpuPodStats(now time.Time) provider.PodStats {
+	cores, seconds, workingSet := uint64(500_000_000), uint64(3_000_000_000), uint64(1<<30)
+	gpu := provider.GPUStats{
+		Time:               now,
+		ID:                 "GPU-0",
+		Model:              "NVIDIA A10G",
+		UtilizationPercent: 87,
+		MemoryUsedBytes:    4 << 30,
+		MemoryTotalBytes:   24 << 30,
+	}
+	return provider.PodStats{
+		PodRef: provider.PodReference{Name: "trainer", Namespace: "ml", UID: "uid-trainer"},
+		CPU:    &provider.CPUStats{Time: now, UsageNanoCores: &cores, UsageCoreNanoSeconds: &seconds},
+		Memory: &provider.MemoryStats{Time: now, WorkingSetBytes: &workingSet},
+		GPUs:   []provider.GPUStats{gpu},
+		Containers: []provider.ContainerStats{
+			{
+				Name:   "trainer",
+				CPU:    &provider.CPUStats{Time: now, UsageNanoCores: &cores, UsageCoreNanoSeconds: &seconds},
+				Memory: &provider.MemoryStats{Time: now, WorkingSetBytes: &workingSet},
+				GPUs:   []provider.GPUStats{gpu},
+			},
+			{Name: "sidecar"},
+		},
+	}
+}
+
+func TestStatsSummary(t *testing.T) {
+	now := time.Now()
+	pod := gpuPodStats(now)
+	stats := &provider.StatsSummary{
+		Node: provider.NodeStats{NodeName: "orca", CPU: pod.CPU, Memory: pod.Memory, GPUs: pod.GPUs},
+		Pods: []provider.PodStats{pod},
+	}
+
+	summary := statsSummary(stats)
+
+	if summary.Node.NodeName != "orca" || *summary.Node.CPU.UsageNanoCores != 500_000_000 {
+		t.Errorf("expected the node's usage, got %+v", summary.Node)
+	}
+	if len(summary.Pods) != 1 || summary.Pods[0].PodRef.UID != "uid-trainer" || *summary.Pods[0].Memory.WorkingSetBytes != 1<<30 {
+		t.Fatalf("expected the pod's usage, got %+v", summary.Pods)
+	}
+	containers := summary.Pods[0].Containers
+	if len(containers) != 2 {
+		t.Fatalf("expected 2 containers, got %d", len(containers))
+	}
+
+	accelerators := containers[0].Accelerators
+	if len(accelerators) != 1 {
+		t.Fatalf("expected the trainer to have one accelerator, got %+v", accelerators)
+	}
+	if a := accelerators[0]; a.Make != "nvidia" || a.ID != "GPU-0" || a.DutyCycle != 87 || a.MemoryUsed != 4<<30 || a.MemoryTotal != 24<<30 {
+		t.Errorf("unexpected accelerator %+v", a)
+	}
+
+	// Usage the sample does not have is left out rather than reported as 0
+	if sidecar := containers[1]; sidecar.CPU != nil || sidecar.Memory != nil || sidecar.Accelerators != nil {
+		t.Errorf("expected the sidecar to have no usage, got %+v", sidecar)
+	}
+}
+
+func TestResourceMetrics(t *testing.T) {
+	now := time.Now()
+	pod := gpuPodStats(now)
+	seconds, workingSet := uint64(9_000_000_000), uint64(2<<30)
+	node := provider.NodeStats{
+		NodeName: "orca",
+		CPU:      &provider.CPUStats{Time: now, UsageCoreNanoSeconds: &seconds},
+		Memory:   &provider.MemoryStats{Time: now, WorkingSetBytes: &workingSet},
+	}
+	gpuNode := node
+	gpuNode.GPUs = pod.GPUs
+
+	tests := []struct {
+		name    string
+		stats   *provider.StatsSummary
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "no pods",
+			stats: &provider.StatsSummary{Node: node},
+			want: []string{
+				"node_cpu_usage_seconds_total 9 ",
+				"node_memory_working_set_bytes 2.147483648e+09 ",
+				"scrape_error 0\n",
+			},
+			notWant: []string{"pod_", "container_", "accelerator"},
+		},
+		{
+			name:  "GPU pod",
+			stats: &provider.StatsSummary{Node: gpuNode, Pods: []provider.PodStats{pod}},
+			want: []string{
+				`node_accelerator_duty_cycle{acc_id="GPU-0",make="nvidia",model="NVIDIA A10G"} 87 `,
+				`node_accelerator_memory_total_bytes{acc_id="GPU-0",make="nvidia",model="NVIDIA A10G"} 2.5769803776e+10 `,
+				`pod_cpu_usage_seconds_total{namespace="ml",pod="trainer"} 3 `,
+				`pod_accelerator_duty_cycle{acc_id="GPU-0",make="nvidia",model="NVIDIA A10G",namespace="ml",pod="trainer"} 87 `,
+				`pod_accelerator_memory_used_bytes{acc_id="GPU-0",make="nvidia",model="NVIDIA A10G",namespace="ml",pod="trainer"} 4.294967296e+09 `,
+				`container_cpu_usage_seconds_total{container="trainer",namespace="ml",pod="trainer"} 3 `,
+				`container_start_time_seconds{container="sidecar",namespace="ml",pod="trainer"}`,
+			},
+			notWant: []string{`container_cpu_usage_seconds_total{container="sidecar"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+			for _, mf := range resourceMetrics(tt.stats) {
+				if err := enc.Encode(mf); err != nil {
+					t.Fatalf("failed to encode %s: %v", mf.GetName(), err)
+				}
+			}
+			out := buf.String()
+
+			for _, line := range tt.want {
+				if !strings.Contains(out, line) {
+					t.Errorf("expected %q in:\n%s", line, out)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("expected no %q in:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+// Package overlay manages the WireGuard network that makes pod IPs on
+// burst instances routable from the cluster.
+//
+// ORCA runs the hub: a WireGuard interface in its own network namespace,
+// with a peer for every pod instance. Each pod gets an address from the
+// overlay's pod CIDR and a key pair; the agent on the instance brings up
+// its side of the tunnel with them. The hub connects to instances at their
+// private IPs, so nothing on-premises needs to accept inbound traffic.
+// Traffic from instances to the configured routes, like the cluster's pod
+// and Service networks, is masqueraded as the hub's; the cluster reaches
+// pod IPs by routing the pod CIDR to the hub.
+//
+// Example usage:
+//
+//	hub, err := overlay.NewHub(cfg.Network.Overlay)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	if err := hub.Start(ctx); err != nil {
+//	    log.Fatal(err)
+//	}
+//
+//	peer, err := hub.NewPeer(pod.UID)
+//	err = hub.AddPeer(ctx, peer, instance.PrivateIP)
+package overlay
@@ -0,0 +1,234 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/pkg/config"
+)
+
+// keepalive is the persistent keepalive of instance peers in seconds. It
+// makes the hub open the tunnel as soon as a peer is added, so that
+// instances can reach the cluster before the cluster sends them anything.
+const keepalive = "25"
+
+// Peer is a pod instance's end of the overlay.
+type Peer struct {
+	// Address is the pod's IP.
+	Address netip.Addr
+
+	// PrivateKey is the instance's key. It is only handed to the pod's
+	// agent, over its TLS API.
+	PrivateKey Key
+}
+
+// Hub is ORCA's end of the overlay. It manages a WireGuard interface with
+// the ip, wg, sysctl and iptables commands, and needs CAP_NET_ADMIN.
+type Hub struct {
+	cfg    config.OverlayConfig
+	prefix netip.Prefix
+	key    Key
+
+	// run runs a command and returns its stdout
+	run func(ctx context.Context, name string, args ...string) (string, error)
+
+	mu    sync.Mutex
+	alloc *allocator
+	peers map[types.UID]*Peer
+}
+
+// NewHub returns the hub of the overlay configured by cfg. Its key is read
+// from cfg.PrivateKeyFile, so that it survives restarts.
+func NewHub(cfg config.OverlayConfig) (*Hub, error) {
+	prefix, err := netip.ParsePrefix(cfg.PodCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse overlay pod CIDR: %w", err)
+	}
+
+	if cfg.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("overlay private key file is not set")
+	}
+	key, err := readKey(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Hub{
+		cfg:    cfg,
+		prefix: prefix.Masked(),
+		key:    key,
+		run:    runCommand,
+		alloc:  newAllocator(prefix),
+		peers:  make(map[types.UID]*Peer),
+	}, nil
+}
+
+// PublicKey returns the hub's public key.
+func (h *Hub) PublicKey() Key {
+	return h.key.PublicKey()
+}
+
+// Address returns the hub's overlay address.
+func (h *Hub) Address() netip.Addr {
+	return h.alloc.hub
+}
+
+// Routes returns the networks instances reach through the hub: the
+// overlay itself, for other pods, and the configured routes.
+func (h *Hub) Routes() []string {
+	return append([]string{h.prefix.String()}, h.cfg.Routes...)
+}
+
+// Start creates the hub's WireGuard interface, replacing any left over
+// from a previous run, and forwards and masquerades instance traffic.
+func (h *Hub) Start(ctx context.Context) error {
+	iface := h.cfg.Interface
+
+	_, _ = h.run(ctx, "ip", "link", "del", iface)
+	if _, err := h.run(ctx, "ip", "link", "add", iface, "type", "wireguard"); err != nil {
+		return fmt.Errorf("failed to create WireGuard interface %s: %w", iface, err)
+	}
+
+	keyFile, err := writeKeyFile(h.key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyFile)
+	if _, err := h.run(ctx, "wg", "set", iface, "listen-port", strconv.Itoa(h.cfg.ListenPort), "private-key", keyFile); err != nil {
+		return fmt.Errorf("failed to configure WireGuard interface %s: %w", iface, err)
+	}
+
+	address := netip.PrefixFrom(h.Address(), h.prefix.Bits()).String()
+	if _, err := h.run(ctx, "ip", "address", "add", address, "dev", iface); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", address, iface, err)
+	}
+	if _, err := h.run(ctx, "ip", "link", "set", iface, "up"); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", iface, err)
+	}
+
+	if _, err := h.run(ctx, "sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+	}
+	rule := []string{"POSTROUTING", "-s", h.prefix.String(), "!", "-o", iface, "-j", "MASQUERADE"}
+	if _, err := h.run(ctx, "iptables", append([]string{"-t", "nat", "-C"}, rule...)...); err != nil {
+		if _, err := h.run(ctx, "iptables", append([]string{"-t", "nat", "-A"}, rule...)...); err != nil {
+			return fmt.Errorf("failed to masquerade overlay traffic: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewPeer returns the peer of a pod, allocating its address and key if it
+// has none yet.
+func (h *Hub) NewPeer(uid types.UID) (*Peer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if peer, ok := h.peers[uid]; ok {
+		return peer, nil
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := h.alloc.allocate(uid)
+	if err != nil {
+		return nil, err
+	}
+	peer := &Peer{Address: addr, PrivateKey: key}
+	h.peers[uid] = peer
+	return peer, nil
+}
+
+// Reserve keeps the address of a pod launched before a restart from being
+// allocated to other pods. Its peer is created by NewPeer, with a new key,
+// if the pod launches again.
+func (h *Hub) Reserve(uid types.UID, addr netip.Addr) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.alloc.reserve(uid, addr)
+}
+
+// Peer returns the peer of a pod, if it has one.
+func (h *Hub) Peer(uid types.UID) (*Peer, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peer, ok := h.peers[uid]
+	return peer, ok
+}
+
+// AddPeer adds a pod's peer to the hub's interface, reached at the private
+// IP of its instance. Adding a peer again updates it.
+func (h *Hub) AddPeer(ctx context.Context, peer *Peer, instanceIP string) error {
+	endpoint := net.JoinHostPort(instanceIP, strconv.Itoa(h.cfg.ListenPort))
+	_, err := h.run(ctx, "wg", "set", h.cfg.Interface,
+		"peer", peer.PrivateKey.PublicKey().String(),
+		"endpoint", endpoint,
+		"allowed-ips", netip.PrefixFrom(peer.Address, 32).String(),
+		"persistent-keepalive", keepalive)
+	if err != nil {
+		return fmt.Errorf("failed to add overlay peer %s: %w", peer.Address, err)
+	}
+	return nil
+}
+
+// RemovePeer removes a pod's peer from the hub's interface and releases
+// its address.
+func (h *Hub) RemovePeer(ctx context.Context, uid types.UID) error {
+	h.mu.Lock()
+	peer, ok := h.peers[uid]
+	delete(h.peers, uid)
+	h.alloc.release(uid)
+	h.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if _, err := h.run(ctx, "wg", "set", h.cfg.Interface, "peer", peer.PrivateKey.PublicKey().String(), "remove"); err != nil {
+		return fmt.Errorf("failed to remove overlay peer %s: %w", peer.Address, err)
+	}
+	return nil
+}
+
+// writeKeyFile writes a private key to a new file only its owner may read,
+// for wg, which takes keys from files.
+func writeKeyFile(key Key) (string, error) {
+	f, err := os.CreateTemp("", "orca-wg-")
+	if err != nil {
+		return "", fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(key.String() + "\n"); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// runCommand runs a command and returns its stdout. Errors include its
+// stderr.
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
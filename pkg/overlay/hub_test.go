@@ -0,0 +1,177 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/scttfrdmn/orca/pkg/config"
+)
+
+// testKeyFile writes a new private key to a file and returns its path.
+func testKeyFile(t *testing.T) string {
+	t.Helper()
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "private.key")
+	if err := os.WriteFile(path, []byte(key.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testOverlayConfig(keyFile string) config.OverlayConfig {
+	return config.OverlayConfig{
+		Enabled:        true,
+		Interface:      "orca0",
+		PodCIDR:        "100.96.0.0/16",
+		ListenPort:     51820,
+		PrivateKeyFile: keyFile,
+		Routes:         []string{"10.96.0.0/12"},
+	}
+}
+
+// recordCommands makes the hub record its commands instead of running
+// them. Commands starting with a prefix in fail fail.
+func recordCommands(h *Hub, fail ...string) *[]string {
+	var commands []string
+	h.run = func(ctx context.Context, name string, args ...string) (string, error) {
+		command := strings.Join(append([]string{name}, args...), " ")
+		commands = append(commands, command)
+		for _, prefix := range fail {
+			if strings.HasPrefix(command, prefix) {
+				return "", errors.New("failed")
+			}
+		}
+		return "", nil
+	}
+	return &commands
+}
+
+func TestHubStart(t *testing.T) {
+	hub, err := NewHub(testOverlayConfig(testKeyFile(t)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The masquerade rule does not exist yet
+	commands := recordCommands(hub, "iptables -t nat -C")
+
+	if err := hub.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"ip link del orca0",
+		"ip link add orca0 type wireguard",
+		"wg set orca0 listen-port 51820 private-key ",
+		"ip address add 100.96.0.1/16 dev orca0",
+		"ip link set orca0 up",
+		"sysctl -w net.ipv4.ip_forward=1",
+		"iptables -t nat -C POSTROUTING -s 100.96.0.0/16 ! -o orca0 -j MASQUERADE",
+		"iptables -t nat -A POSTROUTING -s 100.96.0.0/16 ! -o orca0 -j MASQUERADE",
+	}
+	if len(*commands) != len(want) {
+		t.Fatalf("expected commands %q, got %q", want, *commands)
+	}
+	for i, command := range *commands {
+		if !strings.HasPrefix(command, want[i]) {
+			t.Errorf("command %d = %q, want %q", i, command, want[i])
+		}
+	}
+}
+
+func TestHubPeers(t *testing.T) {
+	hub, err := NewHub(testOverlayConfig(testKeyFile(t)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	commands := recordCommands(hub)
+
+	peer, err := hub.NewPeer("pod-uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again, _ := hub.NewPeer("pod-uid-1"); again != peer {
+		t.Error("expected a pod to keep its peer")
+	}
+	if peer.Address.String() != "100.96.0.2" {
+		t.Errorf("expected the first pod address 100.96.0.2, got %s", peer.Address)
+	}
+
+	if err := hub.AddPeer(context.Background(), peer, "10.0.1.5"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := hub.RemovePeer(context.Background(), "pod-uid-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := hub.Peer("pod-uid-1"); ok {
+		t.Error("expected the peer to be removed")
+	}
+
+	public := peer.PrivateKey.PublicKey().String()
+	want := []string{
+		"wg set orca0 peer " + public + " endpoint 10.0.1.5:51820 allowed-ips 100.96.0.2/32 persistent-keepalive 25",
+		"wg set orca0 peer " + public + " remove",
+	}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected commands %q, got %q", want, *commands)
+	}
+
+	if routes := hub.Routes(); strings.Join(routes, ",") != "100.96.0.0/16,10.96.0.0/12" {
+		t.Errorf("unexpected routes %v", routes)
+	}
+}
+
+func TestNewHubNeedsKey(t *testing.T) {
+	if _, err := NewHub(testOverlayConfig("")); err == nil {
+		t.Error("expected a hub without a private key file to fail")
+	}
+	if _, err := NewHub(testOverlayConfig(filepath.Join(t.TempDir(), "missing.key"))); err == nil {
+		t.Error("expected a missing private key file to fail")
+	}
+}
+
+func TestHubReserve(t *testing.T) {
+	hub, err := NewHub(testOverlayConfig(testKeyFile(t)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	commands := recordCommands(hub)
+
+	// A pod launched before a restart keeps its address
+	if err := hub.Reserve("pod-uid-1", netip.MustParseAddr("100.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := hub.Peer("pod-uid-1"); ok {
+		t.Error("expected a reserved address to have no peer")
+	}
+	other, err := hub.NewPeer("pod-uid-2")
+	if err != nil || other.Address.String() != "100.96.0.3" {
+		t.Errorf("expected a new pod to get 100.96.0.3, got %v, %v", other, err)
+	}
+	peer, err := hub.NewPeer("pod-uid-1")
+	if err != nil || peer.Address.String() != "100.96.0.2" {
+		t.Errorf("expected the pod to get its reserved address, got %v, %v", peer, err)
+	}
+
+	// Removing a pod without a peer releases its reservation
+	if err := hub.Reserve("pod-uid-3", netip.MustParseAddr("100.96.0.4")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := hub.RemovePeer(context.Background(), "pod-uid-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := hub.Reserve("pod-uid-4", netip.MustParseAddr("100.96.0.4")); err != nil {
+		t.Errorf("expected the released address to be free, got %v", err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("expected no commands, got %q", *commands)
+	}
+}
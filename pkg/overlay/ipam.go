@@ -0,0 +1,87 @@
+package overlay
+
+import (
+	"fmt"
+	"net/netip"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// allocator hands out the pod addresses of the overlay. The network
+// address, the hub's address and the broadcast address are never handed
+// out. It is not safe for concurrent use.
+type allocator struct {
+	prefix netip.Prefix
+	hub    netip.Addr
+
+	// next is where the search for a free address starts, so that
+	// released addresses are not reused right away
+	next      netip.Addr
+	addresses map[types.UID]netip.Addr
+	used      map[netip.Addr]bool
+}
+
+// newAllocator returns an allocator for prefix, whose first address is
+// the hub's.
+func newAllocator(prefix netip.Prefix) *allocator {
+	prefix = prefix.Masked()
+	hub := prefix.Addr().Next()
+	return &allocator{
+		prefix:    prefix,
+		hub:       hub,
+		next:      hub.Next(),
+		addresses: make(map[types.UID]netip.Addr),
+		used:      make(map[netip.Addr]bool),
+	}
+}
+
+// allocate returns the address of a pod, allocating one if it has none.
+func (a *allocator) allocate(uid types.UID) (netip.Addr, error) {
+	if addr, ok := a.addresses[uid]; ok {
+		return addr, nil
+	}
+
+	addr := a.next
+	for range 1 << (32 - a.prefix.Bits()) {
+		if !a.usable(addr) {
+			addr = a.hub.Next()
+		}
+		if !a.used[addr] {
+			a.addresses[uid] = addr
+			a.used[addr] = true
+			a.next = addr.Next()
+			return addr, nil
+		}
+		addr = addr.Next()
+	}
+	return netip.Addr{}, fmt.Errorf("no free address in overlay network %s", a.prefix)
+}
+
+// reserve allocates a given address to a pod.
+func (a *allocator) reserve(uid types.UID, addr netip.Addr) error {
+	if !a.usable(addr) {
+		return fmt.Errorf("address %s is not a pod address of overlay network %s", addr, a.prefix)
+	}
+	if current, ok := a.addresses[uid]; ok && current != addr {
+		return fmt.Errorf("pod %s already has address %s", uid, current)
+	}
+	if a.used[addr] && a.addresses[uid] != addr {
+		return fmt.Errorf("address %s is already allocated", addr)
+	}
+	a.addresses[uid] = addr
+	a.used[addr] = true
+	return nil
+}
+
+// release frees the address of a pod.
+func (a *allocator) release(uid types.UID) {
+	if addr, ok := a.addresses[uid]; ok {
+		delete(a.used, addr)
+		delete(a.addresses, uid)
+	}
+}
+
+// usable reports whether addr may be allocated to a pod.
+func (a *allocator) usable(addr netip.Addr) bool {
+	return a.prefix.Contains(addr) && addr.Compare(a.hub) > 0 && a.prefix.Contains(addr.Next())
+}
@@ -0,0 +1,85 @@
+package overlay
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestAllocator(t *testing.T) {
+	// 100.96.0.0/29 has the hub at .1 and pod addresses .2 to .6
+	a := newAllocator(netip.MustParsePrefix("100.96.0.0/29"))
+	if a.hub != netip.MustParseAddr("100.96.0.1") {
+		t.Fatalf("expected the hub at 100.96.0.1, got %s", a.hub)
+	}
+
+	var got []string
+	for _, uid := range []types.UID{"a", "b", "c", "d", "e"} {
+		addr, err := a.allocate(uid)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, addr.String())
+	}
+	want := []string{"100.96.0.2", "100.96.0.3", "100.96.0.4", "100.96.0.5", "100.96.0.6"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("allocation %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	// Pods keep their address
+	if addr, _ := a.allocate("c"); addr.String() != "100.96.0.4" {
+		t.Errorf("expected pod c to keep 100.96.0.4, got %s", addr)
+	}
+
+	if _, err := a.allocate("f"); err == nil {
+		t.Error("expected an error once the network is full")
+	}
+
+	// Released addresses are reused once the search wraps around
+	a.release("b")
+	if addr, err := a.allocate("f"); err != nil || addr.String() != "100.96.0.3" {
+		t.Errorf("expected pod f to get 100.96.0.3, got %s, %v", addr, err)
+	}
+}
+
+func TestAllocatorReserve(t *testing.T) {
+	a := newAllocator(netip.MustParsePrefix("100.96.0.0/29"))
+
+	tests := []struct {
+		name    string
+		uid     types.UID
+		addr    string
+		wantErr bool
+	}{
+		{name: "free address", uid: "a", addr: "100.96.0.3"},
+		{name: "again", uid: "a", addr: "100.96.0.3"},
+		{name: "other address of the pod", uid: "a", addr: "100.96.0.4", wantErr: true},
+		{name: "address of another pod", uid: "b", addr: "100.96.0.3", wantErr: true},
+		{name: "hub address", uid: "b", addr: "100.96.0.1", wantErr: true},
+		{name: "broadcast address", uid: "b", addr: "100.96.0.7", wantErr: true},
+		{name: "outside the network", uid: "b", addr: "100.97.0.2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := a.reserve(tt.uid, netip.MustParseAddr(tt.addr)); (err != nil) != tt.wantErr {
+			t.Errorf("%s: reserve(%s, %s) error = %v, wantErr %v", tt.name, tt.uid, tt.addr, err, tt.wantErr)
+		}
+	}
+
+	// Allocation skips the reserved address, and the pod keeps it
+	var got []string
+	for _, uid := range []types.UID{"b", "c", "a"} {
+		addr, err := a.allocate(uid)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, addr.String())
+	}
+	if want := "100.96.0.2 100.96.0.4 100.96.0.3"; strings.Join(got, " ") != want {
+		t.Errorf("expected allocations %s, got %s", want, strings.Join(got, " "))
+	}
+}
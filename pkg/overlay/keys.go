@@ -0,0 +1,59 @@
+package overlay
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Key is a WireGuard Curve25519 key.
+type Key [32]byte
+
+// GenerateKey returns a new private key.
+func GenerateKey() (Key, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return Key(private.Bytes()), nil
+}
+
+// ParseKey parses a base64 encoded key, as written by wg genkey.
+func ParseKey(s string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(Key{}) {
+		return Key{}, fmt.Errorf("invalid WireGuard key")
+	}
+	return Key(b), nil
+}
+
+// readKey reads a base64 encoded key from a file.
+func readKey(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// PublicKey returns the public key of a private key.
+func (k Key) PublicKey() Key {
+	private, err := ecdh.X25519().NewPrivateKey(k[:])
+	if err != nil {
+		// Every 32 byte string is a valid X25519 private key
+		panic(err)
+	}
+	return Key(private.PublicKey().Bytes())
+}
+
+// String returns the key base64 encoded, as wg expects it.
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
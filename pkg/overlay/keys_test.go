@@ -0,0 +1,61 @@
+package overlay
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyPublicKey(t *testing.T) {
+	// Alice's key pair from RFC 7748, section 6.1
+	private, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	key, err := ParseKey(base64.StdEncoding.EncodeToString(private))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := key.PublicKey().String(), base64.StdEncoding.EncodeToString(public); got != want {
+		t.Errorf("PublicKey() = %s, want %s", got, want)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Key files end in a newline
+	parsed, err := ParseKey(key.String() + "\n")
+	if err != nil || parsed != key {
+		t.Errorf("ParseKey(%q) = %v, %v, want %v", key.String(), parsed, err, key)
+	}
+
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) expected an error", s)
+		}
+	}
+}
+
+func TestNewHubReadsKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "private.key")
+	if err := os.WriteFile(path, []byte(key.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hub, err := NewHub(testOverlayConfig(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hub.PublicKey() != key.PublicKey() {
+		t.Errorf("expected the hub to use the key from %s", path)
+	}
+}
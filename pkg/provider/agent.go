@@ -0,0 +1,174 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
+	"github.com/scttfrdmn/orca/pkg/config"
+)
+
+// agentRequestTimeout bounds short, non-streaming requests to an agent.
+const agentRequestTimeout = 5 * time.Second
+
+// newAgentAuthority loads the configured agent authority, or creates an
+// ephemeral one if none is configured.
+func newAgentAuthority(cfg config.AgentConfig) (*agent.Authority, error) {
+	if cfg.CACertFile != "" {
+		return agent.LoadAuthority(cfg.CACertFile, cfg.CAKeyFile)
+	}
+	return agent.NewAuthority()
+}
+
+// podAgent returns a client for the agent of a running pod. The agent is
+// found through the instance tracked for the pod, never by the pod's name,
+// which an earlier pod's instance may still carry.
+func (p *OrcaProvider) podAgent(ctx context.Context, namespace, name string) (*agent.Client, error) {
+	pod, err := p.GetPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.podsMu.RLock()
+	instanceID, ok := p.instanceIDs[pod.UID]
+	p.podsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("pod %s/%s has no instance", namespace, name)
+	}
+
+	instance, err := p.awsClient.GetInstance(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance %s: %w", instanceID, err)
+	}
+	if instance.State != "running" || instance.PrivateIP == "" {
+		return nil, fmt.Errorf("instance %s for pod %s/%s is %s", instance.ID, namespace, name, instance.State)
+	}
+
+	return p.agentClient(pod, instance), nil
+}
+
+// agentClient returns a client for the agent running the pod on instance.
+// Clients are cached per pod so connections to the agent are reused, and
+// each new client starts watching the agent's usage samples.
+func (p *OrcaProvider) agentClient(pod *corev1.Pod, instance *aws.Instance) *agent.Client {
+	p.agentsMu.Lock()
+	defer p.agentsMu.Unlock()
+
+	entry, ok := p.agents[pod.UID]
+	if ok && entry.host == instance.PrivateIP {
+		return entry.client
+	}
+	if ok {
+		entry.stopStats()
+		entry.client.Close()
+	}
+
+	client := agent.NewClient(
+		instance.PrivateIP,
+		p.config.Agent.Port,
+		p.agentAuthority.Token(pod.UID),
+		p.agentAuthority.ClientTLSConfig(pod.UID),
+	)
+
+	ctx, stopStats := context.WithCancel(context.Background())
+	go p.watchStats(ctx, pod.UID, client)
+
+	p.agents[pod.UID] = agentEntry{host: instance.PrivateIP, client: client, stopStats: stopStats}
+
+	return client
+}
+
+// forgetAgent drops the cached agent client and usage samples of a pod.
+func (p *OrcaProvider) forgetAgent(uid types.UID) {
+	p.agentsMu.Lock()
+	if entry, ok := p.agents[uid]; ok {
+		entry.stopStats()
+		entry.client.Close()
+		delete(p.agents, uid)
+	}
+	p.agentsMu.Unlock()
+
+	p.statsMu.Lock()
+	delete(p.stats, uid)
+	p.statsMu.Unlock()
+}
+
+// agentHost returns the private IP of the instance whose agent runs a pod,
+// or "" if the pod has no agent client.
+func (p *OrcaProvider) agentHost(uid types.UID) string {
+	p.agentsMu.Lock()
+	defer p.agentsMu.Unlock()
+	return p.agents[uid].host
+}
+
+// agentEntry is a cached agent client and the host it connects to.
+type agentEntry struct {
+	host   string
+	client *agent.Client
+
+	// stopStats stops watching the agent's usage samples
+	stopStats context.CancelFunc
+}
+
+// agentStreamIO converts the streams of an exec or attach request for the
+// agent client.
+func agentStreamIO(ctx context.Context, attach AttachIO) agent.StreamIO {
+	sio := agent.StreamIO{TTY: attach.TTY()}
+
+	// Leave unset streams as nil interfaces rather than typed nils.
+	if stdin := attach.Stdin(); stdin != nil {
+		sio.Stdin = stdin
+	}
+	if stdout := attach.Stdout(); stdout != nil {
+		sio.Stdout = stdout
+	}
+	if stderr := attach.Stderr(); stderr != nil {
+		sio.Stderr = stderr
+	}
+
+	if sizes := attach.Resize(); sizes != nil {
+		resize := make(chan agent.TermSize)
+		go func() {
+			defer close(resize)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case size, ok := <-sizes:
+					if !ok {
+						return
+					}
+					select {
+					case resize <- agent.TermSize{Width: size.Width, Height: size.Height}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+		sio.Resize = resize
+	}
+
+	return sio
+}
+
+// sessionResult turns the outcome of an exec or attach session into the
+// error virtual-kubelet expects: a CodeExitError for non-zero exit codes.
+func sessionResult(code int, err error) error {
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with exit code %d", code),
+			Code: code,
+		}
+	}
+	return nil
+}
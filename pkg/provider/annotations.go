@@ -40,13 +40,25 @@ const (
 	AnnotationAMI = "orca.research/ami"
 
 	// AnnotationUserData specifies custom EC2 user data script.
-	// Must be base64 encoded.
+	// Must be base64 encoded. Shell scripts, cloud-config and multipart
+	// archives (optionally gzip compressed) are merged with ORCA's bootstrap.
 	AnnotationUserData = "orca.research/user-data"
 
 	// AnnotationTerminationProtection enables termination protection.
 	// Valid values: "true", "false"
 	// Default: "false"
 	AnnotationTerminationProtection = "orca.research/termination-protection"
+
+	// AnnotationGang names the gang a pod belongs to. ORCA holds the pods of
+	// a gang until all of them arrive, then launches their instances together
+	// in one cluster placement group, with EFA where the instance type
+	// supports it. Requires AnnotationGangSize.
+	// Example: "llama-finetune"
+	AnnotationGang = "orca.research/gang"
+
+	// AnnotationGangSize is the number of pods in the pod's gang.
+	// Example: "8"
+	AnnotationGangSize = "orca.research/gang-size"
 )
 
 // Node labels used by ORCA.
@@ -81,6 +93,13 @@ const (
 	// TagPodUID is the Kubernetes pod UID.
 	TagPodUID = "orca.research/pod-uid"
 
+	// TagNode is the name of the ORCA node that launched the instance.
+	TagNode = "orca.research/node"
+
+	// TagOverlayAddress is the pod's overlay IP, reserved again when ORCA
+	// restarts.
+	TagOverlayAddress = "orca.research/overlay-address"
+
 	// TagCluster identifies which cluster this instance belongs to.
 	TagCluster = "orca.research/cluster"
 
@@ -6,7 +6,7 @@
 //
 // Example usage:
 //
-//	provider, err := provider.NewProvider(cfg, "orca-node", "kube-system", "v0.1.0")
+//	provider, err := provider.NewProvider(cfg, kubeClient, recorder, "orca-node", "kube-system", "v0.1.0")
 //	if err != nil {
 //	    log.Fatal(err)
 //	}
@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+const (
+	// ebsCSIDriver is the name of the EBS CSI driver.
+	ebsCSIDriver = "ebs.csi.aws.com"
+
+	// defaultFSType is the filesystem of EBS volumes that name none, as
+	// applied by the EBS CSI driver.
+	defaultFSType = "ext4"
+
+	// volumeAttachTimeout bounds how long a pod's EBS volumes may take to
+	// attach to its instance.
+	volumeAttachTimeout = 10 * time.Minute
+
+	// maxEBSVolumes is the number of EBS volumes a pod may have, one for
+	// each device name from /dev/xvdb to /dev/xvdz.
+	maxEBSVolumes = 25
+)
+
+// ebsVolume is an EBS volume backing one of a pod's persistentVolumeClaim
+// volumes.
+type ebsVolume struct {
+	// name is the pod volume's name
+	name string
+
+	volumeID string
+	zone     string
+	fsType   string
+	readOnly bool
+
+	// device is the device name the volume is attached as
+	device string
+}
+
+// ebsVolume returns the i-th EBS volume of a pod, for its volume v bound
+// to pv.
+func (p *OrcaProvider) ebsVolume(ctx context.Context, v corev1.Volume, pv *corev1.PersistentVolume, i int) (ebsVolume, error) {
+	if pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+		return ebsVolume{}, unsupportedVolume("volume %q uses PersistentVolume %s in block mode, which ORCA does not support", v.Name, pv.Name)
+	}
+	if i >= maxEBSVolumes {
+		return ebsVolume{}, unsupportedVolume("volume %q exceeds the limit of %d EBS volumes per pod", v.Name, maxEBSVolumes)
+	}
+
+	volume := ebsVolume{
+		name:     v.Name,
+		readOnly: v.PersistentVolumeClaim.ReadOnly,
+		device:   ebsDeviceName(i),
+	}
+	switch source := pv.Spec.PersistentVolumeSource; {
+	case source.CSI != nil && source.CSI.Driver == ebsCSIDriver:
+		volume.volumeID = source.CSI.VolumeHandle
+		volume.fsType = source.CSI.FSType
+		volume.readOnly = volume.readOnly || source.CSI.ReadOnly
+	case source.AWSElasticBlockStore != nil:
+		// Legacy volume IDs may be written as aws://<zone>/<volume ID>
+		id := source.AWSElasticBlockStore.VolumeID
+		volume.volumeID = id[strings.LastIndex(id, "/")+1:]
+		volume.fsType = source.AWSElasticBlockStore.FSType
+		volume.readOnly = volume.readOnly || source.AWSElasticBlockStore.ReadOnly
+	default:
+		return ebsVolume{}, unsupportedVolume("volume %q uses PersistentVolume %s, which is not an EBS, EFS, FSx for Lustre or NFS volume", v.Name, pv.Name)
+	}
+	if volume.fsType == "" {
+		volume.fsType = defaultFSType
+	}
+
+	ebs, err := p.awsClient.GetVolume(ctx, volume.volumeID)
+	if err != nil {
+		return ebsVolume{}, err
+	}
+	volume.zone = ebs.AvailabilityZone
+
+	return volume, nil
+}
+
+// ebsDeviceName returns the device name of a pod's i-th EBS volume, for i
+// below maxEBSVolumes. The root volume takes /dev/xvda.
+func ebsDeviceName(i int) string {
+	return fmt.Sprintf("/dev/xvd%c", 'b'+i)
+}
+
+// launchSubnet returns the subnet to launch a pod's instance in: one in the
+// availability zone of its EBS volumes, or "" for the default subnet if it
+// has none.
+func (p *OrcaProvider) launchSubnet(ctx context.Context, volumes []ebsVolume) (string, error) {
+	if len(volumes) == 0 {
+		return "", nil
+	}
+
+	zone := volumes[0].zone
+	for _, v := range volumes[1:] {
+		if v.zone != zone {
+			return "", unsupportedVolume("volumes %q and %q are in different availability zones (%s and %s)", volumes[0].name, v.name, zone, v.zone)
+		}
+	}
+
+	var subnetIDs []string
+	for _, id := range append([]string{p.config.AWS.SubnetID}, p.config.AWS.SubnetIDs...) {
+		if id != "" {
+			subnetIDs = append(subnetIDs, id)
+		}
+	}
+	zones, err := p.awsClient.SubnetZones(ctx, subnetIDs)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range subnetIDs {
+		if zones[id] == zone {
+			return id, nil
+		}
+	}
+
+	return "", &unsupportedError{
+		reason:  "NoSubnetInZone",
+		message: fmt.Sprintf("no configured subnet is in availability zone %s of volume %q; add one to aws.subnetIDs", zone, volumes[0].name),
+	}
+}
+
+// podEBSVolumes returns the EBS volumes of a pod.
+func (p *OrcaProvider) podEBSVolumes(uid types.UID) []ebsVolume {
+	p.podsMu.RLock()
+	defer p.podsMu.RUnlock()
+	return p.ebsVolumes[uid]
+}
+
+// agentDisks returns the EBS volumes of a pod as submitted to its agent.
+func agentDisks(volumes []ebsVolume) map[string]agent.Disk {
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	disks := make(map[string]agent.Disk, len(volumes))
+	for _, v := range volumes {
+		disks[v.name] = agent.Disk{
+			VolumeID: v.volumeID,
+			Device:   v.device,
+			FSType:   v.fsType,
+			ReadOnly: v.readOnly,
+		}
+	}
+	return disks
+}
+
+// attachVolumes attaches a pod's EBS volumes to its instance. It returns a
+// message describing what it waits for, or "" once every volume is
+// attached.
+func (p *OrcaProvider) attachVolumes(ctx context.Context, uid types.UID, instanceID string) (string, error) {
+	var waiting []string
+	for _, v := range p.podEBSVolumes(uid) {
+		volume, err := p.awsClient.GetVolume(ctx, v.volumeID)
+		if err != nil {
+			return "", err
+		}
+
+		attached := false
+		var elsewhere string
+		for _, a := range volume.Attachments {
+			switch {
+			case a.InstanceID == instanceID && a.State == "attached":
+				attached = true
+			case a.InstanceID != instanceID:
+				elsewhere = a.InstanceID
+			}
+		}
+
+		switch {
+		case attached:
+			continue
+		case elsewhere != "":
+			// Wait for the volume's previous instance to release it
+			waiting = append(waiting, fmt.Sprintf("volume %s is attached to instance %s", v.volumeID, elsewhere))
+		case volume.State == "available":
+			if err := p.awsClient.AttachVolume(ctx, v.volumeID, instanceID, v.device); err != nil {
+				return "", err
+			}
+			waiting = append(waiting, fmt.Sprintf("attaching volume %s", v.volumeID))
+		default:
+			waiting = append(waiting, fmt.Sprintf("volume %s is %s", v.volumeID, volume.State))
+		}
+	}
+
+	sort.Strings(waiting)
+	return strings.Join(waiting, ", "), nil
+}
+
+// detachVolumes detaches a pod's EBS volumes from its instance. Failures
+// are ignored: terminating the instance releases the volumes as well.
+func (p *OrcaProvider) detachVolumes(ctx context.Context, uid types.UID, instanceID string) {
+	for _, v := range p.podEBSVolumes(uid) {
+		_ = p.awsClient.DetachVolume(ctx, v.volumeID, instanceID)
+	}
+}
+
+// terminateInstance detaches a pod's EBS volumes from its instance and
+// terminates the instance.
+func (p *OrcaProvider) terminateInstance(ctx context.Context, uid types.UID, instanceID string) error {
+	p.detachVolumes(ctx, uid, instanceID)
+	return p.awsClient.TerminateInstance(ctx, instanceID)
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// boundClaim returns a PersistentVolumeClaim bound to a PersistentVolume
+// with source.
+func boundClaim(name string, source corev1.PersistentVolumeSource) []runtime.Object {
+	return []runtime.Object{
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name},
+			Spec:       corev1.PersistentVolumeSpec{PersistentVolumeSource: source},
+		},
+	}
+}
+
+// ebsClaim returns a PersistentVolumeClaim bound to the EBS CSI volume
+// volumeID.
+func ebsClaim(name, volumeID string) []runtime.Object {
+	return boundClaim(name, corev1.PersistentVolumeSource{
+		CSI: &corev1.CSIPersistentVolumeSource{Driver: ebsCSIDriver, VolumeHandle: volumeID, FSType: "xfs"},
+	})
+}
+
+// withClaims adds a volume for each claim to pod, named after the claim.
+func withClaims(pod *corev1.Pod, claims ...string) *corev1.Pod {
+	for _, claim := range claims {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: claim,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			},
+		})
+	}
+	return pod
+}
+
+// withSubnets configures subnets of the zones us-west-2a and us-west-2b.
+func withSubnets(p *OrcaProvider, cloud *fakeAWS) {
+	p.config.AWS.SubnetID = "subnet-a"
+	p.config.AWS.SubnetIDs = []string{"subnet-b"}
+	cloud.subnetZones = map[string]string{"subnet-a": "us-west-2a", "subnet-b": "us-west-2b"}
+}
+
+func TestEBSVolumeZones(t *testing.T) {
+	tests := []struct {
+		name       string
+		zones      map[string]string
+		wantSubnet string
+		wantReason string
+		wantErr    string
+	}{
+		{
+			name:       "subnet in the volume's zone",
+			zones:      map[string]string{"vol-1": "us-west-2b"},
+			wantSubnet: "subnet-b",
+		},
+		{
+			name:       "volumes in one zone",
+			zones:      map[string]string{"vol-1": "us-west-2a", "vol-2": "us-west-2a"},
+			wantSubnet: "subnet-a",
+		},
+		{
+			name:       "volumes in different zones",
+			zones:      map[string]string{"vol-1": "us-west-2a", "vol-2": "us-west-2b"},
+			wantReason: "UnsupportedVolume",
+			wantErr:    "different availability zones",
+		},
+		{
+			name:       "no subnet in the volume's zone",
+			zones:      map[string]string{"vol-1": "us-west-2c"},
+			wantReason: "NoSubnetInZone",
+			wantErr:    "availability zone us-west-2c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("db")
+			objects := []runtime.Object{pod}
+			var claims []string
+			for _, id := range []string{"vol-1", "vol-2"} {
+				if _, ok := tt.zones[id]; ok {
+					claims = append(claims, "claim-"+id)
+					objects = append(objects, ebsClaim("claim-"+id, id)...)
+				}
+			}
+			withClaims(pod, claims...)
+			p, cloud := newTestProvider(t, objects...)
+			withSubnets(p, cloud)
+			for id, zone := range tt.zones {
+				cloud.addVolume(id, zone)
+			}
+
+			if err := p.CreatePod(context.Background(), pod); err != nil {
+				t.Fatalf("failed to create pod: %v", err)
+			}
+
+			status := podStatus(t, p, pod)
+			if tt.wantReason != "" {
+				if status.Phase != corev1.PodFailed || status.Reason != tt.wantReason || !strings.Contains(status.Message, tt.wantErr) {
+					t.Errorf("expected the pod to fail with %s %q, got %s %s %q", tt.wantReason, tt.wantErr, status.Phase, status.Reason, status.Message)
+				}
+				if len(cloud.launches) != 0 {
+					t.Errorf("expected no instance to be launched, got %d", len(cloud.launches))
+				}
+				return
+			}
+			if len(cloud.launches) != 1 || cloud.launches[0].SubnetID != tt.wantSubnet {
+				t.Errorf("expected the instance to launch in %s, got %+v", tt.wantSubnet, cloud.launches)
+			}
+		})
+	}
+}
+
+func TestEBSVolumeAttach(t *testing.T) {
+	pod := withClaims(testPod("db"), "data", "logs")
+	pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = true
+	objects := append([]runtime.Object{pod}, ebsClaim("data", "vol-data")...)
+	objects = append(objects, boundClaim("logs", corev1.PersistentVolumeSource{
+		AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-west-2b/vol-logs"},
+	})...)
+	p, cloud := newTestProvider(t, objects...)
+	withSubnets(p, cloud)
+	cloud.addVolume("vol-data", "us-west-2b")
+	cloud.addVolume("vol-logs", "us-west-2b")
+	ctx := context.Background()
+
+	// The volume is still attached to the instance of the pod's previous run
+	cloud.mu.Lock()
+	cloud.volumes["vol-data"].State = "in-use"
+	cloud.volumes["vol-data"].Attachments = []aws.VolumeAttachment{{InstanceID: "i-old", State: "detaching"}}
+	cloud.mu.Unlock()
+
+	instanceID, a := launchPod(t, p, pod)
+	cloud.setState(instanceID, "running", a.host)
+	a.setReport(runningReport(true))
+
+	p.syncPods(ctx)
+	p.syncPods(ctx)
+	status := podStatus(t, p, pod)
+	if c := podCondition(status, corev1.PodReady); c == nil || c.Reason != "VolumesAttaching" ||
+		!strings.Contains(c.Message, "volume vol-data is attached to instance i-old") || !strings.Contains(c.Message, "attaching volume vol-logs") {
+		t.Fatalf("expected the pod to wait for vol-data and attach vol-logs, got %+v", c)
+	}
+
+	cloud.mu.Lock()
+	cloud.volumes["vol-data"].State = "available"
+	cloud.volumes["vol-data"].Attachments = nil
+	cloud.mu.Unlock()
+	for range 5 {
+		p.syncPods(ctx)
+	}
+	if _, ok := p.launchState(pod.UID); ok {
+		t.Fatalf("expected the pod to have started, status %+v", podStatus(t, p, pod))
+	}
+
+	for _, id := range []string{"vol-data", "vol-logs"} {
+		volume, _ := cloud.GetVolume(ctx, id)
+		if len(volume.Attachments) != 1 || volume.Attachments[0].InstanceID != instanceID {
+			t.Errorf("expected %s to be attached to %s, got %+v", id, instanceID, volume.Attachments)
+		}
+	}
+	want := map[string]agent.Disk{
+		"data": {VolumeID: "vol-data", Device: "/dev/xvdb", FSType: "xfs", ReadOnly: true},
+		"logs": {VolumeID: "vol-logs", Device: "/dev/xvdc", FSType: "ext4"},
+	}
+	if disks := a.submission().Disks; len(disks) != len(want) || disks["data"] != want["data"] || disks["logs"] != want["logs"] {
+		t.Errorf("expected disks %+v, got %+v", want, disks)
+	}
+
+	// Deleting the pod detaches its volumes once it has stopped
+	if err := p.DeletePod(ctx, pod); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	cloud.mu.Lock()
+	stopping := len(cloud.detached) == 0
+	cloud.mu.Unlock()
+	if !stopping {
+		t.Fatal("expected the volumes to stay attached while the pod stops")
+	}
+	a.setReport(agent.PodReport{Phase: corev1.PodSucceeded, Initialized: true})
+	p.syncPods(ctx)
+
+	cloud.mu.Lock()
+	detached := slices.Sorted(slices.Values(cloud.detached))
+	cloud.mu.Unlock()
+	if want := []string{"vol-data:" + instanceID, "vol-logs:" + instanceID}; !slices.Equal(detached, want) {
+		t.Errorf("expected %v to be detached, got %v", want, detached)
+	}
+	if terminated := cloud.terminatedIDs(); !slices.Contains(terminated, instanceID) {
+		t.Errorf("expected instance %s to be terminated, got %v", instanceID, terminated)
+	}
+}
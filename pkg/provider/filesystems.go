@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+const (
+	// efsCSIDriver is the name of the EFS CSI driver.
+	efsCSIDriver = "efs.csi.aws.com"
+
+	// fsxLustreCSIDriver is the name of the FSx for Lustre CSI driver.
+	fsxLustreCSIDriver = "fsx.csi.aws.com"
+)
+
+// efsMountOptions are the NFS options AWS recommends for EFS.
+var efsMountOptions = []string{"nfsvers=4.1", "rsize=1048576", "wsize=1048576", "hard", "timeo=600", "retrans=2", "noresvport"}
+
+// nfsFilesystem returns an NFS export as mounted by the agent.
+func nfsFilesystem(server, path string, readOnly bool, options []string) agent.Filesystem {
+	return agent.Filesystem{
+		Type:     "nfs",
+		Source:   server + ":" + path,
+		Options:  options,
+		ReadOnly: readOnly,
+	}
+}
+
+// sharedFilesystem returns the shared filesystem of a pod volume bound to
+// pv, and whether pv is one: an NFS export, or an EFS or FSx for Lustre
+// file system of their CSI drivers.
+func (p *OrcaProvider) sharedFilesystem(v corev1.Volume, pv *corev1.PersistentVolume) (agent.Filesystem, bool, error) {
+	readOnly := v.PersistentVolumeClaim.ReadOnly
+	source := pv.Spec.PersistentVolumeSource
+
+	switch {
+	case source.NFS != nil:
+		return nfsFilesystem(source.NFS.Server, source.NFS.Path, readOnly || source.NFS.ReadOnly, pv.Spec.MountOptions), true, nil
+	case source.CSI != nil && source.CSI.Driver == efsCSIDriver:
+		fs, err := p.efsFilesystem(v.Name, source.CSI.VolumeHandle, pv.Spec.MountOptions)
+		fs.ReadOnly = readOnly || source.CSI.ReadOnly
+		return fs, true, err
+	case source.CSI != nil && source.CSI.Driver == fsxLustreCSIDriver:
+		fs, err := p.lustreFilesystem(v.Name, source.CSI, pv.Spec.MountOptions)
+		fs.ReadOnly = readOnly || source.CSI.ReadOnly
+		return fs, true, err
+	}
+	return agent.Filesystem{}, false, nil
+}
+
+// efsFilesystem returns the EFS file system of a volume handle of the EFS
+// CSI driver: "<file system ID>[:<path>[:<access point ID>]]". Access
+// points are mounted with the EFS mount helper, which enforces them over
+// TLS; everything else over plain NFS.
+func (p *OrcaProvider) efsFilesystem(volume, handle string, options []string) (agent.Filesystem, error) {
+	parts := strings.SplitN(handle, ":", 3)
+	fsID := parts[0]
+	if !strings.HasPrefix(fsID, "fs-") {
+		return agent.Filesystem{}, unsupportedVolume("volume %q has malformed EFS volume handle %q", volume, handle)
+	}
+	path := "/"
+	if len(parts) > 1 && parts[1] != "" {
+		path = parts[1]
+	}
+	mountTarget := p.config.AWS.SharedFilesystems.MountTargets[fsID]
+
+	if len(parts) == 3 && parts[2] != "" {
+		options = append([]string{"tls", "accesspoint=" + parts[2]}, options...)
+		if mountTarget != "" {
+			options = append(options, "mounttargetip="+mountTarget)
+		}
+		return agent.Filesystem{Type: "efs", Source: fsID + ":" + path, Options: options}, nil
+	}
+
+	if mountTarget == "" {
+		mountTarget = fmt.Sprintf("%s.efs.%s.amazonaws.com", fsID, p.config.AWS.Region)
+	}
+	if len(options) == 0 {
+		options = efsMountOptions
+	}
+	return agent.Filesystem{Type: "nfs4", Source: mountTarget + ":" + path, Options: options}, nil
+}
+
+// lustreFilesystem returns the FSx for Lustre file system of a volume of
+// the FSx CSI driver, which names the file system's DNS name and mount
+// name in its attributes.
+func (p *OrcaProvider) lustreFilesystem(volume string, csi *corev1.CSIPersistentVolumeSource, options []string) (agent.Filesystem, error) {
+	address := p.config.AWS.SharedFilesystems.MountTargets[csi.VolumeHandle]
+	if address == "" {
+		address = csi.VolumeAttributes["dnsname"]
+	}
+	mountName := csi.VolumeAttributes["mountname"]
+	if address == "" || mountName == "" {
+		return agent.Filesystem{}, unsupportedVolume("volume %q uses FSx for Lustre file system %s without the dnsname and mountname volume attributes", volume, csi.VolumeHandle)
+	}
+
+	return agent.Filesystem{Type: "lustre", Source: address + "@tcp:/" + mountName, Options: options}, nil
+}
+
+// podFilesystems returns the shared filesystems of a pod, by volume name.
+func (p *OrcaProvider) podFilesystems(uid types.UID) map[string]agent.Filesystem {
+	p.podsMu.RLock()
+	defer p.podsMu.RUnlock()
+
+	if len(p.filesystems[uid]) == 0 {
+		return nil
+	}
+	return p.filesystems[uid]
+}
+
+// recordMountErrors records a FailedMount event, as the kubelet does, for
+// every new mount error an agent reports.
+func (p *OrcaProvider) recordMountErrors(pod *corev1.Pod, errs map[string]string) {
+	if len(errs) == 0 {
+		return
+	}
+
+	p.podsMu.Lock()
+	recorded := p.mountErrors[pod.UID]
+	if recorded == nil {
+		recorded = make(map[string]string)
+		p.mountErrors[pod.UID] = recorded
+	}
+	var names []string
+	for name, msg := range errs {
+		if recorded[name] != msg {
+			recorded[name] = msg
+			names = append(names, name)
+		}
+	}
+	p.podsMu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		p.recorder.Eventf(pod, corev1.EventTypeWarning, "FailedMount", "MountVolume.SetUp failed for volume %q : %s", name, errs[name])
+	}
+}
@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+func TestSharedFilesystems(t *testing.T) {
+	efs := func(handle string) corev1.PersistentVolumeSource {
+		return corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: efsCSIDriver, VolumeHandle: handle}}
+	}
+	lustre := func(attributes map[string]string) corev1.PersistentVolumeSource {
+		return corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+			Driver:           fsxLustreCSIDriver,
+			VolumeHandle:     "fs-0789",
+			VolumeAttributes: attributes,
+		}}
+	}
+
+	tests := []struct {
+		name string
+		// nfs is an inline nfs volume; otherwise the volume claims a
+		// PersistentVolume with source
+		nfs          *corev1.NFSVolumeSource
+		source       corev1.PersistentVolumeSource
+		mountOptions []string
+		readOnly     bool
+		want         agent.Filesystem
+		wantErr      string
+	}{
+		{
+			name: "inline NFS",
+			nfs:  &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/data", ReadOnly: true},
+			want: agent.Filesystem{Type: "nfs", Source: "nfs.example.com:/exports/data", ReadOnly: true},
+		},
+		{
+			name:         "NFS PersistentVolume",
+			source:       corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "10.0.0.9", Path: "/data"}},
+			mountOptions: []string{"nfsvers=3"},
+			readOnly:     true,
+			want:         agent.Filesystem{Type: "nfs", Source: "10.0.0.9:/data", Options: []string{"nfsvers=3"}, ReadOnly: true},
+		},
+		{
+			name:   "EFS by regional DNS name",
+			source: efs("fs-0123"),
+			want:   agent.Filesystem{Type: "nfs4", Source: "fs-0123.efs.us-west-2.amazonaws.com:/", Options: efsMountOptions},
+		},
+		{
+			name:         "EFS by mount target",
+			source:       efs("fs-0456:/shared"),
+			mountOptions: []string{"nfsvers=4.1", "hard"},
+			want:         agent.Filesystem{Type: "nfs4", Source: "10.0.1.5:/shared", Options: []string{"nfsvers=4.1", "hard"}},
+		},
+		{
+			name:     "EFS access point",
+			source:   efs("fs-0456::fsap-0abc"),
+			readOnly: true,
+			want: agent.Filesystem{
+				Type:     "efs",
+				Source:   "fs-0456:/",
+				Options:  []string{"tls", "accesspoint=fsap-0abc", "mounttargetip=10.0.1.5"},
+				ReadOnly: true,
+			},
+		},
+		{
+			name:         "FSx for Lustre",
+			source:       lustre(map[string]string{"dnsname": "fs-0789.fsx.us-west-2.amazonaws.com", "mountname": "abcdef"}),
+			mountOptions: []string{"flock"},
+			want:         agent.Filesystem{Type: "lustre", Source: "fs-0789.fsx.us-west-2.amazonaws.com@tcp:/abcdef", Options: []string{"flock"}},
+		},
+		{
+			name:    "malformed EFS volume handle",
+			source:  efs("vol-0123"),
+			wantErr: `malformed EFS volume handle "vol-0123"`,
+		},
+		{
+			name:    "FSx for Lustre without mount name",
+			source:  lustre(map[string]string{"dnsname": "fs-0789.fsx.us-west-2.amazonaws.com"}),
+			wantErr: "without the dnsname and mountname volume attributes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("analysis")
+			objects := []runtime.Object{pod}
+			if tt.nfs != nil {
+				pod.Spec.Volumes = []corev1.Volume{{Name: "shared", VolumeSource: corev1.VolumeSource{NFS: tt.nfs}}}
+			} else {
+				withClaims(pod, "shared")
+				pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = tt.readOnly
+				claim := boundClaim("shared", tt.source)
+				claim[1].(*corev1.PersistentVolume).Spec.MountOptions = tt.mountOptions
+				objects = append(objects, claim...)
+			}
+			p, cloud := newTestProvider(t, objects...)
+			p.config.AWS.Region = "us-west-2"
+			p.config.AWS.SharedFilesystems.MountTargets = map[string]string{"fs-0456": "10.0.1.5"}
+			p.config.AWS.SharedFilesystems.SecurityGroupIDs = []string{"sg-efs"}
+
+			if tt.wantErr != "" {
+				if err := p.CreatePod(context.Background(), pod); err != nil {
+					t.Fatalf("failed to create pod: %v", err)
+				}
+				status := podStatus(t, p, pod)
+				if status.Phase != corev1.PodFailed || status.Reason != "UnsupportedVolume" || !strings.Contains(status.Message, tt.wantErr) {
+					t.Errorf("expected the pod to fail with %q, got %s %s %q", tt.wantErr, status.Phase, status.Reason, status.Message)
+				}
+				return
+			}
+
+			_, a := startPod(t, p, cloud, pod, runningReport(true))
+
+			// The instance gets the security groups that reach mount targets
+			if len(cloud.launches) != 1 || !slices.Equal(cloud.launches[0].SecurityGroupIDs, []string{"sg-efs"}) {
+				t.Errorf("expected the instance to launch with the shared filesystem security groups, got %+v", cloud.launches)
+			}
+			submission := a.submission()
+			if len(submission.Disks) != 0 {
+				t.Errorf("expected no EBS volumes, got %+v", submission.Disks)
+			}
+			if fs := submission.Filesystems["shared"]; len(submission.Filesystems) != 1 || !reflect.DeepEqual(fs, tt.want) {
+				t.Errorf("expected filesystem %+v, got %+v", tt.want, submission.Filesystems)
+			}
+		})
+	}
+}
+
+func TestMountErrors(t *testing.T) {
+	pod := testPod("analysis")
+	pod.Spec.Volumes = []corev1.Volume{{Name: "shared", VolumeSource: corev1.VolumeSource{
+		NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/data"},
+	}}}
+	p, cloud := newTestProvider(t, pod)
+	ctx := context.Background()
+
+	instanceID, a := launchPod(t, p, pod)
+	cloud.setState(instanceID, "running", a.host)
+	mounting := func(msg string) {
+		a.setReport(agent.PodReport{Phase: corev1.PodPending, MountErrors: map[string]string{"shared": msg}})
+	}
+	mounting("mount.nfs: Connection timed out")
+	for range 4 {
+		p.syncPods(ctx)
+	}
+
+	// An error is recorded once, and again when it changes
+	recorded := events(p)
+	if len(recorded) != 1 || !strings.Contains(recorded[0], `FailedMount MountVolume.SetUp failed for volume "shared" : mount.nfs: Connection timed out`) {
+		t.Fatalf("expected one FailedMount event, got %v", recorded)
+	}
+	mounting("mount.nfs: access denied by server")
+	p.syncPods(ctx)
+	p.syncPods(ctx)
+	if recorded := events(p); len(recorded) != 1 || !strings.Contains(recorded[0], "access denied by server") {
+		t.Errorf("expected a FailedMount event for the new error, got %v", recorded)
+	}
+	if _, ok := p.launchState(pod.UID); !ok {
+		t.Error("expected the pod to keep starting while its volume fails to mount")
+	}
+}
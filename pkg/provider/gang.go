@@ -0,0 +1,408 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+)
+
+const (
+	// gangMasterPort is the MASTER_PORT of gang members, the default port
+	// of torch.distributed. Pods that set MASTER_PORT keep theirs.
+	gangMasterPort = 29500
+
+	// completionIndexAnnotation holds the index of a pod of an Indexed Job.
+	completionIndexAnnotation = "batch.kubernetes.io/job-completion-index"
+
+	// gangFormationTimeout bounds how long the first pod of a gang waits
+	// for the rest of it.
+	gangFormationTimeout = 10 * time.Minute
+)
+
+// gang is a group of pods whose instances are launched together, in one
+// cluster placement group.
+type gang struct {
+	namespace string
+	name      string
+	size      int
+
+	// since is when the gang's first pod arrived
+	since time.Time
+
+	// members are the gang's pods in the order they arrived, and by rank
+	// once the gang is launched
+	members []*gangMember
+
+	// placementGroup is the placement group of a launched gang, and empty
+	// while the gang is still forming
+	placementGroup string
+}
+
+// gangMember is a pod of a gang.
+type gangMember struct {
+	pod  *corev1.Pod
+	opts aws.LaunchOptions
+
+	// address is the private IP of the member's instance once it runs
+	address string
+}
+
+// gangAnnotations returns the gang a pod belongs to and its size, or "" if
+// it belongs to none.
+func gangAnnotations(pod *corev1.Pod) (string, int, *unsupportedError) {
+	name := pod.Annotations[AnnotationGang]
+	if name == "" {
+		return "", 0, nil
+	}
+	size, err := strconv.Atoi(pod.Annotations[AnnotationGangSize])
+	if err != nil || size < 1 {
+		return "", 0, &unsupportedError{
+			reason:  "InvalidGang",
+			message: fmt.Sprintf("gang %q needs a positive %s annotation", name, AnnotationGangSize),
+		}
+	}
+	return name, size, nil
+}
+
+// joinGang adds a pod to its gang, and queues the gang for syncGangs to
+// launch once its last pod arrives. Until then the pod is held pending
+// without an instance.
+func (p *OrcaProvider) joinGang(ctx context.Context, pod *corev1.Pod, name string, size int, opts aws.LaunchOptions) {
+	key := pod.Namespace + "/" + name
+
+	p.gangsMu.Lock()
+	g := p.gangs[key]
+	if g == nil {
+		g = &gang{namespace: pod.Namespace, name: name, size: size, since: time.Now()}
+		p.gangs[key] = g
+	}
+	if g.size != size {
+		p.gangsMu.Unlock()
+		p.rejectPod(pod, &unsupportedError{
+			reason:  "InvalidGang",
+			message: fmt.Sprintf("pod declares a size of %d for gang %q, whose other pods declare %d", size, name, g.size),
+		})
+		return
+	}
+	g.members = append(g.members, &gangMember{pod: pod.DeepCopy(), opts: opts})
+	p.podGangs[pod.UID] = g
+
+	complete := len(g.members) == g.size
+	if complete {
+		// Ranks follow Indexed Job completion indexes, or pod names
+		delete(p.gangs, key)
+		slices.SortStableFunc(g.members, func(a, b *gangMember) int {
+			ai, aErr := strconv.Atoi(a.pod.Annotations[completionIndexAnnotation])
+			bi, bErr := strconv.Atoi(b.pod.Annotations[completionIndexAnnotation])
+			if aErr == nil && bErr == nil && ai != bi {
+				return cmp.Compare(ai, bi)
+			}
+			return cmp.Compare(a.pod.Name, b.pod.Name)
+		})
+		g.placementGroup = placementGroupName(g)
+		p.gangLaunches = append(p.gangLaunches, g)
+	}
+	members := slices.Clone(g.members)
+	p.gangsMu.Unlock()
+
+	p.reportGangPending(g, members)
+}
+
+// reportGangPending reports the members of a forming gang as waiting for
+// the rest of it, or those of a complete one as waiting for its launch.
+func (p *OrcaProvider) reportGangPending(g *gang, members []*gangMember) {
+	message := fmt.Sprintf("Waiting for %d of %d pods of gang %q", g.size-len(members), g.size, g.name)
+	if len(members) == g.size {
+		message = fmt.Sprintf("Launching the instances of the %d pods of gang %q", g.size, g.name)
+	}
+	for _, m := range members {
+		p.updatePodStatus(m.pod.UID, func(status *corev1.PodStatus) {
+			setLaunchConditions(m.pod, status, "GangPending", message)
+		})
+	}
+}
+
+// placementGroupName returns the name of a gang's placement group, made
+// unique by the UID of its first member.
+func placementGroupName(g *gang) string {
+	uid := string(g.members[0].pod.UID)
+	return fmt.Sprintf("orca-%s-%s-%s", g.namespace, g.name, uid[:min(len(uid), 8)])
+}
+
+// launchGang launches the instances of every member of a gang in its
+// placement group, all at once, with an EFA where the instance type
+// supports one. If any instance fails to launch, the whole gang is rolled
+// back.
+func (p *OrcaProvider) launchGang(ctx context.Context, g *gang, members []*gangMember) {
+	// A cluster placement group is in a single availability zone
+	var subnetID string
+	for _, m := range members {
+		if m.opts.SubnetID == "" || m.opts.SubnetID == subnetID {
+			continue
+		}
+		if subnetID != "" {
+			p.failGang(ctx, g, "GangLaunchFailed", fmt.Sprintf("pods of gang %q have volumes in different availability zones", g.name))
+			return
+		}
+		subnetID = m.opts.SubnetID
+	}
+
+	if err := p.awsClient.CreatePlacementGroup(ctx, g.placementGroup); err != nil {
+		p.failGang(ctx, g, "GangLaunchFailed", fmt.Sprintf("failed to launch gang %q: %v", g.name, err))
+		return
+	}
+	p.gangsMu.Lock()
+	p.placements[g.placementGroup] = g
+	p.gangsMu.Unlock()
+
+	instanceIDs := make([]string, len(members))
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			opts := m.opts
+			opts.PlacementGroup = g.placementGroup
+			if subnetID != "" {
+				opts.SubnetID = subnetID
+			}
+			efa, err := p.awsClient.EFASupported(ctx, opts.InstanceType)
+			if err == nil {
+				opts.EFA = efa
+				instanceIDs[i], err = p.awsClient.CreateInstance(ctx, m.pod, opts)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to launch the instance of pod %s of gang %q: %w", m.pod.Name, g.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Record every instance first, so that a rollback terminates them all
+	tracked := make([]bool, len(members))
+	for i, m := range members {
+		if instanceIDs[i] == "" {
+			continue
+		}
+		p.podsMu.Lock()
+		_, tracked[i] = p.pods[m.pod.UID]
+		if tracked[i] {
+			p.instanceIDs[m.pod.UID] = instanceIDs[i]
+		}
+		p.podsMu.Unlock()
+
+		// The pod was deleted while its instance launched
+		if !tracked[i] {
+			_ = p.awsClient.TerminateInstance(ctx, instanceIDs[i])
+		}
+	}
+	if i := slices.IndexFunc(errs, func(err error) bool { return err != nil }); i >= 0 {
+		p.failGang(ctx, g, "GangLaunchFailed", errs[i].Error())
+		return
+	}
+
+	for i, m := range members {
+		if !tracked[i] {
+			continue
+		}
+		p.trackLaunch(m.pod.UID)
+		message := fmt.Sprintf("Waiting for EC2 instance %s of rank %d of gang %q to start", instanceIDs[i], i, g.name)
+		p.updatePodStatus(m.pod.UID, func(status *corev1.PodStatus) {
+			setLaunchConditions(m.pod, status, "InstancePending", message)
+		})
+	}
+}
+
+// failGang fails every member of a gang that has not finished, terminates
+// its instance and records an event, so that no member waits for peers that
+// will never come. The gang's placement group is deleted, by syncGangs if
+// EC2 refuses while instances are still terminating.
+func (p *OrcaProvider) failGang(ctx context.Context, g *gang, reason, message string) {
+	p.gangsMu.Lock()
+	members := slices.Clone(g.members)
+	for _, m := range members {
+		if p.podGangs[m.pod.UID] == g {
+			delete(p.podGangs, m.pod.UID)
+		}
+	}
+	if key := g.namespace + "/" + g.name; p.gangs[key] == g {
+		delete(p.gangs, key)
+	}
+	_, placed := p.placements[g.placementGroup]
+	p.gangsMu.Unlock()
+
+	for _, m := range members {
+		uid := m.pod.UID
+		p.forgetLaunch(uid)
+
+		p.podsMu.RLock()
+		tracked, ok := p.pods[uid]
+		instanceID := p.instanceIDs[uid]
+		p.podsMu.RUnlock()
+		if !ok || podFinished(tracked) {
+			continue
+		}
+
+		if instanceID != "" {
+			_ = p.terminateInstance(ctx, uid, instanceID)
+		}
+		p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+			markPodTerminated(status, reason, message)
+		})
+		p.forgetAgent(uid)
+		p.recorder.Event(m.pod, corev1.EventTypeWarning, reason, message)
+	}
+
+	if placed && p.awsClient.DeletePlacementGroup(ctx, g.placementGroup) == nil {
+		p.gangsMu.Lock()
+		delete(p.placements, g.placementGroup)
+		p.gangsMu.Unlock()
+	}
+}
+
+// gangOf returns the gang of a pod, or nil.
+func (p *OrcaProvider) gangOf(uid types.UID) *gang {
+	p.gangsMu.Lock()
+	defer p.gangsMu.Unlock()
+	return p.podGangs[uid]
+}
+
+// setGangAddress records the private IP of a gang member's instance.
+func (p *OrcaProvider) setGangAddress(uid types.UID, address string) {
+	p.gangsMu.Lock()
+	defer p.gangsMu.Unlock()
+
+	g := p.podGangs[uid]
+	if g == nil {
+		return
+	}
+	for _, m := range g.members {
+		if m.pod.UID == uid {
+			m.address = address
+		}
+	}
+}
+
+// gangEnv returns the torch.distributed variables of a gang member: the
+// address of the instance of rank 0, the member's rank and the gang's size.
+// It reports false while the address of rank 0 is not known yet. Pods
+// outside gangs get none.
+func (p *OrcaProvider) gangEnv(uid types.UID) ([]corev1.EnvVar, bool) {
+	p.gangsMu.Lock()
+	defer p.gangsMu.Unlock()
+
+	g := p.podGangs[uid]
+	if g == nil || g.placementGroup == "" {
+		return nil, true
+	}
+	master := g.members[0].address
+	if master == "" {
+		return nil, false
+	}
+	rank := slices.IndexFunc(g.members, func(m *gangMember) bool { return m.pod.UID == uid })
+	return []corev1.EnvVar{
+		{Name: "MASTER_ADDR", Value: master},
+		{Name: "MASTER_PORT", Value: strconv.Itoa(gangMasterPort)},
+		{Name: "WORLD_SIZE", Value: strconv.Itoa(g.size)},
+		{Name: "RANK", Value: strconv.Itoa(rank)},
+		{Name: "NODE_RANK", Value: strconv.Itoa(rank)},
+	}, true
+}
+
+// leaveGang removes a deleted pod from its gang. A gang that is still
+// forming waits for a replacement.
+func (p *OrcaProvider) leaveGang(uid types.UID) {
+	p.gangsMu.Lock()
+	g := p.podGangs[uid]
+	delete(p.podGangs, uid)
+	if g == nil || g.placementGroup != "" {
+		p.gangsMu.Unlock()
+		return
+	}
+	g.members = slices.DeleteFunc(g.members, func(m *gangMember) bool { return m.pod.UID == uid })
+	if len(g.members) == 0 {
+		delete(p.gangs, g.namespace+"/"+g.name)
+	}
+	members := slices.Clone(g.members)
+	p.gangsMu.Unlock()
+
+	p.reportGangPending(g, members)
+}
+
+// syncGangs launches complete gangs in the background and fails those that
+// did not form within gangFormationTimeout. It then deletes the placement
+// groups of gangs whose members have all finished or been deleted. EC2
+// refuses while their instances are still terminating, so deletion is
+// retried on every sync.
+func (p *OrcaProvider) syncGangs(ctx context.Context) {
+	p.gangsMu.Lock()
+	launches := make(map[*gang][]*gangMember, len(p.gangLaunches))
+	for _, g := range p.gangLaunches {
+		launches[g] = slices.Clone(g.members)
+	}
+	p.gangLaunches = nil
+
+	expired := make(map[*gang]string)
+	for key, g := range p.gangs {
+		if time.Since(g.since) > gangFormationTimeout {
+			// Pods arriving from now on form a new gang
+			delete(p.gangs, key)
+			expired[g] = fmt.Sprintf("only %d of %d pods of gang %q arrived within %s", len(g.members), g.size, g.name, gangFormationTimeout)
+		}
+	}
+	p.gangsMu.Unlock()
+
+	for g, members := range launches {
+		go p.launchGang(ctx, g, members)
+	}
+	for g, message := range expired {
+		p.failGang(ctx, g, "GangFormationTimeout", message)
+	}
+
+	p.gangsMu.Lock()
+	gangs := make(map[string][]types.UID, len(p.placements))
+	for name, g := range p.placements {
+		for _, m := range g.members {
+			gangs[name] = append(gangs[name], m.pod.UID)
+		}
+	}
+	p.gangsMu.Unlock()
+
+	for name, uids := range gangs {
+		p.podsMu.RLock()
+		done := true
+		for _, uid := range uids {
+			if pod, ok := p.pods[uid]; ok && !podFinished(pod) {
+				done = false
+			}
+		}
+		p.podsMu.RUnlock()
+		if !done {
+			continue
+		}
+
+		if err := p.awsClient.DeletePlacementGroup(ctx, name); err != nil {
+			continue
+		}
+		p.gangsMu.Lock()
+		g := p.placements[name]
+		delete(p.placements, name)
+		for _, uid := range uids {
+			if p.podGangs[uid] == g {
+				delete(p.podGangs, uid)
+			}
+		}
+		p.gangsMu.Unlock()
+	}
+}
@@ -0,0 +1,279 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// gangPod returns the pod of an Indexed Job with the given completion index
+// that belongs to a gang.
+func gangPod(name string, index, size int) *corev1.Pod {
+	pod := testPod(name)
+	pod.Annotations[AnnotationGang] = "trainers"
+	pod.Annotations[AnnotationGangSize] = strconv.Itoa(size)
+	pod.Annotations[completionIndexAnnotation] = strconv.Itoa(index)
+	return pod
+}
+
+// createGang creates the pods of a gang, last index first.
+func createGang(t *testing.T, p *OrcaProvider, size int) []*corev1.Pod {
+	t.Helper()
+
+	pods := make([]*corev1.Pod, size)
+	for i := size - 1; i >= 0; i-- {
+		pods[i] = gangPod("trainer-"+strconv.Itoa(i), i, size)
+		if err := p.CreatePod(context.Background(), pods[i]); err != nil {
+			t.Fatalf("failed to create pod %s: %v", pods[i].Name, err)
+		}
+	}
+	return pods
+}
+
+// syncGangLaunches runs syncGangs and waits for the gangs it launches to
+// have an instance, or to fail, for each pod.
+func syncGangLaunches(t *testing.T, p *OrcaProvider, pods []*corev1.Pod) {
+	t.Helper()
+
+	p.syncGangs(context.Background())
+	waitFor(t, "the gang to launch", func() bool {
+		for _, pod := range pods {
+			if _, launching := p.launchState(pod.UID); !launching && !podFinished(p.podByUID(pod.UID)) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor waits for a condition to hold.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// events returns the events recorded so far.
+func events(p *OrcaProvider) []string {
+	var recorded []string
+	for {
+		select {
+		case event := <-p.recorder.(*record.FakeRecorder).Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+func TestGangEnv(t *testing.T) {
+	p, cloud := newTestProvider(t)
+
+	pods := createGang(t, p, 3)
+	if len(cloud.launches) != 0 {
+		t.Fatalf("expected CreatePod to leave the launch to syncGangs, got %d instances", len(cloud.launches))
+	}
+	syncGangLaunches(t, p, pods)
+
+	if len(cloud.launches) != 3 {
+		t.Fatalf("expected 3 instances, got %d", len(cloud.launches))
+	}
+	for _, opts := range cloud.launches {
+		if opts.PlacementGroup == "" || !opts.EFA {
+			t.Errorf("expected an instance in a placement group with an EFA, got %+v", opts)
+		}
+	}
+
+	// Nobody starts before the address of rank 0 is known
+	p.setGangAddress(pods[2].UID, "10.0.0.3")
+	if _, ok := p.gangEnv(pods[2].UID); ok {
+		t.Error("expected the gang environment to wait for rank 0")
+	}
+	p.setGangAddress(pods[0].UID, "10.0.0.1")
+
+	for rank, pod := range pods {
+		env, ok := p.gangEnv(pod.UID)
+		if !ok {
+			t.Fatalf("expected the gang environment of %s", pod.Name)
+		}
+		want := map[string]string{
+			"MASTER_ADDR": "10.0.0.1",
+			"MASTER_PORT": "29500",
+			"WORLD_SIZE":  "3",
+			"RANK":        strconv.Itoa(rank),
+			"NODE_RANK":   strconv.Itoa(rank),
+		}
+		for _, e := range env {
+			if want[e.Name] != e.Value {
+				t.Errorf("%s: expected %s=%s, got %s", pod.Name, e.Name, want[e.Name], e.Value)
+			}
+			delete(want, e.Name)
+		}
+		if len(want) != 0 {
+			t.Errorf("%s: missing variables %v", pod.Name, want)
+		}
+	}
+
+	if env, ok := p.gangEnv(types.UID("uid-other")); env != nil || !ok {
+		t.Errorf("expected no gang environment outside gangs, got %v, %v", env, ok)
+	}
+}
+
+func TestGangRollback(t *testing.T) {
+	tests := []struct {
+		name         string
+		placementErr error
+		createErr    map[string]error
+		instances    int
+	}{
+		{
+			name:         "placement group fails",
+			placementErr: errors.New("placement group limit exceeded"),
+		},
+		{
+			name:      "member launch fails",
+			createErr: map[string]error{"trainer-1": errors.New("InsufficientInstanceCapacity")},
+			instances: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, cloud := newTestProvider(t)
+			cloud.placementErr = tt.placementErr
+			for name, err := range tt.createErr {
+				cloud.createErr[name] = err
+			}
+
+			pods := createGang(t, p, 3)
+			syncGangLaunches(t, p, pods)
+			waitFor(t, "the placement group to be deleted", func() bool {
+				p.gangsMu.Lock()
+				defer p.gangsMu.Unlock()
+				return len(p.placements) == 0
+			})
+
+			for _, pod := range pods {
+				status := podStatus(t, p, pod)
+				if status.Phase != corev1.PodFailed || status.Reason != "GangLaunchFailed" {
+					t.Errorf("%s: expected phase Failed with reason GangLaunchFailed, got %s with %s", pod.Name, status.Phase, status.Reason)
+				}
+				if p.gangOf(pod.UID) != nil {
+					t.Errorf("%s: expected the pod to leave its gang", pod.Name)
+				}
+			}
+
+			if terminated := cloud.terminatedIDs(); len(terminated) != tt.instances {
+				t.Errorf("expected %d instances to be terminated, got %v", tt.instances, terminated)
+			}
+			cloud.mu.Lock()
+			groups := len(cloud.groups)
+			cloud.mu.Unlock()
+			if groups != 0 {
+				t.Errorf("expected the placement group to be deleted, got %d groups", groups)
+			}
+			if recorded := events(p); len(recorded) != 3 || !strings.Contains(recorded[0], "GangLaunchFailed") {
+				t.Errorf("expected a GangLaunchFailed event for each pod, got %v", recorded)
+			}
+		})
+	}
+}
+
+func TestLeaveGang(t *testing.T) {
+	p, cloud := newTestProvider(t)
+	ctx := context.Background()
+
+	pods := []*corev1.Pod{gangPod("trainer-0", 0, 3), gangPod("trainer-1", 1, 3)}
+	for _, pod := range pods {
+		if err := p.CreatePod(ctx, pod); err != nil {
+			t.Fatalf("failed to create pod %s: %v", pod.Name, err)
+		}
+	}
+
+	if err := p.DeletePod(ctx, pods[1]); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	if p.gangOf(pods[1].UID) != nil {
+		t.Error("expected the deleted pod to leave its gang")
+	}
+	status := podStatus(t, p, pods[0])
+	if c := podCondition(status, corev1.PodReady); c == nil || c.Reason != "GangPending" || !strings.Contains(c.Message, "2 of 3") {
+		t.Errorf("expected the remaining pod to wait for 2 of 3 pods, got %+v", c)
+	}
+
+	// Replacements complete the gang
+	replacements := []*corev1.Pod{gangPod("trainer-1b", 1, 3), gangPod("trainer-2", 2, 3)}
+	for _, pod := range replacements {
+		if err := p.CreatePod(ctx, pod); err != nil {
+			t.Fatalf("failed to create pod %s: %v", pod.Name, err)
+		}
+	}
+	syncGangLaunches(t, p, append(replacements, pods[0]))
+	if len(cloud.launches) != 3 {
+		t.Errorf("expected 3 instances, got %d", len(cloud.launches))
+	}
+
+	// A gang whose pods all leave is forgotten
+	p2, _ := newTestProvider(t)
+	pod := gangPod("trainer-0", 0, 2)
+	if err := p2.CreatePod(ctx, pod); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	if err := p2.DeletePod(ctx, pod); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	if len(p2.gangs) != 0 {
+		t.Errorf("expected the empty gang to be forgotten, got %d gangs", len(p2.gangs))
+	}
+}
+
+func TestGangFormationTimeout(t *testing.T) {
+	p, cloud := newTestProvider(t)
+
+	pod := gangPod("trainer-0", 0, 2)
+	if err := p.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+
+	// Within the timeout the pod keeps waiting
+	p.syncGangs(context.Background())
+	if status := podStatus(t, p, pod); status.Phase != corev1.PodPending {
+		t.Fatalf("expected phase Pending before the timeout, got %s", status.Phase)
+	}
+
+	p.gangsMu.Lock()
+	p.gangs["default/trainers"].since = time.Now().Add(-time.Hour)
+	p.gangsMu.Unlock()
+	p.syncGangs(context.Background())
+
+	status := podStatus(t, p, pod)
+	if status.Phase != corev1.PodFailed || status.Reason != "GangFormationTimeout" {
+		t.Errorf("expected phase Failed with reason GangFormationTimeout, got %s with %s", status.Phase, status.Reason)
+	}
+	if !strings.Contains(status.Message, "only 1 of 2 pods") {
+		t.Errorf("expected the message to say how many pods arrived, got %q", status.Message)
+	}
+	if recorded := events(p); !slices.ContainsFunc(recorded, func(e string) bool { return strings.Contains(e, "GangFormationTimeout") }) {
+		t.Errorf("expected a GangFormationTimeout event, got %v", recorded)
+	}
+	if len(p.gangs) != 0 || p.gangOf(pod.UID) != nil {
+		t.Error("expected the gang to be forgotten")
+	}
+	if len(cloud.launches) != 0 {
+		t.Errorf("expected no instance to be launched, got %d", len(cloud.launches))
+	}
+}
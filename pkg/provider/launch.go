@@ -0,0 +1,276 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+)
+
+const (
+	// instanceStartTimeout bounds how long an instance may stay pending.
+	instanceStartTimeout = 10 * time.Minute
+
+	// agentStartTimeout bounds how long a running instance may take to
+	// boot and start the agent.
+	agentStartTimeout = 10 * time.Minute
+)
+
+// launchPhase is a step in bringing up a pod's instance.
+type launchPhase string
+
+const (
+	// launchInstancePending waits for EC2 to report the instance running.
+	launchInstancePending launchPhase = "InstancePending"
+
+	// launchVolumesAttaching waits for the pod's EBS volumes to attach to
+	// the instance.
+	launchVolumesAttaching launchPhase = "VolumesAttaching"
+
+	// launchAgentStarting waits for the instance to boot and the agent to
+	// answer.
+	launchAgentStarting launchPhase = "AgentStarting"
+
+	// launchContainersStarting waits for every container to start.
+	launchContainersStarting launchPhase = "ContainersStarting"
+)
+
+// launch tracks a pod whose instance is being brought up.
+type launch struct {
+	phase launchPhase
+	since time.Time
+}
+
+// trackLaunch starts tracking the launch of a pod's instance.
+func (p *OrcaProvider) trackLaunch(uid types.UID) {
+	p.launchesMu.Lock()
+	defer p.launchesMu.Unlock()
+
+	p.launches[uid] = &launch{
+		phase: launchInstancePending,
+		since: time.Now(),
+	}
+}
+
+// forgetLaunch stops tracking a pod's launch.
+func (p *OrcaProvider) forgetLaunch(uid types.UID) {
+	p.launchesMu.Lock()
+	defer p.launchesMu.Unlock()
+	delete(p.launches, uid)
+}
+
+// launchState returns the launch of a pod, if it is still launching.
+func (p *OrcaProvider) launchState(uid types.UID) (launch, bool) {
+	p.launchesMu.Lock()
+	defer p.launchesMu.Unlock()
+
+	if l, ok := p.launches[uid]; ok {
+		return *l, true
+	}
+	return launch{}, false
+}
+
+// advanceLaunch moves one pod's launch forward. instance is nil if EC2 did
+// not return it.
+func (p *OrcaProvider) advanceLaunch(ctx context.Context, pod *corev1.Pod, instanceID string, l launch, instance *aws.Instance) {
+	uid := pod.UID
+
+	if instance != nil {
+		switch instance.State {
+		case "shutting-down", "terminated", "stopping", "stopped":
+			msg := fmt.Sprintf("EC2 instance %s is %s", instance.ID, instance.State)
+			if instance.StateReason != "" {
+				msg += ": " + instance.StateReason
+			}
+			p.failLaunch(ctx, pod, instanceID, "InstanceLaunchFailed", msg)
+			return
+		}
+	}
+
+	if l.phase != launchInstancePending && instance == nil {
+		return
+	}
+
+	switch l.phase {
+	case launchInstancePending:
+		if instance == nil || instance.State != "running" || instance.PrivateIP == "" {
+			if time.Since(l.since) > instanceStartTimeout {
+				p.failLaunch(ctx, pod, instanceID, "InstanceLaunchTimeout",
+					fmt.Sprintf("EC2 instance %s did not start within %s", instanceID, instanceStartTimeout))
+			}
+			return
+		}
+
+		// The pod's IP routes to the instance once its peer is connected
+		if err := p.connectPeer(ctx, uid, instance); err != nil {
+			if time.Since(l.since) > instanceStartTimeout {
+				p.failLaunch(ctx, pod, instanceID, "NetworkNotReady",
+					fmt.Sprintf("pod network did not connect to instance %s within %s: %v", instanceID, instanceStartTimeout, err))
+				return
+			}
+			p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+				setLaunchConditions(pod, status, "NetworkNotReady", err.Error())
+			})
+			return
+		}
+
+		p.setGangAddress(uid, instance.PrivateIP)
+
+		next, reason, msg := launchAgentStarting, "InstanceBooting", fmt.Sprintf("EC2 instance %s is running, waiting for the ORCA agent", instance.ID)
+		if len(p.podEBSVolumes(uid)) > 0 {
+			next, reason, msg = launchVolumesAttaching, "VolumesAttaching", fmt.Sprintf("EC2 instance %s is running, attaching volumes", instance.ID)
+		}
+		p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+			status.HostIP = instance.PublicIP
+			p.setPodIP(status, uid, instance)
+			setLaunchConditions(pod, status, reason, msg)
+		})
+		p.setLaunchPhase(uid, next)
+
+	case launchVolumesAttaching:
+		waiting, err := p.attachVolumes(ctx, uid, instanceID)
+		if err != nil {
+			waiting = err.Error()
+		}
+		if waiting != "" {
+			if time.Since(l.since) > volumeAttachTimeout {
+				p.failLaunch(ctx, pod, instanceID, "FailedAttachVolume",
+					fmt.Sprintf("volumes did not attach to instance %s within %s: %s", instanceID, volumeAttachTimeout, waiting))
+				return
+			}
+			p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+				setLaunchConditions(pod, status, "VolumesAttaching", waiting)
+			})
+			return
+		}
+
+		p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+			setLaunchConditions(pod, status, "InstanceBooting", "Volumes attached, waiting for the ORCA agent")
+		})
+		p.setLaunchPhase(uid, launchAgentStarting)
+
+	case launchAgentStarting:
+		client := p.agentClient(pod, instance)
+		agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+		err := client.Health(agentCtx)
+		cancel()
+		if err != nil {
+			if time.Since(l.since) > agentStartTimeout {
+				p.failLaunch(ctx, pod, instanceID, "AgentUnreachable",
+					fmt.Sprintf("ORCA agent on instance %s did not start within %s: %v", instanceID, agentStartTimeout, err))
+			}
+			return
+		}
+
+		// Gang members learn the address of rank 0 before they start
+		if _, ok := p.gangEnv(uid); !ok {
+			p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+				setLaunchConditions(pod, status, "GangStarting", "Waiting for the instance of rank 0 of the pod's gang")
+			})
+			return
+		}
+
+		// Like the kubelet, keep retrying while referenced objects are missing
+		if err := p.submitPod(ctx, pod, client); err != nil {
+			p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+				setLaunchConditions(pod, status, "CreateContainerConfigError", err.Error())
+			})
+			return
+		}
+
+		p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+			setLaunchConditions(pod, status, "ContainersStarting", "ORCA agent is running, starting containers")
+		})
+		p.setLaunchPhase(uid, launchContainersStarting)
+
+	case launchContainersStarting:
+		agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+		report, err := p.agentClient(pod, instance).Status(agentCtx)
+		cancel()
+		if err != nil {
+			return
+		}
+		p.recordMountErrors(pod, report.MountErrors)
+
+		if report.Phase == "" || report.Phase == corev1.PodPending {
+			p.updatePodStatus(uid, func(status *corev1.PodStatus) {
+				status.InitContainerStatuses = report.InitContainerStatuses
+				status.ContainerStatuses = report.ContainerStatuses
+				setInitializedCondition(status, report.Initialized)
+			})
+			return
+		}
+
+		// Every container has started; from here on the pod follows the
+		// agent's reports
+		p.forgetLaunch(uid)
+		p.applyReport(ctx, pod, instanceID, instance, report)
+	}
+}
+
+// setLaunchPhase moves a launch to the next phase.
+func (p *OrcaProvider) setLaunchPhase(uid types.UID, phase launchPhase) {
+	p.launchesMu.Lock()
+	defer p.launchesMu.Unlock()
+
+	if l, ok := p.launches[uid]; ok {
+		l.phase = phase
+		l.since = time.Now()
+	}
+}
+
+// failLaunch marks the pod failed and terminates its instance, along with
+// the rest of its gang.
+func (p *OrcaProvider) failLaunch(ctx context.Context, pod *corev1.Pod, instanceID, reason, message string) {
+	p.forgetLaunch(pod.UID)
+
+	p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+		status.Phase = corev1.PodFailed
+		status.Reason = reason
+		status.Message = message
+		setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, reason, message)
+	})
+
+	_ = p.terminateInstance(ctx, pod.UID, instanceID)
+	p.forgetAgent(pod.UID)
+
+	// A gang launches all or nothing
+	if g := p.gangOf(pod.UID); g != nil {
+		p.failGang(ctx, g, "GangLaunchFailed", fmt.Sprintf("pod %s of gang %q failed to launch: %s", pod.Name, g.name, message))
+	}
+}
+
+// setLaunchConditions reports a pod that is still launching: scheduled, and
+// initialized unless it has init containers, but with containers not ready
+// yet.
+func setLaunchConditions(pod *corev1.Pod, status *corev1.PodStatus, reason, message string) {
+	if !podInitialized(status) {
+		setInitializedCondition(status, len(pod.Spec.InitContainers) == 0)
+	}
+	setPodCondition(status, corev1.ContainersReady, corev1.ConditionFalse, reason, message)
+	setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, reason, message)
+}
+
+// setInitializedCondition sets the Initialized condition from the agent's
+// report.
+func setInitializedCondition(status *corev1.PodStatus, initialized bool) {
+	if initialized {
+		setPodCondition(status, corev1.PodInitialized, corev1.ConditionTrue, "", "")
+		return
+	}
+	setPodCondition(status, corev1.PodInitialized, corev1.ConditionFalse, "ContainersNotInitialized", "containers with incomplete status")
+}
+
+// podInitialized reports whether the pod's Initialized condition is true.
+func podInitialized(status *corev1.PodStatus) bool {
+	for _, c := range status.Conditions {
+		if c.Type == corev1.PodInitialized {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// podIP returns the IP a pod reports on its instance: its overlay address,
+// or the instance's private IP without an overlay. Pods published through
+// the service proxy report none, which keeps them out of the EndpointSlice
+// controller's slices, since the cluster cannot reach their instance.
+func (p *OrcaProvider) podIP(uid types.UID, instance *aws.Instance) string {
+	switch {
+	case p.overlay != nil:
+		if peer, ok := p.overlay.Peer(uid); ok {
+			return peer.Address.String()
+		}
+	case p.services != nil:
+		return ""
+	}
+	return instance.PrivateIP
+}
+
+// withPodIP returns pod with the IP it has on its instance in its status.
+// Proxied pods report none, but their containers still see it through the
+// downward API and in their hosts file.
+func (p *OrcaProvider) withPodIP(pod *corev1.Pod) *corev1.Pod {
+	if pod.Status.PodIP != "" {
+		return pod
+	}
+	host := p.agentHost(pod.UID)
+	if host == "" {
+		return pod
+	}
+	pod = pod.DeepCopy()
+	pod.Status.PodIP = host
+	pod.Status.PodIPs = []corev1.PodIP{{IP: host}}
+	return pod
+}
+
+// setPodIP sets the IPs of a pod on its instance in its status.
+func (p *OrcaProvider) setPodIP(status *corev1.PodStatus, uid types.UID, instance *aws.Instance) {
+	status.PodIP = p.podIP(uid, instance)
+	status.PodIPs = nil
+	if status.PodIP != "" {
+		status.PodIPs = []corev1.PodIP{{IP: status.PodIP}}
+	}
+}
+
+// connectPeer adds a pod's overlay peer to the hub, at its instance.
+func (p *OrcaProvider) connectPeer(ctx context.Context, uid types.UID, instance *aws.Instance) error {
+	if p.overlay == nil {
+		return nil
+	}
+	peer, ok := p.overlay.Peer(uid)
+	if !ok {
+		return fmt.Errorf("pod has no overlay address")
+	}
+	return p.overlay.AddPeer(ctx, peer, instance.PrivateIP)
+}
+
+// disconnectPeer removes a pod's overlay peer and releases its address.
+// Failures are ignored: the peer's instance is gone.
+func (p *OrcaProvider) disconnectPeer(ctx context.Context, uid types.UID) {
+	if p.overlay != nil {
+		_ = p.overlay.RemovePeer(ctx, uid)
+	}
+}
+
+// reserveOverlayAddresses reserves the overlay addresses of the node's
+// instances that are still up from before a restart, so that new pods never
+// get an address one of them uses.
+func (p *OrcaProvider) reserveOverlayAddresses(ctx context.Context) error {
+	if p.overlay == nil {
+		return nil
+	}
+
+	instances, err := p.awsClient.ListInstances(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list instances for overlay addresses: %w", err)
+	}
+	for _, instance := range instances {
+		uid, address := instance.Tags[TagPodUID], instance.Tags[TagOverlayAddress]
+		if instance.Tags[TagNode] != p.nodeName || uid == "" || address == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return fmt.Errorf("failed to parse overlay address of instance %s: %w", instance.ID, err)
+		}
+		if err := p.overlay.Reserve(types.UID(uid), addr); err != nil {
+			return fmt.Errorf("failed to reserve overlay address of instance %s: %w", instance.ID, err)
+		}
+	}
+	return nil
+}
+
+// podNetwork returns how a pod's agent connects it to the cluster network.
+func (p *OrcaProvider) podNetwork(uid types.UID) *agent.PodNetwork {
+	cfg := p.config.Network
+	network := &agent.PodNetwork{
+		ClusterDomain: cfg.ClusterDomain,
+		ClusterDNS:    cfg.ClusterDNS,
+	}
+	if p.overlay == nil {
+		return network
+	}
+
+	peer, ok := p.overlay.Peer(uid)
+	if !ok {
+		return network
+	}
+	network.Overlay = &agent.Overlay{
+		Interface:    cfg.Overlay.Interface,
+		Address:      peer.Address.String(),
+		PrivateKey:   peer.PrivateKey.String(),
+		ListenPort:   cfg.Overlay.ListenPort,
+		HubPublicKey: p.overlay.PublicKey().String(),
+		HubAddress:   p.overlay.Address().String(),
+		Routes:       p.overlay.Routes(),
+	}
+	return network
+}
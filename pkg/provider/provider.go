@@ -2,19 +2,47 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
 	"github.com/scttfrdmn/orca/pkg/config"
 	"github.com/scttfrdmn/orca/pkg/instances"
+	"github.com/scttfrdmn/orca/pkg/overlay"
+	"github.com/scttfrdmn/orca/pkg/userdata"
 )
 
+// awsAPI is the part of the AWS client the provider uses.
+type awsAPI interface {
+	CreateInstance(ctx context.Context, pod *corev1.Pod, opts aws.LaunchOptions) (string, error)
+	TerminateInstance(ctx context.Context, instanceID string) error
+	GetInstance(ctx context.Context, instanceID string) (*aws.Instance, error)
+	GetInstanceByPod(ctx context.Context, pod *corev1.Pod) (*aws.Instance, error)
+	GetInstances(ctx context.Context, instanceIDs []string) (map[string]*aws.Instance, error)
+	ListInstances(ctx context.Context) ([]*aws.Instance, error)
+	InstanceStorageGB(ctx context.Context, instanceType string) (int64, error)
+
+	CreatePlacementGroup(ctx context.Context, name string) error
+	DeletePlacementGroup(ctx context.Context, name string) error
+	EFASupported(ctx context.Context, instanceType string) (bool, error)
+
+	GetVolume(ctx context.Context, volumeID string) (*aws.Volume, error)
+	AttachVolume(ctx context.Context, volumeID, instanceID, device string) error
+	DetachVolume(ctx context.Context, volumeID, instanceID string) error
+	SubnetZones(ctx context.Context, subnetIDs []string) (map[string]string, error)
+}
+
 // OrcaProvider implements the Provider interface for AWS EC2.
 type OrcaProvider struct {
 	// Configuration
@@ -24,7 +52,33 @@ type OrcaProvider struct {
 	selector instances.Selector
 
 	// AWS client for EC2 operations
-	awsClient *aws.Client
+	awsClient awsAPI
+
+	// Kubernetes client for the objects pods refer to
+	kubeClient kubernetes.Interface
+
+	// Service account tokens of pods
+	tokens *tokenCache
+
+	// Variables that point in-cluster clients at the API server
+	apiServerEnv []corev1.EnvVar
+
+	// Authority for the credentials of on-instance agents
+	agentAuthority *agent.Authority
+
+	// Hub of the overlay that routes pod IPs, nil without one
+	overlay *overlay.Hub
+
+	// Proxy that publishes pods behind Services, nil without one
+	services *serviceProxy
+
+	// Agent clients by pod UID
+	agents   map[types.UID]agentEntry
+	agentsMu sync.Mutex
+
+	// Latest agent usage samples by pod UID
+	stats   map[types.UID]*agent.StatsSample
+	statsMu sync.RWMutex
 
 	// Node information
 	nodeName  string
@@ -35,13 +89,57 @@ type OrcaProvider struct {
 	// Pod tracking
 	pods   map[types.UID]*corev1.Pod
 	podsMu sync.RWMutex
+
+	// EC2 instance IDs by pod UID
+	instanceIDs map[types.UID]string
+
+	// EBS volumes and shared filesystems by pod UID
+	ebsVolumes  map[types.UID][]ebsVolume
+	filesystems map[types.UID]map[string]agent.Filesystem
+
+	// Mount errors last recorded as events, by pod UID and volume name
+	mountErrors map[types.UID]map[string]string
+
+	// Hashes of the volume files last sent to each pod's agent
+	volumeHashes map[types.UID]string
+
+	// Deadlines of pods being stopped, after which their instances are
+	// terminated regardless
+	stopDeadlines map[types.UID]time.Time
+
+	// Recorder for pod events
+	recorder record.EventRecorder
+
+	// Callback that pushes pod status changes to virtual-kubelet
+	notify func(*corev1.Pod)
+
+	// Pods whose instances are still launching
+	launches   map[types.UID]*launch
+	launchesMu sync.Mutex
+
+	// Gangs still forming by namespace/name, complete gangs waiting to be
+	// launched, gangs by member pod UID, and launched gangs by placement
+	// group
+	gangs        map[string]*gang
+	gangLaunches []*gang
+	podGangs     map[types.UID]*gang
+	placements   map[string]*gang
+	gangsMu      sync.Mutex
 }
 
-// NewProvider creates a new ORCA provider.
-func NewProvider(cfg *config.Config, nodeName, namespace, version string) (*OrcaProvider, error) {
+// NewProvider creates a new ORCA provider. kubeClient is used to resolve
+// the ConfigMaps, Secrets and pod fields that pods refer to, and to request
+// their service account tokens. Pod events are recorded with recorder.
+func NewProvider(cfg *config.Config, kubeClient kubernetes.Interface, recorder record.EventRecorder, nodeName, namespace, version string) (*OrcaProvider, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
+	if kubeClient == nil {
+		return nil, fmt.Errorf("kubeClient cannot be nil")
+	}
+	if recorder == nil {
+		return nil, fmt.Errorf("recorder cannot be nil")
+	}
 	if nodeName == "" {
 		return nil, fmt.Errorf("nodeName cannot be empty")
 	}
@@ -59,21 +157,91 @@ func NewProvider(cfg *config.Config, nodeName, namespace, version string) (*Orca
 		return nil, fmt.Errorf("failed to create AWS client: %w", err)
 	}
 
-	p := &OrcaProvider{
-		config:    cfg,
-		selector:  selector,
-		awsClient: awsClient,
-		nodeName:  nodeName,
-		namespace: namespace,
-		version:   version,
-		startTime: time.Now(),
-		pods:      make(map[types.UID]*corev1.Pod),
+	// Load or create the agent credential authority
+	agentAuthority, err := newAgentAuthority(cfg.Agent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent authority: %w", err)
+	}
+
+	env, err := apiServerEnv(cfg.Agent.APIServerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring up the overlay before any pod joins it
+	var hub *overlay.Hub
+	if cfg.Network.Overlay.Enabled {
+		if hub, err = overlay.NewHub(cfg.Network.Overlay); err != nil {
+			return nil, fmt.Errorf("failed to create overlay: %w", err)
+		}
+		if err := hub.Start(ctx); err != nil {
+			return nil, fmt.Errorf("failed to start overlay: %w", err)
+		}
+	}
+
+	var services *serviceProxy
+	if proxy := cfg.Network.ServiceProxy; proxy.Enabled {
+		address := proxy.Address
+		if address == "" {
+			address = cfg.Kubelet.Address
+		}
+		if address == "" {
+			return nil, fmt.Errorf("network.serviceProxy needs an address: set network.serviceProxy.address or kubelet.address")
+		}
+		first, last, err := proxy.Ports()
+		if err != nil {
+			return nil, fmt.Errorf("invalid network.serviceProxy.portRange: %w", err)
+		}
+		services = newServiceProxy(address, first, last)
+	}
+
+	p := newOrcaProvider(cfg, awsClient, kubeClient, recorder)
+	p.selector = selector
+	p.apiServerEnv = env
+	p.agentAuthority = agentAuthority
+	p.overlay = hub
+	p.services = services
+	p.nodeName = nodeName
+	p.namespace = namespace
+	p.version = version
+
+	if err := p.reserveOverlayAddresses(ctx); err != nil {
+		return nil, err
 	}
 
 	return p, nil
 }
 
-// CreatePod creates a new pod by launching an EC2 instance.
+// newOrcaProvider returns a provider without pods that uses awsClient and
+// kubeClient.
+func newOrcaProvider(cfg *config.Config, awsClient awsAPI, kubeClient kubernetes.Interface, recorder record.EventRecorder) *OrcaProvider {
+	return &OrcaProvider{
+		config:        cfg,
+		awsClient:     awsClient,
+		kubeClient:    kubeClient,
+		tokens:        newTokenCache(kubeClient),
+		startTime:     time.Now(),
+		pods:          make(map[types.UID]*corev1.Pod),
+		instanceIDs:   make(map[types.UID]string),
+		ebsVolumes:    make(map[types.UID][]ebsVolume),
+		filesystems:   make(map[types.UID]map[string]agent.Filesystem),
+		mountErrors:   make(map[types.UID]map[string]string),
+		recorder:      recorder,
+		volumeHashes:  make(map[types.UID]string),
+		stopDeadlines: make(map[types.UID]time.Time),
+		agents:        make(map[types.UID]agentEntry),
+		stats:         make(map[types.UID]*agent.StatsSample),
+		launches:      make(map[types.UID]*launch),
+		gangs:         make(map[string]*gang),
+		podGangs:      make(map[types.UID]*gang),
+		placements:    make(map[string]*gang),
+	}
+}
+
+// CreatePod creates a new pod by launching an EC2 instance. Pods that
+// violate the security profile of their namespace, or with volumes ORCA
+// cannot provide, are failed with the reason in their status. Pods of a
+// gang are held until the gang is complete.
 func (p *OrcaProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	if pod == nil {
 		return fmt.Errorf("pod cannot be nil")
@@ -84,11 +252,69 @@ func (p *OrcaProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 		return fmt.Errorf("pod %s/%s missing required annotations", pod.Namespace, pod.Name)
 	}
 
+	// Pods that break the security policy never get an instance
+	if violations := p.config.Security.CheckPod(pod); len(violations) > 0 {
+		p.rejectPod(pod, &unsupportedError{
+			reason:  "SecurityPolicyViolation",
+			message: config.FormatViolations(p.config.Security.Profile(pod.Namespace), violations),
+		})
+		return nil
+	}
+
+	gangName, gangSize, gangErr := gangAnnotations(pod)
+	if gangErr != nil {
+		p.rejectPod(pod, gangErr)
+		return nil
+	}
+
+	// Find the volumes the instance provides; EBS volumes decide its zone
+	volumes, err := p.podVolumes(ctx, pod)
+	var subnetID string
+	if err == nil {
+		subnetID, err = p.launchSubnet(ctx, volumes.ebs)
+	}
+	var unsupported *unsupportedError
+	if errors.As(err, &unsupported) {
+		p.rejectPod(pod, unsupported)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
 	// Select instance type
 	instanceType, err := p.selector.Select(pod)
 	if err != nil {
 		return fmt.Errorf("failed to select instance type: %w", err)
 	}
+	rootVolume, ephemeralGiB, err := p.rootVolume(ctx, pod, instanceType)
+	if err != nil {
+		return err
+	}
+
+	// Render the bootstrap that starts the agent with the pod
+	creds, err := p.agentAuthority.Issue(pod.UID)
+	if err != nil {
+		return fmt.Errorf("failed to issue agent credentials: %w", err)
+	}
+	userData, err := userdata.Render(pod, userdata.Options{
+		AgentPort:      p.config.Agent.Port,
+		AgentBinaryURL: p.config.Agent.BinaryURL,
+		Credentials:    creds,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render user data: %w", err)
+	}
+
+	// The pod's overlay address is its IP from the start
+	var tags map[string]string
+	if p.overlay != nil {
+		peer, err := p.overlay.NewPeer(pod.UID)
+		if err != nil {
+			return fmt.Errorf("failed to allocate pod IP: %w", err)
+		}
+		tags = map[string]string{TagNode: p.nodeName, TagOverlayAddress: peer.Address.String()}
+	}
 
 	// Update pod status to Pending
 	p.podsMu.Lock()
@@ -104,41 +330,51 @@ func (p *OrcaProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 		},
 	}
 	p.pods[pod.UID] = podCopy
+	p.ebsVolumes[pod.UID] = volumes.ebs
+	p.filesystems[pod.UID] = volumes.filesystems
 	p.podsMu.Unlock()
 
-	// Create EC2 instance
-	instanceID, err := p.awsClient.CreateInstance(ctx, pod, instanceType)
+	// Shared filesystems may need security groups that reach their mount
+	// targets
+	opts := aws.LaunchOptions{
+		InstanceType:        instanceType,
+		SubnetID:            subnetID,
+		UserData:            userData,
+		RootVolume:          rootVolume,
+		EphemeralStorageGiB: ephemeralGiB,
+		Tags:                tags,
+	}
+	if len(volumes.filesystems) > 0 {
+		opts.SecurityGroupIDs = p.config.AWS.SharedFilesystems.SecurityGroupIDs
+	}
+
+	// Gang members are launched together once the whole gang has arrived
+	if gangName != "" {
+		p.joinGang(ctx, pod, gangName, gangSize, opts)
+		return nil
+	}
+
+	// Request the EC2 instance; the launch is tracked in the background
+	instanceID, err := p.awsClient.CreateInstance(ctx, pod, opts)
 	if err != nil {
 		// Update pod status to Failed
-		p.podsMu.Lock()
-		podCopy.Status.Phase = corev1.PodFailed
-		podCopy.Status.Conditions = append(podCopy.Status.Conditions, corev1.PodCondition{
-			Type:               corev1.PodReady,
-			Status:             corev1.ConditionFalse,
-			LastTransitionTime: metav1.Now(),
-			Reason:             "InstanceCreationFailed",
-			Message:            fmt.Sprintf("Failed to create EC2 instance: %v", err),
+		p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+			status.Phase = corev1.PodFailed
+			setPodCondition(status, corev1.PodReady, corev1.ConditionFalse,
+				"InstanceCreationFailed", fmt.Sprintf("Failed to create EC2 instance: %v", err))
 		})
-		p.pods[pod.UID] = podCopy
-		p.podsMu.Unlock()
 
 		return fmt.Errorf("failed to create instance: %w", err)
 	}
 
-	// Update pod status to Running
 	p.podsMu.Lock()
-	podCopy.Status.Phase = corev1.PodRunning
-	podCopy.Status.Conditions = append(podCopy.Status.Conditions, corev1.PodCondition{
-		Type:               corev1.PodReady,
-		Status:             corev1.ConditionTrue,
-		LastTransitionTime: metav1.Now(),
-		Reason:             "InstanceRunning",
-		Message:            fmt.Sprintf("EC2 instance %s is running", instanceID),
-	})
-	podCopy.Status.HostIP = "" // Will be updated when we query instance details
-	podCopy.Status.PodIP = ""  // Will be updated when we query instance details
-	p.pods[pod.UID] = podCopy
+	p.instanceIDs[pod.UID] = instanceID
 	p.podsMu.Unlock()
+	p.trackLaunch(pod.UID)
+
+	p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+		setLaunchConditions(pod, status, "InstancePending", fmt.Sprintf("Waiting for EC2 instance %s to start", instanceID))
+	})
 
 	return nil
 }
@@ -154,7 +390,7 @@ func (p *OrcaProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 
 	existing, exists := p.pods[pod.UID]
 	if !exists {
-		return fmt.Errorf("pod %s/%s not found", pod.Namespace, pod.Name)
+		return errdefs.NotFoundf("pod %s/%s not found", pod.Namespace, pod.Name)
 	}
 
 	// Update pod (limited operations supported)
@@ -164,32 +400,33 @@ func (p *OrcaProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 	return nil
 }
 
-// DeletePod deletes a pod by terminating its EC2 instance.
+// DeletePod stops a pod the way the kubelet does: its agent runs preStop
+// hooks and gives containers the pod's grace period before killing them, and
+// the instance is terminated once they have stopped. Pods that are still
+// launching, or whose agent cannot be reached, are terminated right away.
+// Pods ORCA does not track have any instance left for them terminated, and
+// are reported not found.
 func (p *OrcaProvider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 	if pod == nil {
 		return fmt.Errorf("pod cannot be nil")
 	}
 
-	// Find the instance for this pod
-	instance, err := p.awsClient.GetInstanceByPod(ctx, pod.Namespace, pod.Name)
-	if err != nil {
-		// Instance not found - pod may have already been cleaned up
-		p.podsMu.Lock()
-		delete(p.pods, pod.UID)
-		p.podsMu.Unlock()
+	p.podsMu.RLock()
+	_, tracked := p.pods[pod.UID]
+	p.podsMu.RUnlock()
+
+	_, launching := p.launchState(pod.UID)
+	p.forgetLaunch(pod.UID)
+
+	if !launching && p.stopPod(ctx, pod) {
 		return nil
 	}
-
-	// Terminate the instance
-	if err := p.awsClient.TerminateInstance(ctx, instance.ID); err != nil {
-		return fmt.Errorf("failed to terminate instance %s: %w", instance.ID, err)
+	if err := p.removePod(ctx, pod); err != nil {
+		return err
+	}
+	if !tracked {
+		return errdefs.NotFoundf("pod %s/%s not found", pod.Namespace, pod.Name)
 	}
-
-	// Remove from tracking
-	p.podsMu.Lock()
-	delete(p.pods, pod.UID)
-	p.podsMu.Unlock()
-
 	return nil
 }
 
@@ -204,37 +441,17 @@ func (p *OrcaProvider) GetPod(ctx context.Context, namespace, name string) (*cor
 		}
 	}
 
-	return nil, fmt.Errorf("pod %s/%s not found", namespace, name)
+	return nil, errdefs.NotFoundf("pod %s/%s not found", namespace, name)
 }
 
-// GetPodStatus retrieves the status of a pod.
+// GetPodStatus retrieves the status of a pod. Status is kept current by
+// Run, so this does not call AWS or the agent.
 func (p *OrcaProvider) GetPodStatus(ctx context.Context, namespace, name string) (*corev1.PodStatus, error) {
 	pod, err := p.GetPod(ctx, namespace, name)
 	if err != nil {
 		return nil, err
 	}
 
-	// Query actual instance status from AWS
-	instance, err := p.awsClient.GetInstanceByPod(ctx, namespace, name)
-	if err == nil {
-		// Update pod status based on instance state
-		switch instance.State {
-		case "running":
-			pod.Status.Phase = corev1.PodRunning
-			pod.Status.HostIP = instance.PublicIP
-			pod.Status.PodIP = instance.PrivateIP
-		case "pending":
-			pod.Status.Phase = corev1.PodPending
-		case "stopping", "stopped", "shutting-down", "terminated":
-			pod.Status.Phase = corev1.PodFailed
-		}
-
-		// Update our cached copy
-		p.podsMu.Lock()
-		p.pods[pod.UID] = pod
-		p.podsMu.Unlock()
-	}
-
 	return &pod.Status, nil
 }
 
@@ -327,6 +544,20 @@ func (p *OrcaProvider) ConfigureNode(ctx context.Context, node *corev1.Node) {
 		OSImage:                 "AWS EC2",
 		SystemUUID:              "",
 	}
+
+	// Point the API server at the kubelet API served by ORCA
+	node.Status.DaemonEndpoints = corev1.NodeDaemonEndpoints{
+		KubeletEndpoint: corev1.DaemonEndpoint{Port: int32(p.config.Kubelet.Port)},
+	}
+	node.Status.Addresses = []corev1.NodeAddress{
+		{Type: corev1.NodeHostName, Address: p.nodeName},
+	}
+	if p.config.Kubelet.Address != "" {
+		node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{
+			Type:    corev1.NodeInternalIP,
+			Address: p.config.Kubelet.Address,
+		})
+	}
 }
 
 // GetNodeStatus returns the current status of the virtual node.
@@ -343,32 +574,63 @@ func (p *OrcaProvider) GetNodeStatus(ctx context.Context) (*corev1.NodeStatus, e
 	return &node.Status, nil
 }
 
-// GetContainerLogs retrieves logs from a container.
-func (p *OrcaProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) ([]byte, error) {
-	// TODO: Implement via AWS Systems Manager or CloudWatch Logs
-	return nil, fmt.Errorf("GetContainerLogs not yet implemented")
+// GetContainerLogs streams logs from a container through the agent on its
+// instance. The caller must close the returned reader.
+func (p *OrcaProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) (io.ReadCloser, error) {
+	client, err := p.podAgent(ctx, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+
+	logOpts := agent.LogOptions{
+		Follow:     opts.Follow,
+		Previous:   opts.Previous,
+		Timestamps: opts.Timestamps,
+		Tail:       opts.Tail,
+		LimitBytes: opts.LimitBytes,
+		SinceTime:  opts.SinceTime,
+	}
+	if opts.SinceSeconds > 0 {
+		logOpts.SinceTime = time.Now().Add(-time.Duration(opts.SinceSeconds) * time.Second)
+	}
+
+	return client.Logs(ctx, containerName, logOpts)
 }
 
 // RunInContainer executes a command in a container (for kubectl exec).
+// A non-zero exit code is returned as a utilexec.CodeExitError so that it is
+// reported to the client.
 func (p *OrcaProvider) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error {
-	// TODO: Implement via AWS Systems Manager Session Manager
-	return fmt.Errorf("RunInContainer not yet implemented")
+	client, err := p.podAgent(ctx, namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	code, err := client.Exec(ctx, containerName, cmd, agentStreamIO(ctx, attach))
+	return sessionResult(code, err)
 }
 
-// GetStatsSummary retrieves resource usage statistics.
-func (p *OrcaProvider) GetStatsSummary(ctx context.Context) (*StatsSummary, error) {
-	// TODO: Implement via CloudWatch metrics
-	now := time.Now()
-
-	summary := &StatsSummary{
-		Node: NodeStats{
-			NodeName:  p.nodeName,
-			StartTime: p.startTime,
-			CPU:       &CPUStats{Time: now},
-			Memory:    &MemoryStats{Time: now},
-		},
-		Pods: []PodStats{},
+// AttachToContainer attaches to a container's main process (for kubectl attach).
+func (p *OrcaProvider) AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach AttachIO) error {
+	client, err := p.podAgent(ctx, namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	code, err := client.Attach(ctx, containerName, agentStreamIO(ctx, attach))
+	return sessionResult(code, err)
+}
+
+// PortForward tunnels stream to a port of the pod (for kubectl port-forward).
+// The tunnel runs through the agent, which connects to the port on the
+// instance.
+func (p *OrcaProvider) PortForward(ctx context.Context, namespace, podName string, port int32, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+
+	client, err := p.podAgent(ctx, namespace, podName)
+	if err != nil {
+		return err
 	}
 
-	return summary, nil
+	return client.PortForward(ctx, port, stream)
 }
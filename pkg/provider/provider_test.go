@@ -0,0 +1,616 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
+	"github.com/scttfrdmn/orca/pkg/config"
+	"github.com/scttfrdmn/orca/pkg/instances"
+	"github.com/scttfrdmn/orca/pkg/overlay"
+)
+
+// fakeAWS is an in-memory EC2. Instances start pending; tests move them on
+// with setState.
+type fakeAWS struct {
+	mu        sync.Mutex
+	instances map[string]*aws.Instance
+	launches  []aws.LaunchOptions
+	// podUIDs holds the pod UID each instance is tagged with
+	podUIDs map[string]types.UID
+	nextID  int
+
+	// createErr fails the launch of the pod with that name
+	createErr map[string]error
+
+	// placementErr fails creating placement groups
+	placementErr error
+
+	terminated []string
+	groups     map[string]bool
+	deleted    []string
+
+	// volumes are the EBS volumes, which attach as soon as asked
+	volumes map[string]*aws.Volume
+	// detached lists the volumes detached, as volume ID:instance ID
+	detached []string
+	// subnetZones maps subnets to their availability zones
+	subnetZones map[string]string
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		instances: make(map[string]*aws.Instance),
+		podUIDs:   make(map[string]types.UID),
+		createErr: make(map[string]error),
+		groups:    make(map[string]bool),
+		volumes:   make(map[string]*aws.Volume),
+	}
+}
+
+func (f *fakeAWS) CreateInstance(ctx context.Context, pod *corev1.Pod, opts aws.LaunchOptions) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.createErr[pod.Name]; err != nil {
+		return "", err
+	}
+	f.nextID++
+	id := fmt.Sprintf("i-%04d", f.nextID)
+	tags := map[string]string{TagPodUID: string(pod.UID)}
+	for key, value := range opts.Tags {
+		tags[key] = value
+	}
+	f.instances[id] = &aws.Instance{ID: id, State: "pending", InstanceType: opts.InstanceType, Tags: tags}
+	f.podUIDs[id] = pod.UID
+	f.launches = append(f.launches, opts)
+	return id, nil
+}
+
+func (f *fakeAWS) TerminateInstance(ctx context.Context, instanceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.terminated = append(f.terminated, instanceID)
+	if instance, ok := f.instances[instanceID]; ok {
+		instance.State = "shutting-down"
+	}
+	return nil
+}
+
+func (f *fakeAWS) GetInstance(ctx context.Context, instanceID string) (*aws.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+	copied := *instance
+	return &copied, nil
+}
+
+func (f *fakeAWS) GetInstanceByPod(ctx context.Context, pod *corev1.Pod) (*aws.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, uid := range f.podUIDs {
+		if instance := f.instances[id]; uid == pod.UID && (instance.State == "pending" || instance.State == "running") {
+			copied := *instance
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("no instance for pod %s/%s", pod.Namespace, pod.Name)
+}
+
+func (f *fakeAWS) ListInstances(ctx context.Context) ([]*aws.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result []*aws.Instance
+	for _, instance := range f.instances {
+		if instance.State == "pending" || instance.State == "running" {
+			copied := *instance
+			result = append(result, &copied)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeAWS) GetInstances(ctx context.Context, instanceIDs []string) (map[string]*aws.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := make(map[string]*aws.Instance, len(instanceIDs))
+	for _, id := range instanceIDs {
+		if instance, ok := f.instances[id]; ok {
+			copied := *instance
+			result[id] = &copied
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeAWS) InstanceStorageGB(ctx context.Context, instanceType string) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeAWS) CreatePlacementGroup(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.placementErr != nil {
+		return f.placementErr
+	}
+	f.groups[name] = true
+	return nil
+}
+
+func (f *fakeAWS) DeletePlacementGroup(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.groups, name)
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func (f *fakeAWS) EFASupported(ctx context.Context, instanceType string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeAWS) GetVolume(ctx context.Context, volumeID string) (*aws.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	volume, ok := f.volumes[volumeID]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", volumeID)
+	}
+	copied := *volume
+	copied.Attachments = append([]aws.VolumeAttachment(nil), volume.Attachments...)
+	return &copied, nil
+}
+
+func (f *fakeAWS) AttachVolume(ctx context.Context, volumeID, instanceID, device string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	volume, ok := f.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %s not found", volumeID)
+	}
+	if volume.State != "available" {
+		return fmt.Errorf("volume %s is %s", volumeID, volume.State)
+	}
+	volume.State = "in-use"
+	volume.Attachments = []aws.VolumeAttachment{{InstanceID: instanceID, Device: device, State: "attached"}}
+	return nil
+}
+
+func (f *fakeAWS) DetachVolume(ctx context.Context, volumeID, instanceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.detached = append(f.detached, volumeID+":"+instanceID)
+	if volume, ok := f.volumes[volumeID]; ok {
+		volume.State = "available"
+		volume.Attachments = nil
+	}
+	return nil
+}
+
+func (f *fakeAWS) SubnetZones(ctx context.Context, subnetIDs []string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	zones := make(map[string]string, len(subnetIDs))
+	for _, id := range subnetIDs {
+		if zone, ok := f.subnetZones[id]; ok {
+			zones[id] = zone
+		}
+	}
+	return zones, nil
+}
+
+// addVolume adds an available EBS volume in a zone.
+func (f *fakeAWS) addVolume(volumeID, zone string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.volumes[volumeID] = &aws.Volume{ID: volumeID, State: "available", AvailabilityZone: zone}
+}
+
+// setState sets the state and private IP of an instance.
+func (f *fakeAWS) setState(instanceID, state, privateIP string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.instances[instanceID].State = state
+	f.instances[instanceID].PrivateIP = privateIP
+}
+
+// terminatedIDs returns the instances terminated so far.
+func (f *fakeAWS) terminatedIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.terminated...)
+}
+
+// fakeAgent serves the agent API of one pod with the credentials the
+// provider issued for it.
+type fakeAgent struct {
+	mu        sync.Mutex
+	report    agent.PodReport
+	submitted *agent.PodSubmission
+	healthy   bool
+	stopped   bool
+
+	host string
+	port int
+}
+
+// startFakeAgent serves the agent API for the pod with UID uid. The provider
+// reaches it once the pod's instance has the agent's host as its private IP
+// and the config has the agent's port.
+func startFakeAgent(t *testing.T, p *OrcaProvider, uid types.UID) *fakeAgent {
+	t.Helper()
+
+	creds, err := p.agentAuthority.Issue(uid)
+	if err != nil {
+		t.Fatalf("failed to issue agent credentials: %v", err)
+	}
+	cert, err := tls.X509KeyPair(creds.CertPEM, creds.KeyPEM)
+	if err != nil {
+		t.Fatalf("failed to load agent key pair: %v", err)
+	}
+
+	a := &fakeAgent{healthy: true}
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bearer "+creds.Token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if !a.healthy {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("GET /v1/pod", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(a.report)
+	})
+	mux.HandleFunc("PUT /v1/pod", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		var submission agent.PodSubmission
+		if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.submitted = &submission
+		a.report.PodUID = submission.Pod.UID
+	})
+	mux.HandleFunc("DELETE /v1/pod", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.stopped = true
+	})
+	mux.HandleFunc("GET /v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		// Stats streams wait for the client to go away
+		<-r.Context().Done()
+	})
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	// Cleanups run last first: stop the provider's stats stream before
+	// the server waits for it
+	t.Cleanup(func() { p.forgetAgent(uid) })
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	a.host = host
+	a.port, _ = strconv.Atoi(port)
+	return a
+}
+
+// setReport sets the report the agent returns.
+func (a *fakeAgent) setReport(report agent.PodReport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report.PodUID = a.report.PodUID
+	a.report = report
+}
+
+// submission returns the pod submitted to the agent, or nil.
+func (a *fakeAgent) submission() *agent.PodSubmission {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.submitted
+}
+
+// newTestProvider returns a provider on a fake EC2 and Kubernetes API that
+// holds objects.
+func newTestProvider(t *testing.T, objects ...runtime.Object) (*OrcaProvider, *fakeAWS) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Instances.SelectionMode = "explicit"
+	cfg.Agent.Port = 9440
+	cfg.Network.ClusterDomain = "cluster.local"
+
+	selector, err := instances.NewSelector(cfg.Instances)
+	if err != nil {
+		t.Fatalf("failed to create selector: %v", err)
+	}
+	authority, err := agent.NewAuthority()
+	if err != nil {
+		t.Fatalf("failed to create agent authority: %v", err)
+	}
+
+	cloud := newFakeAWS()
+	p := newOrcaProvider(cfg, cloud, fake.NewClientset(objects...), record.NewFakeRecorder(100))
+	p.selector = selector
+	p.agentAuthority = authority
+	p.nodeName = "orca"
+	return p, cloud
+}
+
+// testPod returns a pod with one container that runs on a t3.micro.
+func testPod(name string) *corev1.Pod {
+	automount := false
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			UID:         types.UID("uid-" + name),
+			Annotations: map[string]string{AnnotationInstanceType: "t3.micro"},
+		},
+		Spec: corev1.PodSpec{
+			AutomountServiceAccountToken: &automount,
+			Containers:                   []corev1.Container{{Name: "main", Image: "busybox"}},
+		},
+	}
+}
+
+// podStatus returns the status of a tracked pod.
+func podStatus(t *testing.T, p *OrcaProvider, pod *corev1.Pod) corev1.PodStatus {
+	t.Helper()
+
+	status, err := p.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("failed to get pod status: %v", err)
+	}
+	return *status
+}
+
+// podCondition returns the condition of a type, or nil.
+func podCondition(status corev1.PodStatus, conditionType corev1.PodConditionType) *corev1.PodCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// readyReason returns the reason of a pod's Ready condition.
+func readyReason(status corev1.PodStatus) string {
+	if c := podCondition(status, corev1.PodReady); c != nil {
+		return c.Reason
+	}
+	return ""
+}
+
+func TestGetPodNotFound(t *testing.T) {
+	p, _ := newTestProvider(t)
+
+	_, err := p.GetPod(context.Background(), "default", "missing")
+	if !errdefs.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err := p.DeletePod(context.Background(), testPod("missing")); !errdefs.IsNotFound(err) {
+		t.Errorf("expected deleting an untracked pod to be not found, got %v", err)
+	}
+}
+
+func TestEBSVolumeLimit(t *testing.T) {
+	p, cloud := newTestProvider(t)
+	cloud.addVolume("vol-1", "us-west-2a")
+
+	v := corev1.Volume{
+		Name:         "data",
+		VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}},
+	}
+	pv := &corev1.PersistentVolume{
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-1"},
+			},
+		},
+	}
+	volume, err := p.ebsVolume(context.Background(), v, pv, maxEBSVolumes-1)
+	if err != nil || volume.device != "/dev/xvdz" {
+		t.Errorf("expected the last volume to use /dev/xvdz, got %q, %v", volume.device, err)
+	}
+	_, err = p.ebsVolume(context.Background(), v, pv, maxEBSVolumes)
+	if err == nil || !strings.Contains(err.Error(), "limit of 25 EBS volumes") {
+		t.Errorf("expected the volume limit to be reported, got %v", err)
+	}
+}
+
+func TestDeleteUntrackedPod(t *testing.T) {
+	pod := testPod("web")
+	p, cloud := newTestProvider(t, pod)
+	ctx := context.Background()
+
+	instanceID, _ := launchPod(t, p, pod)
+
+	// A pod of the same name that was deleted earlier leaves the new pod's
+	// instance alone
+	stale := testPod("web")
+	stale.UID = "uid-web-old"
+	if err := p.DeletePod(ctx, stale); !errdefs.IsNotFound(err) {
+		t.Errorf("expected deleting the stale pod to be not found, got %v", err)
+	}
+	if terminated := cloud.terminatedIDs(); len(terminated) != 0 {
+		t.Fatalf("expected no instance to be terminated, got %v", terminated)
+	}
+
+	// After a restart the pod is untracked, but its instance is still found
+	// by the pod's UID
+	p.podsMu.Lock()
+	delete(p.pods, pod.UID)
+	delete(p.instanceIDs, pod.UID)
+	p.podsMu.Unlock()
+	if err := p.DeletePod(ctx, pod); !errdefs.IsNotFound(err) {
+		t.Errorf("expected deleting the untracked pod to be not found, got %v", err)
+	}
+	if terminated := cloud.terminatedIDs(); len(terminated) != 1 || terminated[0] != instanceID {
+		t.Errorf("expected instance %s to be terminated, got %v", instanceID, terminated)
+	}
+}
+
+func TestPodAgent(t *testing.T) {
+	pod := testPod("web")
+	p, cloud := newTestProvider(t, pod)
+	ctx := context.Background()
+
+	if _, err := p.podAgent(ctx, "default", "web"); !errdefs.IsNotFound(err) {
+		t.Errorf("expected an untracked pod to be not found, got %v", err)
+	}
+
+	// A pod waiting for its gang has no instance yet
+	waiting := gangPod("trainer-0", 0, 2)
+	if err := p.CreatePod(ctx, waiting); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	if _, err := p.podAgent(ctx, "default", "trainer-0"); err == nil || !strings.Contains(err.Error(), "has no instance") {
+		t.Errorf("expected a pod without an instance to fail, got %v", err)
+	}
+
+	instanceID, a := launchPod(t, p, pod)
+	if _, err := p.podAgent(ctx, "default", "web"); err == nil || !strings.Contains(err.Error(), "is pending") {
+		t.Errorf("expected a pod on a pending instance to fail, got %v", err)
+	}
+
+	cloud.setState(instanceID, "running", a.host)
+	client, err := p.podAgent(ctx, "default", "web")
+	if err != nil {
+		t.Fatalf("failed to get the pod's agent: %v", err)
+	}
+	if client != p.cachedAgentClient(pod.UID) {
+		t.Error("expected the cached client of the pod's agent")
+	}
+}
+
+func TestReserveOverlayAddresses(t *testing.T) {
+	key, err := overlay.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "private.key")
+	if err := os.WriteFile(keyFile, []byte(key.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	newHub := func() *overlay.Hub {
+		t.Helper()
+		hub, err := overlay.NewHub(config.OverlayConfig{
+			Enabled:        true,
+			Interface:      "orca0",
+			PodCIDR:        "100.96.0.0/16",
+			ListenPort:     51820,
+			PrivateKeyFile: keyFile,
+		})
+		if err != nil {
+			t.Fatalf("failed to create overlay: %v", err)
+		}
+		return hub
+	}
+
+	first := testPod("first")
+	p, cloud := newTestProvider(t, first)
+	p.overlay = newHub()
+	launchPod(t, p, first)
+	firstPeer, _ := p.overlay.Peer(first.UID)
+
+	// The instance carries the pod's overlay address
+	cloud.mu.Lock()
+	tags := cloud.launches[0].Tags
+	cloud.mu.Unlock()
+	if tags[TagOverlayAddress] != firstPeer.Address.String() || tags[TagNode] != "orca" {
+		t.Fatalf("expected the launch to be tagged with the pod's address, got %v", tags)
+	}
+
+	// Another node's instance in the same pod CIDR is not this node's
+	cloud.mu.Lock()
+	cloud.instances["i-other"] = &aws.Instance{ID: "i-other", State: "running", Tags: map[string]string{
+		TagNode:           "other",
+		TagPodUID:         "uid-other",
+		TagOverlayAddress: "100.96.0.3",
+	}}
+	cloud.mu.Unlock()
+
+	// After a restart the address stays taken while the instance runs
+	restarted, _ := newTestProvider(t)
+	restarted.awsClient = cloud
+	restarted.overlay = newHub()
+	if err := restarted.reserveOverlayAddresses(context.Background()); err != nil {
+		t.Fatalf("failed to reserve overlay addresses: %v", err)
+	}
+	second, err := restarted.overlay.NewPeer("uid-second")
+	if err != nil {
+		t.Fatalf("failed to allocate an address: %v", err)
+	}
+	if second.Address == firstPeer.Address {
+		t.Errorf("expected a new pod not to get %s of a running instance", firstPeer.Address)
+	}
+	if second.Address.String() != "100.96.0.3" {
+		t.Errorf("expected another node's address to be free, got %s", second.Address)
+	}
+
+	// The pod re-created with the same UID gets its address back
+	again, err := restarted.overlay.NewPeer(first.UID)
+	if err != nil {
+		t.Fatalf("failed to allocate an address: %v", err)
+	}
+	if again.Address != firstPeer.Address {
+		t.Errorf("expected pod %s to get %s back, got %s", first.Name, firstPeer.Address, again.Address)
+	}
+}
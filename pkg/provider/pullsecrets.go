@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// dockerConfigEntry is a registry login in a docker config file.
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// registryCredentials returns the logins of the pod's image pull secrets,
+// or of its ServiceAccount's if the pod names none. Missing or malformed
+// secrets are skipped, as by the kubelet: images may still be public or
+// covered by the instance profile.
+func (r *resolver) registryCredentials(ctx context.Context) ([]agent.RegistryCredential, error) {
+	refs := r.pod.Spec.ImagePullSecrets
+	if len(refs) == 0 {
+		var err error
+		if refs, err = r.serviceAccountPullSecrets(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var credentials []agent.RegistryCredential
+	for _, ref := range refs {
+		secret, err := r.secret(ctx, ref.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			continue
+		}
+		entries, err := dockerConfigEntries(secret)
+		if err != nil {
+			continue
+		}
+
+		registries := make([]string, 0, len(entries))
+		for registry := range entries {
+			registries = append(registries, registry)
+		}
+		sort.Strings(registries)
+		for _, registry := range registries {
+			if credential, ok := registryCredential(registry, entries[registry]); ok {
+				credentials = append(credentials, credential)
+			}
+		}
+	}
+	return credentials, nil
+}
+
+// serviceAccountPullSecrets returns the image pull secrets of the pod's
+// ServiceAccount. The ServiceAccount admission plugin normally copies them
+// into the pod already.
+func (r *resolver) serviceAccountPullSecrets(ctx context.Context) ([]corev1.LocalObjectReference, error) {
+	name := r.pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+
+	sa, err := r.client.CoreV1().ServiceAccounts(r.pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get ServiceAccount %s: %w", name, err)
+	}
+	return sa.ImagePullSecrets, nil
+}
+
+// dockerConfigEntries returns the registry logins of a dockerconfigjson or
+// legacy dockercfg Secret.
+func dockerConfigEntries(secret *corev1.Secret) (map[string]dockerConfigEntry, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config struct {
+			Auths map[string]dockerConfigEntry `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return nil, fmt.Errorf("failed to parse Secret %s: %w", secret.Name, err)
+		}
+		return config.Auths, nil
+	case corev1.SecretTypeDockercfg:
+		var entries map[string]dockerConfigEntry
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse Secret %s: %w", secret.Name, err)
+		}
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("secret %s has type %s, which holds no registry logins", secret.Name, secret.Type)
+	}
+}
+
+// registryCredential converts a docker config entry, which may hold its
+// login in the base64 encoded auth field only.
+func registryCredential(registry string, entry dockerConfigEntry) (agent.RegistryCredential, bool) {
+	credential := agent.RegistryCredential{Registry: registry, Username: entry.Username, Password: entry.Password}
+	if credential.Username == "" && entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return credential, false
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return credential, false
+		}
+		credential.Username, credential.Password = username, password
+	}
+	return credential, credential.Username != ""
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"encoding/base64"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	auth := func(login string) string {
+		return base64.StdEncoding.EncodeToString([]byte(login))
+	}
+	secret := func(name string, secretType corev1.SecretType, key, data string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Type:       secretType,
+			Data:       map[string][]byte{key: []byte(data)},
+		}
+	}
+	objects := []runtime.Object{
+		secret("registry", corev1.SecretTypeDockerConfigJson, corev1.DockerConfigJsonKey, `{"auths": {
+			"ghcr.io": {"username": "octocat", "password": "ghp_token"},
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com": {"auth": "`+auth("AWS:ecr-token")+`"}
+		}}`),
+		secret("legacy", corev1.SecretTypeDockercfg, corev1.DockerConfigKey, `{"quay.io": {"auth": "`+auth("robot:secret")+`"}}`),
+		secret("opaque", corev1.SecretTypeOpaque, "password", "hunter2"),
+		secret("broken", corev1.SecretTypeDockerConfigJson, corev1.DockerConfigJsonKey, `{"auths": `),
+		secret("bad-auth", corev1.SecretTypeDockerConfigJson, corev1.DockerConfigJsonKey, `{"auths": {
+			"not-base64.io": {"auth": "%%%"},
+			"no-password.io": {"auth": "`+auth("user")+`"}
+		}}`),
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "builder", Namespace: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "legacy"}},
+		},
+	}
+
+	ghcr := agent.RegistryCredential{Registry: "ghcr.io", Username: "octocat", Password: "ghp_token"}
+	ecr := agent.RegistryCredential{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Username: "AWS", Password: "ecr-token"}
+	quay := agent.RegistryCredential{Registry: "quay.io", Username: "robot", Password: "secret"}
+
+	tests := []struct {
+		name           string
+		secrets        []string
+		serviceAccount string
+		want           []agent.RegistryCredential
+	}{
+		{
+			name:    "docker config secrets",
+			secrets: []string{"registry", "legacy"},
+			want:    []agent.RegistryCredential{ecr, ghcr, quay},
+		},
+		{
+			name:    "missing and malformed secrets skipped",
+			secrets: []string{"missing", "opaque", "broken", "bad-auth", "legacy"},
+			want:    []agent.RegistryCredential{quay},
+		},
+		{
+			name:           "service account secrets",
+			serviceAccount: "builder",
+			want:           []agent.RegistryCredential{quay},
+		},
+		{
+			name:           "pod secrets replace service account secrets",
+			secrets:        []string{"registry"},
+			serviceAccount: "builder",
+			want:           []agent.RegistryCredential{ecr, ghcr},
+		},
+		{
+			name: "no secrets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("web")
+			pod.Spec.ServiceAccountName = tt.serviceAccount
+			for _, name := range tt.secrets {
+				pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+			}
+			p, cloud := newTestProvider(t, append(slices.Clone(objects), pod)...)
+
+			_, a := startPod(t, p, cloud, pod, runningReport(true))
+
+			submission := a.submission()
+			if submission == nil {
+				t.Fatal("expected the pod to be submitted to its agent")
+			}
+			if !slices.Equal(submission.RegistryCredentials, tt.want) {
+				t.Errorf("expected registry credentials %+v, got %+v", tt.want, submission.RegistryCredentials)
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// defaultVolumeFileMode is the mode of volume files that set none, as
+// applied by the API server.
+const defaultVolumeFileMode int32 = 0o644
+
+// resolver looks up the ConfigMaps, Secrets and service account tokens a
+// pod refers to. Each object is fetched at most once per resolver.
+type resolver struct {
+	client       kubernetes.Interface
+	tokens       *tokenCache
+	apiServerEnv []corev1.EnvVar
+	gangEnv      []corev1.EnvVar
+	pod          *corev1.Pod
+	configMaps   map[string]*corev1.ConfigMap
+	secrets      map[string]*corev1.Secret
+}
+
+// newResolver returns a resolver for the references of pod.
+func (p *OrcaProvider) newResolver(pod *corev1.Pod) *resolver {
+	return &resolver{
+		client:       p.kubeClient,
+		tokens:       p.tokens,
+		apiServerEnv: p.apiServerEnv,
+		pod:          pod,
+		configMaps:   make(map[string]*corev1.ConfigMap),
+		secrets:      make(map[string]*corev1.Secret),
+	}
+}
+
+// resolvePod returns the submission of a pod to its agent: the pod with
+// environment variables from ConfigMaps, Secrets and the downward API
+// resolved to plain values, the files of its configMap, secret, downwardAPI
+// and projected volumes, service account tokens included, its attached EBS
+// volumes and shared filesystems, and the logins of its image pull
+// secrets. virtual-kubelet flattens the environment before CreatePod, so
+// the original container specs are read back from the API server.
+func (p *OrcaProvider) resolvePod(ctx context.Context, pod *corev1.Pod) (*agent.PodSubmission, error) {
+	original, err := p.kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if original.UID != pod.UID || len(original.Spec.InitContainers) != len(pod.Spec.InitContainers) ||
+		len(original.Spec.Containers) != len(pod.Spec.Containers) {
+		return nil, fmt.Errorf("pod %s/%s was replaced", pod.Namespace, pod.Name)
+	}
+
+	pod = p.withPodIP(pod)
+	r := p.newResolver(pod)
+	r.gangEnv, _ = p.gangEnv(pod.UID)
+	resolved := pod.DeepCopy()
+	for i := range resolved.Spec.InitContainers {
+		if err := r.resolveEnv(ctx, &resolved.Spec.InitContainers[i], original.Spec.InitContainers[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range resolved.Spec.Containers {
+		if err := r.resolveEnv(ctx, &resolved.Spec.Containers[i], original.Spec.Containers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	volumes, err := r.volumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := r.registryCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent.PodSubmission{
+		Pod:                 resolved,
+		Volumes:             volumes,
+		Disks:               agentDisks(p.podEBSVolumes(pod.UID)),
+		Filesystems:         p.podFilesystems(pod.UID),
+		RegistryCredentials: credentials,
+		Network:             p.podNetwork(pod.UID),
+	}, nil
+}
+
+// resolveVolumes returns the files of the pod's configMap, secret,
+// downwardAPI and projected volumes.
+func (p *OrcaProvider) resolveVolumes(ctx context.Context, pod *corev1.Pod) (map[string][]agent.VolumeFile, error) {
+	return p.newResolver(p.withPodIP(pod)).volumes(ctx)
+}
+
+// resolveEnv sets the environment of c from the original spec: the API
+// server and gang variables first, then envFrom sources, then env, with
+// later definitions replacing earlier ones. Variable references are left
+// for the agent to expand in order.
+func (r *resolver) resolveEnv(ctx context.Context, c *corev1.Container, original corev1.Container) error {
+	env := append([]corev1.EnvVar(nil), r.apiServerEnv...)
+	set := func(name, value string) {
+		for i := range env {
+			if env[i].Name == name {
+				env = append(env[:i], env[i+1:]...)
+				break
+			}
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	for _, e := range r.gangEnv {
+		set(e.Name, e.Value)
+	}
+
+	for _, from := range original.EnvFrom {
+		data, err := r.envFromData(ctx, from)
+		if err != nil {
+			return fmt.Errorf("container %s: %w", c.Name, err)
+		}
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Keys that are not valid variable names are skipped, as by the kubelet
+			if name := from.Prefix + k; len(validation.IsEnvVarName(name)) == 0 {
+				set(name, data[k])
+			}
+		}
+	}
+
+	for _, e := range original.Env {
+		if e.ValueFrom == nil {
+			set(e.Name, e.Value)
+			continue
+		}
+		value, ok, err := r.envValue(ctx, original, e.ValueFrom)
+		if err != nil {
+			return fmt.Errorf("container %s: variable %s: %w", c.Name, e.Name, err)
+		}
+		if ok {
+			set(e.Name, value)
+		}
+	}
+
+	c.Env = env
+	c.EnvFrom = nil
+	return nil
+}
+
+// envFromData returns the variables of an envFrom source.
+func (r *resolver) envFromData(ctx context.Context, from corev1.EnvFromSource) (map[string]string, error) {
+	switch {
+	case from.ConfigMapRef != nil:
+		cm, err := r.configMap(ctx, from.ConfigMapRef.Name, isOptional(from.ConfigMapRef.Optional))
+		if err != nil || cm == nil {
+			return nil, err
+		}
+		return cm.Data, nil
+	case from.SecretRef != nil:
+		secret, err := r.secret(ctx, from.SecretRef.Name, isOptional(from.SecretRef.Optional))
+		if err != nil || secret == nil {
+			return nil, err
+		}
+		data := make(map[string]string, len(secret.Data))
+		for k, v := range secret.Data {
+			data[k] = string(v)
+		}
+		return data, nil
+	default:
+		return nil, nil
+	}
+}
+
+// envValue resolves a variable's source. It reports false for an optional
+// reference that does not exist.
+func (r *resolver) envValue(ctx context.Context, c corev1.Container, from *corev1.EnvVarSource) (string, bool, error) {
+	switch {
+	case from.ConfigMapKeyRef != nil:
+		ref := from.ConfigMapKeyRef
+		data, ok, err := r.configMapKey(ctx, ref.Name, ref.Key, isOptional(ref.Optional))
+		return string(data), ok, err
+	case from.SecretKeyRef != nil:
+		ref := from.SecretKeyRef
+		data, ok, err := r.secretKey(ctx, ref.Name, ref.Key, isOptional(ref.Optional))
+		return string(data), ok, err
+	case from.FieldRef != nil:
+		value, err := podFieldValue(r.pod, from.FieldRef.FieldPath)
+		return value, err == nil, err
+	case from.ResourceFieldRef != nil:
+		value, err := containerResourceValue(c, from.ResourceFieldRef)
+		return value, err == nil, err
+	default:
+		return "", false, nil
+	}
+}
+
+// volumes returns the files of every volume whose contents come from the
+// cluster, by volume name.
+func (r *resolver) volumes(ctx context.Context) (map[string][]agent.VolumeFile, error) {
+	volumes := make(map[string][]agent.VolumeFile)
+	for _, v := range r.pod.Spec.Volumes {
+		var (
+			files []agent.VolumeFile
+			err   error
+		)
+		switch {
+		case v.ConfigMap != nil:
+			files, err = r.configMapFiles(ctx, v.ConfigMap.Name, v.ConfigMap.Items,
+				isOptional(v.ConfigMap.Optional), fileMode(v.ConfigMap.DefaultMode))
+		case v.Secret != nil:
+			files, err = r.secretFiles(ctx, v.Secret.SecretName, v.Secret.Items,
+				isOptional(v.Secret.Optional), fileMode(v.Secret.DefaultMode))
+		case v.DownwardAPI != nil:
+			files, err = r.downwardAPIFiles(v.DownwardAPI.Items, fileMode(v.DownwardAPI.DefaultMode))
+		case v.Projected != nil:
+			files, err = r.projectedFiles(ctx, v.Projected)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %w", v.Name, err)
+		}
+		volumes[v.Name] = files
+	}
+	return volumes, nil
+}
+
+// projectedFiles returns the files of a projected volume, source by source.
+func (r *resolver) projectedFiles(ctx context.Context, projected *corev1.ProjectedVolumeSource) ([]agent.VolumeFile, error) {
+	mode := fileMode(projected.DefaultMode)
+
+	var files []agent.VolumeFile
+	for _, source := range projected.Sources {
+		var (
+			sourceFiles []agent.VolumeFile
+			err         error
+		)
+		switch {
+		case source.ConfigMap != nil:
+			sourceFiles, err = r.configMapFiles(ctx, source.ConfigMap.Name, source.ConfigMap.Items,
+				isOptional(source.ConfigMap.Optional), mode)
+		case source.Secret != nil:
+			sourceFiles, err = r.secretFiles(ctx, source.Secret.Name, source.Secret.Items,
+				isOptional(source.Secret.Optional), mode)
+		case source.DownwardAPI != nil:
+			sourceFiles, err = r.downwardAPIFiles(source.DownwardAPI.Items, mode)
+		case source.ServiceAccountToken != nil:
+			sourceFiles, err = r.tokenFiles(ctx, source.ServiceAccountToken, mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sourceFiles...)
+	}
+	return files, nil
+}
+
+// tokenFiles returns the file holding a service account token.
+func (r *resolver) tokenFiles(ctx context.Context, projection *corev1.ServiceAccountTokenProjection, mode int32) ([]agent.VolumeFile, error) {
+	token, err := r.tokens.token(ctx, r.pod, projection)
+	if err != nil {
+		return nil, err
+	}
+	return []agent.VolumeFile{{Path: projection.Path, Data: token, Mode: mode}}, nil
+}
+
+// configMapFiles returns the files of a ConfigMap: the selected items, or
+// every key.
+func (r *resolver) configMapFiles(ctx context.Context, name string, items []corev1.KeyToPath, optional bool, mode int32) ([]agent.VolumeFile, error) {
+	cm, err := r.configMap(ctx, name, optional)
+	if err != nil || cm == nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = v
+	}
+	return keyFiles(fmt.Sprintf("ConfigMap %s", name), data, items, optional, mode)
+}
+
+// secretFiles returns the files of a Secret: the selected items, or every
+// key.
+func (r *resolver) secretFiles(ctx context.Context, name string, items []corev1.KeyToPath, optional bool, mode int32) ([]agent.VolumeFile, error) {
+	secret, err := r.secret(ctx, name, optional)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	return keyFiles(fmt.Sprintf("Secret %s", name), secret.Data, items, optional, mode)
+}
+
+// keyFiles turns the keys of a ConfigMap or Secret into files.
+func keyFiles(source string, data map[string][]byte, items []corev1.KeyToPath, optional bool, mode int32) ([]agent.VolumeFile, error) {
+	if len(items) == 0 {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		files := make([]agent.VolumeFile, 0, len(keys))
+		for _, k := range keys {
+			files = append(files, agent.VolumeFile{Path: k, Data: data[k], Mode: mode})
+		}
+		return files, nil
+	}
+
+	files := make([]agent.VolumeFile, 0, len(items))
+	for _, item := range items {
+		value, ok := data[item.Key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("%s has no key %s", source, item.Key)
+		}
+		itemMode := mode
+		if item.Mode != nil {
+			itemMode = *item.Mode
+		}
+		files = append(files, agent.VolumeFile{Path: item.Path, Data: value, Mode: itemMode})
+	}
+	return files, nil
+}
+
+// downwardAPIFiles returns files holding pod fields and container resources.
+func (r *resolver) downwardAPIFiles(items []corev1.DownwardAPIVolumeFile, mode int32) ([]agent.VolumeFile, error) {
+	files := make([]agent.VolumeFile, 0, len(items))
+	for _, item := range items {
+		var (
+			value string
+			err   error
+		)
+		switch {
+		case item.FieldRef != nil:
+			value, err = podFieldValue(r.pod, item.FieldRef.FieldPath)
+		case item.ResourceFieldRef != nil:
+			c, ok := findContainer(r.pod, item.ResourceFieldRef.ContainerName)
+			if !ok {
+				return nil, fmt.Errorf("container %s not found", item.ResourceFieldRef.ContainerName)
+			}
+			value, err = containerResourceValue(c, item.ResourceFieldRef)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item.Path, err)
+		}
+
+		itemMode := mode
+		if item.Mode != nil {
+			itemMode = *item.Mode
+		}
+		files = append(files, agent.VolumeFile{Path: item.Path, Data: []byte(value), Mode: itemMode})
+	}
+	return files, nil
+}
+
+// configMap returns the named ConfigMap in the pod's namespace. A missing
+// ConfigMap is an error unless optional, in which case it is nil.
+func (r *resolver) configMap(ctx context.Context, name string, optional bool) (*corev1.ConfigMap, error) {
+	if cm, ok := r.configMaps[name]; ok {
+		return cm, nil
+	}
+
+	cm, err := r.client.CoreV1().ConfigMaps(r.pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err) && optional:
+		cm = nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get ConfigMap %s: %w", name, err)
+	}
+	r.configMaps[name] = cm
+	return cm, nil
+}
+
+// secret returns the named Secret in the pod's namespace. A missing Secret
+// is an error unless optional, in which case it is nil.
+func (r *resolver) secret(ctx context.Context, name string, optional bool) (*corev1.Secret, error) {
+	if secret, ok := r.secrets[name]; ok {
+		return secret, nil
+	}
+
+	secret, err := r.client.CoreV1().Secrets(r.pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err) && optional:
+		secret = nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get Secret %s: %w", name, err)
+	}
+	r.secrets[name] = secret
+	return secret, nil
+}
+
+// configMapKey returns a ConfigMap value. It reports false if an optional
+// reference does not exist.
+func (r *resolver) configMapKey(ctx context.Context, name, key string, optional bool) ([]byte, bool, error) {
+	cm, err := r.configMap(ctx, name, optional)
+	if err != nil || cm == nil {
+		return nil, false, err
+	}
+	if value, ok := cm.Data[key]; ok {
+		return []byte(value), true, nil
+	}
+	if value, ok := cm.BinaryData[key]; ok {
+		return value, true, nil
+	}
+	if optional {
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("ConfigMap %s has no key %s", name, key)
+}
+
+// secretKey returns a Secret value. It reports false if an optional
+// reference does not exist.
+func (r *resolver) secretKey(ctx context.Context, name, key string, optional bool) ([]byte, bool, error) {
+	secret, err := r.secret(ctx, name, optional)
+	if err != nil || secret == nil {
+		return nil, false, err
+	}
+	if value, ok := secret.Data[key]; ok {
+		return value, true, nil
+	}
+	if optional {
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("Secret %s has no key %s", name, key)
+}
+
+// podFieldValue returns a pod field selected by the downward API.
+func podFieldValue(pod *corev1.Pod, fieldPath string) (string, error) {
+	if key, ok := subscript(fieldPath, "metadata.labels"); ok {
+		return pod.Labels[key], nil
+	}
+	if key, ok := subscript(fieldPath, "metadata.annotations"); ok {
+		return pod.Annotations[key], nil
+	}
+
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	case "metadata.labels":
+		return formatMap(pod.Labels), nil
+	case "metadata.annotations":
+		return formatMap(pod.Annotations), nil
+	case "spec.nodeName":
+		return pod.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.hostIPs":
+		ips := make([]string, 0, len(pod.Status.HostIPs))
+		for _, ip := range pod.Status.HostIPs {
+			ips = append(ips, ip.IP)
+		}
+		return strings.Join(ips, ","), nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.podIPs":
+		ips := make([]string, 0, len(pod.Status.PodIPs))
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		return strings.Join(ips, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported field path %s", fieldPath)
+	}
+}
+
+// subscript parses a field path of the form prefix['key'].
+func subscript(fieldPath, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(fieldPath, prefix+"['")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rest, "']")
+}
+
+// formatMap renders labels or annotations one per line, as key="value"
+// sorted by key.
+func formatMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, strconv.Quote(m[k]))
+	}
+	return b.String()
+}
+
+// containerResourceValue returns a container's request or limit in units of
+// the divisor, rounded up. The instance is sized for the pod, so an unset
+// limit falls back to the request.
+func containerResourceValue(c corev1.Container, ref *corev1.ResourceFieldSelector) (string, error) {
+	kind, name, ok := strings.Cut(ref.Resource, ".")
+	if !ok || (kind != "limits" && kind != "requests") {
+		return "", fmt.Errorf("unsupported resource %s", ref.Resource)
+	}
+
+	resourceName := corev1.ResourceName(name)
+	quantity, ok := c.Resources.Requests[resourceName]
+	if kind == "limits" {
+		if limit, hasLimit := c.Resources.Limits[resourceName]; hasLimit {
+			quantity, ok = limit, true
+		}
+	}
+	if !ok {
+		quantity = resource.Quantity{}
+	}
+
+	divisor := ref.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+
+	if resourceName == corev1.ResourceCPU {
+		return strconv.FormatInt(int64(math.Ceil(float64(quantity.MilliValue())/float64(divisor.MilliValue()))), 10), nil
+	}
+	return strconv.FormatInt(int64(math.Ceil(float64(quantity.Value())/float64(divisor.Value()))), 10), nil
+}
+
+// findContainer returns the named app or init container of pod.
+func findContainer(pod *corev1.Pod, name string) (corev1.Container, bool) {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return corev1.Container{}, false
+}
+
+// isOptional dereferences an optional flag.
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// fileMode returns a volume's default file mode.
+func fileMode(mode *int32) int32 {
+	if mode == nil {
+		return defaultVolumeFileMode
+	}
+	return *mode
+}
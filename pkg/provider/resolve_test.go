@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveEnvPrecedence(t *testing.T) {
+	settings := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "default"},
+		Data: map[string]string{
+			"MASTER_PORT":             "29600",
+			"KUBERNETES_SERVICE_HOST": "from-config-map",
+			"LOG_LEVEL":               "info",
+			"not-a-variable=":         "skipped",
+		},
+	}
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+		Data:       map[string][]byte{"PASSWORD": []byte("hunter2"), "LOG_LEVEL": []byte("debug")},
+	}
+	p, _ := newTestProvider(t, settings, credentials)
+
+	apiServerEnv := []corev1.EnvVar{
+		{Name: "KUBERNETES_SERVICE_HOST", Value: "api.example.com"},
+		{Name: "MASTER_PORT", Value: "from-api-server"},
+	}
+	gangEnv := []corev1.EnvVar{
+		{Name: "MASTER_ADDR", Value: "10.0.0.1"},
+		{Name: "MASTER_PORT", Value: "29500"},
+		{Name: "RANK", Value: "0"},
+	}
+	fromConfigMap := corev1.EnvFromSource{ConfigMapRef: &corev1.ConfigMapEnvSource{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "settings"},
+	}}
+	fromSecret := corev1.EnvFromSource{Prefix: "DB_", SecretRef: &corev1.SecretEnvSource{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+	}}
+
+	tests := []struct {
+		name    string
+		envFrom []corev1.EnvFromSource
+		env     []corev1.EnvVar
+		want    map[string]string
+	}{
+		{
+			name: "API server and gang",
+			want: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "api.example.com",
+				"MASTER_ADDR":             "10.0.0.1",
+				"MASTER_PORT":             "29500",
+				"RANK":                    "0",
+			},
+		},
+		{
+			name:    "envFrom replaces API server and gang",
+			envFrom: []corev1.EnvFromSource{fromConfigMap},
+			want: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "from-config-map",
+				"MASTER_ADDR":             "10.0.0.1",
+				"MASTER_PORT":             "29600",
+				"RANK":                    "0",
+				"LOG_LEVEL":               "info",
+			},
+		},
+		{
+			name:    "later envFrom sources replace earlier ones",
+			envFrom: []corev1.EnvFromSource{fromConfigMap, {SecretRef: fromSecret.SecretRef}},
+			want: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "from-config-map",
+				"MASTER_ADDR":             "10.0.0.1",
+				"MASTER_PORT":             "29600",
+				"RANK":                    "0",
+				"LOG_LEVEL":               "debug",
+				"PASSWORD":                "hunter2",
+			},
+		},
+		{
+			name:    "env replaces everything",
+			envFrom: []corev1.EnvFromSource{fromConfigMap, fromSecret},
+			env: []corev1.EnvVar{
+				{Name: "MASTER_PORT", Value: "12345"},
+				{Name: "RANK", Value: "3"},
+				{Name: "LOG_LEVEL", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+					Key:                  "LOG_LEVEL",
+				}}},
+				{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			},
+			want: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "from-config-map",
+				"MASTER_ADDR":             "10.0.0.1",
+				"MASTER_PORT":             "12345",
+				"RANK":                    "3",
+				"LOG_LEVEL":               "debug",
+				"DB_PASSWORD":             "hunter2",
+				"DB_LOG_LEVEL":            "debug",
+				"POD_NAME":                "trainer",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("trainer")
+			r := p.newResolver(pod)
+			r.apiServerEnv, r.gangEnv = apiServerEnv, gangEnv
+
+			original := corev1.Container{Name: "main", EnvFrom: tt.envFrom, Env: tt.env}
+			c := pod.Spec.Containers[0]
+			if err := r.resolveEnv(context.Background(), &c, original); err != nil {
+				t.Fatalf("failed to resolve env: %v", err)
+			}
+
+			if c.EnvFrom != nil {
+				t.Errorf("expected envFrom to be resolved, got %v", c.EnvFrom)
+			}
+			got := make(map[string]string, len(c.Env))
+			for _, e := range c.Env {
+				if _, ok := got[e.Name]; ok {
+					t.Errorf("expected %s to be set once", e.Name)
+				}
+				if strings.Contains(e.Name, "=") {
+					t.Errorf("expected the invalid variable %q to be skipped", e.Name)
+				}
+				got[e.Name] = e.Value
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("expected %s=%s, got %q", name, value, got[name])
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("expected %d variables, got %v", len(tt.want), got)
+			}
+		})
+	}
+}
+
+func TestResolveEnvMissingReference(t *testing.T) {
+	p, _ := newTestProvider(t)
+	optional := true
+
+	tests := []struct {
+		name    string
+		envFrom []corev1.EnvFromSource
+		env     []corev1.EnvVar
+		wantErr bool
+	}{
+		{
+			name: "missing ConfigMap",
+			envFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+			}}},
+			wantErr: true,
+		},
+		{
+			name: "optional ConfigMap",
+			envFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Optional:             &optional,
+			}}},
+		},
+		{
+			name: "missing Secret key",
+			env: []corev1.EnvVar{{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Key:                  "token",
+			}}}},
+			wantErr: true,
+		},
+		{
+			name: "optional Secret key",
+			env: []corev1.EnvVar{{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Key:                  "token",
+				Optional:             &optional,
+			}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("web")
+			c := pod.Spec.Containers[0]
+			err := p.newResolver(pod).resolveEnv(context.Background(), &c, corev1.Container{Name: "main", EnvFrom: tt.envFrom, Env: tt.env})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && len(c.Env) != 0 {
+				t.Errorf("expected no variables, got %v", c.Env)
+			}
+		})
+	}
+}
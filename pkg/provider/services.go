@@ -0,0 +1,422 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// serviceSyncInterval is how often the EndpointSlices of proxied pods
+	// are brought up to date.
+	serviceSyncInterval = 10 * time.Second
+
+	// serviceProxyManager is the managed-by label of the EndpointSlices
+	// ORCA publishes, which the EndpointSlice controller leaves alone.
+	serviceProxyManager = "service-proxy.orca.research"
+
+	// labelProxyNode names the virtual node whose pods an EndpointSlice
+	// publishes.
+	labelProxyNode = "orca.research/node"
+)
+
+// serviceProxy listens on ports of ORCA's own for the container ports of
+// running pods, so that Services reach pods whose instances the cluster
+// cannot route to.
+type serviceProxy struct {
+	// address is ORCA's IP, which Service clients connect to
+	address string
+
+	// first and last bound the proxy's ports
+	first, last int32
+
+	mu   sync.Mutex
+	used map[int32]bool
+	pods map[types.UID]*proxiedPod
+}
+
+// proxiedPod holds the listeners of one pod.
+type proxiedPod struct {
+	// ports maps the pod's container ports to their proxy ports
+	ports     map[int32]int32
+	listeners []net.Listener
+}
+
+// newServiceProxy returns a proxy that listens on ports first to last and
+// publishes them at address.
+func newServiceProxy(address string, first, last int) *serviceProxy {
+	return &serviceProxy{
+		address: address,
+		first:   int32(first),
+		last:    int32(last),
+		used:    make(map[int32]bool),
+		pods:    make(map[types.UID]*proxiedPod),
+	}
+}
+
+// expose listens on a proxy port for each of a pod's TCP container ports,
+// unless it does already, and hands every connection to forward with the
+// container port it is for. It returns the pod's proxy ports by container
+// port.
+func (s *serviceProxy) expose(pod *corev1.Pod, forward func(port int32, conn net.Conn)) (map[int32]int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proxied, ok := s.pods[pod.UID]; ok {
+		return proxied.ports, nil
+	}
+
+	proxied := &proxiedPod{ports: make(map[int32]int32)}
+	for _, cp := range podContainerPorts(pod) {
+		if _, ok := proxied.ports[cp.ContainerPort]; ok {
+			continue
+		}
+		port, listener, err := s.listen()
+		if err != nil {
+			s.release(proxied)
+			return nil, err
+		}
+		proxied.ports[cp.ContainerPort] = port
+		proxied.listeners = append(proxied.listeners, listener)
+
+		containerPort := cp.ContainerPort
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					// The listener was closed
+					return
+				}
+				go forward(containerPort, conn)
+			}
+		}()
+	}
+	s.pods[pod.UID] = proxied
+	return proxied.ports, nil
+}
+
+// listen listens on the first free port of the proxy's range. Callers must
+// hold s.mu.
+func (s *serviceProxy) listen() (int32, net.Listener, error) {
+	for port := s.first; port <= s.last; port++ {
+		if s.used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+		if err != nil {
+			// Taken by another process
+			continue
+		}
+		s.used[port] = true
+		return port, listener, nil
+	}
+	return 0, nil, fmt.Errorf("no free port in service proxy port range %d-%d", s.first, s.last)
+}
+
+// release closes a pod's listeners and frees their ports. Callers must
+// hold s.mu.
+func (s *serviceProxy) release(proxied *proxiedPod) {
+	for _, listener := range proxied.listeners {
+		_ = listener.Close()
+	}
+	for _, port := range proxied.ports {
+		delete(s.used, port)
+	}
+}
+
+// close stops proxying a pod. Connections already forwarded are left to
+// end on their own.
+func (s *serviceProxy) close(uid types.UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proxied, ok := s.pods[uid]; ok {
+		s.release(proxied)
+		delete(s.pods, uid)
+	}
+}
+
+// retain stops proxying every pod not in keep.
+func (s *serviceProxy) retain(keep map[types.UID]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for uid, proxied := range s.pods {
+		if !keep[uid] {
+			s.release(proxied)
+			delete(s.pods, uid)
+		}
+	}
+}
+
+// podContainerPorts returns the TCP ports of a pod's app and sidecar
+// containers.
+func podContainerPorts(pod *corev1.Pod) []corev1.ContainerPort {
+	var containers []corev1.Container
+	for _, c := range pod.Spec.InitContainers {
+		if isSidecar(c) {
+			containers = append(containers, c)
+		}
+	}
+	containers = append(containers, pod.Spec.Containers...)
+
+	var ports []corev1.ContainerPort
+	for _, c := range containers {
+		for _, cp := range c.Ports {
+			if cp.Protocol == "" || cp.Protocol == corev1.ProtocolTCP {
+				ports = append(ports, cp)
+			}
+		}
+	}
+	return ports
+}
+
+// forwardConnection tunnels a connection to the proxy to a container port
+// of a pod, through the pod's agent.
+func (p *OrcaProvider) forwardConnection(ctx context.Context, uid types.UID, port int32, conn net.Conn) {
+	defer conn.Close()
+
+	client := p.cachedAgentClient(uid)
+	if client == nil {
+		return
+	}
+	_ = client.PortForward(ctx, port, conn)
+}
+
+// syncServices proxies the ports of running pods and publishes them
+// behind the Services that select them, with one EndpointSlice for each
+// Service and pod. Failures are retried on the next sync.
+func (p *OrcaProvider) syncServices(ctx context.Context) {
+	if p.services == nil {
+		return
+	}
+
+	p.podsMu.RLock()
+	var pods []*corev1.Pod
+	terminating := make(map[types.UID]bool)
+	for uid, pod := range p.pods {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		pods = append(pods, pod.DeepCopy())
+		_, stopping := p.stopDeadlines[uid]
+		terminating[uid] = stopping || pod.DeletionTimestamp != nil
+	}
+	p.podsMu.RUnlock()
+
+	running := make(map[types.UID]bool, len(pods))
+	proxyPorts := make(map[types.UID]map[int32]int32, len(pods))
+	for _, pod := range pods {
+		running[pod.UID] = true
+		ports, err := p.services.expose(pod, func(port int32, conn net.Conn) {
+			p.forwardConnection(ctx, pod.UID, port, conn)
+		})
+		if err != nil {
+			p.recorder.Eventf(pod, corev1.EventTypeWarning, "FailedToProxyPorts", "Failed to proxy the pod's ports for Services: %v", err)
+			continue
+		}
+		proxyPorts[pod.UID] = ports
+	}
+	p.services.retain(running)
+
+	// Find the Services that select each pod
+	desired := make(map[string]*discoveryv1.EndpointSlice)
+	services := make(map[string][]corev1.Service)
+	for _, pod := range pods {
+		ports, ok := proxyPorts[pod.UID]
+		if !ok {
+			continue
+		}
+		list, ok := services[pod.Namespace]
+		if !ok {
+			result, err := p.kubeClient.CoreV1().Services(pod.Namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				// Keep every slice as it is until the next sync
+				return
+			}
+			list = result.Items
+			services[pod.Namespace] = list
+		}
+
+		for i := range list {
+			svc := &list[i]
+			if !proxiesService(svc, pod) {
+				continue
+			}
+			if slice := p.endpointSlice(svc, pod, ports, terminating[pod.UID]); slice != nil {
+				desired[slice.Namespace+"/"+slice.Name] = slice
+			}
+		}
+	}
+
+	existing, err := p.kubeClient.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			discoveryv1.LabelManagedBy: serviceProxyManager,
+			labelProxyNode:             p.nodeName,
+		}).String(),
+	})
+	if err != nil {
+		return
+	}
+	for i := range existing.Items {
+		current := &existing.Items[i]
+		key := current.Namespace + "/" + current.Name
+		slice, ok := desired[key]
+		delete(desired, key)
+
+		switch {
+		case !ok, current.AddressType != slice.AddressType:
+			// The address type is immutable; the slice is created anew on
+			// the next sync
+			_ = p.kubeClient.DiscoveryV1().EndpointSlices(current.Namespace).Delete(ctx, current.Name, metav1.DeleteOptions{})
+		case !equality.Semantic.DeepEqual(current.Endpoints, slice.Endpoints) || !equality.Semantic.DeepEqual(current.Ports, slice.Ports):
+			current.Endpoints, current.Ports = slice.Endpoints, slice.Ports
+			if _, err := p.kubeClient.DiscoveryV1().EndpointSlices(current.Namespace).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+				p.recordEndpointSliceError(slice, err)
+			}
+		}
+	}
+	for _, slice := range desired {
+		if _, err := p.kubeClient.DiscoveryV1().EndpointSlices(slice.Namespace).Create(ctx, slice, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			p.recordEndpointSliceError(slice, err)
+		}
+	}
+}
+
+// proxiesService reports whether a Service's endpoints include a pod: the
+// Service selects it and balances connections over its endpoints. Headless
+// Services are left out, since their clients connect to the pod's own
+// ports.
+func proxiesService(svc *corev1.Service, pod *corev1.Pod) bool {
+	if len(svc.Spec.Selector) == 0 || svc.Spec.Type == corev1.ServiceTypeExternalName || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return false
+	}
+	return labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels))
+}
+
+// endpointSlice returns the EndpointSlice that publishes a pod behind a
+// Service at the pod's proxy ports, or nil if none of the Service's ports
+// reaches the pod. Like the EndpointSlice controller, only ready pods that
+// are not terminating are ready endpoints.
+func (p *OrcaProvider) endpointSlice(svc *corev1.Service, pod *corev1.Pod, proxyPorts map[int32]int32, terminating bool) *discoveryv1.EndpointSlice {
+	var ports []discoveryv1.EndpointPort
+	for _, sp := range svc.Spec.Ports {
+		if sp.Protocol != "" && sp.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		containerPort, ok := serviceTargetPort(pod, sp)
+		if !ok {
+			continue
+		}
+		proxyPort, ok := proxyPorts[containerPort]
+		if !ok {
+			continue
+		}
+		ports = append(ports, discoveryv1.EndpointPort{
+			Name:     ptr.To(sp.Name),
+			Protocol: ptr.To(corev1.ProtocolTCP),
+			Port:     ptr.To(proxyPort),
+		})
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	addressType := discoveryv1.AddressTypeIPv4
+	if addr, err := netip.ParseAddr(p.services.address); err == nil && addr.Is6() {
+		addressType = discoveryv1.AddressTypeIPv6
+	}
+	ready := podReady(pod)
+
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      endpointSliceName(svc.Name, pod.UID),
+			Namespace: svc.Namespace,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: svc.Name,
+				discoveryv1.LabelManagedBy:   serviceProxyManager,
+				labelProxyNode:               p.nodeName,
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(svc, corev1.SchemeGroupVersion.WithKind("Service"))},
+		},
+		AddressType: addressType,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses: []string{p.services.address},
+			Conditions: discoveryv1.EndpointConditions{
+				Ready:       ptr.To(ready && !terminating),
+				Serving:     ptr.To(ready),
+				Terminating: ptr.To(terminating),
+			},
+			TargetRef: &corev1.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				UID:       pod.UID,
+			},
+			NodeName: ptr.To(p.nodeName),
+		}},
+		Ports: ports,
+	}
+}
+
+// endpointSliceName returns the name of the EndpointSlice that publishes
+// a pod behind a Service.
+func endpointSliceName(service string, uid types.UID) string {
+	if len(service) > 200 {
+		service = service[:200]
+	}
+	return fmt.Sprintf("%s-orca-%s", service, uid)
+}
+
+// serviceTargetPort returns the container port a Service port forwards to
+// on a pod. Named target ports are looked up in the pod's containers.
+func serviceTargetPort(pod *corev1.Pod, port corev1.ServicePort) (int32, bool) {
+	switch {
+	case port.TargetPort.Type == intstr.String:
+		for _, cp := range podContainerPorts(pod) {
+			if cp.Name == port.TargetPort.StrVal {
+				return cp.ContainerPort, true
+			}
+		}
+		return 0, false
+	case port.TargetPort.IntVal != 0:
+		return port.TargetPort.IntVal, true
+	}
+	return port.Port, true
+}
+
+// podReady reports whether a pod's Ready condition is true.
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// recordEndpointSliceError records a failure to publish a pod behind a
+// Service on the Service, as the EndpointSlice controller does.
+func (p *OrcaProvider) recordEndpointSliceError(slice *discoveryv1.EndpointSlice, err error) {
+	ref := &corev1.ObjectReference{
+		Kind:      "Service",
+		Namespace: slice.Namespace,
+		Name:      slice.Labels[discoveryv1.LabelServiceName],
+		UID:       slice.OwnerReferences[0].UID,
+	}
+	p.recorder.Eventf(ref, corev1.EventTypeWarning, "FailedToUpdateEndpointSlices", "Error updating EndpointSlice %s for pod %s: %v", slice.Name, slice.Endpoints[0].TargetRef.Name, err)
+}
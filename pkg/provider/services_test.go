@@ -0,0 +1,291 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newServicesProvider returns a provider that proxies pods' ports for
+// Services, with the Service web selecting pods labelled app=web.
+func newServicesProvider(t *testing.T) *OrcaProvider {
+	t.Helper()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-service"},
+		Spec: corev1.ServiceSpec{
+			Selector:  map[string]string{"app": "web"},
+			ClusterIP: "10.96.0.10",
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("http")},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+	headless := svc.DeepCopy()
+	headless.Name, headless.UID, headless.Spec.ClusterIP = "web-headless", "uid-headless", corev1.ClusterIPNone
+	other := svc.DeepCopy()
+	other.Name, other.UID, other.Spec.Selector = "api", "uid-api", map[string]string{"app": "api"}
+
+	p, _ := newTestProvider(t, svc, headless, other)
+	p.services = newServiceProxy("127.0.0.1", 41000, 41100)
+	t.Cleanup(func() { p.services.retain(nil) })
+	return p
+}
+
+// trackRunningPod tracks a running pod labelled app=web that serves HTTP on
+// port 8080.
+func trackRunningPod(p *OrcaProvider) *corev1.Pod {
+	pod := testPod("web")
+	pod.Labels = map[string]string{"app": "web"}
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
+	p.podsMu.Lock()
+	p.pods[pod.UID] = pod.DeepCopy()
+	p.podsMu.Unlock()
+	return pod
+}
+
+// endpointSlices returns the EndpointSlices in the default namespace.
+func endpointSlices(t *testing.T, p *OrcaProvider) []discoveryv1.EndpointSlice {
+	t.Helper()
+
+	list, err := p.kubeClient.DiscoveryV1().EndpointSlices("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list EndpointSlices: %v", err)
+	}
+	return list.Items
+}
+
+// sliceWrites counts the EndpointSlice requests of a verb made so far.
+func sliceWrites(p *OrcaProvider, verb string) int {
+	n := 0
+	for _, action := range p.kubeClient.(*fake.Clientset).Actions() {
+		if action.GetResource().Resource == "endpointslices" && action.GetVerb() == verb {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSyncServicesEndpointSlice(t *testing.T) {
+	p := newServicesProvider(t)
+	ctx := context.Background()
+	pod := trackRunningPod(p)
+
+	p.syncServices(ctx)
+
+	slices := endpointSlices(t, p)
+	if len(slices) != 1 {
+		t.Fatalf("expected one EndpointSlice, for Service web only, got %d", len(slices))
+	}
+	slice := slices[0]
+	if slice.Name != endpointSliceName("web", pod.UID) || slice.Labels[discoveryv1.LabelServiceName] != "web" {
+		t.Errorf("expected the EndpointSlice of Service web, got %s with labels %v", slice.Name, slice.Labels)
+	}
+	if slice.Labels[discoveryv1.LabelManagedBy] != serviceProxyManager || slice.Labels[labelProxyNode] != p.nodeName {
+		t.Errorf("expected the EndpointSlice to be managed by ORCA, got labels %v", slice.Labels)
+	}
+	if len(slice.OwnerReferences) != 1 || slice.OwnerReferences[0].UID != "uid-service" {
+		t.Errorf("expected the EndpointSlice to be owned by its Service, got %v", slice.OwnerReferences)
+	}
+	if slice.AddressType != discoveryv1.AddressTypeIPv4 || len(slice.Endpoints) != 1 || slice.Endpoints[0].Addresses[0] != "127.0.0.1" {
+		t.Fatalf("expected one endpoint at the proxy address, got %+v", slice.Endpoints)
+	}
+	if ref := slice.Endpoints[0].TargetRef; ref == nil || ref.UID != pod.UID {
+		t.Errorf("expected the endpoint to refer to the pod, got %+v", ref)
+	}
+
+	// Only the TCP port is proxied, at the proxy port of the named target
+	if len(slice.Ports) != 1 || *slice.Ports[0].Name != "http" {
+		t.Fatalf("expected the http port only, got %+v", slice.Ports)
+	}
+	proxyPort := *slice.Ports[0].Port
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(proxyPort))))
+	if err != nil {
+		t.Fatalf("expected the proxy to listen on port %d: %v", proxyPort, err)
+	}
+	_ = conn.Close()
+
+	// An unchanged pod leaves its EndpointSlice alone
+	p.syncServices(ctx)
+	if creates, updates := sliceWrites(p, "create"), sliceWrites(p, "update"); creates != 1 || updates != 0 {
+		t.Errorf("expected the EndpointSlice to be left alone, got %d creates and %d updates", creates, updates)
+	}
+}
+
+func TestSyncServicesEndpointConditions(t *testing.T) {
+	tests := []struct {
+		name        string
+		ready       bool
+		stopping    bool
+		deleted     bool
+		wantReady   bool
+		wantServing bool
+	}{
+		{
+			name:        "ready",
+			ready:       true,
+			wantReady:   true,
+			wantServing: true,
+		},
+		{
+			name: "not ready",
+		},
+		{
+			name:        "stopping",
+			ready:       true,
+			stopping:    true,
+			wantServing: true,
+		},
+		{
+			name:     "stopping and not ready",
+			stopping: true,
+		},
+		{
+			name:        "deleted",
+			ready:       true,
+			deleted:     true,
+			wantServing: true,
+		},
+	}
+
+	// Each case updates the EndpointSlice of the previous one
+	p := newServicesProvider(t)
+	ctx := context.Background()
+	pod := trackRunningPod(p)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.podsMu.Lock()
+			tracked := p.pods[pod.UID]
+			tracked.Status.Conditions[0].Status = corev1.ConditionFalse
+			if tt.ready {
+				tracked.Status.Conditions[0].Status = corev1.ConditionTrue
+			}
+			tracked.DeletionTimestamp = nil
+			if tt.deleted {
+				tracked.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			}
+			delete(p.stopDeadlines, pod.UID)
+			if tt.stopping {
+				p.stopDeadlines[pod.UID] = time.Now().Add(time.Minute)
+			}
+			p.podsMu.Unlock()
+
+			p.syncServices(ctx)
+
+			slices := endpointSlices(t, p)
+			if len(slices) != 1 {
+				t.Fatalf("expected one EndpointSlice, got %d", len(slices))
+			}
+			conditions := slices[0].Endpoints[0].Conditions
+			terminating := tt.stopping || tt.deleted
+			if *conditions.Ready != tt.wantReady || *conditions.Serving != tt.wantServing || *conditions.Terminating != terminating {
+				t.Errorf("expected ready %v, serving %v and terminating %v, got %v, %v and %v",
+					tt.wantReady, tt.wantServing, terminating, *conditions.Ready, *conditions.Serving, *conditions.Terminating)
+			}
+		})
+	}
+
+	if creates, updates := sliceWrites(p, "create"), sliceWrites(p, "update"); creates != 1 || updates != len(tests)-1 {
+		t.Errorf("expected the EndpointSlice to be created once and then updated, got %d creates and %d updates", creates, updates)
+	}
+}
+
+func TestSyncServicesPodRemoved(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(p *OrcaProvider, pod *corev1.Pod)
+	}{
+		{
+			name: "pod finished",
+			remove: func(p *OrcaProvider, pod *corev1.Pod) {
+				p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+					status.Phase = corev1.PodSucceeded
+				})
+			},
+		},
+		{
+			name: "pod deleted",
+			remove: func(p *OrcaProvider, pod *corev1.Pod) {
+				if err := p.removePod(context.Background(), pod); err != nil {
+					t.Fatalf("failed to remove pod: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newServicesProvider(t)
+			ctx := context.Background()
+			pod := trackRunningPod(p)
+
+			p.syncServices(ctx)
+			slices := endpointSlices(t, p)
+			if len(slices) != 1 {
+				t.Fatalf("expected one EndpointSlice, got %d", len(slices))
+			}
+			address := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(*slices[0].Ports[0].Port)))
+
+			tt.remove(p, pod)
+			p.syncServices(ctx)
+
+			if slices := endpointSlices(t, p); len(slices) != 0 {
+				t.Errorf("expected the EndpointSlice to be deleted, got %d", len(slices))
+			}
+			if conn, err := net.Dial("tcp", address); err == nil {
+				_ = conn.Close()
+				t.Errorf("expected the proxy to stop listening on %s", address)
+			}
+			p.services.mu.Lock()
+			proxied, used := len(p.services.pods), len(p.services.used)
+			p.services.mu.Unlock()
+			if proxied != 0 || used != 0 {
+				t.Errorf("expected the pod's proxy ports to be freed, got %d pods and %d ports", proxied, used)
+			}
+		})
+	}
+}
+
+func TestProxiedPodIP(t *testing.T) {
+	pod := testPod("web")
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{
+		Name:      "POD_IP",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}},
+	}}
+	p, cloud := newTestProvider(t, pod)
+	p.services = newServiceProxy("127.0.0.1", 41000, 41100)
+	t.Cleanup(func() { p.services.retain(nil) })
+
+	_, a := startPod(t, p, cloud, pod, runningReport(true))
+
+	// The cluster cannot reach the instance, so the pod reports no IP
+	status := podStatus(t, p, pod)
+	if status.PodIP != "" || len(status.PodIPs) != 0 {
+		t.Errorf("expected no pod IP, got %q and %v", status.PodIP, status.PodIPs)
+	}
+
+	// Containers still see the address they have on the instance
+	submission := a.submission()
+	if submission == nil {
+		t.Fatal("expected the pod to be submitted to its agent")
+	}
+	if env := submission.Pod.Spec.Containers[0].Env; len(env) != 1 || env[0].Value != a.host {
+		t.Errorf("expected POD_IP=%s, got %v", a.host, env)
+	}
+	if submission.Pod.Status.PodIP != a.host {
+		t.Errorf("expected the submitted pod to have IP %s, got %q", a.host, submission.Pod.Status.PodIP)
+	}
+}
@@ -0,0 +1,196 @@
+package provider
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+const (
+	// statsRetryInterval is how long to wait before re-opening a failed
+	// stats stream.
+	statsRetryInterval = 10 * time.Second
+
+	// statsMaxAge is how old a sample may get before it is no longer
+	// reported, e.g. because the agent became unreachable.
+	statsMaxAge = time.Minute
+)
+
+// watchStats records the usage samples streamed by a pod's agent until ctx
+// is cancelled, re-opening the stream when it fails.
+func (p *OrcaProvider) watchStats(ctx context.Context, uid types.UID, client *agent.Client) {
+	for {
+		_ = client.WatchStats(ctx, func(sample *agent.StatsSample) {
+			p.statsMu.Lock()
+			p.stats[uid] = sample
+			p.statsMu.Unlock()
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(statsRetryInterval):
+		}
+	}
+}
+
+// GetStatsSummary returns the resource usage of the node and its pods from
+// the latest samples of the pods' agents. The node's usage is the sum of
+// its instances.
+func (p *OrcaProvider) GetStatsSummary(ctx context.Context) (*StatsSummary, error) {
+	now := time.Now()
+
+	pods, err := p.GetPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+
+	var nodeCPU cpuTotals
+	var nodeMemory memoryTotals
+	summary := &StatsSummary{
+		Node: NodeStats{
+			NodeName:  p.nodeName,
+			StartTime: p.startTime,
+		},
+		Pods: []PodStats{},
+	}
+
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+
+	for _, pod := range pods {
+		sample, ok := p.stats[pod.UID]
+		if !ok || now.Sub(sample.Time) > statsMaxAge {
+			continue
+		}
+
+		nodeCPU.add(sample.CPU)
+		nodeMemory.add(sample.Memory)
+
+		podStats := podStatsFromSample(pod, sample)
+		summary.Node.GPUs = append(summary.Node.GPUs, podStats.GPUs...)
+		summary.Pods = append(summary.Pods, podStats)
+	}
+
+	summary.Node.CPU = nodeCPU.stats(now)
+	summary.Node.Memory = nodeMemory.stats(now)
+
+	return summary, nil
+}
+
+// podStatsFromSample converts an agent sample into the pod's stats. The pod
+// usage is the sum of its containers; instance overhead is node usage.
+func podStatsFromSample(pod *corev1.Pod, sample *agent.StatsSample) PodStats {
+	stats := PodStats{
+		PodRef: PodReference{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			UID:       string(pod.UID),
+		},
+		StartTime: pod.CreationTimestamp.Time,
+	}
+	if pod.Status.StartTime != nil {
+		stats.StartTime = pod.Status.StartTime.Time
+	}
+
+	for _, gpu := range sample.GPUs {
+		stats.GPUs = append(stats.GPUs, GPUStats{
+			Time:               sample.Time,
+			ID:                 gpu.ID,
+			Model:              gpu.Model,
+			UtilizationPercent: gpu.UtilizationPercent,
+			MemoryUsedBytes:    gpu.MemoryUsedBytes,
+			MemoryTotalBytes:   gpu.MemoryTotalBytes,
+		})
+	}
+
+	// The instance's GPUs are visible to every container that requests
+	// GPUs; the driver does not report which container uses which GPU.
+	gpuContainers := make(map[string]bool)
+	for _, c := range pod.Spec.Containers {
+		if gpu, ok := c.Resources.Limits["nvidia.com/gpu"]; ok && gpu.Value() > 0 {
+			gpuContainers[c.Name] = true
+		}
+	}
+
+	var podCPU cpuTotals
+	var podMemory memoryTotals
+	for _, c := range sample.Containers {
+		podCPU.add(c.CPU)
+		podMemory.add(c.Memory)
+
+		containerStats := ContainerStats{
+			Name:      c.Name,
+			StartTime: c.StartTime,
+			CPU:       cpuStats(sample.Time, c.CPU),
+			Memory:    memoryStats(sample.Time, c.Memory),
+		}
+		if gpuContainers[c.Name] {
+			containerStats.GPUs = stats.GPUs
+		}
+		stats.Containers = append(stats.Containers, containerStats)
+	}
+	stats.CPU = podCPU.stats(sample.Time)
+	stats.Memory = podMemory.stats(sample.Time)
+
+	return stats
+}
+
+// cpuTotals sums CPU usage.
+type cpuTotals agent.CPUUsage
+
+func (t *cpuTotals) add(usage agent.CPUUsage) {
+	t.UsageCoreNanoSeconds += usage.UsageCoreNanoSeconds
+	t.UsageNanoCores += usage.UsageNanoCores
+}
+
+func (t *cpuTotals) stats(now time.Time) *CPUStats {
+	return cpuStats(now, agent.CPUUsage(*t))
+}
+
+// memoryTotals sums memory usage.
+type memoryTotals agent.MemoryUsage
+
+func (t *memoryTotals) add(usage agent.MemoryUsage) {
+	t.UsageBytes += usage.UsageBytes
+	t.WorkingSetBytes += usage.WorkingSetBytes
+	t.AvailableBytes += usage.AvailableBytes
+}
+
+func (t *memoryTotals) stats(now time.Time) *MemoryStats {
+	return memoryStats(now, agent.MemoryUsage(*t))
+}
+
+// cpuStats converts agent CPU usage.
+func cpuStats(now time.Time, usage agent.CPUUsage) *CPUStats {
+	return &CPUStats{
+		Time:                 now,
+		UsageNanoCores:       &usage.UsageNanoCores,
+		UsageCoreNanoSeconds: &usage.UsageCoreNanoSeconds,
+	}
+}
+
+// memoryStats converts agent memory usage. Unknown available memory is
+// left unset.
+func memoryStats(now time.Time, usage agent.MemoryUsage) *MemoryStats {
+	stats := &MemoryStats{
+		Time:            now,
+		UsageBytes:      &usage.UsageBytes,
+		WorkingSetBytes: &usage.WorkingSetBytes,
+	}
+	if usage.AvailableBytes > 0 {
+		stats.AvailableBytes = &usage.AvailableBytes
+	}
+	return stats
+}
@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// statsSample returns a sample in which each named container uses one core
+// and 1 GiB of memory.
+func statsSample(at time.Time, gpus []agent.GPUUsage, containers ...string) *agent.StatsSample {
+	sample := &agent.StatsSample{
+		Time:   at,
+		CPU:    agent.CPUUsage{UsageCoreNanoSeconds: 10e9, UsageNanoCores: 1e9},
+		Memory: agent.MemoryUsage{UsageBytes: 4 << 30, WorkingSetBytes: 2 << 30},
+		GPUs:   gpus,
+	}
+	for _, name := range containers {
+		sample.Containers = append(sample.Containers, agent.ContainerUsage{
+			Name:   name,
+			CPU:    agent.CPUUsage{UsageCoreNanoSeconds: 5e9, UsageNanoCores: 1e9},
+			Memory: agent.MemoryUsage{UsageBytes: 1 << 30, WorkingSetBytes: 1 << 30},
+		})
+	}
+	return sample
+}
+
+func TestGetStatsSummary(t *testing.T) {
+	now := time.Now()
+	gpus := []agent.GPUUsage{
+		{ID: "GPU-0", Model: "NVIDIA A10G", UtilizationPercent: 90, MemoryUsedBytes: 1 << 30, MemoryTotalBytes: 24 << 30},
+		{ID: "GPU-1", Model: "NVIDIA A10G", UtilizationPercent: 10, MemoryUsedBytes: 2 << 30, MemoryTotalBytes: 24 << 30},
+	}
+
+	// trainer requests GPUs for its main container only
+	trainer := testPod("trainer")
+	trainer.Spec.Containers[0].Resources.Limits = corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")}
+	trainer.Spec.Containers = append(trainer.Spec.Containers, corev1.Container{Name: "sidecar", Image: "busybox"})
+
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		sample *agent.StatsSample
+		// containers maps the reported containers to their number of GPUs
+		containers map[string]int
+		gpus       int
+	}{
+		{
+			name:       "CPU pod",
+			pod:        testPod("web"),
+			sample:     statsSample(now, nil, "main"),
+			containers: map[string]int{"main": 0},
+		},
+		{
+			name:       "GPU pod",
+			pod:        trainer,
+			sample:     statsSample(now, gpus, "main", "sidecar"),
+			containers: map[string]int{"main": 2, "sidecar": 0},
+			gpus:       2,
+		},
+		{
+			name:       "container not running",
+			pod:        trainer,
+			sample:     statsSample(now, gpus),
+			containers: map[string]int{},
+			gpus:       2,
+		},
+		{
+			name: "no sample",
+			pod:  testPod("web"),
+		},
+		{
+			name:   "stale sample",
+			pod:    testPod("web"),
+			sample: statsSample(now.Add(-2*statsMaxAge), nil, "main"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProvider(t)
+			p.podsMu.Lock()
+			p.pods[tt.pod.UID] = tt.pod
+			p.podsMu.Unlock()
+			if tt.sample != nil {
+				p.stats[tt.pod.UID] = tt.sample
+			}
+
+			summary, err := p.GetStatsSummary(context.Background())
+			if err != nil {
+				t.Fatalf("failed to get stats summary: %v", err)
+			}
+
+			if summary.Node.NodeName != "orca" || summary.Node.CPU == nil || summary.Node.Memory == nil {
+				t.Fatalf("expected the node's usage, got %+v", summary.Node)
+			}
+			if len(summary.Node.GPUs) != tt.gpus {
+				t.Errorf("expected the node to have %d GPUs, got %d", tt.gpus, len(summary.Node.GPUs))
+			}
+			if tt.containers == nil {
+				if len(summary.Pods) != 0 || *summary.Node.CPU.UsageCoreNanoSeconds != 0 {
+					t.Errorf("expected no usage without a recent sample, got %+v", summary)
+				}
+				return
+			}
+
+			// The node's usage is its instances' usage, overhead included
+			if *summary.Node.CPU.UsageCoreNanoSeconds != 10e9 || *summary.Node.Memory.WorkingSetBytes != 2<<30 {
+				t.Errorf("expected the instance's usage on the node, got %d ns and %d bytes",
+					*summary.Node.CPU.UsageCoreNanoSeconds, *summary.Node.Memory.WorkingSetBytes)
+			}
+
+			if len(summary.Pods) != 1 {
+				t.Fatalf("expected one pod, got %d", len(summary.Pods))
+			}
+			pod := summary.Pods[0]
+			if pod.PodRef.UID != string(tt.pod.UID) || len(pod.GPUs) != tt.gpus {
+				t.Errorf("expected pod %s with %d GPUs, got %s with %d", tt.pod.UID, tt.gpus, pod.PodRef.UID, len(pod.GPUs))
+			}
+			for _, gpu := range pod.GPUs {
+				if !gpu.Time.Equal(tt.sample.Time) || gpu.MemoryTotalBytes != 24<<30 {
+					t.Errorf("unexpected GPU %+v", gpu)
+				}
+			}
+
+			// The pod's usage is the sum of its containers'
+			n := uint64(len(tt.containers))
+			if *pod.CPU.UsageCoreNanoSeconds != n*5e9 || *pod.Memory.WorkingSetBytes != n<<30 {
+				t.Errorf("expected the pod to use %d containers' worth, got %d ns and %d bytes",
+					n, *pod.CPU.UsageCoreNanoSeconds, *pod.Memory.WorkingSetBytes)
+			}
+			if pod.Memory.AvailableBytes != nil {
+				t.Errorf("expected unknown available memory to be unset, got %d", *pod.Memory.AvailableBytes)
+			}
+			if len(pod.Containers) != len(tt.containers) {
+				t.Fatalf("expected %d containers, got %d", len(tt.containers), len(pod.Containers))
+			}
+			for _, c := range pod.Containers {
+				want, ok := tt.containers[c.Name]
+				if !ok || len(c.GPUs) != want {
+					t.Errorf("expected container %s to have %d GPUs, got %d", c.Name, want, len(c.GPUs))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/internal/aws"
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// statusSyncInterval is how often pod status is refreshed from EC2 and the
+// agents.
+const statusSyncInterval = 5 * time.Second
+
+// NotifyPods registers the callback that receives pod status changes. Once
+// it is set, virtual-kubelet stops polling GetPodStatus and relies on Run
+// to push every change.
+func (p *OrcaProvider) NotifyPods(ctx context.Context, notify func(*corev1.Pod)) {
+	p.podsMu.Lock()
+	defer p.podsMu.Unlock()
+	p.notify = notify
+}
+
+// Run keeps pod status up to date until ctx is cancelled. CreatePod returns
+// as soon as the instance is requested; Run moves each pod through its
+// launch phases, then follows its instance and containers.
+func (p *OrcaProvider) Run(ctx context.Context) {
+	ticker := time.NewTicker(statusSyncInterval)
+	defer ticker.Stop()
+	volumeTicker := time.NewTicker(volumeSyncInterval)
+	defer volumeTicker.Stop()
+	serviceTicker := time.NewTicker(serviceSyncInterval)
+	defer serviceTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.syncPods(ctx)
+			p.syncGangs(ctx)
+		case <-volumeTicker.C:
+			p.syncVolumes(ctx)
+		case <-serviceTicker.C:
+			p.syncServices(ctx)
+		}
+	}
+}
+
+// syncPods refreshes the status of every pod that has not finished. All
+// instances are described with a single EC2 call; agents are queried
+// concurrently.
+func (p *OrcaProvider) syncPods(ctx context.Context) {
+	p.podsMu.RLock()
+	pods := make(map[string]*corev1.Pod, len(p.instanceIDs))
+	instanceIDs := make([]string, 0, len(p.instanceIDs))
+	for uid, instanceID := range p.instanceIDs {
+		pod, ok := p.pods[uid]
+		if !ok || podFinished(pod) {
+			continue
+		}
+		pods[instanceID] = pod.DeepCopy()
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	p.podsMu.RUnlock()
+
+	if len(pods) == 0 {
+		return
+	}
+
+	// On error, launches still time out and running pods keep their status
+	// until the next sync.
+	instances, err := p.awsClient.GetInstances(ctx, instanceIDs)
+
+	var wg sync.WaitGroup
+	for instanceID, pod := range pods {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if l, ok := p.launchState(pod.UID); ok {
+				p.advanceLaunch(ctx, pod, instanceID, l, instances[instanceID])
+				return
+			}
+			if deadline, ok := p.stopDeadline(pod.UID); ok && time.Now().After(deadline) {
+				p.forceStop(ctx, pod, instanceID)
+				return
+			}
+			if err == nil {
+				p.refreshPod(ctx, pod, instanceID, instances[instanceID])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// refreshPod updates a started pod from its instance and the container
+// state reported by its agent. instance is nil if EC2 no longer knows it.
+func (p *OrcaProvider) refreshPod(ctx context.Context, pod *corev1.Pod, instanceID string, instance *aws.Instance) {
+	if instance == nil || instance.State != "running" {
+		message := fmt.Sprintf("EC2 instance %s no longer exists", instanceID)
+		if instance != nil {
+			message = fmt.Sprintf("EC2 instance %s is %s", instanceID, instance.State)
+			if instance.StateReason != "" {
+				message += ": " + instance.StateReason
+			}
+		}
+
+		p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+			status.Phase = corev1.PodFailed
+			status.Reason = "InstanceTerminated"
+			status.Message = message
+			setPodCondition(status, corev1.ContainersReady, corev1.ConditionFalse, "InstanceTerminated", message)
+			setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, "InstanceTerminated", message)
+		})
+		p.forgetAgent(pod.UID)
+		return
+	}
+
+	agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+	report, err := p.agentClient(pod, instance).Status(agentCtx)
+	cancel()
+	if err != nil {
+		// The containers may be fine, but nothing says so: keep the pod out
+		// of its Services' endpoints until the agent answers again
+		message := fmt.Sprintf("ORCA agent on instance %s is unreachable: %v", instanceID, err)
+		p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+			setPodCondition(status, corev1.ContainersReady, corev1.ConditionFalse, "AgentUnreachable", message)
+			setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, "AgentUnreachable", message)
+		})
+		return
+	}
+
+	p.applyReport(ctx, pod, instanceID, instance, report)
+}
+
+// applyReport updates a started pod from its agent's report. Once every
+// container has terminated the pod is Succeeded or Failed, and its instance
+// is terminated since nothing is left to run on it.
+func (p *OrcaProvider) applyReport(ctx context.Context, pod *corev1.Pod, instanceID string, instance *aws.Instance, report *agent.PodReport) {
+	phase := report.Phase
+	if phase == "" || phase == corev1.PodPending {
+		// A started pod does not go back to Pending
+		phase = corev1.PodRunning
+	}
+
+	// Sidecars must be ready too; other init containers have completed
+	ready := len(report.ContainerStatuses) == len(pod.Spec.Containers)
+	for _, cs := range report.ContainerStatuses {
+		ready = ready && cs.Ready
+	}
+	for i, cs := range report.InitContainerStatuses {
+		if i < len(pod.Spec.InitContainers) && isSidecar(pod.Spec.InitContainers[i]) {
+			ready = ready && cs.Ready
+		}
+	}
+	conditionStatus := corev1.ConditionFalse
+	if ready {
+		conditionStatus = corev1.ConditionTrue
+	}
+
+	p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+		status.Phase = phase
+		status.HostIP = instance.PublicIP
+		p.setPodIP(status, pod.UID, instance)
+		status.InitContainerStatuses = report.InitContainerStatuses
+		status.ContainerStatuses = report.ContainerStatuses
+		setInitializedCondition(status, report.Initialized)
+		if status.StartTime == nil {
+			now := metav1.Now()
+			status.StartTime = &now
+		}
+
+		if phase == corev1.PodRunning {
+			setPodCondition(status, corev1.ContainersReady, conditionStatus, "", "")
+			setPodCondition(status, corev1.PodReady, conditionStatus, "", "")
+			return
+		}
+		setPodCondition(status, corev1.ContainersReady, corev1.ConditionFalse, "PodCompleted", "")
+		setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, "PodCompleted", "")
+	})
+
+	if phase == corev1.PodSucceeded || phase == corev1.PodFailed {
+		// Best effort: the final status is recorded either way
+		_ = p.terminateInstance(ctx, pod.UID, instanceID)
+		p.forgetAgent(pod.UID)
+	}
+}
+
+// isSidecar reports whether an init container is a restartable sidecar.
+func isSidecar(c corev1.Container) bool {
+	return c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
+// podFinished reports whether a pod has reached a terminal phase.
+func podFinished(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// podByUID returns the tracked pod with the given UID, or nil.
+func (p *OrcaProvider) podByUID(uid types.UID) *corev1.Pod {
+	p.podsMu.RLock()
+	defer p.podsMu.RUnlock()
+
+	if pod, ok := p.pods[uid]; ok {
+		return pod.DeepCopy()
+	}
+	return nil
+}
+
+// updatePodStatus applies update to the status of a tracked pod and, if the
+// status changed, pushes the pod to virtual-kubelet.
+func (p *OrcaProvider) updatePodStatus(uid types.UID, update func(*corev1.PodStatus)) {
+	p.podsMu.Lock()
+	existing, ok := p.pods[uid]
+	if !ok {
+		p.podsMu.Unlock()
+		return
+	}
+	pod := existing.DeepCopy()
+	update(&pod.Status)
+	p.pods[uid] = pod
+	notify := p.notify
+	p.podsMu.Unlock()
+
+	if notify != nil && !equality.Semantic.DeepEqual(existing.Status, pod.Status) {
+		notify(pod.DeepCopy())
+	}
+}
+
+// setPodCondition sets a pod condition. The transition time only changes
+// when the condition's status does.
+func setPodCondition(status *corev1.PodStatus, conditionType corev1.PodConditionType, conditionStatus corev1.ConditionStatus, reason, message string) {
+	condition := corev1.PodCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	for i := range status.Conditions {
+		if status.Conditions[i].Type != conditionType {
+			continue
+		}
+		if status.Conditions[i].Status == conditionStatus {
+			condition.LastTransitionTime = status.Conditions[i].LastTransitionTime
+		}
+		status.Conditions[i] = condition
+		return
+	}
+
+	status.Conditions = append(status.Conditions, condition)
+}
@@ -0,0 +1,354 @@
+package provider
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// launchPod creates pod on p and returns the ID of its instance along with
+// the agent that serves it once the instance is running.
+func launchPod(t *testing.T, p *OrcaProvider, pod *corev1.Pod) (string, *fakeAgent) {
+	t.Helper()
+
+	a := startFakeAgent(t, p, pod.UID)
+	p.config.Agent.Port = a.port
+
+	if err := p.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	p.podsMu.RLock()
+	instanceID, ok := p.instanceIDs[pod.UID]
+	p.podsMu.RUnlock()
+	if !ok {
+		t.Fatalf("expected an instance to be launched for pod %s", pod.Name)
+	}
+	return instanceID, a
+}
+
+// startPod launches pod and syncs it until its containers have started.
+func startPod(t *testing.T, p *OrcaProvider, cloud *fakeAWS, pod *corev1.Pod, report agent.PodReport) (string, *fakeAgent) {
+	t.Helper()
+
+	instanceID, a := launchPod(t, p, pod)
+	cloud.setState(instanceID, "running", a.host)
+	a.setReport(report)
+
+	for range 3 {
+		p.syncPods(context.Background())
+	}
+	if _, ok := p.launchState(pod.UID); ok {
+		t.Fatalf("expected pod %s to have started, status %+v", pod.Name, podStatus(t, p, pod))
+	}
+	return instanceID, a
+}
+
+// expireLaunch makes the current phase of a pod's launch start long ago.
+func expireLaunch(p *OrcaProvider, pod *corev1.Pod) {
+	p.launchesMu.Lock()
+	defer p.launchesMu.Unlock()
+	p.launches[pod.UID].since = time.Now().Add(-time.Hour)
+}
+
+func runningReport(ready bool) agent.PodReport {
+	return agent.PodReport{
+		Phase:             corev1.PodRunning,
+		Initialized:       true,
+		ContainerStatuses: []corev1.ContainerStatus{{Name: "main", Ready: ready}},
+	}
+}
+
+func TestSyncPodsLaunchPhases(t *testing.T) {
+	pod := testPod("web")
+	p, cloud := newTestProvider(t, pod)
+	ctx := context.Background()
+
+	instanceID, a := launchPod(t, p, pod)
+
+	steps := []struct {
+		name   string
+		before func()
+		phase  launchPhase
+		reason string
+	}{
+		{
+			name:   "instance pending",
+			before: func() {},
+			phase:  launchInstancePending,
+			reason: "InstancePending",
+		},
+		{
+			name:   "instance running",
+			before: func() { cloud.setState(instanceID, "running", a.host) },
+			phase:  launchAgentStarting,
+			reason: "InstanceBooting",
+		},
+		{
+			name:   "agent answers",
+			before: func() {},
+			phase:  launchContainersStarting,
+			reason: "ContainersStarting",
+		},
+		{
+			name:   "containers creating",
+			before: func() { a.setReport(agent.PodReport{Phase: corev1.PodPending}) },
+			phase:  launchContainersStarting,
+			reason: "ContainersStarting",
+		},
+	}
+
+	for _, step := range steps {
+		step.before()
+		p.syncPods(ctx)
+
+		l, ok := p.launchState(pod.UID)
+		if !ok {
+			t.Fatalf("%s: expected the pod to still be launching", step.name)
+		}
+		if l.phase != step.phase {
+			t.Errorf("%s: expected launch phase %s, got %s", step.name, step.phase, l.phase)
+		}
+		status := podStatus(t, p, pod)
+		if status.Phase != corev1.PodPending {
+			t.Errorf("%s: expected phase Pending, got %s", step.name, status.Phase)
+		}
+		if reason := readyReason(status); reason != step.reason {
+			t.Errorf("%s: expected Ready reason %q, got %q", step.name, step.reason, reason)
+		}
+	}
+
+	submission := a.submission()
+	if submission == nil || submission.Pod.UID != pod.UID {
+		t.Fatalf("expected the pod to be submitted to its agent, got %+v", submission)
+	}
+
+	a.setReport(runningReport(true))
+	p.syncPods(ctx)
+
+	if _, ok := p.launchState(pod.UID); ok {
+		t.Error("expected the launch to be forgotten once the containers started")
+	}
+	status := podStatus(t, p, pod)
+	if status.Phase != corev1.PodRunning {
+		t.Errorf("expected phase Running, got %s", status.Phase)
+	}
+	if c := podCondition(status, corev1.PodReady); c == nil || c.Status != corev1.ConditionTrue {
+		t.Errorf("expected the pod to be ready, got %+v", c)
+	}
+	if status.PodIP != a.host {
+		t.Errorf("expected pod IP %s, got %s", a.host, status.PodIP)
+	}
+}
+
+func TestSyncPodsLaunchTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		running bool
+		reason  string
+	}{
+		{
+			name:   "instance never starts",
+			reason: "InstanceLaunchTimeout",
+		},
+		{
+			name:    "agent never answers",
+			running: true,
+			reason:  "AgentUnreachable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("web")
+			p, cloud := newTestProvider(t, pod)
+			ctx := context.Background()
+
+			instanceID, a := launchPod(t, p, pod)
+			a.mu.Lock()
+			a.healthy = false
+			a.mu.Unlock()
+			if tt.running {
+				cloud.setState(instanceID, "running", a.host)
+				p.syncPods(ctx)
+			}
+
+			// Within the timeout the launch keeps waiting
+			p.syncPods(ctx)
+			if status := podStatus(t, p, pod); status.Phase != corev1.PodPending {
+				t.Fatalf("expected phase Pending before the timeout, got %s", status.Phase)
+			}
+
+			expireLaunch(p, pod)
+			p.syncPods(ctx)
+
+			status := podStatus(t, p, pod)
+			if status.Phase != corev1.PodFailed || status.Reason != tt.reason {
+				t.Errorf("expected phase Failed with reason %s, got %s with %s", tt.reason, status.Phase, status.Reason)
+			}
+			if !slices.Contains(cloud.terminatedIDs(), instanceID) {
+				t.Errorf("expected instance %s to be terminated, got %v", instanceID, cloud.terminatedIDs())
+			}
+			if _, ok := p.launchState(pod.UID); ok {
+				t.Error("expected the failed launch to be forgotten")
+			}
+		})
+	}
+}
+
+func TestSyncPodsTerminalPhase(t *testing.T) {
+	tests := []struct {
+		name       string
+		report     agent.PodReport
+		phase      corev1.PodPhase
+		terminated bool
+	}{
+		{
+			name:  "running",
+			phase: corev1.PodRunning,
+			report: agent.PodReport{
+				Phase:             corev1.PodRunning,
+				Initialized:       true,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "main", Ready: true}},
+			},
+		},
+		{
+			name:  "succeeded",
+			phase: corev1.PodSucceeded,
+			report: agent.PodReport{
+				Phase:       corev1.PodSucceeded,
+				Initialized: true,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "main",
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+				}},
+			},
+			terminated: true,
+		},
+		{
+			name:  "failed",
+			phase: corev1.PodFailed,
+			report: agent.PodReport{
+				Phase:       corev1.PodFailed,
+				Initialized: true,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "main",
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+				}},
+			},
+			terminated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("job")
+			p, cloud := newTestProvider(t, pod)
+
+			instanceID, a := startPod(t, p, cloud, pod, runningReport(true))
+			a.setReport(tt.report)
+			p.syncPods(context.Background())
+
+			status := podStatus(t, p, pod)
+			if status.Phase != tt.phase {
+				t.Errorf("expected phase %s, got %s", tt.phase, status.Phase)
+			}
+			terminated := slices.Contains(cloud.terminatedIDs(), instanceID)
+			if terminated != tt.terminated {
+				t.Errorf("expected instance terminated %v, got %v", tt.terminated, terminated)
+			}
+			if tt.terminated && readyReason(status) != "PodCompleted" {
+				t.Errorf("expected Ready reason PodCompleted, got %q", readyReason(status))
+			}
+		})
+	}
+}
+
+func TestSyncPodsInstanceGone(t *testing.T) {
+	pod := testPod("web")
+	p, cloud := newTestProvider(t, pod)
+
+	instanceID, _ := startPod(t, p, cloud, pod, runningReport(true))
+	cloud.setState(instanceID, "terminated", "")
+	p.syncPods(context.Background())
+
+	status := podStatus(t, p, pod)
+	if status.Phase != corev1.PodFailed || status.Reason != "InstanceTerminated" {
+		t.Errorf("expected phase Failed with reason InstanceTerminated, got %s with %s", status.Phase, status.Reason)
+	}
+}
+
+func TestSyncPodsReadiness(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+
+	tests := []struct {
+		name           string
+		initContainers []corev1.Container
+		initStatuses   []corev1.ContainerStatus
+		containers     []corev1.ContainerStatus
+		ready          bool
+	}{
+		{
+			name:       "containers ready",
+			containers: []corev1.ContainerStatus{{Name: "main", Ready: true}},
+			ready:      true,
+		},
+		{
+			name:       "container not ready",
+			containers: []corev1.ContainerStatus{{Name: "main", Ready: false}},
+		},
+		{
+			name: "container not reported",
+		},
+		{
+			name:           "completed init container",
+			initContainers: []corev1.Container{{Name: "setup", Image: "busybox"}},
+			initStatuses:   []corev1.ContainerStatus{{Name: "setup", Ready: false}},
+			containers:     []corev1.ContainerStatus{{Name: "main", Ready: true}},
+			ready:          true,
+		},
+		{
+			name:           "sidecar ready",
+			initContainers: []corev1.Container{{Name: "proxy", Image: "envoy", RestartPolicy: &always}},
+			initStatuses:   []corev1.ContainerStatus{{Name: "proxy", Ready: true}},
+			containers:     []corev1.ContainerStatus{{Name: "main", Ready: true}},
+			ready:          true,
+		},
+		{
+			name:           "sidecar not ready",
+			initContainers: []corev1.Container{{Name: "proxy", Image: "envoy", RestartPolicy: &always}},
+			initStatuses:   []corev1.ContainerStatus{{Name: "proxy", Ready: false}},
+			containers:     []corev1.ContainerStatus{{Name: "main", Ready: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("web")
+			pod.Spec.InitContainers = tt.initContainers
+			p, cloud := newTestProvider(t, pod)
+
+			startPod(t, p, cloud, pod, agent.PodReport{
+				Phase:                 corev1.PodRunning,
+				Initialized:           true,
+				InitContainerStatuses: tt.initStatuses,
+				ContainerStatuses:     tt.containers,
+			})
+
+			status := podStatus(t, p, pod)
+			want := corev1.ConditionFalse
+			if tt.ready {
+				want = corev1.ConditionTrue
+			}
+			for _, conditionType := range []corev1.PodConditionType{corev1.ContainersReady, corev1.PodReady} {
+				if c := podCondition(status, conditionType); c == nil || c.Status != want {
+					t.Errorf("expected %s to be %s, got %+v", conditionType, want, c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+	"github.com/scttfrdmn/orca/pkg/config"
+	"github.com/scttfrdmn/orca/pkg/instances"
+)
+
+// unsupportedError reports a pod that ORCA cannot run as specified. Such
+// pods are failed rather than retried.
+type unsupportedError struct {
+	reason  string
+	message string
+}
+
+func (e *unsupportedError) Error() string {
+	return e.message
+}
+
+// unsupportedVolume returns the error for a pod volume ORCA cannot provide.
+func unsupportedVolume(format string, args ...any) *unsupportedError {
+	return &unsupportedError{reason: "UnsupportedVolume", message: fmt.Sprintf(format, args...)}
+}
+
+// instanceVolumes are the volumes of a pod that its instance provides,
+// rather than files the agent writes.
+type instanceVolumes struct {
+	ebs         []ebsVolume
+	filesystems map[string]agent.Filesystem
+}
+
+// checkVolumeTypes rejects volumes of kinds that ORCA cannot provide on a
+// burst instance.
+func checkVolumeTypes(pod *corev1.Pod) error {
+	for _, v := range pod.Spec.Volumes {
+		switch {
+		case v.ConfigMap != nil, v.Secret != nil, v.DownwardAPI != nil, v.Projected != nil,
+			v.EmptyDir != nil, v.NFS != nil, v.PersistentVolumeClaim != nil:
+		default:
+			return unsupportedVolume("volume %q has a type ORCA does not support; use configMap, secret, downwardAPI, projected, emptyDir, nfs or a persistentVolumeClaim bound to an EBS, EFS, FSx for Lustre or NFS volume", v.Name)
+		}
+	}
+	return nil
+}
+
+// podVolumes checks the pod's volumes and returns those its instance
+// provides: EBS volumes to attach, and shared filesystems for the agent to
+// mount.
+func (p *OrcaProvider) podVolumes(ctx context.Context, pod *corev1.Pod) (*instanceVolumes, error) {
+	if err := checkVolumeTypes(pod); err != nil {
+		return nil, err
+	}
+
+	volumes := &instanceVolumes{filesystems: make(map[string]agent.Filesystem)}
+	for _, v := range pod.Spec.Volumes {
+		switch {
+		case v.NFS != nil:
+			volumes.filesystems[v.Name] = nfsFilesystem(v.NFS.Server, v.NFS.Path, v.NFS.ReadOnly, nil)
+
+		case v.PersistentVolumeClaim != nil:
+			pv, err := p.claimVolume(ctx, pod.Namespace, v.PersistentVolumeClaim.ClaimName)
+			if err != nil {
+				return nil, err
+			}
+			fs, ok, err := p.sharedFilesystem(v, pv)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				volumes.filesystems[v.Name] = fs
+				continue
+			}
+			ebs, err := p.ebsVolume(ctx, v, pv, len(volumes.ebs))
+			if err != nil {
+				return nil, err
+			}
+			volumes.ebs = append(volumes.ebs, ebs)
+		}
+	}
+	return volumes, nil
+}
+
+// claimVolume returns the PersistentVolume bound to a claim. Claims that
+// are not bound yet return an error, so that the pod is retried.
+func (p *OrcaProvider) claimVolume(ctx context.Context, namespace, claimName string) (*corev1.PersistentVolume, error) {
+	claim, err := p.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PersistentVolumeClaim %s: %w", claimName, err)
+	}
+	if claim.Status.Phase != corev1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("PersistentVolumeClaim %s is not bound", claimName)
+	}
+
+	pv, err := p.kubeClient.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PersistentVolume %s: %w", claim.Spec.VolumeName, err)
+	}
+	return pv, nil
+}
+
+// rejectPod fails a pod that ORCA cannot run, with the reason in its
+// status and Ready condition.
+func (p *OrcaProvider) rejectPod(pod *corev1.Pod, err *unsupportedError) {
+	p.podsMu.Lock()
+	if _, ok := p.pods[pod.UID]; !ok {
+		p.pods[pod.UID] = pod.DeepCopy()
+	}
+	p.podsMu.Unlock()
+
+	p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+		status.Phase = corev1.PodFailed
+		status.Reason = err.reason
+		status.Message = err.message
+		setPodCondition(status, corev1.PodScheduled, corev1.ConditionTrue, "Scheduled", "")
+		setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, err.reason, err.message)
+	})
+}
+
+// gib is the size of a GiB in bytes.
+const gib = 1 << 30
+
+// rootVolume returns the root volume settings of a pod's instance, those
+// of its workload template over the configured ones, and the GiB its
+// ephemeral storage adds to the volume: the pod's ephemeral-storage
+// request, or the size limits of its disk-backed emptyDir volumes if larger
+// and the instance type has no instance store to hold them.
+func (p *OrcaProvider) rootVolume(ctx context.Context, pod *corev1.Pod, instanceType string) (config.RootVolume, int32, error) {
+	volume := p.config.AWS.RootVolume
+	if template, ok := p.config.Instances.Templates[pod.Annotations[instances.AnnotationWorkloadTemplate]]; ok {
+		volume = volume.Override(template.RootVolume)
+	}
+
+	ephemeral := instances.PodRequests(pod)[corev1.ResourceEphemeralStorage]
+	var emptyDirs resource.Quantity
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir != nil && v.EmptyDir.Medium != corev1.StorageMediumMemory && v.EmptyDir.SizeLimit != nil {
+			emptyDirs.Add(*v.EmptyDir.SizeLimit)
+		}
+	}
+	if emptyDirs.Cmp(ephemeral) > 0 {
+		instanceStore, err := p.awsClient.InstanceStorageGB(ctx, instanceType)
+		if err != nil {
+			return volume, 0, err
+		}
+		if instanceStore == 0 {
+			ephemeral = emptyDirs
+		}
+	}
+
+	return volume, int32((ephemeral.Value() + gib - 1) / gib), nil
+}
@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// defaultTerminationGracePeriod is the grace period of a pod that does
+	// not set one, as applied by the API server.
+	defaultTerminationGracePeriod = 30 * time.Second
+
+	// stopTimeoutMargin is how long past its grace period a pod may take to
+	// report that it has stopped before its instance is terminated anyway.
+	stopTimeoutMargin = 30 * time.Second
+)
+
+// deletionGracePeriod returns how long a deleted pod's containers get to
+// stop before they are killed.
+func deletionGracePeriod(pod *corev1.Pod) time.Duration {
+	switch {
+	case pod.DeletionGracePeriodSeconds != nil:
+		return time.Duration(*pod.DeletionGracePeriodSeconds) * time.Second
+	case pod.Spec.TerminationGracePeriodSeconds != nil:
+		return time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	default:
+		return defaultTerminationGracePeriod
+	}
+}
+
+// stopPod asks the agent of a running pod to stop it gracefully, and reports
+// whether it did. The instance is terminated by the sync loop once the agent
+// reports every container stopped, or once the grace period has run out.
+func (p *OrcaProvider) stopPod(ctx context.Context, pod *corev1.Pod) bool {
+	p.podsMu.RLock()
+	tracked, ok := p.pods[pod.UID]
+	instanceID := p.instanceIDs[pod.UID]
+	_, stopping := p.stopDeadlines[pod.UID]
+	p.podsMu.RUnlock()
+
+	switch {
+	case !ok || podFinished(tracked) || instanceID == "":
+		return false
+	case stopping:
+		return true
+	}
+
+	instance, err := p.awsClient.GetInstance(ctx, instanceID)
+	if err != nil || instance.State != "running" || instance.PrivateIP == "" {
+		return false
+	}
+
+	gracePeriod := deletionGracePeriod(pod)
+	agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+	err = p.agentClient(tracked, instance).StopPod(agentCtx, gracePeriod)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	p.podsMu.Lock()
+	p.stopDeadlines[pod.UID] = time.Now().Add(gracePeriod + stopTimeoutMargin)
+	p.podsMu.Unlock()
+
+	return true
+}
+
+// stopDeadline returns when a stopping pod's instance is terminated
+// regardless of its containers.
+func (p *OrcaProvider) stopDeadline(uid types.UID) (time.Time, bool) {
+	p.podsMu.RLock()
+	defer p.podsMu.RUnlock()
+
+	deadline, ok := p.stopDeadlines[uid]
+	return deadline, ok
+}
+
+// removePod terminates a pod's instance right away and stops tracking the
+// pod. A pod that had not finished is reported failed first.
+func (p *OrcaProvider) removePod(ctx context.Context, pod *corev1.Pod) error {
+	p.podsMu.RLock()
+	tracked, ok := p.pods[pod.UID]
+	instanceID := p.instanceIDs[pod.UID]
+	p.podsMu.RUnlock()
+	finished := ok && podFinished(tracked)
+
+	if instanceID == "" {
+		// Find the instance tagged with this pod's UID, never another pod's
+		// of the same name; it may have been cleaned up already
+		if instance, err := p.awsClient.GetInstanceByPod(ctx, pod); err == nil {
+			instanceID = instance.ID
+		}
+	}
+
+	// The instance of a finished pod has been terminated already
+	if instanceID != "" {
+		if err := p.terminateInstance(ctx, pod.UID, instanceID); err != nil && !finished {
+			return fmt.Errorf("failed to terminate instance %s: %w", instanceID, err)
+		}
+	}
+
+	if ok && !finished {
+		p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+			markPodTerminated(status, "Terminated", "Pod was deleted")
+		})
+	}
+
+	// Remove from tracking
+	p.podsMu.Lock()
+	delete(p.pods, pod.UID)
+	delete(p.instanceIDs, pod.UID)
+	delete(p.ebsVolumes, pod.UID)
+	delete(p.filesystems, pod.UID)
+	delete(p.mountErrors, pod.UID)
+	delete(p.stopDeadlines, pod.UID)
+	delete(p.volumeHashes, pod.UID)
+	p.podsMu.Unlock()
+	p.forgetAgent(pod.UID)
+	p.tokens.forget(pod.UID)
+	p.disconnectPeer(ctx, pod.UID)
+	p.leaveGang(pod.UID)
+	if p.services != nil {
+		p.services.close(pod.UID)
+	}
+
+	return nil
+}
+
+// forceStop terminates the instance of a pod that did not stop within its
+// grace period.
+func (p *OrcaProvider) forceStop(ctx context.Context, pod *corev1.Pod, instanceID string) {
+	// Best effort: the pod is reported failed either way
+	_ = p.terminateInstance(ctx, pod.UID, instanceID)
+
+	p.updatePodStatus(pod.UID, func(status *corev1.PodStatus) {
+		markPodTerminated(status, "GracePeriodExceeded", "Pod did not stop within its grace period")
+	})
+	p.forgetAgent(pod.UID)
+}
+
+// markPodTerminated reports a pod whose instance was terminated under it:
+// Failed, with every container that had not exited terminated.
+func markPodTerminated(status *corev1.PodStatus, reason, message string) {
+	status.Phase = corev1.PodFailed
+	status.Reason = reason
+	status.Message = message
+
+	now := metav1.Now()
+	for _, statuses := range [][]corev1.ContainerStatus{status.InitContainerStatuses, status.ContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].State.Terminated != nil {
+				continue
+			}
+			statuses[i].State = corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					ExitCode:   137,
+					Reason:     "ContainerStatusUnknown",
+					Message:    message,
+					FinishedAt: now,
+				},
+			}
+			statuses[i].Ready = false
+		}
+	}
+
+	setPodCondition(status, corev1.ContainersReady, corev1.ConditionFalse, reason, message)
+	setPodCondition(status, corev1.PodReady, corev1.ConditionFalse, reason, message)
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultTokenExpiration is the lifetime of a projected token that does
+	// not set one, as applied by the API server.
+	defaultTokenExpiration = time.Hour
+
+	// maxTokenAge is how long a token is used before it is refreshed,
+	// however long it is valid for, as by the kubelet.
+	maxTokenAge = 24 * time.Hour
+)
+
+// tokenKey identifies the token of a serviceAccountToken projection.
+type tokenKey struct {
+	uid        types.UID
+	audience   string
+	expiration time.Duration
+}
+
+// serviceAccountToken is a bound token issued through the TokenRequest API.
+type serviceAccountToken struct {
+	token     string
+	refreshAt time.Time
+}
+
+// tokenCache requests bound service account tokens for pods and reuses each
+// one until it is close to expiring. Refreshed tokens change the pod's
+// volume contents, so the volume sync delivers them to the agent.
+type tokenCache struct {
+	client kubernetes.Interface
+
+	mu     sync.Mutex
+	tokens map[tokenKey]serviceAccountToken
+}
+
+// newTokenCache returns a token cache that requests tokens through client.
+func newTokenCache(client kubernetes.Interface) *tokenCache {
+	return &tokenCache{
+		client: client,
+		tokens: make(map[tokenKey]serviceAccountToken),
+	}
+}
+
+// token returns a token for the pod's service account as described by
+// projection, bound to the pod so that it is invalidated when the pod is
+// deleted.
+func (c *tokenCache) token(ctx context.Context, pod *corev1.Pod, projection *corev1.ServiceAccountTokenProjection) ([]byte, error) {
+	expiration := defaultTokenExpiration
+	if projection.ExpirationSeconds != nil {
+		expiration = time.Duration(*projection.ExpirationSeconds) * time.Second
+	}
+	key := tokenKey{uid: pod.UID, audience: projection.Audience, expiration: expiration}
+
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.refreshAt) {
+		return []byte(cached.token), nil
+	}
+
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+
+	seconds := int64(expiration / time.Second)
+	request := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &seconds,
+			BoundObjectRef: &authenticationv1.BoundObjectReference{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			},
+		},
+	}
+	// An empty audience means the API server's own
+	if projection.Audience != "" {
+		request.Spec.Audiences = []string{projection.Audience}
+	}
+
+	issued := time.Now()
+	response, err := c.client.CoreV1().ServiceAccounts(pod.Namespace).CreateToken(ctx, serviceAccount, request, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token for service account %s: %w", serviceAccount, err)
+	}
+
+	c.mu.Lock()
+	c.tokens[key] = serviceAccountToken{
+		token:     response.Status.Token,
+		refreshAt: tokenRefreshTime(issued, response.Status.ExpirationTimestamp.Time),
+	}
+	c.mu.Unlock()
+
+	return []byte(response.Status.Token), nil
+}
+
+// forget drops the tokens of a pod.
+func (c *tokenCache) forget(uid types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.tokens {
+		if key.uid == uid {
+			delete(c.tokens, key)
+		}
+	}
+}
+
+// tokenRefreshTime returns when a token should be replaced: once 80% of its
+// lifetime has passed, or after maxTokenAge.
+func tokenRefreshTime(issued, expires time.Time) time.Time {
+	refreshAt := issued.Add(expires.Sub(issued) * 4 / 5)
+	if latest := issued.Add(maxTokenAge); refreshAt.After(latest) {
+		return latest
+	}
+	return refreshAt
+}
+
+// apiServerEnv returns the variables that in-cluster clients use to find
+// the API server, pointed at the endpoint instances reach it at. The
+// kubelet sets them in every container from the kubernetes Service, whose
+// cluster IP is not routable from an instance.
+func apiServerEnv(endpoint string) ([]corev1.EnvVar, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse API server URL %q: %w", endpoint, err)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	address := "tcp://" + net.JoinHostPort(host, port)
+	return []corev1.EnvVar{
+		{Name: "KUBERNETES_SERVICE_HOST", Value: host},
+		{Name: "KUBERNETES_SERVICE_PORT", Value: port},
+		{Name: "KUBERNETES_SERVICE_PORT_HTTPS", Value: port},
+		{Name: "KUBERNETES_PORT", Value: address},
+		{Name: "KUBERNETES_PORT_" + port + "_TCP", Value: address},
+		{Name: "KUBERNETES_PORT_" + port + "_TCP_PROTO", Value: "tcp"},
+		{Name: "KUBERNETES_PORT_" + port + "_TCP_PORT", Value: port},
+		{Name: "KUBERNETES_PORT_" + port + "_TCP_ADDR", Value: host},
+	}, nil
+}
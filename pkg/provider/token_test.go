@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestTokenRefreshTime(t *testing.T) {
+	issued := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{"one hour", time.Hour, 48 * time.Minute},
+		{"ten minutes", 10 * time.Minute, 8 * time.Minute},
+		{"one day", 24 * time.Hour, 24 * time.Hour * 4 / 5},
+		{"thirty hours", 30 * time.Hour, 24 * time.Hour},
+		{"one year", 365 * 24 * time.Hour, maxTokenAge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tokenRefreshTime(issued, issued.Add(tt.lifetime))
+			if want := issued.Add(tt.want); !got.Equal(want) {
+				t.Errorf("expected refresh after %s, got %s", tt.want, got.Sub(issued))
+			}
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	client := fake.NewClientset()
+	requests := 0
+	client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		requests++
+		request := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest)
+		lifetime := time.Duration(*request.Spec.ExpirationSeconds) * time.Second
+		request.Status = authenticationv1.TokenRequestStatus{
+			Token:               fmt.Sprintf("token-%d", requests),
+			ExpirationTimestamp: metav1.NewTime(time.Now().Add(lifetime)),
+		}
+		return true, request, nil
+	})
+	cache := newTokenCache(client)
+	ctx := context.Background()
+
+	web, job := testPod("web"), testPod("job")
+	hour := &corev1.ServiceAccountTokenProjection{Audience: "vault"}
+	seconds := int64(600)
+	short := &corev1.ServiceAccountTokenProjection{Audience: "vault", ExpirationSeconds: &seconds}
+
+	steps := []struct {
+		name       string
+		before     func()
+		pod        *corev1.Pod
+		projection *corev1.ServiceAccountTokenProjection
+		want       string
+	}{
+		{name: "first request", pod: web, projection: hour, want: "token-1"},
+		{name: "cached", pod: web, projection: hour, want: "token-1"},
+		{name: "other expiration", pod: web, projection: short, want: "token-2"},
+		{name: "other pod", pod: job, projection: hour, want: "token-3"},
+		{
+			name: "refresh due",
+			before: func() {
+				key := tokenKey{uid: web.UID, audience: "vault", expiration: time.Hour}
+				cache.mu.Lock()
+				cached := cache.tokens[key]
+				cached.refreshAt = time.Now().Add(-time.Second)
+				cache.tokens[key] = cached
+				cache.mu.Unlock()
+			},
+			pod:        web,
+			projection: hour,
+			want:       "token-4",
+		},
+		{name: "forgotten", before: func() { cache.forget(web.UID) }, pod: web, projection: short, want: "token-5"},
+		{name: "other pod kept", pod: job, projection: hour, want: "token-3"},
+	}
+
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		token, err := cache.token(ctx, step.pod, step.projection)
+		if err != nil {
+			t.Fatalf("%s: failed to get token: %v", step.name, err)
+		}
+		if string(token) != step.want {
+			t.Errorf("%s: expected %s, got %s", step.name, step.want, token)
+		}
+	}
+}
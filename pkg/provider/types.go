@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"io"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -42,12 +43,19 @@ type Provider interface {
 
 	// Container Operations (for kubectl logs, exec)
 
-	// GetContainerLogs retrieves logs from a container.
-	GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) ([]byte, error)
+	// GetContainerLogs streams logs from a container.
+	// The caller must close the returned reader.
+	GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) (io.ReadCloser, error)
 
 	// RunInContainer executes a command in a container (for kubectl exec).
 	RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error
 
+	// AttachToContainer attaches to a container's main process (for kubectl attach).
+	AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach AttachIO) error
+
+	// PortForward tunnels stream to a port of the pod (for kubectl port-forward).
+	PortForward(ctx context.Context, namespace, podName string, port int32, stream io.ReadWriteCloser) error
+
 	// GetStatsSummary retrieves resource usage statistics.
 	GetStatsSummary(ctx context.Context) (*StatsSummary, error)
 }
@@ -55,6 +63,7 @@ type Provider interface {
 // ContainerLogOpts specifies options for retrieving container logs.
 type ContainerLogOpts struct {
 	Tail         int
+	LimitBytes   int
 	Follow       bool
 	Previous     bool
 	SinceSeconds int
@@ -63,11 +72,27 @@ type ContainerLogOpts struct {
 }
 
 // AttachIO represents streams for interactive container operations.
+// It mirrors virtual-kubelet's api.AttachIO.
 type AttachIO interface {
-	Stdin() []byte
-	Stdout() chan []byte
-	Stderr() chan []byte
+	// Stdin returns the client's input, or nil if stdin is not attached.
+	Stdin() io.Reader
+
+	// Stdout and Stderr return the client's output streams. Either may be
+	// nil; with a TTY all output goes to Stdout.
+	Stdout() io.WriteCloser
+	Stderr() io.WriteCloser
+
+	// TTY reports whether the client requested a terminal.
 	TTY() bool
+
+	// Resize delivers terminal size changes from the client.
+	Resize() <-chan TermSize
+}
+
+// TermSize is the size of a terminal in characters.
+type TermSize struct {
+	Width  uint16
+	Height uint16
 }
 
 // StatsSummary represents resource usage statistics for the node.
@@ -82,14 +107,26 @@ type NodeStats struct {
 	StartTime time.Time    `json:"startTime"`
 	CPU       *CPUStats    `json:"cpu,omitempty"`
 	Memory    *MemoryStats `json:"memory,omitempty"`
+	GPUs      []GPUStats   `json:"gpus,omitempty"`
 }
 
 // PodStats represents resource usage for a pod.
 type PodStats struct {
-	PodRef    PodReference `json:"podRef"`
+	PodRef     PodReference     `json:"podRef"`
+	StartTime  time.Time        `json:"startTime"`
+	CPU        *CPUStats        `json:"cpu,omitempty"`
+	Memory     *MemoryStats     `json:"memory,omitempty"`
+	Containers []ContainerStats `json:"containers,omitempty"`
+	GPUs       []GPUStats       `json:"gpus,omitempty"`
+}
+
+// ContainerStats represents resource usage for a container.
+type ContainerStats struct {
+	Name      string       `json:"name"`
 	StartTime time.Time    `json:"startTime"`
 	CPU       *CPUStats    `json:"cpu,omitempty"`
 	Memory    *MemoryStats `json:"memory,omitempty"`
+	GPUs      []GPUStats   `json:"gpus,omitempty"`
 }
 
 // PodReference identifies a pod.
@@ -111,4 +148,15 @@ type MemoryStats struct {
 	Time            time.Time `json:"time"`
 	UsageBytes      *uint64   `json:"usageBytes,omitempty"`
 	WorkingSetBytes *uint64   `json:"workingSetBytes,omitempty"`
+	AvailableBytes  *uint64   `json:"availableBytes,omitempty"`
+}
+
+// GPUStats represents usage statistics of a GPU.
+type GPUStats struct {
+	Time               time.Time `json:"time"`
+	ID                 string    `json:"id"`
+	Model              string    `json:"model"`
+	UtilizationPercent uint64    `json:"utilizationPercent"`
+	MemoryUsedBytes    uint64    `json:"memoryUsedBytes"`
+	MemoryTotalBytes   uint64    `json:"memoryTotalBytes"`
 }
@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// volumeSyncInterval is how often the sources of controller-provided
+// volumes are checked for changes, close to the kubelet's sync period.
+const volumeSyncInterval = time.Minute
+
+// submitPod resolves the pod's configuration and sends it to its agent.
+// Resolved values only travel over the agent's TLS connection, never in
+// user-data.
+func (p *OrcaProvider) submitPod(ctx context.Context, pod *corev1.Pod, client *agent.Client) error {
+	submission, err := p.resolvePod(ctx, pod)
+	if err != nil {
+		return err
+	}
+
+	agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+	defer cancel()
+	if err := client.StartPod(agentCtx, *submission); err != nil {
+		return fmt.Errorf("failed to submit pod to agent: %w", err)
+	}
+
+	p.podsMu.Lock()
+	p.volumeHashes[pod.UID] = volumesHash(submission.Volumes)
+	p.podsMu.Unlock()
+
+	return nil
+}
+
+// syncVolumes resolves the volumes of every submitted pod again and sends
+// those that changed to the pod's agent.
+func (p *OrcaProvider) syncVolumes(ctx context.Context) {
+	p.podsMu.RLock()
+	pods := make([]*corev1.Pod, 0, len(p.volumeHashes))
+	for uid := range p.volumeHashes {
+		pod, ok := p.pods[uid]
+		if _, stopping := p.stopDeadlines[uid]; !ok || stopping || podFinished(pod) {
+			continue
+		}
+		pods = append(pods, pod.DeepCopy())
+	}
+	p.podsMu.RUnlock()
+
+	// Failures are retried on the next sync; the pod keeps its current files
+	for _, pod := range pods {
+		_ = p.syncPodVolumes(ctx, pod)
+	}
+}
+
+// syncPodVolumes sends the pod's volumes to its agent if they changed since
+// they were last sent.
+func (p *OrcaProvider) syncPodVolumes(ctx context.Context, pod *corev1.Pod) error {
+	client := p.cachedAgentClient(pod.UID)
+	if client == nil {
+		return nil
+	}
+
+	volumes, err := p.resolveVolumes(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	hash := volumesHash(volumes)
+	p.podsMu.RLock()
+	unchanged := p.volumeHashes[pod.UID] == hash
+	p.podsMu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	agentCtx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+	defer cancel()
+	if err := client.UpdateVolumes(agentCtx, volumes); err != nil {
+		return fmt.Errorf("failed to update volumes on agent: %w", err)
+	}
+
+	p.podsMu.Lock()
+	if _, ok := p.volumeHashes[pod.UID]; ok {
+		p.volumeHashes[pod.UID] = hash
+	}
+	p.podsMu.Unlock()
+
+	return nil
+}
+
+// cachedAgentClient returns the cached agent client of a pod, or nil if
+// there is none.
+func (p *OrcaProvider) cachedAgentClient(uid types.UID) *agent.Client {
+	p.agentsMu.Lock()
+	defer p.agentsMu.Unlock()
+
+	entry, ok := p.agents[uid]
+	if !ok {
+		return nil
+	}
+	return entry.client
+}
+
+// volumesHash returns a digest of volume contents, to tell when they change
+// without keeping resolved Secrets around.
+func volumesHash(volumes map[string][]agent.VolumeFile) string {
+	// Map keys are marshalled in sorted order, so equal volumes hash equally
+	data, _ := json.Marshal(volumes)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
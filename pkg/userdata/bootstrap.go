@@ -0,0 +1,159 @@
+package userdata
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+// metadataAddress is the address of the EC2 instance metadata service.
+const metadataAddress = "169.254.169.254"
+
+// cloudInitUserData are cloud-init's copies of the instance's user data,
+// which hold the agent's credentials.
+var cloudInitUserData = []string{
+	"/var/lib/cloud/instance/user-data.txt",
+	"/var/lib/cloud/instance/user-data.txt.i",
+}
+
+// Paths on the instance written by the bootstrap.
+const (
+	agentBinaryPath = "/usr/local/bin/orca-agent"
+	agentUnitPath   = "/etc/systemd/system/orca-agent.service"
+	sliceUnitPath   = "/etc/systemd/system/" + agent.PodSlice
+	firewallUnit    = "orca-firewall.service"
+	firewallPath    = "/etc/systemd/system/" + firewallUnit
+	tokenPath       = "/etc/orca/agent/token"
+	tlsCertPath     = "/etc/orca/agent/tls.crt"
+	tlsKeyPath      = "/etc/orca/agent/tls.key"
+)
+
+// cloudConfig is the subset of cloud-config used by the bootstrap.
+type cloudConfig struct {
+	WriteFiles []writeFile `yaml:"write_files"`
+	RunCmd     [][]string  `yaml:"runcmd"`
+}
+
+// writeFile is a cloud-config write_files entry.
+type writeFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+// bootstrapConfig renders ORCA's cloud-config. It carries no part of the
+// pod: user data is readable by anything on the instance that can reach the
+// metadata service, so the controller sends the pod, with its resolved
+// ConfigMaps and Secrets, over the agent's TLS API instead.
+//
+// The agent's credentials cannot avoid user data. A firewall unit keeps the
+// pod's containers, which run in agent.PodSlice, from the metadata service
+// and the agent's API, and cloud-init's copies of the user data are removed
+// once the credentials are written.
+func bootstrapConfig(opts Options) ([]byte, error) {
+	cfg := cloudConfig{
+		WriteFiles: []writeFile{
+			{Path: tokenPath, Permissions: "0600", Content: opts.Credentials.Token},
+			{Path: tlsCertPath, Permissions: "0644", Content: string(opts.Credentials.CertPEM)},
+			{Path: tlsKeyPath, Permissions: "0600", Content: string(opts.Credentials.KeyPEM)},
+			{Path: sliceUnitPath, Permissions: "0644", Content: sliceUnit},
+			{Path: firewallPath, Permissions: "0644", Content: firewallUnitFile(opts.AgentPort)},
+			{Path: agentUnitPath, Permissions: "0644", Content: agentUnit(opts.AgentPort)},
+		},
+		RunCmd: [][]string{append([]string{"rm", "-f"}, cloudInitUserData...)},
+	}
+
+	if opts.AgentBinaryURL != "" {
+		cfg.RunCmd = append(cfg.RunCmd,
+			[]string{"curl", "--fail", "--silent", "--show-error", "--location", "--retry", "5",
+				"--output", agentBinaryPath, opts.AgentBinaryURL},
+			[]string{"chmod", "0755", agentBinaryPath},
+		)
+	}
+	cfg.RunCmd = append(cfg.RunCmd,
+		[]string{"systemctl", "daemon-reload"},
+		[]string{"systemctl", "enable", "--now", "orca-agent.service"},
+	)
+
+	var buf bytes.Buffer
+	buf.WriteString("#cloud-config\n")
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to encode bootstrap cloud-config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode bootstrap cloud-config: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sliceUnit is the systemd slice of pod containers.
+const sliceUnit = `[Unit]
+Description=ORCA pod containers
+Before=slices.target
+`
+
+// firewallUnitFile returns the systemd unit that rejects traffic from the
+// pod's containers to the metadata service and to the agent's API. Pods
+// share the instance's network namespace, so the rules match their cgroup
+// rather than an interface. The agent requires the unit, so that no pod
+// starts without it.
+func firewallUnitFile(agentPort int) string {
+	rules := [][]string{
+		{"-m", "cgroup", "--path", agent.PodSlice, "-d", metadataAddress, "-j", "REJECT"},
+		{"-m", "cgroup", "--path", agent.PodSlice, "-m", "addrtype", "--dst-type", "LOCAL",
+			"-p", "tcp", "--dport", strconv.Itoa(agentPort), "-j", "REJECT", "--reject-with", "tcp-reset"},
+	}
+
+	var unit strings.Builder
+	unit.WriteString(`[Unit]
+Description=ORCA pod firewall
+Requires=` + agent.PodSlice + `
+After=` + agent.PodSlice + `
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+`)
+	for _, rule := range rules {
+		unit.WriteString("ExecStart=iptables -I OUTPUT " + strings.Join(rule, " ") + "\n")
+	}
+	for _, rule := range rules {
+		unit.WriteString("ExecStop=iptables -D OUTPUT " + strings.Join(rule, " ") + "\n")
+	}
+	return unit.String()
+}
+
+// agentUnit returns the systemd unit that runs the agent.
+func agentUnit(port int) string {
+	args := []string{
+		agentBinaryPath,
+		fmt.Sprintf("--listen-addr=:%d", port),
+		"--token-file=" + tokenPath,
+		"--tls-cert-file=" + tlsCertPath,
+		"--tls-key-file=" + tlsKeyPath,
+	}
+
+	return `[Unit]
+Description=ORCA pod agent
+Wants=network-online.target containerd.service
+Requires=` + firewallUnit + `
+After=network-online.target containerd.service ` + firewallUnit + `
+
+[Service]
+ExecStart=` + strings.Join(args, " ") + `
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+}
@@ -0,0 +1,33 @@
+// Package userdata renders the EC2 user data that bootstraps a pod's instance.
+//
+// The rendered document is a multipart cloud-init archive with two kinds of
+// parts:
+//
+//  1. The user's own user data from the orca.research/user-data annotation
+//     (base64 encoded shell script, cloud-config, or multipart archive)
+//  2. ORCA's bootstrap cloud-config, which writes the agent credentials,
+//     installs the ORCA agent, and starts it under systemd behind a
+//     firewall that keeps pod containers from the metadata service
+//
+// The pod itself is not part of the user data. The controller submits it to
+// the agent over TLS once the agent is up, together with the contents of its
+// ConfigMaps and Secrets.
+//
+// User parts come first so their packages and settings are in place before
+// the agent starts the pod. ORCA's cloud-config is merged with list append
+// semantics so it never replaces the user's write_files or runcmd entries.
+//
+// EC2 limits user data to 16 KB. Documents larger than that are gzip
+// compressed, which cloud-init detects and decompresses transparently;
+// documents that are still too large are rejected with ErrTooLarge.
+//
+// Example usage:
+//
+//	data, err := userdata.Render(pod, userdata.Options{
+//	    AgentPort:   9440,
+//	    Credentials: creds,
+//	})
+//	if err != nil {
+//	    return err
+//	}
+package userdata
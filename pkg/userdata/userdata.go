@@ -0,0 +1,275 @@
+package userdata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/scttfrdmn/orca/pkg/agent"
+)
+
+const (
+	// MaxSize is the largest user data EC2 accepts, before base64 encoding.
+	MaxSize = 16 * 1024
+
+	// annotationUserData holds the user's base64 encoded user data
+	// (duplicated from pkg/provider to avoid an import cycle).
+	annotationUserData = "orca.research/user-data"
+
+	// boundary separates the parts of the rendered multipart document.
+	boundary = "==ORCA-BOUNDARY=="
+)
+
+// ErrTooLarge is returned when the user data exceeds MaxSize even after
+// compression.
+var ErrTooLarge = errors.New("user data exceeds EC2 size limit")
+
+// Options configures the bootstrap rendered for a pod.
+type Options struct {
+	// AgentPort is the port the agent API listens on.
+	AgentPort int
+
+	// AgentBinaryURL is where the agent binary is downloaded from. If empty,
+	// the agent must already be installed in the AMI.
+	AgentBinaryURL string
+
+	// Credentials are the agent API credentials issued for the pod.
+	Credentials *agent.Credentials
+}
+
+// part is a single part of a multipart cloud-init document.
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Render returns the user data that bootstraps pod on its instance.
+// The result is raw user data; EC2 expects it base64 encoded.
+func Render(pod *corev1.Pod, opts Options) ([]byte, error) {
+	if pod == nil {
+		return nil, fmt.Errorf("pod cannot be nil")
+	}
+	if opts.Credentials == nil {
+		return nil, fmt.Errorf("agent credentials are required")
+	}
+
+	var parts []part
+
+	if encoded := pod.Annotations[annotationUserData]; encoded != "" {
+		userParts, err := userDataParts(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", annotationUserData, err)
+		}
+		parts = append(parts, userParts...)
+	}
+
+	bootstrap, err := bootstrapConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	parts = append(parts, part{
+		header: textproto.MIMEHeader{
+			"Content-Type":        {`text/cloud-config; charset="us-ascii"`},
+			"Merge-Type":          {"list(append)+dict(no_replace,recursive_update)"},
+			"Content-Disposition": {`attachment; filename="orca-bootstrap.yaml"`},
+		},
+		body: bootstrap,
+	})
+
+	data, err := writeMultipart(parts)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= MaxSize {
+		return data, nil
+	}
+
+	compressed, err := compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes compressed, limit is %d", ErrTooLarge, len(compressed), MaxSize)
+	}
+
+	return compressed, nil
+}
+
+// userDataParts decodes the user's annotation into cloud-init parts.
+func userDataParts(encoded string) ([]part, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64: %w", err)
+	}
+
+	if isGzip(data) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	if isMultipart(data) {
+		return splitMultipart(data)
+	}
+
+	contentType, err := detectContentType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []part{{
+		header: textproto.MIMEHeader{
+			"Content-Type":        {contentType + `; charset="us-ascii"`},
+			"Content-Disposition": {`attachment; filename="user-data"`},
+		},
+		body: data,
+	}}, nil
+}
+
+// contentTypes maps the first line prefix of a cloud-init user data part to
+// its MIME type. Longer prefixes come first so they win over their prefixes.
+var contentTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{prefix: "#include-once", contentType: "text/x-include-once-url"},
+	{prefix: "#include", contentType: "text/x-include-url"},
+	{prefix: "#cloud-config-archive", contentType: "text/cloud-config-archive"},
+	{prefix: "#cloud-config", contentType: "text/cloud-config"},
+	{prefix: "#cloud-boothook", contentType: "text/cloud-boothook"},
+	{prefix: "#part-handler", contentType: "text/part-handler"},
+	{prefix: "## template: jinja", contentType: "text/jinja2"},
+	{prefix: "#!", contentType: "text/x-shellscript"},
+}
+
+// detectContentType returns the MIME type cloud-init would infer for data.
+func detectContentType(data []byte) (string, error) {
+	for _, ct := range contentTypes {
+		if bytes.HasPrefix(data, []byte(ct.prefix)) {
+			return ct.contentType, nil
+		}
+	}
+	return "", fmt.Errorf("unrecognized user data format, expected a script (#!) or #cloud-config")
+}
+
+// isGzip reports whether data starts with the gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// isMultipart reports whether data is a MIME multipart document.
+func isMultipart(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Type") {
+			return strings.HasPrefix(strings.TrimSpace(strings.ToLower(value)), "multipart/")
+		}
+	}
+	return false
+}
+
+// splitMultipart returns the parts of a user supplied multipart document so
+// they can be merged with ORCA's parts.
+func splitMultipart(data []byte) ([]part, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart document: %w", err)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart content type: %w", err)
+	}
+
+	var parts []part
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := reader.NextRawPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart document: %w", err)
+		}
+
+		body, err := io.ReadAll(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart document: %w", err)
+		}
+		parts = append(parts, part{header: p.Header, body: body})
+	}
+
+	return parts, nil
+}
+
+// writeMultipart assembles parts into a multipart cloud-init document.
+func writeMultipart(parts []part) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n\r\n")
+
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, fmt.Errorf("failed to set multipart boundary: %w", err)
+	}
+
+	for _, p := range parts {
+		if bytes.Contains(p.body, []byte("--"+boundary)) {
+			return nil, fmt.Errorf("user data must not contain the boundary %q", boundary)
+		}
+
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write user data part: %w", err)
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, fmt.Errorf("failed to write user data part: %w", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write user data: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compress gzips data. cloud-init detects and decompresses gzip user data.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress user data: %w", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress user data: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress user data: %w", err)
+	}
+	return buf.Bytes(), nil
+}